@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+// errAdvisoryLockLeak означает, что после сценария остались advisory блокировки.
+var errAdvisoryLockLeak = errors.New("advisory lock leak")
+
+// advisoryLocks учитывает advisory блокировки уровня сессии по пулам сценариев.
+// Такая блокировка переживает commit и rollback и остается на соединении пула,
+// поэтому без явного pg_advisory_unlock она мешает следующим сценариям.
+var advisoryLocks = struct {
+	mu   sync.Mutex
+	held map[*sqlx.DB]map[int64]int
+}{held: make(map[*sqlx.DB]map[int64]int)}
+
+// advisoryLock берет advisory блокировку уровня сессии и регистрирует ее.
+func (t *transaction) advisoryLock(key int64) error {
+	if _, err := t.tx.ExecContext(t.ctx, t.sql("SELECT pg_advisory_lock($1);"), key); err != nil {
+		t.logger.Error("failed to take advisory lock", zap.Error(err), zap.Int64("key", key))
+		return err
+	}
+	advisoryLocks.mu.Lock()
+	defer advisoryLocks.mu.Unlock()
+	if advisoryLocks.held[t.db] == nil {
+		advisoryLocks.held[t.db] = make(map[int64]int)
+	}
+	advisoryLocks.held[t.db][key]++
+	t.logger.Info("session advisory lock taken", zap.Int64("key", key))
+	return nil
+}
+
+// advisoryUnlock освобождает advisory блокировку уровня сессии.
+func (t *transaction) advisoryUnlock(key int64) error {
+	var released bool
+	if err := t.tx.QueryRowContext(t.ctx, t.sql("SELECT pg_advisory_unlock($1);"), key).Scan(&released); err != nil {
+		t.logger.Error("failed to release advisory lock", zap.Error(err), zap.Int64("key", key))
+		return err
+	}
+	if !released {
+		err := fmt.Errorf("advisory lock %d is not held by this session", key)
+		t.logger.Error("failed to release advisory lock", zap.Error(err))
+		return err
+	}
+	advisoryLocks.mu.Lock()
+	defer advisoryLocks.mu.Unlock()
+	if held := advisoryLocks.held[t.db]; held != nil {
+		if held[key]--; held[key] <= 0 {
+			delete(held, key)
+		}
+	}
+	t.logger.Info("session advisory lock released", zap.Int64("key", key))
+	return nil
+}
+
+// advisoryXactLock берет advisory блокировку до конца транзакции, ждет ее при конфликте.
+func (t *transaction) advisoryXactLock(key int64) error {
+	if _, err := t.tx.ExecContext(t.ctx, t.sql("SELECT pg_advisory_xact_lock($1);"), key); err != nil {
+		t.logger.Error("failed to take advisory lock", zap.Error(err), zap.Int64("key", key))
+		return err
+	}
+	t.logger.Info("transaction advisory lock taken", zap.Int64("key", key))
+	return nil
+}
+
+// tryAdvisoryXactLock берет advisory блокировку до конца транзакции без ожидания.
+func (t *transaction) tryAdvisoryXactLock(key int64) (bool, error) {
+	var taken bool
+	if err := t.tx.QueryRowContext(t.ctx, t.sql("SELECT pg_try_advisory_xact_lock($1);"), key).Scan(&taken); err != nil {
+		t.logger.Error("failed to try advisory lock", zap.Error(err), zap.Int64("key", key))
+		return false, err
+	}
+	t.logger.Info("transaction advisory lock tried", zap.Int64("key", key), zap.Bool("taken", taken))
+	return taken, nil
+}
+
+// checkAdvisoryLocks проверяет после сценария, что его сессии не держат advisory
+// блокировок: по реестру и по pg_locks, куда попадают и блокировки, взятые
+// запросами в обход помощников. Сессии с оставшимися блокировками отключаются,
+// чтобы блокировки не достались следующим сценариям через пул.
+func checkAdvisoryLocks(db, monitor *sqlx.DB, namespace string, logger *zap.Logger) error {
+	advisoryLocks.mu.Lock()
+	var registered []int64
+	for key := range advisoryLocks.held[db] {
+		registered = append(registered, key)
+	}
+	delete(advisoryLocks.held, db)
+	advisoryLocks.mu.Unlock()
+
+	const locksQuery = `SELECT l.pid, (l.classid::bigint << 32) | l.objid::bigint AS key
+         FROM pg_locks l
+         JOIN pg_stat_activity a ON a.pid = l.pid
+         WHERE l.locktype = 'advisory' AND a.datname = current_database()
+           AND (a.application_name = $1 OR left(a.application_name, length($1) + 1) = $1 || ':')
+         ORDER BY 1, 2;`
+	var held []struct {
+		PID int   `db:"pid"`
+		Key int64 `db:"key"`
+	}
+	applicationName := scenarioApplicationName(namespace)
+	// Без доступа к pg_locks проверяется только реестр помощников
+	if monitorAccess.locks {
+		if err := monitor.Select(&held, locksQuery, applicationName); err != nil {
+			logger.Error("failed to read advisory locks", zap.Error(err))
+			return err
+		}
+	}
+	if len(registered) == 0 && len(held) == 0 {
+		return nil
+	}
+
+	for _, h := range held {
+		logger.Error("advisory lock held after scenario", zap.Int("pid", h.PID), zap.Int64("key", h.Key))
+	}
+	if len(held) > 0 {
+		if err := terminateSessions(monitor, applicationName, logger); err != nil {
+			return err
+		}
+	}
+	err := fmt.Errorf("%w: %d registered session locks %v not released, %d advisory locks held", errAdvisoryLockLeak, len(registered), registered, len(held))
+	logger.Error("advisory locks leaked", zap.Error(err))
+	return err
+}
+
+// advisoryLockScope показывает разницу областей advisory блокировок: после
+// ROLLBACK TO SAVEPOINT блокировка транзакции, взятая после точки сохранения,
+// освобождается, а блокировка сессии остается до pg_advisory_unlock.
+func advisoryLockScope(db *sqlx.DB, logger *zap.Logger) error {
+	const sessionKey, xactKey = 1, 2
+	if err := requireSessionState("session advisory lock"); err != nil {
+		return err
+	}
+
+	tx1 := newTransaction(db, logger.With(zap.String("tx", "tx1")))
+	if err := tx1.begin(); err != nil {
+		return err
+	}
+	if _, err := tx1.exec("SAVEPOINT before_locks;"); err != nil {
+		return err
+	}
+	if err := tx1.advisoryLock(sessionKey); err != nil {
+		return err
+	}
+	if err := tx1.advisoryXactLock(xactKey); err != nil {
+		return err
+	}
+	if _, err := tx1.exec("ROLLBACK TO SAVEPOINT before_locks;"); err != nil {
+		return err
+	}
+
+	// Другая транзакция проверяет, какие блокировки остались у tx1
+	tx2 := newTransaction(db, logger.With(zap.String("tx", "tx2")))
+	if err := tx2.begin(); err != nil {
+		return err
+	}
+	xactTaken, err := tx2.tryAdvisoryXactLock(xactKey)
+	if err != nil {
+		return err
+	}
+	sessionTaken, err := tx2.tryAdvisoryXactLock(sessionKey)
+	if err != nil {
+		return err
+	}
+	if !xactTaken || sessionTaken {
+		return fmt.Errorf("after rollback to savepoint: transaction lock free = %t, session lock free = %t, expected true and false", xactTaken, sessionTaken)
+	}
+
+	// Блокировку сессии нужно освободить явно, иначе ее унесет соединение пула
+	if err = tx1.advisoryUnlock(sessionKey); err != nil {
+		return err
+	}
+	return commitPair(tx1, tx2)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// errExpectedFailure - сценарий завершился ошибкой на СУБД, для которой она
+// ожидается аннотацией xfail.
+var errExpectedFailure = errors.New("expected failure")
+
+// errUnexpectedPass - сценарий с аннотацией xfail прошел: аннотация устарела.
+var errUnexpectedPass = errors.New("unexpected pass")
+
+// backendAnnotation отмечает сочетание сценария с СУБД и диапазоном ее версий,
+// на котором сценарий пропускается (skip) или должен завершиться ошибкой (xfail),
+// например грязное чтение при READ UNCOMMITTED, которое видно только в MySQL.
+//
+//	skip:
+//	  - {backend: postgres, max_version: 120000, reason: "needs generated columns"}
+//	xfail:
+//	  - {backend: postgres, reason: "READ UNCOMMITTED behaves as READ COMMITTED"}
+type backendAnnotation struct {
+	// Backend - СУБД (postgres, mysql, sqlserver, oracle), пусто - любая
+	Backend string `yaml:"backend"`
+	// MinVersion и MaxVersion - границы server_version_num: нижняя включается,
+	// верхняя нет; 0 - без границы
+	MinVersion int    `yaml:"min_version"`
+	MaxVersion int    `yaml:"max_version"`
+	Reason     string `yaml:"reason"`
+}
+
+func (a backendAnnotation) validate() error {
+	switch a.Backend {
+	case "", backendPostgres, backendMySQL, backendSQLServer, backendOracle:
+	default:
+		return fmt.Errorf("unknown backend %q", a.Backend)
+	}
+	if a.Reason == "" {
+		return errors.New("reason is required")
+	}
+	if a.MaxVersion != 0 && a.MinVersion >= a.MaxVersion {
+		return fmt.Errorf("min_version %d is not below max_version %d", a.MinVersion, a.MaxVersion)
+	}
+	return nil
+}
+
+// matches сообщает, относится ли аннотация к СУБД backend версии version.
+// Аннотация с границами версий не относится к серверу неизвестной версии (0).
+func (a backendAnnotation) matches(backend string, version int) bool {
+	if a.Backend != "" && a.Backend != backend {
+		return false
+	}
+	if a.MinVersion == 0 && a.MaxVersion == 0 {
+		return true
+	}
+	return version != 0 && version >= a.MinVersion && (a.MaxVersion == 0 || version < a.MaxVersion)
+}
+
+func (a backendAnnotation) String() string {
+	var scope []string
+	if a.Backend != "" {
+		scope = append(scope, a.Backend)
+	}
+	if a.MinVersion != 0 {
+		scope = append(scope, fmt.Sprintf(">= %d", a.MinVersion))
+	}
+	if a.MaxVersion != 0 {
+		scope = append(scope, fmt.Sprintf("< %d", a.MaxVersion))
+	}
+	if len(scope) == 0 {
+		return a.Reason
+	}
+	return fmt.Sprintf("%s (%s)", a.Reason, strings.Join(scope, " "))
+}
+
+// matchAnnotation возвращает первую аннотацию, относящуюся к серверу, или nil.
+func matchAnnotation(annotations []backendAnnotation, backend string, version int) *backendAnnotation {
+	for i := range annotations {
+		if annotations[i].matches(backend, version) {
+			return &annotations[i]
+		}
+	}
+	return nil
+}
+
+// validateAnnotations проверяет аннотации skip и xfail сценария.
+func validateAnnotations(skip, xfail []backendAnnotation) error {
+	for i, a := range skip {
+		if err := a.validate(); err != nil {
+			return fmt.Errorf("skip %d: %w", i+1, err)
+		}
+	}
+	for i, a := range xfail {
+		if err := a.validate(); err != nil {
+			return fmt.Errorf("xfail %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// expectFailure сверяет результат сценария с аннотацией xfail: ожидаемая
+// ошибка не считается провалом, а успешный запуск означает, что аннотацию
+// пора снять. Пропуск и превышение времени сохраняют свой вердикт.
+func expectFailure(err error, a *backendAnnotation, logger *zap.Logger) error {
+	switch {
+	case errors.Is(err, errScenarioSkipped), errors.Is(err, errScenarioTimeout):
+		return err
+	case err != nil:
+		logger.Info("scenario failed as expected", zap.String("xfail", a.String()), zap.Error(err))
+		return fmt.Errorf("%w: %s: %w", errExpectedFailure, a, err)
+	default:
+		err = fmt.Errorf("%w: %s", errUnexpectedPass, a)
+		logger.Error("scenario passed despite xfail", zap.Error(err))
+		return err
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+
+	"transactionIsolation/isolation"
+)
+
+// Сценарии ansi/<феномен>/<уровень> выполняют по одному чередованию на каждый
+// феномен стандарта ANSI SQL и на каждое название уровня, которое принимает
+// PostgreSQL. Флаг -ansi выполняет их все и печатает сопоставление: что
+// стандарт разрешает уровню и что PostgreSQL на этом уровне действительно
+// допускает.
+
+// ansiPhenomenon - феномен и чередование двух транзакций, в котором он
+// проявляется. Обозначение, таблица стандарта и уровни, на которых феномен
+// допускает PostgreSQL, общие с isolation.Expect.
+type ansiPhenomenon struct {
+	isolation.Anomaly
+	run func(t1, t2 *transaction) (bool, error)
+}
+
+var ansiPhenomena = []ansiPhenomenon{
+	{Anomaly: isolation.DirtyRead, run: ansiDirtyRead},
+	{Anomaly: isolation.NonRepeatableRead, run: ansiNonRepeatableRead},
+	{Anomaly: isolation.Phantom, run: ansiPhantom},
+	{Anomaly: isolation.LostUpdate, run: ansiLostUpdate},
+	{Anomaly: isolation.WriteSkew, run: ansiWriteSkew},
+}
+
+var ansiLevels = isolation.Levels(isolation.Postgres)
+
+func ansiScenarioName(p ansiPhenomenon, level sql.IsolationLevel) string {
+	return "ansi/" + p.Name + "/" + strings.ReplaceAll(strings.ToLower(level.String()), " ", "_")
+}
+
+// ansiScenarios возвращает сценарии всех феноменов для всех уровней.
+func ansiScenarios() map[string]scenario {
+	scenarios := make(map[string]scenario, len(ansiPhenomena)*len(ansiLevels))
+	for _, p := range ansiPhenomena {
+		for _, level := range ansiLevels {
+			anomaly := p.Possible(level, isolation.Postgres)
+			scenarios[ansiScenarioName(p, level)] = scenario{level: level, migrations: personMigrations, problem: ansiProblem(p, level), namespace: "ansi",
+				description: "ANSI SQL " + p.Code + ": " + strings.ReplaceAll(p.Name, "_", " "), tags: []string{"ansi", p.Code}, anomaly: &anomaly}
+		}
+	}
+	return scenarios
+}
+
+func ansiProblem(p ansiPhenomenon, level sql.IsolationLevel) isolationProblem {
+	return func(db *sqlx.DB, logger *zap.Logger) error {
+		observed, err := observePhenomenon(db, logger, p, level)
+		if err != nil {
+			return err
+		}
+		d := ansiCell{level: level, phenomenon: p, observed: observed}.diff()
+		logger.Info("compared with ANSI SQL-92", zap.String("ansi", d.ANSI), zap.String("postgres", d.Postgres), zap.String("verdict", d.Verdict))
+		if expected := p.Possible(level, isolation.Postgres); observed != expected {
+			return fmt.Errorf("%s at %s: observed %t, expected %t", p.Code, level, observed, expected)
+		}
+		return nil
+	}
+}
+
+// observePhenomenon выполняет чередование феномена, обе транзакции на уровне level.
+func observePhenomenon(db *sqlx.DB, logger *zap.Logger, p ansiPhenomenon, level sql.IsolationLevel) (bool, error) {
+	logger = logger.With(zap.String("phenomenon", p.Code))
+	t1 := newTransaction(db, logger.With(zap.String("tx", "tx1")))
+	if err := t1.begin(); err != nil {
+		return false, err
+	}
+	if err := t1.setLevel(level); err != nil {
+		return false, err
+	}
+	t2 := newTransaction(db, logger.With(zap.String("tx", "tx2")))
+	if err := t2.begin(); err != nil {
+		return false, err
+	}
+	if err := t2.setLevel(level); err != nil {
+		return false, err
+	}
+	observed, err := p.run(t1, t2)
+	if err != nil {
+		return false, err
+	}
+	logger.Info("ansi phenomenon", zap.Bool("observed", observed),
+		zap.Bool("ansi_defined", p.ANSI != nil), zap.Bool("ansi_allowed", p.ANSI[level]))
+	return observed, nil
+}
+
+// P1: tx1 читает изменение tx2 до его фиксации.
+func ansiDirtyRead(t1, t2 *transaction) (bool, error) {
+	if err := t2.updateUser(1, 2000); err != nil {
+		return false, err
+	}
+	balance, err := ansiBalance(t1, 1)
+	if err != nil {
+		return false, err
+	}
+	if err = t2.rollback(); err != nil {
+		return false, err
+	}
+	return balance == 2000, t1.commit()
+}
+
+// P2: повторное чтение строки в tx1 видит изменение, зафиксированное tx2.
+func ansiNonRepeatableRead(t1, t2 *transaction) (bool, error) {
+	before, err := ansiBalance(t1, 1)
+	if err != nil {
+		return false, err
+	}
+	if err = t2.updateUser(1, 2000); err != nil {
+		return false, err
+	}
+	if err = t2.commit(); err != nil {
+		return false, err
+	}
+	after, err := ansiBalance(t1, 1)
+	if err != nil {
+		return false, err
+	}
+	return before != after, t1.commit()
+}
+
+// P3: повторное чтение по предикату в tx1 видит строку, вставленную tx2.
+func ansiPhantom(t1, t2 *transaction) (bool, error) {
+	const countQuery = "SELECT COUNT(*) FROM person WHERE balance >= 1000;"
+	before, err := t1.query(countQuery)
+	if err != nil {
+		return false, err
+	}
+	if err = t2.insertUser(3, 1000); err != nil {
+		return false, err
+	}
+	if err = t2.commit(); err != nil {
+		return false, err
+	}
+	after, err := t1.query(countQuery)
+	if err != nil {
+		return false, err
+	}
+	return before[0][0] != after[0][0], t1.commit()
+}
+
+// P4: обе транзакции читают баланс и записывают увеличенное значение, прибавка tx1 теряется.
+func ansiLostUpdate(t1, t2 *transaction) (bool, error) {
+	read1, err := ansiBalance(t1, 1)
+	if err != nil {
+		return false, err
+	}
+	read2, err := ansiBalance(t2, 1)
+	if err != nil {
+		return false, err
+	}
+	if err = t1.updateUser(1, int(read1)+100); err != nil {
+		return false, err
+	}
+	// Запись tx2 ждет tx1; после фиксации tx1 она либо затирает ее, либо отклоняется
+	t2Done := runAsync(func() error {
+		return t2.updateUser(1, int(read2)+200)
+	})
+	committed1, err := hermitageCommit(t1)
+	if err != nil {
+		return false, err
+	}
+	if err = <-t2Done; err != nil {
+		return false, hermitageAbort(t2, err)
+	}
+	committed2, err := hermitageCommit(t2)
+	if err != nil {
+		return false, err
+	}
+	return committed1 && committed2, nil
+}
+
+// A5B: обе транзакции проверяют сумму двух балансов и списывают с разных строк.
+func ansiWriteSkew(t1, t2 *transaction) (bool, error) {
+	const totalQuery = "SELECT SUM(balance) FROM person WHERE id IN (1, 2);"
+	for _, t := range []*transaction{t1, t2} {
+		if _, err := t.query(totalQuery); err != nil {
+			return false, err
+		}
+	}
+	if _, err := t1.withdraw(1, 1500); err != nil {
+		return false, err
+	}
+	if _, err := t2.withdraw(2, 1500); err != nil {
+		return false, hermitageAbort(t2, err)
+	}
+	return concurrentCommitPair(t1, t2)
+}
+
+func ansiBalance(t *transaction, id int) (int64, error) {
+	return t.queryBalance("SELECT balance FROM person WHERE id = $1;", id)
+}
+
+// ansiCell - наблюдение одного феномена на одном уровне.
+type ansiCell struct {
+	level      sql.IsolationLevel
+	phenomenon ansiPhenomenon
+	observed   bool
+}
+
+// buildANSIReport выполняет все феномены на всех уровнях в схеме по умолчанию.
+func buildANSIReport(db *sqlx.DB, logger *zap.Logger) ([]ansiCell, error) {
+	var cells []ansiCell
+	for _, level := range ansiLevels {
+		for _, p := range ansiPhenomena {
+			suiteProgress.begin(ansiScenarioName(p, level))
+			if err := migrate(db, zap.NewNop(), personMigrations); err != nil {
+				return nil, err
+			}
+			observed, err := observePhenomenon(db, logger.With(zap.Stringer("level", level)), p, level)
+			suiteProgress.end()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", ansiScenarioName(p, level), err)
+			}
+			cells = append(cells, ansiCell{level: level, phenomenon: p, observed: observed})
+		}
+	}
+	return cells, nil
+}
+
+// effectiveANSILevel возвращает самый строгий уровень стандарта, запреты
+// которого выполняются по наблюдениям. Без P1-P3 уровень формально
+// SERIALIZABLE, но наблюдаемый write skew указывает на snapshot isolation.
+func effectiveANSILevel(observed map[string]bool) string {
+	for i := len(ansiLevels) - 1; i >= 0; i-- {
+		level := ansiLevels[i]
+		ok := true
+		for _, p := range ansiPhenomena {
+			if p.ANSI != nil && observed[p.Code] && !p.ANSI[level] {
+				ok = false
+			}
+		}
+		if !ok {
+			continue
+		}
+		if level == sql.LevelSerializable && observed["A5B"] {
+			return "SNAPSHOT ISOLATION (no P1-P3, but write skew)"
+		}
+		return strings.ToUpper(level.String())
+	}
+	return "none"
+}
+
+// Сравнение наблюдения с таблицей стандарта.
+const (
+	ansiAsStandard = "as_standard"
+	ansiStricter   = "stricter"
+	ansiWeaker     = "weaker"
+	ansiUndefined  = "not_in_standard"
+)
+
+// ansiDiff - сравнение одной ячейки с таблицей ANSI SQL-92.
+type ansiDiff struct {
+	Level      string `json:"level"`
+	Code       string `json:"code"`
+	Phenomenon string `json:"phenomenon"`
+	// ANSI - allowed, forbidden или undefined
+	ANSI string `json:"ansi"`
+	// Postgres - observed или prevented
+	Postgres string `json:"postgres"`
+	Verdict  string `json:"verdict"`
+}
+
+// diff сравнивает наблюдение с таблицей стандарта: PostgreSQL строже, если
+// предотвращает разрешенный стандартом феномен, и слабее, если допускает
+// запрещенный.
+func (c ansiCell) diff() ansiDiff {
+	d := ansiDiff{
+		Level:      strings.ToUpper(c.level.String()),
+		Code:       c.phenomenon.Code,
+		Phenomenon: c.phenomenon.Name,
+		ANSI:       "undefined",
+		Postgres:   "prevented",
+		Verdict:    ansiUndefined,
+	}
+	if c.observed {
+		d.Postgres = "observed"
+	}
+	if c.phenomenon.ANSI == nil {
+		return d
+	}
+	allowed := c.phenomenon.ANSI[c.level]
+	d.ANSI = "forbidden"
+	if allowed {
+		d.ANSI = "allowed"
+	}
+	switch {
+	case allowed && !c.observed:
+		d.Verdict = ansiStricter
+	case !allowed && c.observed:
+		d.Verdict = ansiWeaker
+	default:
+		d.Verdict = ansiAsStandard
+	}
+	return d
+}
+
+// ansiReportJSON - отчет -ansi в JSON для архива.
+type ansiReportJSON struct {
+	Metadata *runMetadata `json:"metadata,omitempty"`
+	Cells    []ansiDiff   `json:"cells"`
+}
+
+// writeANSIReportJSON сохраняет сравнение всех ячеек с таблицей стандарта.
+func writeANSIReportJSON(path string, meta *runMetadata, cells []ansiCell) error {
+	report := ansiReportJSON{Metadata: meta}
+	for _, c := range cells {
+		report.Cells = append(report.Cells, c.diff())
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// printANSIReport печатает для каждого названия уровня: разрешает ли феномен
+// стандарт, наблюдается ли он в PostgreSQL, и какому уровню стандарта
+// соответствует поведение. Под таблицей перечислены ячейки, в которых
+// PostgreSQL отличается от таблицы стандарта.
+func printANSIReport(w io.Writer, cells []ansiCell) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	header := []string{"REQUESTED LEVEL"}
+	for _, p := range ansiPhenomena {
+		header = append(header, p.Code+" "+strings.ToUpper(p.Name))
+	}
+	header = append(header, "POSTGRES PROVIDES")
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, level := range ansiLevels {
+		line := []string{strings.ToUpper(level.String())}
+		observed := make(map[string]bool)
+		for _, c := range cells {
+			if c.level != level {
+				continue
+			}
+			observed[c.phenomenon.Code] = c.observed
+			d := c.diff()
+			text := "ansi " + d.ANSI + ", pg " + d.Postgres
+			switch d.Verdict {
+			case ansiStricter:
+				text += " (stricter)"
+			case ansiWeaker:
+				text += " (WEAKER)"
+			}
+			line = append(line, text)
+		}
+		line = append(line, effectiveANSILevel(observed))
+		fmt.Fprintln(tw, strings.Join(line, "\t"))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "\nDifferences from the ANSI SQL-92 table:")
+	differences := 0
+	for _, c := range cells {
+		d := c.diff()
+		switch d.Verdict {
+		case ansiStricter:
+			fmt.Fprintf(w, "  %s %s %s: stricter, the standard allows it but PostgreSQL prevents it\n", d.Level, d.Code, d.Phenomenon)
+		case ansiWeaker:
+			fmt.Fprintf(w, "  %s %s %s: WEAKER, the standard forbids it but PostgreSQL allows it\n", d.Level, d.Code, d.Phenomenon)
+		default:
+			continue
+		}
+		differences++
+	}
+	if differences == 0 {
+		fmt.Fprintln(w, "  none")
+	}
+	fmt.Fprintln(w, "\nP4 and A5B are not ANSI phenomena; A Critique of ANSI SQL Isolation Levels adds them to tell snapshot isolation from SERIALIZABLE.")
+	return nil
+}
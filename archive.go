@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// tableStat - счетчики pg_stat_user_tables для таблицы схемы сценария.
+type tableStat struct {
+	RelID    int64  `db:"relid"`
+	Name     string `db:"relname"`
+	Inserted int64  `db:"n_tup_ins"`
+	Updated  int64  `db:"n_tup_upd"`
+	Deleted  int64  `db:"n_tup_del"`
+	HotUpd   int64  `db:"n_tup_hot_upd"`
+	Live     int64  `db:"n_live_tup"`
+	Dead     int64  `db:"n_dead_tup"`
+	SeqScan  int64  `db:"seq_scan"`
+	IdxScan  int64  `db:"idx_scan"`
+}
+
+// readTableStats читает счетчики таблиц текущей схемы через монитор.
+func readTableStats(monitor *sqlx.DB, logger *zap.Logger) (map[string]tableStat, error) {
+	const statsQuery = `SELECT relid::bigint AS relid, relname, n_tup_ins, n_tup_upd, n_tup_del, n_tup_hot_upd,
+           n_live_tup, n_dead_tup, seq_scan, COALESCE(idx_scan, 0) AS idx_scan
+         FROM pg_stat_user_tables
+         WHERE schemaname = current_schema();`
+	var rows []tableStat
+	if err := monitor.Select(&rows, statsQuery); err != nil {
+		logger.Error("failed to read table stats", zap.Error(err))
+		return nil, err
+	}
+	stats := make(map[string]tableStat, len(rows))
+	for _, row := range rows {
+		stats[row.Name] = row
+	}
+	return stats, nil
+}
+
+// changedTables возвращает таблицы, созданные заново или измененные между снимками.
+// Счетчики обновляются сервером с задержкой, поэтому таблицы, пересозданные
+// миграциями сценария, определяются надежнее, чем просто измененные.
+func changedTables(before, after map[string]tableStat) []string {
+	var names []string
+	for name, a := range after {
+		b, ok := before[name]
+		if !ok || b.RelID != a.RelID || b.Inserted != a.Inserted || b.Updated != a.Updated || b.Deleted != a.Deleted {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// archiveState сохраняет в dir/<сценарий> содержимое таблиц, затронутых
+// сценарием, по одному CSV файлу на таблицу. С withStats дополнительно
+// записывает изменения счетчиков pg_stat_user_tables за время сценария.
+func archiveState(monitor *sqlx.DB, dir, name string, before map[string]tableStat, withStats bool, logger *zap.Logger) error {
+	target := filepath.Join(dir, strings.ReplaceAll(name, "/", "_"))
+	after, err := readTableStats(monitor, logger)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(target, 0o755); err != nil {
+		logger.Error("failed to create archive dir", zap.Error(err), zap.String("dir", target))
+		return err
+	}
+	tables := changedTables(before, after)
+	for _, table := range tables {
+		if err = dumpTableCSV(monitor, table, filepath.Join(target, table+".csv"), logger); err != nil {
+			logger.Error("failed to archive table", zap.Error(err), zap.String("table", table))
+			return err
+		}
+	}
+	if withStats {
+		if err = writeStatsDelta(filepath.Join(target, archivedStatsFile), tables, before, after, logger); err != nil {
+			logger.Error("failed to archive table stats", zap.Error(err))
+			return err
+		}
+	}
+	logger.Info("state archived", zap.String("dir", target), zap.Strings("tables", tables))
+	return nil
+}
+
+// archivedResultFile - результат запуска в каталоге сценария, его читает diff-runs.
+const archivedResultFile = "result.json"
+
+// archivedStatsFile - изменения счетчиков таблиц, зависят от сервера и не сравниваются.
+const archivedStatsFile = "pg_stat_user_tables.csv"
+
+// archiveResult сохраняет результат запуска рядом с состоянием таблиц.
+func archiveResult(dir string, result runResult, logger *zap.Logger) error {
+	target := filepath.Join(dir, strings.ReplaceAll(result.Scenario, "/", "_"))
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(filepath.Join(target, archivedResultFile), data, 0o644); err != nil {
+		logger.Error("failed to archive result", zap.Error(err), zap.String("dir", target))
+		return err
+	}
+	return nil
+}
+
+// dumpTableCSV выгружает таблицу целиком, строки упорядочены по первому столбцу.
+func dumpTableCSV(monitor *sqlx.DB, table, path string, logger *zap.Logger) (err error) {
+	rows, err := monitor.Queryx("SELECT * FROM " + pq.QuoteIdentifier(table) + " ORDER BY 1;")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer closeWritten(logger, f, &err)
+	w := csv.NewWriter(f)
+	if err = w.Write(columns); err != nil {
+		return err
+	}
+	for rows.Next() {
+		values, err := rows.SliceScan()
+		if err != nil {
+			return err
+		}
+		record := make([]string, len(values))
+		for i, v := range values {
+			record[i] = csvValue(v)
+		}
+		if err = w.Write(record); err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// csvValue форматирует значение столбца, NULL записывается пустой строкой.
+func csvValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func writeStatsDelta(path string, tables []string, before, after map[string]tableStat, logger *zap.Logger) (err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer closeWritten(logger, f, &err)
+	w := csv.NewWriter(f)
+	if err = w.Write([]string{"table", "n_tup_ins", "n_tup_upd", "n_tup_del", "n_tup_hot_upd", "n_live_tup", "n_dead_tup", "seq_scan", "idx_scan"}); err != nil {
+		return err
+	}
+	for _, table := range tables {
+		a, b := after[table], before[table]
+		if b.RelID != a.RelID {
+			// Таблица пересоздана, счетчики начинаются с нуля
+			b = tableStat{}
+		}
+		record := []string{table}
+		for _, d := range []int64{a.Inserted - b.Inserted, a.Updated - b.Updated, a.Deleted - b.Deleted, a.HotUpd - b.HotUpd,
+			a.Live - b.Live, a.Dead - b.Dead, a.SeqScan - b.SeqScan, a.IdxScan - b.IdxScan} {
+			record = append(record, fmt.Sprint(d))
+		}
+		if err = w.Write(record); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// blockedPoll - период опроса pg_blocking_pids асинхронного шага
+	blockedPoll = 20 * time.Millisecond
+	// blockedTimeout - сколько асинхронный шаг может выполняться, не упираясь
+	// в блокировку, прежде чем ожидание прервется ошибкой
+	blockedTimeout = 10 * time.Second
+	// blockedWait - время, после которого шаг воспроизведения журнала или
+	// сжатия чередования считается ждущим: их транзакции начинаются внутри
+	// шагов, и pid серверного процесса заранее неизвестен
+	blockedWait = 500 * time.Millisecond
+)
+
+// errNotBlocked означает, что асинхронный шаг за blockedTimeout не завершился
+// и не уперся в блокировку.
+var errNotBlocked = errors.New("step neither finished nor waited for a lock")
+
+// blockedQuery проверяет, ждет ли серверный процесс чужую блокировку.
+const blockedQuery = "SELECT cardinality(pg_blocking_pids($1)) > 0;"
+
+// runAsync выполняет шаг, который может заблокироваться на чужой блокировке.
+func runAsync(step func() error) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- step()
+	}()
+	return done
+}
+
+// pollBlocked опрашивает через монитор серверный процесс pid транзакции t,
+// пока ее асинхронный шаг не упрется в блокировку (true) или не завершится
+// (false). Результат шага остается в done.
+func pollBlocked(t *transaction, pid int, done <-chan error) (bool, error) {
+	monitor := monitorDB(t.db)
+	deadline := time.Now().Add(blockedTimeout)
+	for {
+		if len(done) > 0 {
+			return false, nil
+		}
+		var blocked bool
+		if err := monitor.Get(&blocked, blockedQuery, pid); err != nil {
+			t.logger.Error("failed to poll blocking pids", zap.Error(err), zap.Int("pid", pid))
+			return false, err
+		}
+		if blocked {
+			return true, nil
+		}
+		if time.Now().After(deadline) {
+			return false, fmt.Errorf("%w: backend %d after %s", errNotBlocked, pid, blockedTimeout)
+		}
+		time.Sleep(blockedPoll)
+	}
+}
+
+// waitBlocked ждет, пока асинхронный шаг транзакции t с серверным процессом
+// pid упрется в блокировку. pid читается backendPID до runAsync, пока
+// подключение транзакции свободно. Шаг, завершившийся без ожидания, тоже
+// прекращает ожидание; его результат читается из done.
+func waitBlocked(t *transaction, pid int, done <-chan error) error {
+	started := time.Now()
+	blocked, err := pollBlocked(t, pid, done)
+	if err != nil {
+		return err
+	}
+	t.logger.Info("waiting for the blocked transaction", zap.Bool("blocked", blocked), zap.Duration("wait", time.Since(started)))
+	return nil
+}
+
+// finished ждет, пока асинхронный шаг транзакции t с серверным процессом pid
+// завершится или упрется в блокировку. Возвращает true и ошибку шага, если
+// он завершился; false, если шаг ждет блокировку, - тогда его результат
+// читается из done позже, - или опрос не удался, тогда с ошибкой опроса.
+func finished(t *transaction, pid int, done <-chan error) (bool, error) {
+	blocked, err := pollBlocked(t, pid, done)
+	if err != nil || blocked {
+		return false, err
+	}
+	return true, <-done
+}
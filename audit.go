@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// auditMigrations устанавливают триггеры, записывающие каждое изменение строк
+// во всех таблицах схемы в таблицу audit. Записи аудита вставляются в той же
+// транзакции, поэтому в таблице остаются только зафиксированные изменения.
+var auditMigrations = []string{
+	`DROP TABLE IF EXISTS audit;`,
+	`CREATE TABLE IF NOT EXISTS audit (
+           id BIGSERIAL PRIMARY KEY,
+           txid BIGINT NOT NULL DEFAULT txid_current(),
+           table_name TEXT NOT NULL,
+           op TEXT NOT NULL,
+           row_id TEXT,
+           row_data JSONB,
+           changed_at TIMESTAMPTZ NOT NULL DEFAULT clock_timestamp()
+         );`,
+	`CREATE OR REPLACE FUNCTION audit_row() RETURNS trigger AS $$
+         BEGIN
+           IF TG_OP = 'TRUNCATE' THEN
+             INSERT INTO audit (table_name, op) VALUES (TG_TABLE_NAME, TG_OP);
+             RETURN NULL;
+           ELSIF TG_OP = 'DELETE' THEN
+             INSERT INTO audit (table_name, op, row_id) VALUES (TG_TABLE_NAME, TG_OP, to_jsonb(OLD)->>'id');
+             RETURN OLD;
+           END IF;
+           INSERT INTO audit (table_name, op, row_id, row_data) VALUES (TG_TABLE_NAME, TG_OP, to_jsonb(NEW)->>'id', to_jsonb(NEW));
+           RETURN NEW;
+         END
+         $$ LANGUAGE plpgsql;`,
+	`DO $$
+         DECLARE t TEXT;
+         BEGIN
+           FOR t IN SELECT tablename FROM pg_tables WHERE schemaname = current_schema() AND tablename <> 'audit' LOOP
+             EXECUTE format('DROP TRIGGER IF EXISTS audit_row ON %I', t);
+             EXECUTE format('CREATE TRIGGER audit_row AFTER INSERT OR UPDATE OR DELETE ON %I FOR EACH ROW EXECUTE FUNCTION audit_row()', t);
+             EXECUTE format('DROP TRIGGER IF EXISTS audit_truncate ON %I', t);
+             EXECUTE format('CREATE TRIGGER audit_truncate AFTER TRUNCATE ON %I FOR EACH STATEMENT EXECUTE FUNCTION audit_row()', t);
+           END LOOP;
+         END
+         $$;`,
+}
+
+type auditEntry struct {
+	ID        int64   `db:"id"`
+	TxID      int64   `db:"txid"`
+	TableName string  `db:"table_name"`
+	Op        string  `db:"op"`
+	RowID     *string `db:"row_id"`
+	RowData   []byte  `db:"row_data"`
+}
+
+// verifyAudit выводит зафиксированные изменения по транзакциям и сверяет
+// последний образ каждой строки в аудите с итоговым состоянием таблиц.
+func verifyAudit(db *sqlx.DB, logger *zap.Logger) error {
+	var entries []auditEntry
+	const auditQuery = "SELECT id, txid, table_name, op, row_id, row_data FROM audit ORDER BY id;"
+	if err := db.Select(&entries, auditQuery); err != nil {
+		logger.Error("failed to read audit", zap.Error(err))
+		return err
+	}
+
+	type rowKey struct{ table, id string }
+	last := make(map[rowKey]*auditEntry)
+	for i := range entries {
+		e := &entries[i]
+		if e.Op == "TRUNCATE" {
+			for k := range last {
+				if k.table == e.TableName {
+					delete(last, k)
+				}
+			}
+		} else if e.RowID != nil {
+			last[rowKey{e.TableName, *e.RowID}] = e
+		}
+		logger.Info("committed change",
+			zap.Int64("txid", e.TxID),
+			zap.String("table", e.TableName),
+			zap.String("op", e.Op),
+			zap.ByteString("row", e.RowData),
+		)
+	}
+
+	mismatches := 0
+	for k, e := range last {
+		var current []byte
+		currentQuery := fmt.Sprintf("SELECT to_jsonb(t) FROM %s t WHERE (to_jsonb(t)->>'id') = $1;", pq.QuoteIdentifier(k.table))
+		rows, err := db.Query(currentQuery, k.id)
+		if err != nil {
+			logger.Error("failed to read row", zap.Error(err), zap.String("table", k.table), zap.String("id", k.id))
+			return err
+		}
+		if rows.Next() {
+			err = rows.Scan(&current)
+		}
+		rows.Close()
+		if err != nil {
+			logger.Error("failed to read row", zap.Error(err), zap.String("table", k.table), zap.String("id", k.id))
+			return err
+		}
+
+		if !sameJSON(current, e.RowData) {
+			mismatches++
+			logger.Error("audit mismatch",
+				zap.String("table", k.table),
+				zap.String("id", k.id),
+				zap.ByteString("audited", e.RowData),
+				zap.ByteString("current", current),
+			)
+		}
+	}
+	if mismatches > 0 {
+		return fmt.Errorf("audit: %d rows differ from the committed change log", mismatches)
+	}
+	logger.Info("audit verified", zap.Int("changes", len(entries)), zap.Int("rows", len(last)))
+	return nil
+}
+
+func sameJSON(a, b []byte) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	var va, vb any
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return bytes.Equal(a, b)
+	}
+	ja, _ := json.Marshal(va)
+	jb, _ := json.Marshal(vb)
+	return bytes.Equal(ja, jb)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"go.starlark.net/starlark"
+)
+
+// boundReference - ссылка {{tx.name}} на значение, сохраненное шагом bind.
+var boundReference = regexp.MustCompile(`\{\{\s*([A-Za-z_]\w*)\.([A-Za-z_]\w*)\s*\}\}`)
+
+// bind сохраняет колонки первой строки результата запроса транзакции tx под
+// именами names: names[i] получает колонку i. Пустое имя пропускает колонку.
+func (e *scriptEnv) bind(tx string, names []string, rows [][]any) error {
+	if len(names) == 0 {
+		return nil
+	}
+	if len(rows) == 0 {
+		return fmt.Errorf("bind: query returned no rows")
+	}
+	if len(names) > len(rows[0]) {
+		return fmt.Errorf("bind: %d names for %d columns", len(names), len(rows[0]))
+	}
+	for i, name := range names {
+		if name != "" {
+			e.bound[tx+"."+name] = toStarlark(rows[0][i])
+		}
+	}
+	return nil
+}
+
+// expand подставляет в выражение Starlark сохраненные значения литералами.
+func (e *scriptEnv) expand(expr string) (string, error) {
+	return e.substitute(expr, starlark.Value.String)
+}
+
+// substitute заменяет ссылки в s текстом сохраненных значений, полученным format.
+func (e *scriptEnv) substitute(s string, format func(starlark.Value) string) (string, error) {
+	var missing string
+	expanded := boundReference.ReplaceAllStringFunc(s, func(ref string) string {
+		m := boundReference.FindStringSubmatch(ref)
+		v, ok := e.bound[m[1]+"."+m[2]]
+		if !ok {
+			missing = m[1] + "." + m[2]
+			return ref
+		}
+		return format(v)
+	})
+	if missing != "" {
+		return "", fmt.Errorf("unknown variable %s", missing)
+	}
+	return expanded, nil
+}
+
+// params возвращает параметры шага: вычисленные args или params, в которых
+// строка "{{tx.name}}" заменена сохраненным значением, а ссылки внутри более
+// длинной строки - его текстом.
+func (e *scriptEnv) params(name string, step yamlStep) ([]any, error) {
+	if step.Args != "" {
+		expr, err := e.expand(step.Args)
+		if err != nil {
+			return nil, fmt.Errorf("args: %w", err)
+		}
+		params, err := e.args(name, expr)
+		if err != nil {
+			return nil, fmt.Errorf("args: %w", err)
+		}
+		return params, nil
+	}
+	params := append([]any(nil), step.Params...)
+	for i, p := range params {
+		s, ok := p.(string)
+		if !ok || !boundReference.MatchString(s) {
+			continue
+		}
+		var err error
+		if m := boundReference.FindStringSubmatch(s); m[0] == s {
+			v, ok := e.bound[m[1]+"."+m[2]]
+			if !ok {
+				return nil, fmt.Errorf("params: unknown variable %s.%s", m[1], m[2])
+			}
+			params[i], err = fromStarlark(v)
+		} else {
+			params[i], err = e.substitute(s, func(v starlark.Value) string {
+				if text, ok := starlark.AsString(v); ok {
+					return text
+				}
+				return v.String()
+			})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("params: %w", err)
+		}
+	}
+	return params, nil
+}
+
+// truthExpanded проверяет условие when или assert со ссылками на сохраненные значения.
+func (e *scriptEnv) truthExpanded(name, expr string) (bool, error) {
+	expanded, err := e.expand(expr)
+	if err != nil {
+		return false, err
+	}
+	return e.truth(name, expanded)
+}
+
+// checkBindings проверяет, что каждая ссылка {{tx.name}} указывает на значение,
+// сохраненное одним из предыдущих шагов.
+func (y *yamlScenario) checkBindings() error {
+	bound := make(map[string]bool)
+	for i, step := range y.Steps {
+		texts := []string{step.Args, step.When, step.Assert}
+		for _, p := range step.Params {
+			if s, ok := p.(string); ok {
+				texts = append(texts, s)
+			}
+		}
+		for _, text := range texts {
+			for _, m := range boundReference.FindAllStringSubmatch(text, -1) {
+				if !bound[m[1]+"."+m[2]] {
+					return fmt.Errorf("step %d: %s.%s is not bound by an earlier step", i+1, m[1], m[2])
+				}
+			}
+		}
+		if len(step.Bind) > 0 && ((step.Query == "" && step.Execute == "") || step.Tx == "") {
+			return fmt.Errorf("step %d: bind requires a query or execute step of a transaction", i+1)
+		}
+		for _, name := range step.Bind {
+			bound[step.Tx+"."+name] = true
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+var bookingMigrations = []string{
+	`DROP TABLE IF EXISTS booking;`,
+	`DROP TABLE IF EXISTS seat;`,
+	`CREATE TABLE IF NOT EXISTS seat (
+           id INT PRIMARY KEY,
+           label TEXT NOT NULL
+         );`,
+	`CREATE TABLE IF NOT EXISTS booking (
+           id SERIAL PRIMARY KEY,
+           seat_id INT NOT NULL REFERENCES seat (id),
+           customer TEXT NOT NULL
+         );`,
+	`INSERT INTO seat VALUES (1, 'A1');`,
+	`INSERT INTO seat VALUES (2, 'A2');`,
+}
+
+// bookingVariant - способ защиты от двойного бронирования.
+type bookingVariant struct {
+	name   string
+	level  sql.IsolationLevel
+	unique bool // уникальный индекс на booking.seat_id
+	lock   bool // SELECT ... FOR UPDATE строки места перед проверкой
+	// safe - вариант гарантирует не больше одного бронирования места
+	safe bool
+}
+
+var bookingVariants = []bookingVariant{
+	{name: "race", level: sql.LevelReadCommitted},
+	{name: "unique_constraint", level: sql.LevelReadCommitted, unique: true, safe: true},
+	{name: "for_update", level: sql.LevelReadCommitted, lock: true, safe: true},
+	{name: "serializable", level: sql.LevelSerializable, safe: true},
+}
+
+func doubleBooking(db *sqlx.DB, logger *zap.Logger) error {
+	for _, v := range bookingVariants {
+		if err := runBookingVariant(db, logger.With(zap.String("variant", v.name)), v); err != nil {
+			return fmt.Errorf("%s: %w", v.name, err)
+		}
+	}
+	return nil
+}
+
+func runBookingVariant(db *sqlx.DB, logger *zap.Logger, v bookingVariant) (err error) {
+	prepare := []string{`TRUNCATE booking;`, `DROP INDEX IF EXISTS booking_seat_uniq;`}
+	if v.unique {
+		prepare = append(prepare, `CREATE UNIQUE INDEX booking_seat_uniq ON booking (seat_id);`)
+	}
+	if err := migrate(db, logger, prepare); err != nil {
+		return err
+	}
+
+	// Проверка бронирований после завершения транзакций: защищенные варианты
+	// бронируют место один раз, race - дважды
+	defer checkPostconditions(db, logger, &err, func(db *sqlx.DB, logger *zap.Logger) error {
+		var bookings int
+		if err := db.Get(&bookings, "SELECT COUNT(*) FROM booking WHERE seat_id = 1;"); err != nil {
+			return fmt.Errorf("postcondition bookings: %w", err)
+		}
+		logger.Info("bookings for seat", zap.Int("seat_id", 1), zap.Int("bookings", bookings), zap.Bool("double_booked", bookings > 1))
+		want := 2
+		if v.safe {
+			want = 1
+		}
+		if bookings != want {
+			return fmt.Errorf("postcondition bookings: seat 1 booked %d times, want %d", bookings, want)
+		}
+		return nil
+	})
+
+	// Запуск транзакций
+	tx1 := newTransaction(db, logger.With(zap.String("tx", "tx1")))
+	if err := tx1.begin(); err != nil {
+		return err
+	}
+	if err := tx1.setLevel(v.level); err != nil {
+		return err
+	}
+	tx2 := newTransaction(db, logger.With(zap.String("tx", "tx2")))
+	if err := tx2.begin(); err != nil {
+		return err
+	}
+	if err := tx2.setLevel(v.level); err != nil {
+		return err
+	}
+
+	// Обе транзакции проверяют, что место свободно, и бронируют его
+	var free bool
+	free, err = seatFree(tx1, 1, v.lock)
+	if err != nil {
+		return err
+	}
+	if free {
+		if _, err = tx1.exec("INSERT INTO booking (seat_id, customer) VALUES ($1, $2);", 1, "alice"); err != nil {
+			return err
+		}
+	}
+
+	book := func() error {
+		free, err := seatFree(tx2, 1, v.lock)
+		if err != nil || !free {
+			return err
+		}
+		_, err = tx2.exec("INSERT INTO booking (seat_id, customer) VALUES ($1, $2);", 1, "bob")
+		return err
+	}
+	var bookErr error
+	if v.lock || v.unique {
+		// При FOR UPDATE и уникальном индексе tx2 ждет завершения tx1
+		pid, err := tx2.backendPID()
+		if err != nil {
+			return err
+		}
+		tx2Done := runAsync(book)
+		if err = waitBlocked(tx2, pid, tx2Done); err != nil {
+			return err
+		}
+		if err = tx1.commit(); err != nil {
+			return err
+		}
+		bookErr = <-tx2Done
+	} else {
+		// Без блокировок tx2 проверяет место до фиксации tx1, поэтому в
+		// варианте race оба бронирования проходят на каждом запуске
+		bookErr = book()
+		if err = tx1.commit(); err != nil {
+			return err
+		}
+	}
+	if bookErr != nil {
+		tx2.logger.Info("booking rejected", zap.String("code", errorCode(bookErr)))
+		return tx2.rollback()
+	}
+	if err = tx2.commit(); err != nil {
+		tx2.logger.Info("booking rejected on commit", zap.String("code", errorCode(err)))
+		return nil
+	}
+	return nil
+}
+
+func seatFree(t *transaction, seatID int, lock bool) (bool, error) {
+	if lock {
+		if _, err := t.query("SELECT id FROM seat WHERE id = $1 FOR UPDATE;", seatID); err != nil {
+			return false, err
+		}
+	}
+	rows, err := t.query("SELECT COUNT(*) FROM booking WHERE seat_id = $1;", seatID)
+	if err != nil {
+		return false, err
+	}
+	free := rows[0][0].(int64) == 0
+	t.logger.Info("seat checked", zap.Int("seat_id", seatID), zap.Bool("free", free))
+	return free, nil
+}
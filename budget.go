@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Оценки по умолчанию для запусков, которых нет в истории -history.
+const (
+	estimateScenarioRun = 3 * time.Second
+	// estimateCellRun - ячейка матрицы видимости, явление ANSI или случайный запуск -probability
+	estimateCellRun = 300 * time.Millisecond
+	// estimateWorkloadTx - транзакция нагрузки одного worker
+	estimateWorkloadTx        = 5 * time.Millisecond
+	estimateTransactions      = 2
+	estimateSweepContainer    = 15 * time.Second
+	defaultBudgetDuration     = 10 * time.Minute
+	defaultBudgetTransactions = 100_000
+)
+
+// errOverBudget означает, что оценка запуска превышает бюджет, а запуск не подтвержден.
+var errOverBudget = errors.New("estimated run exceeds the budget, rerun with -yes to start it anyway")
+
+// scenarioCost - оценка одного запуска сценария; нулевые поля заменяются
+// значениями по умолчанию: уровень сценария, две транзакции в двух сеансах
+// и estimateScenarioRun.
+type scenarioCost struct {
+	// levels - уровни изоляции, которые сценарий перебирает за один запуск
+	levels       []sql.IsolationLevel
+	transactions int
+	// sessions - сеансы сценария, открытые одновременно, без монитора
+	sessions int
+	duration time.Duration
+}
+
+func (s scenario) estimatedCost() scenarioCost {
+	c := s.cost
+	if len(c.levels) == 0 {
+		c.levels = []sql.IsolationLevel{s.level}
+	}
+	if c.transactions == 0 {
+		c.transactions = estimateTransactions * len(c.levels)
+	}
+	if c.sessions == 0 {
+		c.sessions = estimateTransactions
+	}
+	if c.duration == 0 {
+		c.duration = estimateScenarioRun * time.Duration(len(c.levels))
+	}
+	return c
+}
+
+// runBudget - пороги, выше которых запуск требует подтверждения (-budget,
+// -budget-transactions); нулевой порог не проверяется.
+type runBudget struct {
+	duration     time.Duration
+	transactions int
+	// confirmed - запуск подтвержден заранее (-yes)
+	confirmed bool
+}
+
+// runEstimate - оценка запуска до подключения к серверу: сколько раз
+// выполняются сценарии на каких уровнях и СУБД, сколько это займет и какую
+// нагрузку создаст на базе.
+type runEstimate struct {
+	what      string
+	scenarios int
+	levels    map[sql.IsolationLevel]bool
+	backends  int
+	// runs - запуски сценариев на каждом уровне и каждой СУБД
+	runs     int
+	duration time.Duration
+	// fromHistory - сценарии, длительность которых взята из истории
+	fromHistory  int
+	transactions int
+	// sessions - наибольшее число одновременных сеансов, включая мониторы
+	sessions int
+}
+
+func newRunEstimate(what string, backends int) *runEstimate {
+	return &runEstimate{what: what, levels: make(map[sql.IsolationLevel]bool), backends: backends}
+}
+
+// estimateScenarios оценивает запуск сценариев names. Длительность берется
+// из averages - средних по истории, - для остальных из scenarioCost. С
+// parallel группы независимых схем выполняются одновременно: длительность -
+// самая долгая группа, сеансы складываются.
+func estimateScenarios(names []string, parallel bool, averages map[string]time.Duration) *runEstimate {
+	e := newRunEstimate("scenarios", 1)
+	groups := [][]string{names}
+	if parallel {
+		groups = parallelGroups(names)
+	}
+	for _, group := range groups {
+		var duration time.Duration
+		var sessions int
+		for _, name := range group {
+			c := isolationProblems[name].estimatedCost()
+			e.scenarios++
+			e.runs += len(c.levels)
+			for _, level := range c.levels {
+				e.levels[level] = true
+			}
+			e.transactions += c.transactions
+			if average, ok := averages[name]; ok {
+				c.duration = average
+				e.fromHistory++
+			}
+			duration += c.duration
+			// Монитор сценария - отдельный сеанс
+			sessions = max(sessions, c.sessions+1)
+		}
+		e.duration = max(e.duration, duration)
+		if parallel {
+			e.sessions += sessions
+		} else {
+			e.sessions = max(e.sessions, sessions)
+		}
+	}
+	return e
+}
+
+// estimateProbability оценивает -probability: runs случайных запусков на
+// каждом уровне probabilityLevels для сценариев со случайным порядком шагов.
+func estimateProbability(names []string, runs int) *runEstimate {
+	e := newRunEstimate("probability", 1)
+	for _, name := range names {
+		s := isolationProblems[name]
+		if s.randomized == nil {
+			continue
+		}
+		c := s.estimatedCost()
+		e.scenarios++
+		e.runs += runs * len(probabilityLevels)
+		e.transactions += runs * len(probabilityLevels) * c.transactions / len(c.levels)
+		e.duration += time.Duration(runs*len(probabilityLevels)) * estimateCellRun
+		e.sessions = max(e.sessions, c.sessions+1)
+	}
+	for _, level := range probabilityLevels {
+		e.levels[level] = true
+	}
+	return e
+}
+
+// estimateCells оценивает отчет из cells ячеек с парой транзакций в каждой
+// (-matrix, -ansi, sweep) на backends серверах.
+func estimateCells(what string, cases int, levels []sql.IsolationLevel, backends int) *runEstimate {
+	e := newRunEstimate(what, backends)
+	e.scenarios = cases
+	for _, level := range levels {
+		e.levels[level] = true
+	}
+	e.runs = cases * len(levels) * backends
+	e.transactions = estimateTransactions * e.runs
+	e.duration = time.Duration(e.runs) * estimateCellRun
+	e.sessions = estimateTransactions
+	return e
+}
+
+func (e *runEstimate) print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "ESTIMATE\t%s\n", e.what)
+	fmt.Fprintf(tw, "runs\t%d = %d scenarios × %d levels × %d backends\n", e.runs, e.scenarios, len(e.levels), e.backends)
+	duration := e.duration.Round(time.Second).String()
+	if e.fromHistory > 0 {
+		duration += fmt.Sprintf(" (%d of %d scenarios from history)", e.fromHistory, e.scenarios)
+	}
+	fmt.Fprintf(tw, "duration\t%s\n", duration)
+	fmt.Fprintf(tw, "transactions\t%d\n", e.transactions)
+	fmt.Fprintf(tw, "peak sessions\t%d\n", e.sessions)
+	return tw.Flush()
+}
+
+// exceeds возвращает пороги бюджета, которые превышает оценка.
+func (e *runEstimate) exceeds(b runBudget) []string {
+	var over []string
+	if b.duration > 0 && e.duration > b.duration {
+		over = append(over, fmt.Sprintf("duration %s > %s", e.duration.Round(time.Second), b.duration))
+	}
+	if b.transactions > 0 && e.transactions > b.transactions {
+		over = append(over, fmt.Sprintf("transactions %d > %d", e.transactions, b.transactions))
+	}
+	return over
+}
+
+// checkBudget выводит оценку в stderr, если она превышает бюджет или print,
+// и требует подтверждения запуска сверх бюджета: -yes или ответ y в
+// терминале. Без терминала запуск сверх бюджета прерывается, чтобы запуск
+// из скрипта не нагрузил общий сервер по ошибке.
+func checkBudget(e *runEstimate, b runBudget, print bool, logger *zap.Logger) error {
+	over := e.exceeds(b)
+	logger.Info("run estimate", zap.String("what", e.what), zap.Int("runs", e.runs), zap.Duration("duration", e.duration),
+		zap.Int("transactions", e.transactions), zap.Int("sessions", e.sessions), zap.Strings("over_budget", over))
+	if print || len(over) > 0 {
+		if err := e.print(os.Stderr); err != nil {
+			return err
+		}
+	}
+	if len(over) == 0 || b.confirmed {
+		return nil
+	}
+	if stat, err := os.Stdin.Stat(); err != nil || stat.Mode()&os.ModeCharDevice == 0 {
+		return fmt.Errorf("%w: %s", errOverBudget, strings.Join(over, ", "))
+	}
+	fmt.Fprintf(os.Stderr, "over budget: %s. Start the run? [y/N] ", strings.Join(over, ", "))
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+		return fmt.Errorf("%w: %s", errOverBudget, strings.Join(over, ", "))
+	}
+	logger.Warn("run over budget confirmed", zap.Strings("over_budget", over))
+	return nil
+}
+
+// selectsBenchmarks сообщает, выбраны ли сценарии с меткой benchmark: оценка
+// таких запусков выводится, даже если они укладываются в бюджет.
+func selectsBenchmarks(names []string) bool {
+	for _, name := range names {
+		if slices.Contains(isolationProblems[name].tags, "benchmark") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+
+	"transactionIsolation/isolation"
+)
+
+// capturedStatement - оператор, выполненный в сессии (подключении) сценария.
+type capturedStatement struct {
+	session int
+	sql     string
+}
+
+// sqlCapture записывает операторы всех подключений, чтобы сценарий можно было
+// повторить вручную в нескольких окнах psql.
+type sqlCapture struct {
+	mu         sync.Mutex
+	sessions   map[*captureConn]int
+	statements []capturedStatement
+}
+
+// start начинает запись нового сценария.
+func (c *sqlCapture) start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sessions = make(map[*captureConn]int)
+	c.statements = nil
+}
+
+func (c *sqlCapture) record(conn *captureConn, query string, args []driver.NamedValue) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sessions == nil {
+		return
+	}
+	session, ok := c.sessions[conn]
+	if !ok {
+		session = len(c.sessions) + 1
+		c.sessions[conn] = session
+	}
+	inlined, err := inlineArgs(query, args)
+	query = strings.TrimSpace(inlined)
+	if !strings.HasSuffix(query, ";") {
+		query += ";"
+	}
+	if err != nil {
+		// Оператор сохраняется с параметрами, которые придется подставить вручную
+		query = fmt.Sprintf("-- %v\n%s", err, query)
+	}
+	c.statements = append(c.statements, capturedStatement{session: session, sql: query})
+}
+
+// write сохраняет операторы каждой сессии в session_N.sql и порядок их
+// чередования в README.md.
+func (c *sqlCapture) write(dir, scenarioName string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	files := make([]strings.Builder, len(c.sessions)+1)
+	var readme strings.Builder
+	fmt.Fprintf(&readme, "# %s\n\n", scenarioName)
+	fmt.Fprintf(&readme, "Open one psql window per session file and run the statements in the order below.\n\n")
+	fmt.Fprintf(&readme, "| # | Session | Statement |\n|---|---|---|\n")
+	for i, st := range c.statements {
+		fmt.Fprintf(&files[st.session], "-- step %d\n%s\n\n", i+1, st.sql)
+		oneLine := strings.Join(strings.Fields(st.sql), " ")
+		fmt.Fprintf(&readme, "| %d | session_%d | `%s` |\n", i+1, st.session, strings.ReplaceAll(oneLine, "|", `\|`))
+	}
+	for session := 1; session < len(files); session++ {
+		name := filepath.Join(dir, fmt.Sprintf("session_%d.sql", session))
+		if err := os.WriteFile(name, []byte(files[session].String()), 0o644); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(filepath.Join(dir, "README.md"), []byte(readme.String()), 0o644)
+}
+
+var placeholder = regexp.MustCompile(`\$(\d+)`)
+
+// inlineArgs подставляет параметры запроса литералами, чтобы его можно было
+// выполнить в psql. Параметр, который нельзя записать литералом, остается
+// в запросе, а inlineArgs возвращает ошибку о первом таком параметре.
+func inlineArgs(query string, args []driver.NamedValue) (string, error) {
+	if len(args) == 0 {
+		return query, nil
+	}
+	var first error
+	inlined := placeholder.ReplaceAllStringFunc(query, func(p string) string {
+		n, _ := strconv.Atoi(p[1:])
+		if n < 1 || n > len(args) {
+			return p
+		}
+		literal, err := isolation.Literal(args[n-1].Value)
+		if err != nil {
+			if first == nil {
+				first = fmt.Errorf("parameter %s: %w", p, err)
+			}
+			return p
+		}
+		return literal
+	})
+	return inlined, first
+}
+
+// registerCaptureDriver регистрирует драйвер, записывающий операторы driverName в capture.
+func registerCaptureDriver(driverName string, capture *sqlCapture) (string, error) {
+	db, err := sql.Open(driverName, "")
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+	name := driverName + "+capture"
+	sql.Register(name, &captureDriver{inner: db.Driver(), capture: capture})
+	sqlx.BindDriver(name, sqlx.DOLLAR)
+	return name, nil
+}
+
+type captureDriver struct {
+	inner   driver.Driver
+	capture *sqlCapture
+}
+
+func (d *captureDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := d.inner.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &captureConn{Conn: conn, capture: d.capture}, nil
+}
+
+// captureConn записывает операторы, BEGIN, COMMIT и ROLLBACK подключения.
+type captureConn struct {
+	driver.Conn
+	capture *sqlCapture
+}
+
+func (c *captureConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	c.capture.record(c, query, args)
+	return execer.ExecContext(ctx, query, args)
+}
+
+func (c *captureConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	c.capture.record(c, query, args)
+	return queryer.QueryContext(ctx, query, args)
+}
+
+func (c *captureConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := c.Conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return &captureStmt{Stmt: stmt, conn: c, query: query}, nil
+}
+
+func (c *captureConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	var tx driver.Tx
+	var err error
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		tx, err = beginner.BeginTx(ctx, opts)
+	} else {
+		tx, err = c.Conn.Begin()
+	}
+	if err != nil {
+		return nil, err
+	}
+	begin := "BEGIN"
+	if level := sql.IsolationLevel(opts.Isolation); level != sql.LevelDefault {
+		begin += " ISOLATION LEVEL " + strings.ToUpper(level.String())
+	}
+	if opts.ReadOnly {
+		begin += " READ ONLY"
+	}
+	c.capture.record(c, begin, nil)
+	return &captureTx{Tx: tx, conn: c}, nil
+}
+
+func (c *captureConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+type captureStmt struct {
+	driver.Stmt
+	conn  *captureConn
+	query string
+}
+
+func (s *captureStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.conn.capture.record(s.conn, s.query, namedValues(args))
+	return s.Stmt.Exec(args)
+}
+
+func (s *captureStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.conn.capture.record(s.conn, s.query, namedValues(args))
+	return s.Stmt.Query(args)
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return named
+}
+
+type captureTx struct {
+	driver.Tx
+	conn *captureConn
+}
+
+func (t *captureTx) Commit() error {
+	t.conn.capture.record(t.conn, "COMMIT", nil)
+	return t.Tx.Commit()
+}
+
+func (t *captureTx) Rollback() error {
+	t.conn.capture.record(t.conn, "ROLLBACK", nil)
+	return t.Tx.Rollback()
+}
+
+// exportScenarioSQL сохраняет записанные операторы сценария в dir/<имя сценария>.
+func exportScenarioSQL(capture *sqlCapture, dir, name string, logger *zap.Logger) error {
+	target := filepath.Join(dir, strings.ReplaceAll(name, "/", "_"))
+	if err := capture.write(target, name); err != nil {
+		logger.Error("failed to export sql", zap.Error(err), zap.String("dir", target))
+		return err
+	}
+	logger.Info("sql exported", zap.String("dir", target))
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"go.uber.org/zap"
+)
+
+// builtinDescriptions - описания встроенных сценариев для каталога list.
+var builtinDescriptions = map[string]string{
+	"dirty_read":                "a READ UNCOMMITTED reader does not see an uncommitted update in PostgreSQL",
+	"non_repeatable_read":       "a repeated read of a row sees an update committed by another transaction",
+	"phantom_read":              "rows inserted by another transaction appear in a repeated range query",
+	"lost_update":               "two read-modify-write transactions overwrite each other's balance update",
+	"lost_update_sqlc":          "lost update through sqlc-generated queries with Queries.WithTx",
+	"counter_increments":        "concurrent counter increments with read-modify-write, atomic UPDATE and row locks",
+	"double_booking":            "two transactions book the same slot after both checked it was free",
+	"inventory_oversell":        "concurrent orders sell more stock than is available",
+	"update_returning":          "read-then-write debit compared with a single UPDATE ... RETURNING",
+	"serializable_locking":      "predicate locks and serialization failures at SERIALIZABLE",
+	"snapshot_too_old":          "long REPEATABLE READ transaction fails with snapshot too old",
+	"partitioned_phantom":       "snapshots and predicate locks span all partitions of a table",
+	"matview_refresh":           "what readers see while a materialized view is refreshed, with and without CONCURRENTLY",
+	"trigger_summary":           "trigger recalculating a summary loses a concurrent change at READ COMMITTED",
+	"cursor_stability":          "row versions returned by a cursor while another transaction updates unread rows",
+	"merge_concurrency":         "concurrent MERGE compared with INSERT ... ON CONFLICT",
+	"money_rounding":            "NUMERIC(18,2) deposits of half a cent: rounding on every write and a lost update of cents",
+	"rc_polling":                "statement-level snapshots of a READ COMMITTED transaction polling a balance",
+	"own_writes":                "a transaction sees its own uncommitted writes, including after ROLLBACK TO SAVEPOINT",
+	"ssi_false_positive":        "serialization failure between logically independent SERIALIZABLE transactions without an index",
+	"for_share_queue":           "FOR SHARE readers jump ahead of a waiting writer in the row lock queue",
+	"multixact":                 "xmax replaced by a MultiXact id when a second transaction locks the row",
+	"event_report":              "analytical report over an append-only table while writers commit new events",
+	"deferred_constraint":       "write skew across tables with an immediate and a deferred constraint trigger",
+	"deferred_foreign_key":      "deferred foreign key check changes who wins a delete/insert race",
+	"pooler_pitfalls":           "session state lost or leaked behind a transaction-mode connection pooler",
+	"in_list_lock_order":        "SELECT ... WHERE id IN (...) FOR UPDATE locks rows in plan order, not list order",
+	"xid_age":                   "long transaction holds back VACUUM FREEZE and ages the database towards xid wraparound",
+	"prepared_snapshot":         "prepared statement plans are kept per session while data is read from the transaction snapshot",
+	"cross_database":            "transfer between two databases without two-phase commit: partial-commit window and lost money after a crash",
+	"deadlock_order":            "deadlock from locking rows in different order compared with sorted lock order",
+	"advisory_lock_scope":       "transaction and session advisory locks across ROLLBACK TO SAVEPOINT",
+	"for_update_reread":         "SELECT FOR UPDATE returns a newer row version than a plain SELECT at READ COMMITTED",
+	"held_cursor":               "what a cursor returns after its transaction commits while other transactions change unread rows",
+	"tenant_isolation":          "row level security policies follow the same snapshot rules as WHERE clauses",
+	"wallet_ledger":             "balance stored in a wallet row compared with a balance summed from a ledger",
+	"gin_predicate_locks":       "SERIALIZABLE predicate locks with a GIN index and fastupdate",
+	"predicate_lock_escalation": "predicate lock escalation and exhaustion of the shared lock table",
+}
+
+// Ожидаемые исходы сценария в каталоге.
+const (
+	outcomePass  = "pass"
+	outcomeXFail = "xfail"
+	outcomeSkip  = "skip"
+)
+
+// catalogEntry - сценарий в каталоге list.
+type catalogEntry struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	Tags        []string          `json:"tags"`
+	Namespace   string            `json:"namespace,omitempty"`
+	Level       string            `json:"level"`
+	After       []string          `json:"after,omitempty"`
+	Expected    []expectedOutcome `json:"expected"`
+}
+
+// expectedOutcome - ожидаемый исход сценария на уровне Level для СУБД Backend
+// версий [MinVersion, MaxVersion); пустой Backend и нулевые границы - любые.
+// Anomaly - должна ли наблюдаться аномалия, если сценарий ее проверяет.
+type expectedOutcome struct {
+	Level      string `json:"level"`
+	Backend    string `json:"backend,omitempty"`
+	MinVersion int    `json:"min_version,omitempty"`
+	MaxVersion int    `json:"max_version,omitempty"`
+	Outcome    string `json:"outcome"`
+	Anomaly    *bool  `json:"anomaly,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+// catalog возвращает зарегистрированные сценарии по имени.
+func catalog() []catalogEntry {
+	names := make([]string, 0, len(isolationProblems))
+	for name := range isolationProblems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	entries := make([]catalogEntry, 0, len(names))
+	for _, name := range names {
+		entries = append(entries, isolationProblems[name].catalogEntry(name))
+	}
+	return entries
+}
+
+func (s scenario) catalogEntry(name string) catalogEntry {
+	e := catalogEntry{
+		Name:        name,
+		Description: s.description,
+		Tags:        s.tags,
+		Namespace:   s.namespace,
+		Level:       s.level.String(),
+		After:       s.after,
+	}
+	if description, ok := builtinDescriptions[name]; ok {
+		e.Description = description
+		e.Tags = []string{"builtin"}
+	}
+	if e.Tags == nil {
+		e.Tags = []string{}
+	}
+	// Аннотации сужают исход по умолчанию, поэтому идут раньше него, как их проверяет runner
+	for _, a := range s.skip {
+		e.Expected = append(e.Expected, s.expectedOutcome(outcomeSkip, a))
+	}
+	for _, a := range s.xfail {
+		e.Expected = append(e.Expected, s.expectedOutcome(outcomeXFail, a))
+	}
+	e.Expected = append(e.Expected, s.expectedOutcome(outcomePass, backendAnnotation{Backend: backendPostgres}))
+	return e
+}
+
+func (s scenario) expectedOutcome(outcome string, a backendAnnotation) expectedOutcome {
+	o := expectedOutcome{
+		Level:      s.level.String(),
+		Backend:    a.Backend,
+		MinVersion: a.MinVersion,
+		MaxVersion: a.MaxVersion,
+		Outcome:    outcome,
+		Reason:     a.Reason,
+	}
+	if outcome != outcomeSkip {
+		o.Anomaly = s.anomaly
+	}
+	return o
+}
+
+// listCommand реализует подкоманду list: печатает каталог сценариев, включая
+// YAML сценарии, нагрузки и наборы, таблицей или в JSON для внешних
+// инструментов, генераторов документации и веб-интерфейса.
+func listCommand(args []string, logger *zap.Logger) error {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	format := flags.String("format", "text", "output format: text or json")
+	scenariosDir := flags.String("scenarios", "", "directory with YAML scenarios to include")
+	var workloads, logReplays, plugins stringList
+	flags.Var(&workloads, "workload", "YAML workload file to include as a benchmark scenario; repeatable")
+	flags.Var(&logReplays, "log-replay", "server log replay description to include; repeatable")
+	flags.Var(&plugins, "plugin", "Go plugin with scenario packs to include; repeatable")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("unknown format %q, expected text or json", *format)
+	}
+	if _, err := registerScenarios(*scenariosDir, workloads, logReplays, plugins, logger); err != nil {
+		return err
+	}
+	entries := catalog()
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+	return printCatalog(os.Stdout, entries)
+}
+
+func printCatalog(w io.Writer, entries []catalogEntry) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCENARIO\tLEVEL\tANOMALY\tTAGS\tDESCRIPTION")
+	for _, e := range entries {
+		anomaly := "-"
+		for _, o := range e.Expected {
+			if o.Outcome == outcomePass && o.Anomaly != nil {
+				anomaly = fmt.Sprint(*o.Anomaly)
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", e.Name, e.Level, anomaly, strings.Join(e.Tags, ","), e.Description)
+	}
+	return tw.Flush()
+}
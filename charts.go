@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// benchmarkResult - итог нагрузочного варианта сценария.
+type benchmarkResult struct {
+	Scenario     string  `json:"scenario"`
+	Variant      string  `json:"variant"`
+	Level        string  `json:"level"`
+	Transactions int     `json:"transactions"`
+	Aborts       int     `json:"aborts"`
+	TPS          float64 `json:"tps"`
+	LatencyMs    float64 `json:"latency_ms"`
+	AbortRate    float64 `json:"abort_rate"`
+}
+
+func newBenchmarkResult(scenario, variant, level string, transactions, aborts int, elapsed, latency time.Duration) benchmarkResult {
+	r := benchmarkResult{
+		Scenario:     scenario,
+		Variant:      variant,
+		Level:        level,
+		Transactions: transactions,
+		Aborts:       aborts,
+		TPS:          float64(transactions) / elapsed.Seconds(),
+	}
+	if transactions > 0 {
+		r.LatencyMs = float64(latency.Microseconds()) / 1000 / float64(transactions)
+	}
+	if attempts := transactions + aborts; attempts > 0 {
+		r.AbortRate = float64(aborts) / float64(attempts)
+	}
+	return r
+}
+
+// benchmarks накапливает результаты нагрузочных сценариев за запуск.
+var benchmarks struct {
+	mu      sync.Mutex
+	results []benchmarkResult
+}
+
+func recordBenchmark(r benchmarkResult) {
+	benchmarks.mu.Lock()
+	defer benchmarks.mu.Unlock()
+	benchmarks.results = append(benchmarks.results, r)
+}
+
+// writeBenchmarkCharts сохраняет в dir график benchmark.svg и спецификацию
+// Vega-Lite benchmark.vl.json с теми же данными и метаданными запуска meta.
+func writeBenchmarkCharts(dir string, meta *runMetadata) error {
+	benchmarks.mu.Lock()
+	results := append([]benchmarkResult(nil), benchmarks.results...)
+	benchmarks.mu.Unlock()
+	if len(results) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "benchmark.svg"), []byte(benchmarkSVG(results, meta)), 0o644); err != nil {
+		return err
+	}
+	spec, err := benchmarkVegaLite(results, meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "benchmark.vl.json"), spec, 0o644)
+}
+
+type benchmarkMetric struct {
+	title string
+	value func(benchmarkResult) float64
+	field string
+}
+
+var benchmarkMetrics = []benchmarkMetric{
+	{title: "Throughput, tx/s", field: "tps", value: func(r benchmarkResult) float64 { return r.TPS }},
+	{title: "Average latency, ms", field: "latency_ms", value: func(r benchmarkResult) float64 { return r.LatencyMs }},
+	{title: "Abort rate, %", field: "abort_rate", value: func(r benchmarkResult) float64 { return 100 * r.AbortRate }},
+}
+
+// benchmarkSVG рисует по горизонтальной столбчатой диаграмме на каждую метрику.
+func benchmarkSVG(results []benchmarkResult, meta *runMetadata) string {
+	const (
+		width      = 800
+		labelWidth = 280
+		barHeight  = 22
+		gap        = 6
+		titleSpace = 30
+	)
+	panelHeight := titleSpace + len(results)*(barHeight+gap) + gap
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif" font-size="12">`+"\n",
+		width, panelHeight*len(benchmarkMetrics))
+	if meta != nil {
+		fmt.Fprintf(&b, "<desc>%s</desc>\n", html.EscapeString(strings.Join(meta.lines(), "\n")))
+	}
+	for m, metric := range benchmarkMetrics {
+		top := m * panelHeight
+		maxValue := 0.0
+		for _, r := range results {
+			maxValue = max(maxValue, metric.value(r))
+		}
+		fmt.Fprintf(&b, `<text x="0" y="%d" font-weight="bold" font-size="14">%s</text>`+"\n", top+20, html.EscapeString(metric.title))
+		for i, r := range results {
+			y := top + titleSpace + i*(barHeight+gap)
+			value := metric.value(r)
+			barWidth := 0.0
+			if maxValue > 0 {
+				barWidth = value / maxValue * (width - labelWidth - 80)
+			}
+			label := fmt.Sprintf("%s/%s (%s)", r.Scenario, r.Variant, r.Level)
+			fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="end">%s</text>`+"\n", labelWidth-8, y+15, html.EscapeString(label))
+			fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%.1f" height="%d" fill="#4c78a8"/>`+"\n", labelWidth, y, barWidth, barHeight)
+			fmt.Fprintf(&b, `<text x="%.1f" y="%d">%.1f</text>`+"\n", labelWidth+barWidth+6, y+15, value)
+		}
+	}
+	b.WriteString("</svg>\n")
+	return b.String()
+}
+
+// benchmarkVegaLite возвращает спецификацию Vega-Lite с данными запуска.
+func benchmarkVegaLite(results []benchmarkResult, meta *runMetadata) ([]byte, error) {
+	var charts []map[string]any
+	for _, metric := range benchmarkMetrics {
+		charts = append(charts, map[string]any{
+			"title": metric.title,
+			"mark":  "bar",
+			"encoding": map[string]any{
+				"y":     map[string]any{"field": "variant", "type": "nominal", "title": nil},
+				"x":     map[string]any{"field": metric.field, "type": "quantitative", "title": nil},
+				"color": map[string]any{"field": "level", "type": "nominal"},
+			},
+		})
+	}
+	spec := map[string]any{
+		"$schema": "https://vega.github.io/schema/vega-lite/v5.json",
+		// usermeta Vega-Lite не интерпретирует, в нем хранятся условия запуска
+		"usermeta": map[string]any{"metadata": meta},
+		"data":     map[string]any{"values": results},
+		"vconcat":  charts,
+	}
+	return json.MarshalIndent(spec, "", "  ")
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"go.uber.org/zap"
+)
+
+// manualTx - транзакция YAML сценариев, которую выполняет человек во внешней
+// сессии psql; пусто - все транзакции выполняет инструмент.
+var manualTx string
+
+// manualIO - куда выводятся подсказки и откуда читается подтверждение.
+var manualIO = struct {
+	out io.Writer
+	in  *bufio.Reader
+}{out: os.Stdout, in: bufio.NewReader(os.Stdin)}
+
+// promptManual выводит оператор шага manualTx и ждет, пока пользователь
+// выполнит его в psql и нажмет Enter. Ожидания шага выводятся как подсказка:
+// результат внешней сессии инструменту не виден.
+func (y *yamlScenario) promptManual(i int, step yamlStep, params []any, level string, logger *zap.Logger) error {
+	statement, err := step.psqlStatement(level, gucProfileFor(y.Name, step.Tx, y.transactionSettings(step.Tx)), params)
+	if err != nil {
+		logger.Error("failed to build the manual statement", zap.Error(err), zap.Int("step", i+1))
+		return err
+	}
+	if statement == "" {
+		logger.Info("script of the manual transaction skipped", zap.Int("step", i+1))
+		return nil
+	}
+
+	w := manualIO.out
+	fmt.Fprintf(w, "\n-- %s step %d: run as %s in your psql session\n", y.Name, i+1, step.Tx)
+	fmt.Fprintln(w, statement)
+	if expect := step.psqlExpectation(); expect != "" {
+		fmt.Fprintf(w, "-- expect %s\n", expect)
+	}
+	fmt.Fprint(w, "-- press Enter when psql has accepted the statement (it may still be waiting for a lock) ")
+	if _, err := manualIO.in.ReadString('\n'); err != nil {
+		logger.Error("failed to read confirmation", zap.Error(err))
+		return err
+	}
+	logger.Info("manual step confirmed", zap.Int("step", i+1), zap.String("statement", statement))
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// cleanupLeftovers удаляет следы прерванных запусков: откатывает подготовленные
+// транзакции, gid которых начинается с application_name сценариев и двоеточия,
+// и отключает сессии с application_name сценариев, которые держат advisory
+// блокировки. Без этого повторный запуск двухфазных и advisory сценариев ждет
+// блокировок, которые некому освободить.
+func cleanupLeftovers(db *sqlx.DB, logger *zap.Logger) error {
+	prefix := scenarioApplicationName("")
+
+	const preparedQuery = `SELECT gid FROM pg_prepared_xacts
+         WHERE database = current_database() AND left(gid, length($1) + 1) = $1 || ':'
+         ORDER BY prepared;`
+	var gids []string
+	if err := db.Select(&gids, preparedQuery, prefix); err != nil {
+		logger.Error("failed to list prepared transactions", zap.Error(err))
+		return err
+	}
+	for _, gid := range gids {
+		// ROLLBACK PREPARED не принимает параметры
+		if _, err := db.Exec("ROLLBACK PREPARED " + pq.QuoteLiteral(gid) + ";"); err != nil {
+			logger.Error("failed to rollback prepared transaction", zap.Error(err), zap.String("gid", gid))
+			return err
+		}
+		logger.Warn("leftover prepared transaction rolled back", zap.String("gid", gid))
+	}
+
+	if !monitorAccess.locks || !monitorAccess.terminate {
+		logger.Warn("leftover sessions with advisory locks are not checked: no access to pg_locks or pg_terminate_backend")
+		return nil
+	}
+	const sessionsQuery = `SELECT DISTINCT a.pid FROM pg_stat_activity a
+         JOIN pg_locks l ON l.pid = a.pid
+         WHERE l.locktype = 'advisory' AND a.datname = current_database()
+           AND (a.application_name = $1 OR left(a.application_name, length($1) + 1) IN ($1 || ':', $1 || '/'))
+           AND a.pid <> pg_backend_pid() AND pg_terminate_backend(a.pid);`
+	var pids []int
+	if err := db.Select(&pids, sessionsQuery, prefix); err != nil {
+		logger.Error("failed to terminate leftover sessions", zap.Error(err))
+		return err
+	}
+	if len(pids) > 0 {
+		logger.Warn("leftover sessions with advisory locks terminated", zap.Ints("pids", pids))
+	}
+	return nil
+}
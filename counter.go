@@ -0,0 +1,197 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+const (
+	counterIncrements = 100
+	// counterMaxRetries ограничивает повторы одного инкремента serializable_retry
+	counterMaxRetries = 50
+)
+
+// counterWorkers - число горутин, одновременно увеличивающих счетчик (-counter-workers).
+var counterWorkers = 8
+
+func validateCounterWorkers(n int) error {
+	if n < 1 {
+		return fmt.Errorf("counter workers must be positive, got %d", n)
+	}
+	return nil
+}
+
+var counterMigrations = []string{
+	`DROP TABLE IF EXISTS counter;`,
+	`CREATE TABLE IF NOT EXISTS counter (
+           id INT PRIMARY KEY,
+           value BIGINT NOT NULL
+         );`,
+	`INSERT INTO counter VALUES (1, 0);`,
+}
+
+// incrementStrategy увеличивает счетчик на 1 в одной транзакции.
+// Возвращает количество повторов транзакции.
+type incrementStrategy func(db *sqlx.DB, logger *zap.Logger) (int, error)
+
+var incrementStrategies = []struct {
+	name      string
+	increment incrementStrategy
+	// lossless - стратегия не теряет инкременты
+	lossless bool
+	level    sql.IsolationLevel
+}{
+	{"naive_read_then_write", naiveIncrement, false, sql.LevelReadCommitted},
+	{"atomic_update", atomicIncrement, true, sql.LevelReadCommitted},
+	{"select_for_update", forUpdateIncrement, true, sql.LevelReadCommitted},
+	{"serializable_retry", serializableIncrement, true, sql.LevelSerializable},
+}
+
+func counterIncrementStrategies(db *sqlx.DB, logger *zap.Logger) error {
+	for _, s := range incrementStrategies {
+		strategyLogger := logger.With(zap.String("strategy", s.name))
+		suiteProgress.setStep("strategy " + s.name)
+		if _, err := db.Exec("UPDATE counter SET value = 0 WHERE id = 1;"); err != nil {
+			strategyLogger.Error("failed to reset counter", zap.Error(err))
+			return err
+		}
+
+		// Логи отдельных инкрементов отключены: их тысячи, а ошибки сериализации ожидаемы
+		workerLogger := zap.NewNop()
+		var retries atomic.Int64
+		var latency atomic.Int64
+		var wg sync.WaitGroup
+		errs := make(chan error, counterWorkers)
+		started := time.Now()
+		for range counterWorkers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < counterIncrements; i++ {
+					incrementStarted := time.Now()
+					n, err := s.increment(db, workerLogger)
+					latency.Add(int64(time.Since(incrementStarted)))
+					retries.Add(int64(n))
+					if err != nil {
+						errs <- err
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		elapsed := time.Since(started)
+		close(errs)
+		if err := <-errs; err != nil {
+			strategyLogger.Error("strategy failed", zap.Error(err))
+			return fmt.Errorf("%s: %w", s.name, err)
+		}
+
+		var value int
+		if err := db.Get(&value, "SELECT value FROM counter WHERE id = 1;"); err != nil {
+			strategyLogger.Error("failed to read counter", zap.Error(err))
+			return err
+		}
+		expected := counterWorkers * counterIncrements
+		strategyLogger.Info("strategy finished",
+			zap.Int("workers", counterWorkers),
+			zap.Int("expected", expected),
+			zap.Int("value", value),
+			zap.Int("lost_increments", expected-value),
+			zap.Int64("retries", retries.Load()),
+			zap.Duration("elapsed", elapsed),
+			zap.Float64("increments_per_sec", float64(expected)/elapsed.Seconds()),
+		)
+		recordBenchmark(newBenchmarkResult("counter_increments", s.name, s.level.String(),
+			expected, int(retries.Load()), elapsed, time.Duration(latency.Load())))
+		if s.lossless && value != expected {
+			return fmt.Errorf("%s: counter is %d, expected %d", s.name, value, expected)
+		}
+	}
+	return nil
+}
+
+func naiveIncrement(db *sqlx.DB, logger *zap.Logger) (int, error) {
+	tx := newTransaction(db, logger)
+	if err := tx.begin(); err != nil {
+		return 0, err
+	}
+	rows, err := tx.query("SELECT value FROM counter WHERE id = 1;")
+	if err != nil {
+		ignoreError(logger, "rollback", tx.rollback())
+		return 0, err
+	}
+	if _, err = tx.exec("UPDATE counter SET value = $1 WHERE id = 1;", rows[0][0].(int64)+1); err != nil {
+		ignoreError(logger, "rollback", tx.rollback())
+		return 0, err
+	}
+	return 0, tx.commit()
+}
+
+func atomicIncrement(db *sqlx.DB, logger *zap.Logger) (int, error) {
+	tx := newTransaction(db, logger)
+	if err := tx.begin(); err != nil {
+		return 0, err
+	}
+	if _, err := tx.exec("UPDATE counter SET value = value + 1 WHERE id = 1;"); err != nil {
+		ignoreError(logger, "rollback", tx.rollback())
+		return 0, err
+	}
+	return 0, tx.commit()
+}
+
+func forUpdateIncrement(db *sqlx.DB, logger *zap.Logger) (int, error) {
+	tx := newTransaction(db, logger)
+	if err := tx.begin(); err != nil {
+		return 0, err
+	}
+	rows, err := tx.query("SELECT value FROM counter WHERE id = 1 FOR UPDATE;")
+	if err != nil {
+		ignoreError(logger, "rollback", tx.rollback())
+		return 0, err
+	}
+	if _, err = tx.exec("UPDATE counter SET value = $1 WHERE id = 1;", rows[0][0].(int64)+1); err != nil {
+		ignoreError(logger, "rollback", tx.rollback())
+		return 0, err
+	}
+	return 0, tx.commit()
+}
+
+// serializableIncrement повторяет транзакцию при ошибке сериализации (40001),
+// но не больше counterMaxRetries раз.
+func serializableIncrement(db *sqlx.DB, logger *zap.Logger) (int, error) {
+	for retries := 0; ; retries++ {
+		err := func() error {
+			tx := newTransaction(db, logger)
+			if err := tx.begin(); err != nil {
+				return err
+			}
+			if err := tx.setLevel(sql.LevelSerializable); err != nil {
+				ignoreError(logger, "rollback", tx.rollback())
+				return err
+			}
+			rows, err := tx.query("SELECT value FROM counter WHERE id = 1;")
+			if err != nil {
+				ignoreError(logger, "rollback", tx.rollback())
+				return err
+			}
+			if _, err = tx.exec("UPDATE counter SET value = $1 WHERE id = 1;", rows[0][0].(int64)+1); err != nil {
+				ignoreError(logger, "rollback", tx.rollback())
+				return err
+			}
+			return tx.commit()
+		}()
+		switch {
+		case errorCode(err) != "40001":
+			return retries, err
+		case retries == counterMaxRetries:
+			return retries, fmt.Errorf("gave up after %d retries: %w", retries, err)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// secondDatabase - другая база того же сервера для сценариев, которые пишут
+// в две базы (-second-database); пусто - такие сценарии пропускаются.
+var secondDatabase string
+
+// peers связывает пул подключений сценария с пулом второй базы. Транзакция
+// Postgres не выходит за пределы одной базы, поэтому сценарий работает со
+// второй базой через отдельный пул.
+var peers = struct {
+	mu   sync.Mutex
+	byDB map[*sqlx.DB]*sqlx.DB
+}{byDB: make(map[*sqlx.DB]*sqlx.DB)}
+
+func registerPeer(db, peer *sqlx.DB) {
+	peers.mu.Lock()
+	defer peers.mu.Unlock()
+	peers.byDB[db] = peer
+}
+
+// peerDB возвращает пул второй базы для пула сценария db или nil, если
+// вторая база не выбрана.
+func peerDB(db *sqlx.DB) *sqlx.DB {
+	peers.mu.Lock()
+	defer peers.mu.Unlock()
+	return peers.byDB[db]
+}
+
+// requirePeer пропускает сценарий с двумя базами, если -second-database не задан.
+func requirePeer(db *sqlx.DB, feature string) (*sqlx.DB, error) {
+	if peer := peerDB(db); peer != nil {
+		return peer, nil
+	}
+	return nil, fmt.Errorf("%w: %s needs a second database, set -second-database", errScenarioSkipped, feature)
+}
+
+// peer открывает пул второй базы для схемы сценария namespace. Схема
+// создается во второй базе так же, как в основной.
+func (r *runner) peer(namespace string, logger *zap.Logger) (*sqlx.DB, error) {
+	if secondDatabase == "" {
+		return nil, nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if peer, ok := r.peers[namespace]; ok {
+		return peer, nil
+	}
+	params, err := parseDSN(r.dsn)
+	if err != nil {
+		return nil, err
+	}
+	if params["dbname"] == secondDatabase {
+		return nil, fmt.Errorf("-second-database %q is the database of -dsn", secondDatabase)
+	}
+	params["dbname"] = secondDatabase
+	params["application_name"] = scenarioApplicationName(namespace)
+	schema := scenarioSchema(namespace)
+	if schema != "" {
+		params["search_path"] = pq.QuoteIdentifier(schema)
+	}
+	peer, err := connect(r.driverName, formatDSN(params), logger.With(zap.String("database", secondDatabase)))
+	if err != nil {
+		return nil, err
+	}
+	if schema != "" {
+		if _, err = peer.Exec("CREATE SCHEMA IF NOT EXISTS " + pq.QuoteIdentifier(schema) + ";"); err != nil {
+			logger.Error("failed to create schema", zap.Error(err), zap.String("database", secondDatabase))
+			ignoreError(logger, "close pool", peer.Close())
+			return nil, err
+		}
+	}
+	if r.peers == nil {
+		r.peers = make(map[string]*sqlx.DB)
+	}
+	r.peers[namespace] = peer
+	logger.Info("second database connected", zap.String("database", secondDatabase), zap.String("namespace", namespace))
+	return peer, nil
+}
+
+var crossDatabaseMigrations = []string{
+	`DROP TABLE IF EXISTS account;`,
+	`CREATE TABLE account (
+           id INT PRIMARY KEY,
+           balance INT NOT NULL
+         );`,
+	`INSERT INTO account VALUES (1, 1000);`,
+}
+
+// crossDatabasePeerMigrations создают во второй базе журнал зачислений.
+var crossDatabasePeerMigrations = []string{
+	`DROP TABLE IF EXISTS credit;`,
+	`CREATE TABLE credit (
+           transfer_id INT PRIMARY KEY,
+           amount INT NOT NULL
+         );`,
+}
+
+// crossDatabaseTotal - сумма денег в обеих базах: баланс счета в основной и
+// зачисления во второй.
+const crossDatabaseTotal = 1000
+
+const crossDatabaseAmount = 100
+
+// crossDatabaseVariant - чем заканчивается вторая фиксация перевода.
+type crossDatabaseVariant struct {
+	name string
+	// commitSecond - транзакция второй базы фиксируется; иначе процесс
+	// приложения падает между фиксациями, и сервер откатывает ее
+	commitSecond bool
+}
+
+var crossDatabaseVariants = []crossDatabaseVariant{
+	{name: "both_commit", commitSecond: true},
+	{name: "crash_between_commits"},
+}
+
+// crossDatabase показывает перевод между двумя базами одного сервера как
+// одну логическую операцию без двухфазной фиксации: tx1 списывает сумму в
+// основной базе, tx2 зачисляет ее во второй, и приложение фиксирует их по
+// очереди. Между фиксациями читатель обеих баз видит списание без зачисления,
+// а если приложение падает до второй фиксации, деньги теряются насовсем.
+// Исправление - PREPARE TRANSACTION в обеих базах до COMMIT PREPARED в любой
+// из них: подготовленная транзакция переживает падение, и координатор
+// доводит обе до одного исхода.
+func crossDatabase(db *sqlx.DB, logger *zap.Logger) error {
+	peer, err := requirePeer(db, "cross-database transfer")
+	if err != nil {
+		return err
+	}
+	for _, v := range crossDatabaseVariants {
+		if err = migrate(db, logger, crossDatabaseMigrations); err != nil {
+			return err
+		}
+		if err = migrate(peer, logger, crossDatabasePeerMigrations); err != nil {
+			return err
+		}
+		if err = runCrossDatabaseVariant(db, peer, logger.With(zap.String("variant", v.name)), v); err != nil {
+			return fmt.Errorf("%s: %w", v.name, err)
+		}
+	}
+	return nil
+}
+
+func runCrossDatabaseVariant(db, peer *sqlx.DB, logger *zap.Logger, v crossDatabaseVariant) (err error) {
+	want := crossDatabaseTotal - crossDatabaseAmount
+	if v.commitSecond {
+		want = crossDatabaseTotal
+	}
+	defer func() {
+		if cerr := expectCrossDatabaseTotal(db, peer, logger, want); err == nil {
+			err = cerr
+		}
+	}()
+
+	tx1, err := beginTx(db, logger, "tx1", sql.LevelReadCommitted)
+	if err != nil {
+		return err
+	}
+	if _, err = tx1.exec("UPDATE account SET balance = balance - $1 WHERE id = 1;", crossDatabaseAmount); err != nil {
+		return err
+	}
+	tx2, err := beginTx(peer, logger.With(zap.String("database", secondDatabase)), "tx2", sql.LevelReadCommitted)
+	if err != nil {
+		return err
+	}
+	if _, err = tx2.exec("INSERT INTO credit VALUES (1, $1);", crossDatabaseAmount); err != nil {
+		return err
+	}
+	if err = tx1.commit(); err != nil {
+		return err
+	}
+
+	// Окно частичной фиксации: списание видно, зачисление еще нет
+	logger.Info("first database committed, second not yet")
+	if err = expectCrossDatabaseTotal(db, peer, logger, crossDatabaseTotal-crossDatabaseAmount); err != nil {
+		return err
+	}
+
+	if !v.commitSecond {
+		// Сервер откатывает транзакцию, клиент которой отключился до COMMIT
+		logger.Warn("application crashed between commits, second database rolls back")
+		return tx2.rollback()
+	}
+	return tx2.commit()
+}
+
+// expectCrossDatabaseTotal проверяет сумму денег в обеих базах. Чтения двух
+// баз - два отдельных снимка, но после фиксаций обеих транзакций это не важно.
+func expectCrossDatabaseTotal(db, peer *sqlx.DB, logger *zap.Logger, want int) error {
+	var balance, credited int
+	if err := monitorDB(db).Get(&balance, "SELECT balance FROM account WHERE id = 1;"); err != nil {
+		logger.Error("failed to read balance", zap.Error(err))
+		return err
+	}
+	if err := peer.Get(&credited, "SELECT COALESCE(sum(amount), 0) FROM credit;"); err != nil {
+		logger.Error("failed to read credits", zap.Error(err), zap.String("database", secondDatabase))
+		return err
+	}
+	logger.Info("money across databases", zap.Int("balance", balance), zap.Int("credited", credited), zap.Int("total", balance+credited))
+	if balance+credited != want {
+		return fmt.Errorf("expected %d across both databases, got %d (balance %d, credited %d)", want, balance+credited, balance, credited)
+	}
+	return nil
+}
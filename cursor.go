@@ -0,0 +1,262 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+var cursorMigrations = append(append([]string{}, personMigrations...),
+	`INSERT INTO person VALUES (3, 1000);`,
+)
+
+// cursorVariant - уровень изоляции и вид курсора.
+type cursorVariant struct {
+	name      string
+	level     sql.IsolationLevel
+	forUpdate bool // DECLARE ... FOR UPDATE блокирует строки по мере чтения
+}
+
+var cursorVariants = []cursorVariant{
+	{name: "read_committed", level: sql.LevelReadCommitted},
+	{name: "repeatable_read", level: sql.LevelRepeatableRead},
+	{name: "serializable", level: sql.LevelSerializable},
+	{name: "read_committed_for_update", level: sql.LevelReadCommitted, forUpdate: true},
+	{name: "repeatable_read_for_update", level: sql.LevelRepeatableRead, forUpdate: true},
+}
+
+// cursorStability показывает, какие версии строк возвращает курсор, пока
+// другая транзакция изменяет еще не прочитанные строки. Снимок курсора
+// фиксируется при DECLARE на любом уровне изоляции, но курсор FOR UPDATE
+// при READ COMMITTED переходит к последней версии блокируемой строки.
+func cursorStability(db *sqlx.DB, logger *zap.Logger) error {
+	for _, v := range cursorVariants {
+		if err := runCursorVariant(db, logger.With(zap.String("variant", v.name)), v); err != nil {
+			return fmt.Errorf("%s: %w", v.name, err)
+		}
+	}
+	return nil
+}
+
+func runCursorVariant(db *sqlx.DB, logger *zap.Logger, v cursorVariant) error {
+	if err := migrate(db, logger, []string{`UPDATE person SET balance = 1000;`, `DELETE FROM person WHERE id > 3;`}); err != nil {
+		return err
+	}
+
+	// Объявление курсора и чтение первой строки в 1 транзакции
+	tx1 := newTransaction(db, logger.With(zap.String("tx", "tx1")))
+	if err := tx1.begin(); err != nil {
+		return err
+	}
+	if err := tx1.setLevel(v.level); err != nil {
+		return err
+	}
+	declare := "DECLARE person_cursor CURSOR FOR SELECT id, balance FROM person ORDER BY id"
+	if v.forUpdate {
+		declare += " FOR UPDATE"
+	}
+	if _, err := tx1.exec(declare + ";"); err != nil {
+		return err
+	}
+	if err := fetchCursor(tx1, "FETCH 1 FROM person_cursor;"); err != nil {
+		return err
+	}
+
+	// Изменение непрочитанной строки и вставка новой во 2 транзакции
+	tx2 := newTransaction(db, logger.With(zap.String("tx", "tx2")))
+	if err := tx2.begin(); err != nil {
+		return err
+	}
+	if err := tx2.updateUser(2, 2000); err != nil {
+		return err
+	}
+	if err := tx2.insertUser(4, 1000); err != nil {
+		return err
+	}
+	if err := tx2.commit(); err != nil {
+		return err
+	}
+
+	// Дочитывание курсора и повторный запрос в 1 транзакции
+	if err := fetchCursor(tx1, "FETCH ALL FROM person_cursor;"); err != nil {
+		tx1.logger.Info("fetch rejected", zap.String("code", errorCode(err)))
+		return tx1.rollback()
+	}
+	rows, err := tx1.query("SELECT id, balance FROM person ORDER BY id;")
+	if err != nil {
+		return err
+	}
+	tx1.logger.Info("rows selected after update", zap.Any("rows", rows))
+	if _, err = tx1.exec("CLOSE person_cursor;"); err != nil {
+		return err
+	}
+	return tx1.commit()
+}
+
+func fetchCursor(t *transaction, fetch string) error {
+	rows, err := t.query(fetch)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		t.logger.Info("row fetched", zap.Any("id", row[0]), zap.Any("balance", row[1]))
+	}
+	return nil
+}
+
+// cursor - курсор, объявленный в транзакции t.
+type cursor struct {
+	t    *transaction
+	name string
+	// hold - курсор WITH HOLD, доступный в сеансе после фиксации транзакции
+	hold bool
+}
+
+// declareCursor объявляет курсор name для запроса query. Курсор WITH HOLD
+// переживает транзакцию только в ее сеансе, поэтому требует транзакцию,
+// созданную newSessionTransaction.
+func (t *transaction) declareCursor(name, query string, hold bool, args ...any) (*cursor, error) {
+	declare := "DECLARE " + pq.QuoteIdentifier(name) + " CURSOR FOR " + query
+	if hold {
+		if t.conn == nil {
+			err := fmt.Errorf("cursor %s: WITH HOLD requires a session transaction", name)
+			t.logger.Error("failed to declare cursor", zap.Error(err))
+			return nil, err
+		}
+		declare = "DECLARE " + pq.QuoteIdentifier(name) + " CURSOR WITH HOLD FOR " + query
+	}
+	if _, err := t.exec(declare, args...); err != nil {
+		return nil, err
+	}
+	t.logger.Info("cursor declared", zap.String("cursor", name), zap.Bool("hold", hold))
+	return &cursor{t: t, name: name, hold: hold}, nil
+}
+
+// fetch читает следующие count строк курсора, все оставшиеся при count <= 0.
+// После завершения транзакции курсор читается вне транзакции в ее сеансе.
+func (c *cursor) fetch(count int) ([][]any, error) {
+	fetch := "FETCH ALL FROM " + pq.QuoteIdentifier(c.name) + ";"
+	if count > 0 {
+		fetch = fmt.Sprintf("FETCH %d FROM %s;", count, pq.QuoteIdentifier(c.name))
+	}
+	return c.t.sessionQuery(fetch)
+}
+
+// close закрывает курсор.
+func (c *cursor) close() error {
+	if _, err := c.t.sessionQuery("CLOSE " + pq.QuoteIdentifier(c.name) + ";"); err != nil {
+		return err
+	}
+	c.t.logger.Info("cursor closed", zap.String("cursor", c.name))
+	return nil
+}
+
+// sessionQuery выполняет запрос в транзакции, пока она открыта, и в ее сеансе после завершения.
+func (t *transaction) sessionQuery(query string) ([][]any, error) {
+	if t.open {
+		return t.query(query)
+	}
+	if t.conn == nil {
+		err := fmt.Errorf("transaction is finished and has no session")
+		t.logger.Error("failed to execute query", zap.Error(err), zap.String("query", query))
+		return nil, err
+	}
+	rows, err := t.conn.QueryContext(t.ctx, t.sql(query))
+	if err != nil {
+		t.logger.Error("failed to execute query", zap.Error(err), zap.String("query", query))
+		return nil, err
+	}
+	return t.readRows(rows, query, nil)
+}
+
+// heldCursorVariant - вид курсора и ожидаемый результат чтения после фиксации.
+type heldCursorVariant struct {
+	name string
+	hold bool
+	// rows - строки, прочитанные после фиксации; code - ожидаемая ошибка чтения
+	rows [][]any
+	code string
+}
+
+var heldCursorVariants = []heldCursorVariant{
+	// Курсор WITH HOLD материализуется при фиксации и сохраняет снимок DECLARE
+	{name: "with_hold", hold: true, rows: [][]any{{int64(2), int64(1000)}, {int64(3), int64(1000)}}},
+	// Обычный курсор закрывается вместе с транзакцией: 34000 invalid_cursor_name
+	{name: "without_hold", code: "34000"},
+}
+
+// heldCursor показывает, что возвращает курсор после фиксации создавшей его
+// транзакции, пока другие транзакции изменяют и удаляют непрочитанные строки.
+func heldCursor(db *sqlx.DB, logger *zap.Logger) error {
+	if err := requireSessionState("WITH HOLD cursor"); err != nil {
+		return err
+	}
+	for _, v := range heldCursorVariants {
+		if err := migrate(db, logger, cursorMigrations); err != nil {
+			return err
+		}
+		if err := runHeldCursorVariant(db, logger.With(zap.String("variant", v.name)), v); err != nil {
+			return fmt.Errorf("%s: %w", v.name, err)
+		}
+	}
+	return nil
+}
+
+func runHeldCursorVariant(db *sqlx.DB, logger *zap.Logger, v heldCursorVariant) (err error) {
+	// Курсор объявляется в 1 транзакции на выделенном сеансе
+	tx1, err := newSessionTransaction(db, logger.With(zap.String("tx", "tx1")))
+	if err != nil {
+		return err
+	}
+	defer ignoreDeferred(logger, "close session", tx1.closeSession)
+	if err = tx1.begin(); err != nil {
+		return err
+	}
+	c, err := tx1.declareCursor("person_cursor", "SELECT id, balance FROM person ORDER BY id;", v.hold)
+	if err != nil {
+		return err
+	}
+	if _, err = c.fetch(1); err != nil {
+		return err
+	}
+	if err = tx1.commit(); err != nil {
+		return err
+	}
+
+	// 2 транзакция меняет и удаляет непрочитанные строки
+	tx2 := newTransaction(db, logger.With(zap.String("tx", "tx2")))
+	if err = tx2.begin(); err != nil {
+		return err
+	}
+	if err = tx2.updateUser(2, 2000); err != nil {
+		return err
+	}
+	if _, err = tx2.exec("DELETE FROM person WHERE id = $1;", 3); err != nil {
+		return err
+	}
+	if err = tx2.commit(); err != nil {
+		return err
+	}
+
+	// Дочитывание курсора в сеансе 1 транзакции после ее фиксации
+	rows, err := c.fetch(0)
+	if v.code != "" {
+		if code := errorCode(err); code != v.code {
+			return fmt.Errorf("fetch after commit: expected error %s, got %v", v.code, err)
+		}
+		logger.Info("fetch rejected", zap.String("code", v.code))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(rows, v.rows) {
+		return fmt.Errorf("fetch after commit: got rows %v, expected %v", rows, v.rows)
+	}
+	logger.Info("held cursor returned snapshot rows", zap.Any("rows", rows))
+	return c.close()
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+// deadlockOrderVariant - блокируют ли транзакции строки в общем порядке.
+type deadlockOrderVariant struct {
+	name   string
+	sorted bool
+	// committed - сколько транзакций фиксируется
+	committed int
+}
+
+var deadlockOrderVariants = []deadlockOrderVariant{
+	// tx1 блокирует 1 и 2, tx2 - 2 и 1: каждая ждет строку, которую держит другая
+	{name: "unordered", committed: 1},
+	// Обе транзакции блокируют строки по возрастанию id, вторая просто ждет первую
+	{name: "sorted", sorted: true, committed: 2},
+}
+
+// deadlockOrder сравнивает взаимоблокировку при захвате строк в разном порядке
+// с захватом в общем порядке отсортированных id: вторая транзакция ждет
+// освобождения первой строки, и цикл ожиданий не возникает.
+func deadlockOrder(db *sqlx.DB, logger *zap.Logger) error {
+	deadlocks := make(map[string]bool, len(deadlockOrderVariants))
+	for _, v := range deadlockOrderVariants {
+		if err := migrate(db, logger, []string{"UPDATE person SET balance = 1000;"}); err != nil {
+			return err
+		}
+		deadlock, err := runDeadlockOrderVariant(db, logger.With(zap.String("variant", v.name)), v)
+		if err != nil {
+			return fmt.Errorf("%s: %w", v.name, err)
+		}
+		deadlocks[v.name] = deadlock
+	}
+	logger.Info("deadlocks by lock order", zap.Any("deadlock", deadlocks))
+	return nil
+}
+
+func runDeadlockOrderVariant(db *sqlx.DB, logger *zap.Logger, v deadlockOrderVariant) (deadlock bool, err error) {
+	// Проверка суммы балансов: каждая зафиксированная транзакция добавляет по 100 к обеим строкам
+	defer checkPostconditions(db, logger, &err,
+		expectValue("total balance", "SELECT SUM(balance) FROM person;", 2000+200*v.committed))
+
+	ids := [][]int{{1, 2}, {2, 1}}
+	if v.sorted {
+		for _, order := range ids {
+			sort.Ints(order)
+		}
+	}
+	lock := func(t *transaction, id int) error {
+		_, err := t.exec("UPDATE person SET balance = balance + 100 WHERE id = $1;", id)
+		return err
+	}
+
+	// Запуск транзакций
+	tx1 := newTransaction(db, logger.With(zap.String("tx", "tx1")))
+	if err = tx1.begin(); err != nil {
+		return false, err
+	}
+	tx2 := newTransaction(db, logger.With(zap.String("tx", "tx2")))
+	if err = tx2.begin(); err != nil {
+		return false, err
+	}
+
+	// tx1 берет первую строку, tx2 выполняет свои шаги параллельно
+	if err = lock(tx1, ids[0][0]); err != nil {
+		return false, err
+	}
+	pid, err := tx2.backendPID()
+	if err != nil {
+		return false, err
+	}
+	tx2Done := runAsync(func() error {
+		for _, id := range ids[1] {
+			if err := lock(tx2, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err = waitBlocked(tx2, pid, tx2Done); err != nil {
+		return false, err
+	}
+
+	// Вторая строка tx1; при встречном порядке сервер обнаруживает цикл через deadlock_timeout
+	committed := 0
+	for _, step := range []struct {
+		t    *transaction
+		done func() error
+	}{
+		{tx1, func() error { return lock(tx1, ids[0][1]) }},
+		{tx2, func() error { return <-tx2Done }},
+	} {
+		err := step.done()
+		if errorCode(err) == "40P01" {
+			deadlock = true
+			step.t.logger.Info("deadlock detected, transaction aborted", zap.String("explanation", classifyError(err).Explanation))
+			if err = step.t.rollback(); err != nil {
+				return deadlock, err
+			}
+			continue
+		}
+		if err != nil {
+			return deadlock, err
+		}
+		if err = step.t.commit(); err != nil {
+			return deadlock, err
+		}
+		committed++
+	}
+	logger.Info("variant finished", zap.Bool("deadlock", deadlock), zap.Int("committed", committed))
+	if deadlock != !v.sorted {
+		return deadlock, errors.New("deadlock outcome does not match the lock order")
+	}
+	return deadlock, nil
+}
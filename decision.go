@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.starlark.net/starlark"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// decisionWorkload - описание нагрузки для сравнения REPEATABLE READ и SERIALIZABLE.
+//
+//	name: withdraw
+//	setup:                  # необязательно, по умолчанию таблица person
+//	  - ...
+//	workers: 4
+//	iterations: 50          # транзакций на worker
+//	templates:              # выполняются по очереди каждым worker, с weight - случайно пропорционально весам
+//	  - name: withdraw
+//	    weight: 3             # необязательно, по умолчанию 1
+//	    steps:
+//	      - {query: "SELECT SUM(balance) FROM person"}
+//	      - {exec: "UPDATE person SET balance = balance - 600 WHERE id = $1", args: "[worker % 2 + 1]", when: "rows[0][0] >= 600"}
+//	invariants:             # запрос должен вернуть true после нагрузки
+//	  - {name: total_non_negative, query: "SELECT SUM(balance) >= 0 FROM person"}
+type decisionWorkload struct {
+	Name       string              `yaml:"name"`
+	Setup      []string            `yaml:"setup"`
+	Workers    int                 `yaml:"workers"`
+	Iterations int                 `yaml:"iterations"`
+	Templates  []decisionTemplate  `yaml:"templates"`
+	Invariants []decisionInvariant `yaml:"invariants"`
+}
+
+type decisionTemplate struct {
+	Name   string         `yaml:"name"`
+	Weight int            `yaml:"weight"`
+	Steps  []decisionStep `yaml:"steps"`
+}
+
+// decisionStep - оператор шаблона. В args и when доступны rows предыдущего
+// запроса, номер worker, номер iteration и генератор данных gen(field, n).
+type decisionStep struct {
+	Exec   string `yaml:"exec"`
+	Query  string `yaml:"query"`
+	Params []any  `yaml:"params"`
+	Args   string `yaml:"args"`
+	When   string `yaml:"when"`
+}
+
+type decisionInvariant struct {
+	Name  string `yaml:"name"`
+	Query string `yaml:"query"`
+}
+
+// decisionMaxRetries ограничивает повторы одной транзакции после ошибок сериализации.
+const decisionMaxRetries = 20
+
+// decisionLevels - сравниваемые уровни изоляции.
+var decisionLevels = []sql.IsolationLevel{sql.LevelRepeatableRead, sql.LevelSerializable}
+
+// readDecisionWorkload читает нагрузку из файла или встроенную нагрузку по имени.
+func readDecisionWorkload(file string) (*decisionWorkload, error) {
+	var r io.Reader
+	if data, ok := builtinWorkloads[file]; ok {
+		r = bytes.NewReader(data)
+	} else {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	w := decisionWorkload{Workers: 4, Iterations: 50}
+	decoder := yaml.NewDecoder(r)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&w); err != nil {
+		return nil, err
+	}
+	if err := w.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return &w, nil
+}
+
+func (w *decisionWorkload) validate() error {
+	if w.Name == "" {
+		return errors.New("workload name is required")
+	}
+	if w.Workers < 1 || w.Iterations < 1 {
+		return fmt.Errorf("workers and iterations must be positive, got %d and %d", w.Workers, w.Iterations)
+	}
+	if len(w.Templates) == 0 {
+		return errors.New("at least one transaction template is required")
+	}
+	for _, t := range w.Templates {
+		if t.Weight < 0 {
+			return fmt.Errorf("template %s: weight must not be negative, got %d", t.Name, t.Weight)
+		}
+		for i, step := range t.Steps {
+			if (step.Exec == "") == (step.Query == "") {
+				return fmt.Errorf("template %s step %d: exactly one of exec or query is required", t.Name, i+1)
+			}
+			if step.Args != "" && len(step.Params) > 0 {
+				return fmt.Errorf("template %s step %d: params and args are mutually exclusive", t.Name, i+1)
+			}
+		}
+	}
+	for _, inv := range w.Invariants {
+		if inv.Name == "" || inv.Query == "" {
+			return errors.New("invariant name and query are required")
+		}
+	}
+	return nil
+}
+
+// weighted сообщает, задан ли вес хотя бы у одного шаблона.
+func (w *decisionWorkload) weighted() bool {
+	for _, t := range w.Templates {
+		if t.Weight > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// picker возвращает выбор шаблона для итерации worker: по очереди или, если
+// заданы веса, случайно пропорционально весам. Шаблон без веса имеет вес 1.
+// Последовательность выбора зависит только от -data-seed и номера worker.
+func (w *decisionWorkload) picker(worker int) func(iteration int) int {
+	if !w.weighted() {
+		return func(iteration int) int {
+			return (worker + iteration) % len(w.Templates)
+		}
+	}
+	total := 0
+	bounds := make([]int, len(w.Templates))
+	for i, t := range w.Templates {
+		weight := t.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		total += weight
+		bounds[i] = total
+	}
+	rng := newGenerator(dataSeed, int64(worker)).rng
+	return func(int) int {
+		n := rng.Intn(total)
+		return sort.SearchInts(bounds, n+1)
+	}
+}
+
+// decisionResult - итог нагрузки на одном уровне изоляции.
+type decisionResult struct {
+	level     sql.IsolationLevel
+	commits   int64
+	aborts    int64
+	elapsed   time.Duration
+	violated  []string
+	templates []templateResult
+}
+
+// templateResult - итог одного шаблона: зафиксированные транзакции, повторы
+// и суммарное время выполнения с учетом повторов.
+type templateResult struct {
+	name    string
+	commits int64
+	aborts  int64
+	latency time.Duration
+}
+
+func (r decisionResult) abortRate() float64 {
+	if r.commits+r.aborts == 0 {
+		return 0
+	}
+	return float64(r.aborts) / float64(r.commits+r.aborts)
+}
+
+func (r decisionResult) tps() float64 {
+	return float64(r.commits) / r.elapsed.Seconds()
+}
+
+// runDecisionLevel заново создает таблицы, выполняет нагрузку на уровне level
+// и проверяет инварианты.
+func runDecisionLevel(db *sqlx.DB, w *decisionWorkload, level sql.IsolationLevel, logger *zap.Logger) (decisionResult, error) {
+	result := decisionResult{level: level}
+	setup := w.Setup
+	if len(setup) == 0 {
+		setup = personMigrations
+	}
+	if err := migrate(db, logger, setup); err != nil {
+		return result, err
+	}
+
+	var commits, aborts atomic.Int64
+	stats := make([]struct{ commits, aborts, latency atomic.Int64 }, len(w.Templates))
+	errs := make(chan error, w.Workers)
+	var wg sync.WaitGroup
+	started := time.Now()
+	for worker := 0; worker < w.Workers; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			pick := w.picker(worker)
+			for i := 0; i < w.Iterations; i++ {
+				n := pick(i)
+				t := w.Templates[n]
+				templateStarted := time.Now()
+				retries, err := runDecisionTemplate(db, t, level, worker, i)
+				stats[n].latency.Add(int64(time.Since(templateStarted)))
+				stats[n].aborts.Add(int64(retries))
+				aborts.Add(int64(retries))
+				if err != nil {
+					errs <- fmt.Errorf("template %s: %w", t.Name, err)
+					return
+				}
+				stats[n].commits.Add(1)
+				commits.Add(1)
+			}
+		}(worker)
+	}
+	wg.Wait()
+	result.elapsed = time.Since(started)
+	close(errs)
+	if err := <-errs; err != nil {
+		logger.Error("workload failed", zap.Error(err))
+		return result, err
+	}
+	result.commits, result.aborts = commits.Load(), aborts.Load()
+	for i, t := range w.Templates {
+		result.templates = append(result.templates, templateResult{
+			name:    t.Name,
+			commits: stats[i].commits.Load(),
+			aborts:  stats[i].aborts.Load(),
+			latency: time.Duration(stats[i].latency.Load()),
+		})
+	}
+
+	for _, inv := range w.Invariants {
+		var ok bool
+		if err := db.Get(&ok, inv.Query); err != nil {
+			logger.Error("failed to check invariant", zap.Error(err), zap.String("invariant", inv.Name))
+			return result, err
+		}
+		if !ok {
+			result.violated = append(result.violated, inv.Name)
+		}
+	}
+	logger.Info("workload finished",
+		zap.Int64("commits", result.commits),
+		zap.Int64("aborts", result.aborts),
+		zap.Duration("elapsed", result.elapsed),
+		zap.Strings("violated_invariants", result.violated),
+	)
+	return result, nil
+}
+
+// runDecisionTemplate выполняет шаблон в транзакции и повторяет ее после
+// ошибок сериализации и взаимоблокировок. Возвращает количество повторов.
+func runDecisionTemplate(db *sqlx.DB, t decisionTemplate, level sql.IsolationLevel, worker, iteration int) (int, error) {
+	// Логи отдельных транзакций отключены: их тысячи, а ошибки сериализации ожидаемы
+	logger := zap.NewNop()
+	for retries := 0; ; retries++ {
+		err := func() error {
+			env := newScriptEnv(logger)
+			env.globals["worker"] = starlark.MakeInt(worker)
+			env.globals["iteration"] = starlark.MakeInt(iteration)
+			// Повтор транзакции получает те же значения gen, что и первая попытка
+			env.globals["gen"] = newGenerator(dataSeed, int64(worker), int64(iteration)).builtin()
+			tx := newTransaction(db, logger)
+			if err := tx.begin(); err != nil {
+				return err
+			}
+			if err := tx.setLevel(level); err != nil {
+				ignoreError(logger, "rollback", tx.rollback())
+				return err
+			}
+			for i, step := range t.Steps {
+				if err := runDecisionStep(env, tx, step, fmt.Sprintf("%s:%d", t.Name, i+1)); err != nil {
+					ignoreError(logger, "rollback", tx.rollback())
+					return err
+				}
+			}
+			return tx.commit()
+		}()
+		switch code := errorCode(err); {
+		case err == nil:
+			return retries, nil
+		case code != "40001" && code != "40P01":
+			return retries, err
+		case retries == decisionMaxRetries:
+			return retries, fmt.Errorf("gave up after %d retries: %w", retries, err)
+		}
+	}
+}
+
+func runDecisionStep(env *scriptEnv, tx *transaction, step decisionStep, name string) error {
+	if step.When != "" {
+		ok, err := env.truth(name, step.When)
+		if err != nil {
+			return fmt.Errorf("condition: %w", err)
+		}
+		if !ok {
+			return nil
+		}
+	}
+	params := step.Params
+	if step.Args != "" {
+		var err error
+		if params, err = env.args(name, step.Args); err != nil {
+			return fmt.Errorf("args: %w", err)
+		}
+	}
+	if step.Exec != "" {
+		_, err := tx.exec(step.Exec, params...)
+		return err
+	}
+	rows, err := tx.query(step.Query, params...)
+	if err != nil {
+		return err
+	}
+	env.setRows(rows)
+	return nil
+}
+
+// printDecisionReport выводит сравнение уровней и рекомендацию.
+func printDecisionReport(w io.Writer, workload string, results []decisionResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "LEVEL\tCOMMITS\tABORTS\tABORT RATE\tTPS\tVIOLATED INVARIANTS")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f%%\t%.1f\t%s\n",
+			r.level, r.commits, r.aborts, r.abortRate()*100, r.tps(), strings.Join(r.violated, ","))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	rr, ser := results[0], results[1]
+	if rr.tps() > 0 {
+		fmt.Fprintf(w, "\nthroughput delta: SERIALIZABLE %+.1f%% vs REPEATABLE READ\n", (ser.tps()/rr.tps()-1)*100)
+	}
+	switch {
+	case len(rr.violated) > 0 && len(ser.violated) > 0:
+		fmt.Fprintf(w, "%s: invariants are violated at both levels, check the workload and invariants\n", workload)
+	case len(rr.violated) > 0:
+		fmt.Fprintf(w, "%s: SERIALIZABLE is required, REPEATABLE READ violated %s; plan for %.1f%% retries\n",
+			workload, strings.Join(rr.violated, ", "), ser.abortRate()*100)
+	default:
+		fmt.Fprintf(w, "%s: no anomalies observed at REPEATABLE READ in this run; it is sufficient unless the invariants are incomplete\n", workload)
+	}
+	return nil
+}
+
+// decideCommand реализует подкоманду decide: decide [-dsn dsn] [-schema name] [-force] workload.yaml.
+// Вместо файла можно указать встроенную нагрузку, например smallbank.
+// Нагрузка выполняется на REPEATABLE READ и SERIALIZABLE по очереди.
+func decideCommand(args []string, logger *zap.Logger) error {
+	fs := flag.NewFlagSet("decide", flag.ContinueOnError)
+	dsn := fs.String("dsn", defaultDSN, "connection string, key=value or postgres:// URL")
+	force := fs.Bool("force", false, "run the workload setup even if the database does not look like a demo database")
+	fs.Int64Var(&dataSeed, "data-seed", dataSeed, "seed of gen() values in workload templates")
+	fs.StringVar(&targetSchema, "schema", "", "create and use this schema instead of the default search_path")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: decide [-dsn dsn] [-schema name] [-force] <workload.yaml|smallbank>")
+	}
+	w, err := readDecisionWorkload(fs.Arg(0))
+	if err != nil {
+		logger.Error("failed to load workload", zap.Error(err), zap.String("file", fs.Arg(0)))
+		return err
+	}
+	target, err := withTargetSchema(*dsn)
+	if err != nil {
+		return err
+	}
+	db, err := connect("postgres", target, logger)
+	if err != nil {
+		return err
+	}
+	defer ignoreDeferred(logger, "close pool", db.Close)
+	if err = createTargetSchema(db, logger); err != nil {
+		return err
+	}
+	if !*force {
+		if err = checkSafeTarget(db, logger, w.Setup); err != nil {
+			return err
+		}
+	}
+	meta, err := collectMetadata(db, logger)
+	if err != nil {
+		return err
+	}
+
+	var results []decisionResult
+	for _, level := range decisionLevels {
+		result, err := runDecisionLevel(db, w, level, logger.With(zap.String("workload", w.Name), zap.String("level", level.String())))
+		if err != nil {
+			return err
+		}
+		results = append(results, result)
+	}
+	if err = meta.print(os.Stdout); err != nil {
+		return err
+	}
+	return printDecisionReport(os.Stdout, w.Name, results)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// defaultsRow - уровень изоляции новой транзакции после очередной настройки.
+type defaultsRow struct {
+	setting string
+	// value и source - default_transaction_isolation и его источник из pg_settings
+	value  string
+	source string
+	// level - transaction_isolation транзакции, expected - ожидаемый по приоритету уровень
+	level    string
+	expected string
+	skipped  string
+}
+
+// defaultsProbe описывает подключение для проверки: DSN, команду сеанса и
+// SET TRANSACTION внутри транзакции.
+type defaultsProbe struct {
+	dsn         string
+	session     string
+	transaction string
+}
+
+// probeIsolationDefault открывает новое подключение, чтобы к сеансу применились
+// текущие настройки базы и роли, и читает уровень изоляции новой транзакции.
+func probeIsolationDefault(p defaultsProbe, logger *zap.Logger) (value, source, level string, err error) {
+	db, err := connect("postgres", p.dsn, logger)
+	if err != nil {
+		return "", "", "", err
+	}
+	defer ignoreDeferred(logger, "close pool", db.Close)
+	// Команда сеанса и транзакция должны выполняться в одном подключении
+	db.SetMaxOpenConns(1)
+	if p.session != "" {
+		if _, err = db.Exec(p.session); err != nil {
+			logger.Error("failed to configure session", zap.Error(err), zap.String("query", p.session))
+			return "", "", "", err
+		}
+	}
+	const settingQuery = "SELECT setting, source FROM pg_settings WHERE name = 'default_transaction_isolation';"
+	if err = db.QueryRow(settingQuery).Scan(&value, &source); err != nil {
+		logger.Error("failed to read default isolation", zap.Error(err))
+		return "", "", "", err
+	}
+	tx := newTransaction(db, logger)
+	if err = tx.begin(); err != nil {
+		return "", "", "", err
+	}
+	if p.transaction != "" {
+		if _, err = tx.exec(p.transaction); err != nil {
+			ignoreError(logger, "rollback", tx.rollback())
+			return "", "", "", err
+		}
+	}
+	rows, err := tx.query("SHOW transaction_isolation;")
+	if err != nil {
+		ignoreError(logger, "rollback", tx.rollback())
+		return "", "", "", err
+	}
+	return value, source, rows[0][0].(string), tx.commit()
+}
+
+// isolationDefaults по очереди добавляет настройки default_transaction_isolation
+// от слабой к сильной по приоритету: базы, роли в базе, параметра подключения,
+// SET SESSION CHARACTERISTICS и SET TRANSACTION. После каждой новая транзакция
+// должна получить уровень последней настройки. Прежние настройки базы и роли
+// восстанавливаются в конце.
+func isolationDefaults(dsn string, logger *zap.Logger) ([]defaultsRow, error) {
+	admin, err := connect("postgres", dsn, logger)
+	if err != nil {
+		return nil, err
+	}
+	defer ignoreDeferred(logger, "close pool", admin.Close)
+	var database string
+	if err = admin.Get(&database, "SELECT current_database();"); err != nil {
+		logger.Error("failed to get database name", zap.Error(err))
+		return nil, err
+	}
+
+	var rows []defaultsRow
+	probe := func(setting string, p defaultsProbe, expected string) error {
+		row := defaultsRow{setting: setting, expected: expected}
+		var err error
+		if row.value, row.source, row.level, err = probeIsolationDefault(p, logger.With(zap.String("setting", setting))); err != nil {
+			return fmt.Errorf("%s: %w", setting, err)
+		}
+		rows = append(rows, row)
+		return nil
+	}
+	// alter выполняет ALTER для target и восстанавливает настройку в конце; roleOid -
+	// setrole в pg_db_role_setting, 0 - настройка базы. Без прав шаг пропускается
+	var resets []string
+	defer func() {
+		for i := len(resets) - 1; i >= 0; i-- {
+			if _, err := admin.Exec(resets[i]); err != nil {
+				logger.Error("failed to reset default isolation", zap.Error(err), zap.String("query", resets[i]))
+			}
+		}
+	}()
+	alter := func(setting, target, roleOid, level string) (bool, error) {
+		// Прежнее значение восстанавливается, чтобы не потерять настройку владельца базы
+		const previousQuery = `SELECT substr(s, length('default_transaction_isolation=') + 1)
+         FROM pg_db_role_setting r, unnest(r.setconfig) AS s
+         WHERE r.setdatabase = (SELECT oid FROM pg_database WHERE datname = current_database())
+           AND r.setrole = %s
+           AND s LIKE 'default_transaction_isolation=%%';`
+		var previous []string
+		if err := admin.Select(&previous, fmt.Sprintf(previousQuery, roleOid)); err != nil {
+			logger.Error("failed to read default isolation", zap.Error(err), zap.String("target", target))
+			return false, err
+		}
+		query := "ALTER " + target + " SET default_transaction_isolation = " + pq.QuoteLiteral(level) + ";"
+		if _, err := admin.Exec(query); err != nil {
+			if errorCode(err) != "42501" {
+				logger.Error("failed to change default isolation", zap.Error(err), zap.String("query", query))
+				return false, err
+			}
+			logger.Info("not allowed to change default isolation", zap.Error(err), zap.String("query", query))
+			rows = append(rows, defaultsRow{setting: setting, expected: level, skipped: "permission denied"})
+			return false, nil
+		}
+		reset := "ALTER " + target + " RESET default_transaction_isolation;"
+		if len(previous) > 0 {
+			reset = "ALTER " + target + " SET default_transaction_isolation = " + pq.QuoteLiteral(previous[0]) + ";"
+		}
+		resets = append(resets, reset)
+		logger.Info("default isolation changed", zap.String("query", query))
+		return true, nil
+	}
+
+	// Значение сервера: postgresql.conf или встроенное
+	if err = probe("server", defaultsProbe{dsn: dsn}, ""); err != nil {
+		return nil, err
+	}
+	dbTarget := "DATABASE " + pq.QuoteIdentifier(database)
+	ok, err := alter("ALTER DATABASE", dbTarget, "0", "repeatable read")
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if err = probe("ALTER DATABASE", defaultsProbe{dsn: dsn}, "repeatable read"); err != nil {
+			return nil, err
+		}
+	}
+	// Настройка роли в базе приоритетнее настройки базы
+	ok, err = alter("ALTER ROLE IN DATABASE", "ROLE CURRENT_USER IN "+dbTarget, "(SELECT oid FROM pg_roles WHERE rolname = current_user)", "serializable")
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if err = probe("ALTER ROLE IN DATABASE", defaultsProbe{dsn: dsn}, "serializable"); err != nil {
+			return nil, err
+		}
+	}
+	// lib/pq передает неизвестные параметры DSN серверу как параметры сеанса
+	params, err := parseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	params["default_transaction_isolation"] = "read committed"
+	clientDSN := formatDSN(params)
+	if err = probe("connection parameter", defaultsProbe{dsn: clientDSN}, "read committed"); err != nil {
+		return nil, err
+	}
+	const sessionQuery = "SET SESSION CHARACTERISTICS AS TRANSACTION ISOLATION LEVEL REPEATABLE READ;"
+	if err = probe("SET SESSION CHARACTERISTICS", defaultsProbe{dsn: clientDSN, session: sessionQuery}, "repeatable read"); err != nil {
+		return nil, err
+	}
+	// Уровень, явно заданный транзакции, приоритетнее любых значений по умолчанию
+	if err = probe("SET TRANSACTION", defaultsProbe{dsn: clientDSN, session: sessionQuery, transaction: "SET TRANSACTION ISOLATION LEVEL SERIALIZABLE;"}, "serializable"); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func printIsolationDefaults(w io.Writer, rows []defaultsRow) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SETTING\tDEFAULT\tSOURCE\tTRANSACTION LEVEL\tEXPECTED\tRESULT")
+	for _, r := range rows {
+		result := "ok"
+		switch {
+		case r.skipped != "":
+			result = "skipped: " + r.skipped
+		case r.expected != "" && r.level != r.expected:
+			result = "UNEXPECTED"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", r.setting, r.value, r.source, r.level, r.expected, result)
+	}
+	return tw.Flush()
+}
+
+// isolationDefaultsCommand реализует подкоманду isolation-defaults:
+// isolation-defaults [-dsn dsn]. Показывает, какая из настроек уровня изоляции
+// по умолчанию побеждает. Временно меняет настройки текущей базы и роли.
+func isolationDefaultsCommand(args []string, logger *zap.Logger) error {
+	fs := flag.NewFlagSet("isolation-defaults", flag.ContinueOnError)
+	dsn := fs.String("dsn", defaultDSN, "connection string, key=value or postgres:// URL")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	// Метаданные читаются до того, как проверка изменит настройки базы и роли
+	db, err := connect("postgres", *dsn, logger)
+	if err != nil {
+		return err
+	}
+	meta, err := collectMetadata(db, logger)
+	ignoreError(logger, "close pool", db.Close())
+	if err != nil {
+		return err
+	}
+	rows, err := isolationDefaults(*dsn, logger)
+	if err != nil {
+		return err
+	}
+	if err = meta.print(os.Stdout); err != nil {
+		return err
+	}
+	if err = printIsolationDefaults(os.Stdout, rows); err != nil {
+		return err
+	}
+	for _, r := range rows {
+		if r.skipped == "" && r.expected != "" && r.level != r.expected {
+			return errors.New("default isolation precedence differs from the expected order")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+var deferredConstraintMigrations = []string{
+	`DROP TABLE IF EXISTS member;`,
+	`DROP TABLE IF EXISTS project;`,
+	`CREATE TABLE project (
+           id INT PRIMARY KEY,
+           name TEXT NOT NULL
+         );`,
+	`CREATE TABLE member (
+           project_id INT NOT NULL REFERENCES project (id),
+           name TEXT NOT NULL,
+           PRIMARY KEY (project_id, name)
+         );`,
+	`INSERT INTO project VALUES (1, 'billing');`,
+	// Инвариант между таблицами: у проекта остается хотя бы один участник
+	`CREATE OR REPLACE FUNCTION member_required() RETURNS trigger AS $$
+         BEGIN
+           IF EXISTS (SELECT 1 FROM project WHERE id = OLD.project_id)
+              AND NOT EXISTS (SELECT 1 FROM member WHERE project_id = OLD.project_id) THEN
+             RAISE EXCEPTION 'project % has no members', OLD.project_id USING ERRCODE = 'check_violation';
+           END IF;
+           RETURN NULL;
+         END;
+         $$ LANGUAGE plpgsql;`,
+}
+
+// deferredConstraintVariant - момент проверки инварианта и уровень изоляции.
+type deferredConstraintVariant struct {
+	name  string
+	level sql.IsolationLevel
+	// timing - DEFERRABLE INITIALLY DEFERRED или пусто для проверки после оператора
+	timing string
+	// consistent - у проекта остается участник после обеих транзакций
+	consistent bool
+}
+
+var deferredConstraintVariants = []deferredConstraintVariant{
+	{name: "immediate", level: sql.LevelReadCommitted},
+	{name: "deferred", level: sql.LevelReadCommitted, timing: "DEFERRABLE INITIALLY DEFERRED", consistent: true},
+	{name: "immediate_serializable", level: sql.LevelSerializable, consistent: true},
+}
+
+// deferredConstraint показывает write skew между таблицами: каждая транзакция
+// удаляет своего участника проекта, и проверка после оператора видит второго
+// участника, еще не удаленного другой транзакцией. Отложенная до commit проверка
+// при READ COMMITTED берет новый снимок и видит уже зафиксированное удаление.
+// Она ловит нарушение, только если фиксации не пересекаются; SERIALIZABLE
+// обнаруживает конфликт чтения и записи независимо от порядка.
+func deferredConstraint(db *sqlx.DB, logger *zap.Logger) error {
+	for _, v := range deferredConstraintVariants {
+		if err := runDeferredConstraintVariant(db, logger.With(zap.String("variant", v.name)), v); err != nil {
+			return fmt.Errorf("%s: %w", v.name, err)
+		}
+	}
+	return nil
+}
+
+func runDeferredConstraintVariant(db *sqlx.DB, logger *zap.Logger, v deferredConstraintVariant) (err error) {
+	prepare := []string{
+		`DROP TRIGGER IF EXISTS member_required ON member;`,
+		`DELETE FROM member;`,
+		`INSERT INTO member VALUES (1, 'alice'), (1, 'bob');`,
+		fmt.Sprintf(`CREATE CONSTRAINT TRIGGER member_required AFTER DELETE ON member %s
+           FOR EACH ROW EXECUTE FUNCTION member_required();`, v.timing),
+	}
+	if err := migrate(db, logger, prepare); err != nil {
+		return err
+	}
+
+	// Проверка инварианта после завершения транзакций
+	defer checkPostconditions(db, logger, &err,
+		expectValue("project has members", "SELECT COUNT(*) > 0 FROM member WHERE project_id = 1;", v.consistent))
+
+	// Запуск транзакций
+	tx1 := newTransaction(db, logger.With(zap.String("tx", "tx1")))
+	if err := tx1.begin(); err != nil {
+		return err
+	}
+	if err := tx1.setLevel(v.level); err != nil {
+		return err
+	}
+	tx2 := newTransaction(db, logger.With(zap.String("tx", "tx2")))
+	if err := tx2.begin(); err != nil {
+		return err
+	}
+	if err := tx2.setLevel(v.level); err != nil {
+		return err
+	}
+
+	// Каждая транзакция удаляет своего участника, строки не пересекаются
+	if _, err := tx1.exec("DELETE FROM member WHERE project_id = $1 AND name = $2;", 1, "alice"); err != nil {
+		return err
+	}
+	if _, err := tx2.exec("DELETE FROM member WHERE project_id = $1 AND name = $2;", 1, "bob"); err != nil {
+		return err
+	}
+
+	// Фиксация; отложенная проверка и SERIALIZABLE отклоняют вторую транзакцию
+	if err := tx1.commit(); err != nil {
+		return err
+	}
+	if err := tx2.commit(); err != nil {
+		class := classifyError(err)
+		if class.Code != "23514" && class.Code != "40001" {
+			return err
+		}
+		tx2.logger.Info("commit rejected", zap.String("code", class.Code), zap.String("explanation", class.Explanation))
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+var deferredForeignKeyMigrations = []string{
+	`DROP TABLE IF EXISTS member;`,
+	`DROP TABLE IF EXISTS project;`,
+	`CREATE TABLE project (
+           id INT PRIMARY KEY
+         );`,
+	`CREATE TABLE member (
+           project_id INT NOT NULL,
+           name TEXT NOT NULL,
+           CONSTRAINT member_project_fk FOREIGN KEY (project_id) REFERENCES project (id)
+             DEFERRABLE INITIALLY IMMEDIATE
+         );`,
+}
+
+// deferredForeignKeyVariant - порядок операций и момент проверки внешнего
+// ключа в транзакции, добавляющей участника.
+type deferredForeignKeyVariant struct {
+	name string
+	// memberFirst - tx2 добавляет участника до того, как tx1 удаляет проект
+	memberFirst bool
+	// deferred - tx2 откладывает проверку member_project_fk до commit
+	deferred bool
+	// immediateBeforeCommit - tx2 возвращает проверку на IMMEDIATE перед commit
+	immediateBeforeCommit bool
+	// blocked - второй по порядку оператор ждет первую транзакцию
+	blocked bool
+	// failed - транзакция и шаг, на котором она получает 23503
+	failed string
+	// projectKept - проект остается после обеих транзакций
+	projectKept bool
+}
+
+var deferredForeignKeyVariants = []deferredForeignKeyVariant{
+	// Проверка ключа ждет удаляющую транзакцию и падает сразу после ее фиксации
+	{name: "immediate", blocked: true, failed: "tx2 insert"},
+	// Без проверки вставка не ждет, ошибка переносится на commit
+	{name: "deferred", deferred: true, failed: "tx2 commit"},
+	// Вставка не ждет, но IMMEDIATE выполняет накопленную проверку, и она ждет tx1
+	{name: "deferred_then_immediate", deferred: true, immediateBeforeCommit: true, failed: "tx2 set constraints"},
+	// Проверка при вставке блокирует проект FOR KEY SHARE, удаление ждет и проигрывает
+	{name: "immediate_member_first", memberFirst: true, blocked: true, failed: "tx1 delete", projectKept: true},
+	// Отложенная вставка проект не блокирует: удаление проходит, проигрывает tx2 на commit
+	{name: "deferred_member_first", memberFirst: true, deferred: true, failed: "tx2 commit"},
+}
+
+// deferredForeignKey показывает, как SET CONSTRAINTS ... DEFERRED меняет исход
+// гонки удаления проекта (tx1) и добавления в него участника (tx2) при READ
+// COMMITTED. Немедленная проверка внешнего ключа блокирует строку проекта и
+// выбирает победителя по порядку операций; отложенная не берет блокировку до
+// commit, поэтому удаление всегда побеждает, а tx2 узнает об этом при фиксации.
+func deferredForeignKey(db *sqlx.DB, logger *zap.Logger) error {
+	for _, v := range deferredForeignKeyVariants {
+		if err := runDeferredForeignKeyVariant(db, logger.With(zap.String("variant", v.name)), v); err != nil {
+			return fmt.Errorf("%s: %w", v.name, err)
+		}
+	}
+	return nil
+}
+
+func runDeferredForeignKeyVariant(db *sqlx.DB, logger *zap.Logger, v deferredForeignKeyVariant) (err error) {
+	if err = migrate(db, logger, []string{
+		`DELETE FROM member;`,
+		`DELETE FROM project;`,
+		`INSERT INTO project VALUES (1);`,
+	}); err != nil {
+		return err
+	}
+
+	// Проверка итога: участник остается только вместе с проектом
+	members := 0
+	if v.projectKept {
+		members = 1
+	}
+	defer checkPostconditions(db, logger, &err,
+		expectValue("project kept", "SELECT EXISTS (SELECT 1 FROM project WHERE id = 1);", v.projectKept),
+		expectValue("members", "SELECT COUNT(*) FROM member;", members))
+
+	// Запуск транзакций
+	tx1 := newTransaction(db, logger.With(zap.String("tx", "tx1")))
+	if err = tx1.begin(); err != nil {
+		return err
+	}
+	tx2 := newTransaction(db, logger.With(zap.String("tx", "tx2")))
+	if err = tx2.begin(); err != nil {
+		return err
+	}
+	if v.deferred {
+		if err = tx2.setConstraints(true, "member_project_fk"); err != nil {
+			return err
+		}
+	}
+
+	// fkStep - шаг транзакции, который может нарушить внешний ключ
+	type fkStep struct {
+		t    *transaction
+		tx   string
+		name string
+		run  func() error
+	}
+	deleteProject := fkStep{tx1, "tx1", "delete", func() error {
+		_, err := tx1.exec("DELETE FROM project WHERE id = $1;", 1)
+		return err
+	}}
+	insertMember := fkStep{tx2, "tx2", "insert", func() error {
+		_, err := tx2.exec("INSERT INTO member VALUES ($1, $2);", 1, "carol")
+		return err
+	}}
+	first, second := deleteProject, insertMember
+	if v.memberFirst {
+		first, second = insertMember, deleteProject
+	}
+
+	var failed string
+	// reject принимает только нарушение ключа: запоминает шаг и откатывает его транзакцию
+	reject := func(s fkStep, step string, stepErr error) error {
+		if errorCode(stepErr) != "23503" {
+			return stepErr
+		}
+		s.t.logger.Info("foreign key violated", zap.String("step", step))
+		failed = s.tx + " " + step
+		if s.t.open {
+			return s.t.rollback()
+		}
+		return nil
+	}
+
+	if err = first.run(); err != nil {
+		return err
+	}
+	pid, err := second.t.backendPID()
+	if err != nil {
+		return err
+	}
+	done := runAsync(second.run)
+	ok, stepErr := finished(second.t, pid, done)
+	if !ok && stepErr != nil {
+		return stepErr
+	}
+	if !ok != v.blocked {
+		return fmt.Errorf("%s %s blocked: %t, want %t", second.tx, second.name, !ok, v.blocked)
+	}
+	if v.immediateBeforeCommit {
+		// Вставка прошла без проверки, IMMEDIATE выполняет ее сейчас и ждет tx1
+		if stepErr != nil {
+			return stepErr
+		}
+		second = fkStep{tx2, "tx2", "set constraints", func() error { return tx2.setConstraints(false, "member_project_fk") }}
+		if pid, err = tx2.backendPID(); err != nil {
+			return err
+		}
+		done = runAsync(second.run)
+		if ok, stepErr = finished(tx2, pid, done); !ok && stepErr != nil {
+			return stepErr
+		}
+		if ok {
+			return errors.New("tx2 set constraints did not wait for tx1")
+		}
+	}
+
+	// Ждущий оператор освобождается фиксацией первой транзакции, иначе удаление
+	// фиксируется первым, и отложенная проверка tx2 видит его при commit
+	commits := []fkStep{deleteProject, insertMember}
+	if !ok {
+		if err = first.t.commit(); err != nil {
+			return err
+		}
+		stepErr = <-done
+		commits = []fkStep{second}
+	}
+	if stepErr != nil {
+		if err = reject(second, second.name, stepErr); err != nil {
+			return err
+		}
+	}
+	for _, c := range commits {
+		if !c.t.open {
+			continue
+		}
+		if err = c.t.commit(); err != nil {
+			if err = reject(c, "commit", err); err != nil {
+				return err
+			}
+		}
+	}
+	if failed != v.failed {
+		return fmt.Errorf("foreign key violation at %q, want %q", failed, v.failed)
+	}
+	return nil
+}
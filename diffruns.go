@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+
+	"go.uber.org/zap"
+)
+
+// runChange - отличие сценария между двумя архивами запусков.
+type runChange struct {
+	scenario string
+	kind     string
+	before   string
+	after    string
+	// regression - изменение в худшую сторону, diff-runs завершается ошибкой
+	regression bool
+}
+
+// archivedRun - сценарий из каталога -archive: результат и CSV файлы таблиц.
+type archivedRun struct {
+	result runResult
+	tables map[string][]byte
+	// steps - в каталоге есть снимки шагов -step-states
+	steps bool
+}
+
+// readArchivedRuns читает каталоги сценариев, в которых есть result.json.
+func readArchivedRuns(dir string) (map[string]archivedRun, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	runs := make(map[string]archivedRun)
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		scenarioDir := filepath.Join(dir, e.Name())
+		data, err := os.ReadFile(filepath.Join(scenarioDir, archivedResultFile))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var run archivedRun
+		if err = json.Unmarshal(data, &run.result); err != nil {
+			return nil, fmt.Errorf("%s: %w", scenarioDir, err)
+		}
+		files, err := filepath.Glob(filepath.Join(scenarioDir, "*.csv"))
+		if err != nil {
+			return nil, err
+		}
+		run.tables = make(map[string][]byte, len(files))
+		for _, file := range files {
+			if filepath.Base(file) == archivedStatsFile {
+				continue
+			}
+			if run.tables[filepath.Base(file)], err = os.ReadFile(file); err != nil {
+				return nil, err
+			}
+		}
+		if _, err = os.Stat(filepath.Join(scenarioDir, archivedStepsFile)); err == nil {
+			run.steps = true
+		}
+		runs[run.result.Scenario] = run
+	}
+	return runs, nil
+}
+
+// diffRuns сравнивает запуски сценариев из двух архивов. Рост длительности
+// считается регрессией, если она выросла больше чем на threshold и на minMs.
+func diffRuns(a, b map[string]archivedRun, threshold float64, minMs int64) []runChange {
+	names := make(map[string]bool)
+	for name := range a {
+		names[name] = true
+	}
+	for name := range b {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	var changes []runChange
+	for _, name := range sorted {
+		before, okA := a[name]
+		after, okB := b[name]
+		switch {
+		case !okA:
+			changes = append(changes, runChange{scenario: name, kind: "added", after: after.result.Verdict})
+			continue
+		case !okB:
+			changes = append(changes, runChange{scenario: name, kind: "removed", before: before.result.Verdict})
+			continue
+		}
+		ra, rb := before.result, after.result
+		if ra.Verdict != rb.Verdict {
+			changes = append(changes, runChange{scenario: name, kind: "verdict", before: ra.Verdict, after: rb.Verdict,
+				regression: rb.Verdict != verdictOK && rb.Verdict != verdictSkipped && rb.Verdict != verdictXFail})
+		} else if ra.Error != rb.Error && rb.Error != "" {
+			changes = append(changes, runChange{scenario: name, kind: "error", before: ra.Error, after: rb.Error, regression: true})
+		}
+		if grown := rb.DurationMs - ra.DurationMs; grown > minMs && float64(grown) > float64(ra.DurationMs)*threshold {
+			changes = append(changes, runChange{scenario: name, kind: "latency",
+				before: fmt.Sprintf("%dms", ra.DurationMs), after: fmt.Sprintf("%dms", rb.DurationMs), regression: true})
+		}
+		for _, table := range stateDiff(before.tables, after.tables) {
+			changes = append(changes, runChange{scenario: name, kind: "state", before: table, after: table})
+		}
+	}
+	return changes
+}
+
+// stateDiff возвращает CSV файлы таблиц, содержимое которых различается.
+func stateDiff(a, b map[string][]byte) []string {
+	var tables []string
+	for table, data := range a {
+		if other, ok := b[table]; !ok || !bytes.Equal(data, other) {
+			tables = append(tables, table)
+		}
+	}
+	for table := range b {
+		if _, ok := a[table]; !ok {
+			tables = append(tables, table)
+		}
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+func printRunChanges(w io.Writer, changes []runChange) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCENARIO\tCHANGE\tBEFORE\tAFTER\tREGRESSION")
+	for _, c := range changes {
+		mark := ""
+		if c.regression {
+			mark = "*"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", c.scenario, c.kind, c.before, c.after, mark)
+	}
+	return tw.Flush()
+}
+
+// diffRunsCommand реализует подкоманду diff-runs: diff-runs [-threshold 0.2] [-min-ms 10] dirA dirB.
+// Каталоги создаются флагом -archive. Завершается ошибкой, если найдены регрессии.
+func diffRunsCommand(args []string, logger *zap.Logger) error {
+	fs := flag.NewFlagSet("diff-runs", flag.ContinueOnError)
+	threshold := fs.Float64("threshold", 0.2, "relative duration growth reported as a latency regression")
+	minMs := fs.Int64("min-ms", 10, "ignore duration growth below this many milliseconds")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return fmt.Errorf("usage: diff-runs [-threshold 0.2] [-min-ms 10] <dirA> <dirB>")
+	}
+
+	var runs [2]map[string]archivedRun
+	for i, dir := range fs.Args() {
+		var err error
+		if runs[i], err = readArchivedRuns(dir); err != nil {
+			logger.Error("failed to read archived runs", zap.Error(err), zap.String("dir", dir))
+			return err
+		}
+	}
+	changes := diffRuns(runs[0], runs[1], *threshold, *minMs)
+	if err := printRunChanges(os.Stdout, changes); err != nil {
+		return err
+	}
+	regressions := 0
+	for _, c := range changes {
+		if c.regression {
+			regressions++
+		}
+	}
+	if regressions > 0 {
+		return fmt.Errorf("%d regressions between %s and %s", regressions, fs.Arg(0), fs.Arg(1))
+	}
+	return nil
+}
@@ -0,0 +1,610 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+
+	"transactionIsolation/isolation"
+)
+
+const (
+	actionBegin    = "begin"
+	actionCommit   = "commit"
+	actionRollback = "rollback"
+)
+
+// yamlScenario - пользовательский сценарий, описанный в YAML файле.
+//
+//	name: lost_update_custom
+//	level: read committed
+//	namespace: lost_update  # необязательно, схема для таблиц сценария
+//	seeded: true            # необязательно, добавить строки person из флагов -seed-*
+//	setup:                # необязательно, по умолчанию таблица person
+//	  - DROP TABLE IF EXISTS person;
+//	transactions:
+//	  - name: tx1
+//	  - name: tx2
+//	    level: serializable
+//	steps:
+//	  - {tx: tx1, action: begin}
+//	  - {tx: tx1, query: "SELECT balance FROM person WHERE id = $1", params: [1], expect: {rows: [[1000]]}}
+//	  - {tx: tx2, exec: "UPDATE person SET balance = $1 WHERE id = $2", params: [10, 1], expect: {error: "40001"}}
+//	  - {tx: tx1, action: commit}
+//	anomaly:              # необязательно, проверка итога для -probability
+//	  query: SELECT balance FROM person WHERE id = 1
+//	  assert: committed["tx1"] and committed["tx2"] and rows[0][0] != 200
+//	xfail:                # необязательно, СУБД и версии, где сценарий должен упасть
+//	  - {backend: postgres, reason: "READ UNCOMMITTED behaves as READ COMMITTED"}
+//	final:                # необязательно, итоговое состояние таблиц
+//	  - {query: "SELECT id, balance FROM person ORDER BY id;", rows: [[1, 10], [2, 1000]]}
+//
+// expect: {affected: N} проверяет количество строк, измененных шагом exec.
+//
+// Шаги могут содержать Starlark: script выполняет код (переменные сохраняются
+// между шагами, результат последнего запроса доступен как rows, количество
+// строк, измененных последним exec, - как affected), when задает
+// условие выполнения шага, args вычисляет параметры запроса, assert проверяет
+// условие после выполнения шага.
+//
+//	steps:
+//	  - {tx: tx1, query: "SELECT balance FROM person WHERE id = $1", params: [1]}
+//	  - {script: "balance = rows[0][0]"}
+//	  - {tx: tx1, exec: "UPDATE person SET balance = $1 WHERE id = $2", args: "[balance - 100, 1]", when: "balance >= 100"}
+//
+// Политика retry повторяет транзакцию шага при ошибке с указанным SQLSTATE или
+// именем класса (по умолчанию serialization_failure и deadlock_detected): транзакция
+// откатывается, ее шаги с последнего begin, включая привязанные к ней script,
+// выполняются заново, затем повторяется сам шаг.
+//
+//	steps:
+//	  - {tx: tx2, script: "balance2 = rows[0][0]"}
+//	  - {tx: tx2, action: commit, retry: {on: ["40001"], attempts: 5, backoff: 10ms}}
+//
+// delay_before и delay_after задают паузу до и после шага: фиксированную
+// (50ms) или случайную из диапазона (10ms..200ms). Случайные паузы зависят
+// только от -data-seed, поэтому окно гонки воспроизводится между запусками.
+//
+//	steps:
+//	  - {tx: tx1, query: "SELECT balance FROM person WHERE id = 1", delay_after: 10ms..50ms}
+//
+// bind сохраняет колонки первой строки результата query под именами
+// {{tx.name}}. Ссылку можно указать параметром целиком, внутри строкового
+// параметра, в args, when и assert. В -probability каждая транзакция видит
+// только значения, сохраненные ею самой.
+//
+//	steps:
+//	  - {tx: tx1, query: "SELECT balance FROM person WHERE id = $1", params: [1], bind: [balance]}
+//	  - {tx: tx1, exec: "UPDATE person SET balance = $1 WHERE id = $2", args: "[{{tx1.balance}} - 100, 1]"}
+//	  - {tx: tx1, query: "SELECT balance FROM person WHERE id = $1", params: [1], assert: "rows[0][0] == {{tx1.balance}} - 100"}
+type yamlScenario struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+	// Tags - метки сценария в каталоге list
+	Tags         []string          `yaml:"tags"`
+	Level        string            `yaml:"level"`
+	Namespace    string            `yaml:"namespace"`
+	Seeded       bool              `yaml:"seeded"`
+	Setup        []string          `yaml:"setup"`
+	Transactions []yamlTransaction `yaml:"transactions"`
+	Steps        []yamlStep        `yaml:"steps"`
+	Anomaly      *yamlAnomaly      `yaml:"anomaly"`
+	// After - сценарии, после которых выполняется этот
+	After []string `yaml:"after"`
+	// Skip и XFail - СУБД и версии, на которых сценарий пропускается или
+	// должен завершиться ошибкой
+	Skip  []backendAnnotation `yaml:"skip"`
+	XFail []backendAnnotation `yaml:"xfail"`
+	// Final - ожидаемое состояние таблиц после всех шагов
+	Final []yamlFinal `yaml:"final"`
+}
+
+// yamlFinal - запрос итогового состояния и строки, которые он должен вернуть.
+// Запрос выполняется через монитор после шагов, даже если шаг завершился ошибкой.
+type yamlFinal struct {
+	Name  string  `yaml:"name"`
+	Query string  `yaml:"query"`
+	Rows  [][]any `yaml:"rows"`
+}
+
+type yamlTransaction struct {
+	Name  string `yaml:"name"`
+	Level string `yaml:"level"`
+	// Settings - параметры сервера, устанавливаемые при каждом begin транзакции,
+	// например enable_indexscan: "off" для сценариев, зависящих от плана
+	Settings gucProfile `yaml:"settings"`
+}
+
+type yamlStep struct {
+	Tx     string `yaml:"tx"`
+	Action string `yaml:"action"`
+	Exec   string `yaml:"exec"`
+	Query  string `yaml:"query"`
+	// Execute - имя оператора, подготовленного PREPARE в одном из прошлых
+	// шагов сеанса; params подставляются в EXECUTE литералами
+	Execute string      `yaml:"execute"`
+	Script  string      `yaml:"script"`
+	Params  []any       `yaml:"params"`
+	Args    string      `yaml:"args"`
+	When    string      `yaml:"when"`
+	Assert  string      `yaml:"assert"`
+	Expect  *yamlExpect `yaml:"expect"`
+	Retry   *yamlRetry  `yaml:"retry"`
+	// Bind - имена колонок первой строки результата query, доступных
+	// последующим шагам как {{tx.name}}
+	Bind []string `yaml:"bind"`
+	// DelayBefore и DelayAfter - паузы вокруг шага, nil - без паузы
+	DelayBefore *yamlDelay `yaml:"delay_before"`
+	DelayAfter  *yamlDelay `yaml:"delay_after"`
+}
+
+// yamlDelay - пауза от min до max включительно; min == max - фиксированная пауза.
+type yamlDelay struct {
+	min, max time.Duration
+}
+
+func (d *yamlDelay) UnmarshalYAML(node *yaml.Node) error {
+	var s string
+	if err := node.Decode(&s); err != nil {
+		return err
+	}
+	low, high, isRange := strings.Cut(s, "..")
+	var err error
+	if d.min, err = time.ParseDuration(strings.TrimSpace(low)); err != nil {
+		return fmt.Errorf("delay %q: %w", s, err)
+	}
+	d.max = d.min
+	if isRange {
+		if d.max, err = time.ParseDuration(strings.TrimSpace(high)); err != nil {
+			return fmt.Errorf("delay %q: %w", s, err)
+		}
+	}
+	if d.min < 0 || d.max < d.min {
+		return fmt.Errorf("delay %q: expected a non-negative duration or an increasing range min..max", s)
+	}
+	return nil
+}
+
+// sleep выдерживает паузу, случайную часть выбирает g.
+func (d *yamlDelay) sleep(g *generator, logger *zap.Logger, position string) {
+	if d == nil {
+		return
+	}
+	delay := d.min
+	if d.max > d.min {
+		delay += time.Duration(g.rng.Int63n(int64(d.max-d.min) + 1))
+	}
+	logger.Info("step delayed", zap.String("position", position), zap.Duration("delay", delay))
+	time.Sleep(delay)
+}
+
+// yamlRetry - политика повтора транзакции при прерывании сервером.
+type yamlRetry struct {
+	On       []string `yaml:"on"`
+	Attempts int      `yaml:"attempts"`
+	Backoff  string   `yaml:"backoff"`
+}
+
+const defaultRetryAttempts = 3
+
+func (r *yamlRetry) validate() error {
+	if r.Attempts < 0 {
+		return fmt.Errorf("retry attempts must be positive, got %d", r.Attempts)
+	}
+	if r.Attempts == 0 {
+		r.Attempts = defaultRetryAttempts
+	}
+	if r.Backoff != "" {
+		if _, err := time.ParseDuration(r.Backoff); err != nil {
+			return fmt.Errorf("retry backoff: %w", err)
+		}
+	}
+	if len(r.On) == 0 {
+		r.On = []string{"40001", "40P01"}
+	}
+	return nil
+}
+
+// matches сообщает, нужно ли повторять транзакцию после ошибки err.
+func (r *yamlRetry) matches(err error) bool {
+	if r == nil {
+		return false
+	}
+	class := classifyError(err)
+	for _, on := range r.On {
+		if class.Code != "" && (on == class.Code || on == class.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff возвращает паузу перед повтором attempt, удваивая ее с каждой попыткой.
+func (r *yamlRetry) backoff(attempt int) time.Duration {
+	base, _ := time.ParseDuration(r.Backoff)
+	return base << (attempt - 1)
+}
+
+// yamlAnomaly - проверка, проявилась ли аномалия после случайного запуска.
+// В assert доступны rows запроса и committed - зафиксирована ли каждая транзакция.
+type yamlAnomaly struct {
+	Query  string `yaml:"query"`
+	Assert string `yaml:"assert"`
+}
+
+// yamlExpect - ожидаемый результат шага: строки запроса, количество строк,
+// измененных exec, или SQLSTATE ошибки.
+type yamlExpect struct {
+	Rows     [][]any `yaml:"rows"`
+	Affected *int64  `yaml:"affected"`
+	Error    string  `yaml:"error"`
+}
+
+func parseLevel(name string) (sql.IsolationLevel, error) {
+	return isolation.ParseLevel(name, isolation.Postgres)
+}
+
+func loadYAMLScenarios(dir string, logger *zap.Logger) (map[string]scenario, error) {
+	var files []string
+	for _, pattern := range []string{"*.yaml", "*.yml"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			logger.Error("failed to list scenarios", zap.Error(err), zap.String("dir", dir))
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+
+	scenarios := make(map[string]scenario, len(files))
+	for _, file := range files {
+		y, err := readYAMLScenario(file)
+		if err != nil {
+			logger.Error("failed to load scenario", zap.Error(err), zap.String("file", file))
+			return nil, err
+		}
+		if _, ok := scenarios[y.Name]; ok {
+			return nil, fmt.Errorf("%s: duplicate scenario %q", file, y.Name)
+		}
+		level, _ := parseLevel(y.Level)
+		migrations := y.Setup
+		if len(migrations) == 0 {
+			migrations = personMigrations
+		}
+		scenarios[y.Name] = scenario{level: level, migrations: migrations, problem: y.run, namespace: y.Namespace, seeded: y.Seeded, after: y.After,
+			skip: y.Skip, xfail: y.XFail, final: y.finalState(), description: y.Description, tags: append([]string{"yaml"}, y.Tags...),
+			cost: scenarioCost{transactions: len(y.Transactions), sessions: len(y.Transactions)}}
+		if y.Anomaly != nil {
+			s := scenarios[y.Name]
+			s.randomized = y.randomizedRun
+			s.shrink = y.shrink
+			scenarios[y.Name] = s
+		}
+		logger.Info("scenario loaded", zap.String("scenario", y.Name), zap.String("file", file))
+	}
+	return scenarios, nil
+}
+
+func readYAMLScenario(file string) (*yamlScenario, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var y yamlScenario
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err = decoder.Decode(&y); err != nil {
+		return nil, err
+	}
+	if err = y.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return &y, nil
+}
+
+func (y *yamlScenario) validate() error {
+	if y.Name == "" {
+		return errors.New("scenario name is required")
+	}
+	if y.Level != "" {
+		if _, err := parseLevel(y.Level); err != nil {
+			return err
+		}
+	}
+	txs := make(map[string]bool, len(y.Transactions))
+	for _, tx := range y.Transactions {
+		if tx.Name == "" {
+			return errors.New("transaction name is required")
+		}
+		if tx.Level != "" {
+			if _, err := parseLevel(tx.Level); err != nil {
+				return fmt.Errorf("transaction %s: %w", tx.Name, err)
+			}
+		}
+		if err := tx.Settings.validate(); err != nil {
+			return fmt.Errorf("transaction %s: %w", tx.Name, err)
+		}
+		txs[tx.Name] = true
+	}
+	if y.Anomaly != nil && (y.Anomaly.Query == "" || y.Anomaly.Assert == "") {
+		return errors.New("anomaly query and assert are required")
+	}
+	if err := validateAnnotations(y.Skip, y.XFail); err != nil {
+		return err
+	}
+	for i, f := range y.Final {
+		if f.Query == "" || f.Rows == nil {
+			return fmt.Errorf("final %d: query and rows are required", i+1)
+		}
+	}
+	for i, step := range y.Steps {
+		if !txs[step.Tx] && (step.Script == "" || step.Tx != "") {
+			return fmt.Errorf("step %d: unknown transaction %q", i+1, step.Tx)
+		}
+		kinds := 0
+		for _, s := range []string{step.Action, step.Exec, step.Query, step.Execute, step.Script} {
+			if s != "" {
+				kinds++
+			}
+		}
+		if kinds != 1 {
+			return fmt.Errorf("step %d: exactly one of action, exec, query, execute or script is required", i+1)
+		}
+		if step.Args != "" && len(step.Params) > 0 {
+			return fmt.Errorf("step %d: params and args are mutually exclusive", i+1)
+		}
+		switch step.Action {
+		case "", actionBegin, actionCommit, actionRollback:
+		default:
+			return fmt.Errorf("step %d: unknown action %q", i+1, step.Action)
+		}
+		if step.Expect != nil && step.Expect.Affected != nil && step.Exec == "" {
+			return fmt.Errorf("step %d: expected affected rows require exec", i+1)
+		}
+		if step.Retry != nil {
+			if step.Tx == "" || step.Action == actionBegin {
+				return fmt.Errorf("step %d: retry requires a transaction step after begin", i+1)
+			}
+			if step.Expect != nil && step.Expect.Error != "" {
+				return fmt.Errorf("step %d: retry and expected error are mutually exclusive", i+1)
+			}
+			if err := step.Retry.validate(); err != nil {
+				return fmt.Errorf("step %d: %w", i+1, err)
+			}
+		}
+	}
+	return y.checkBindings()
+}
+
+func (y *yamlScenario) run(db *sqlx.DB, logger *zap.Logger) error {
+	if y.Description != "" {
+		logger.Info(y.Description)
+	}
+	if manualTx != "" && !y.hasTransaction(manualTx) {
+		return fmt.Errorf("%s: no transaction %q to run manually", y.Name, manualTx)
+	}
+
+	txs := make(map[string]*transaction, len(y.Transactions))
+	levels := make(map[string]string, len(y.Transactions))
+	for _, tx := range y.Transactions {
+		txs[tx.Name] = newTransaction(db, logger.With(zap.String("tx", tx.Name)))
+		txs[tx.Name].settings = tx.Settings
+		levels[tx.Name] = tx.Level
+		if tx.Level == "" {
+			levels[tx.Name] = y.Level
+		}
+	}
+	// Незавершенные транзакции откатываются, чтобы не блокировать следующие сценарии
+	defer func() {
+		for _, t := range txs {
+			if t.tx != nil {
+				ignoreError(t.logger, "rollback", t.tx.Rollback())
+			}
+		}
+	}()
+
+	env := newScriptEnv(logger)
+	delays := newGenerator(dataSeed)
+	// Шаги каждой транзакции с последнего begin, повторяемые при retry
+	executed := make(map[string][]int, len(txs))
+	for i, step := range y.Steps {
+		stepLogger := logger
+		if t := txs[step.Tx]; t != nil {
+			stepLogger = t.logger
+		}
+		stepLogger.Info("step", zap.Int("step", i+1))
+
+		step.DelayBefore.sleep(delays, stepLogger, "before")
+		err := y.runStep(env, txs, levels, i, logger)
+		for attempt := 1; err != nil && step.Retry.matches(err) && attempt < step.Retry.Attempts; attempt++ {
+			backoff := step.Retry.backoff(attempt)
+			stepLogger.Info("retrying transaction", zap.Int("step", i+1), zap.Int("attempt", attempt+1),
+				zap.String("code", errorCode(err)), zap.Duration("backoff", backoff))
+			time.Sleep(backoff)
+			err = y.replay(env, txs, levels, step.Tx, executed[step.Tx], logger)
+			if err == nil {
+				err = y.runStep(env, txs, levels, i, logger)
+			}
+		}
+		if err != nil {
+			stepLogger.Error("step failed", zap.Error(err), zap.Int("step", i+1))
+			return fmt.Errorf("%s: step %d: %w", y.Name, i+1, err)
+		}
+		if step.Tx != "" {
+			if step.Action == actionBegin {
+				executed[step.Tx] = nil
+			}
+			executed[step.Tx] = append(executed[step.Tx], i)
+		}
+		step.DelayAfter.sleep(delays, stepLogger, "after")
+	}
+	return nil
+}
+
+// finalState возвращает проверки итогового состояния сценария.
+func (y *yamlScenario) finalState() []postcondition {
+	var checks []postcondition
+	for i, f := range y.Final {
+		name := f.Name
+		if name == "" {
+			name = fmt.Sprintf("final state %d", i+1)
+		}
+		checks = append(checks, expectRows(name, f.Query, f.Rows))
+	}
+	return checks
+}
+
+// transactionSettings возвращает параметры сервера транзакции name.
+func (y *yamlScenario) transactionSettings(name string) gucProfile {
+	for _, tx := range y.Transactions {
+		if tx.Name == name {
+			return tx.Settings
+		}
+	}
+	return nil
+}
+
+// hasTransaction сообщает, объявлена ли в сценарии транзакция name.
+func (y *yamlScenario) hasTransaction(name string) bool {
+	for _, tx := range y.Transactions {
+		if tx.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// runStep выполняет шаг с условием when, параметрами args, проверками expect и assert.
+func (y *yamlScenario) runStep(env *scriptEnv, txs map[string]*transaction, levels map[string]string, i int, logger *zap.Logger) error {
+	step := y.Steps[i]
+	t := txs[step.Tx]
+	if t != nil {
+		logger = t.logger
+	}
+	name := fmt.Sprintf("%s:%d", y.Name, i+1)
+
+	if step.When != "" {
+		ok, err := env.truthExpanded(name, step.When)
+		if err != nil {
+			return fmt.Errorf("condition: %w", err)
+		}
+		if !ok {
+			logger.Info("step skipped", zap.Int("step", i+1), zap.String("when", step.When))
+			return nil
+		}
+	}
+	params, err := env.params(name, step)
+	if err != nil {
+		return err
+	}
+	if step.Tx != "" && step.Tx == manualTx {
+		return y.promptManual(i, step, params, levels[step.Tx], logger)
+	}
+
+	var rows [][]any
+	var affected int64
+	switch {
+	case step.Action == actionBegin:
+		err = t.begin()
+		if err == nil && levels[step.Tx] != "" {
+			level, _ := parseLevel(levels[step.Tx])
+			err = t.setLevel(level)
+		}
+	case step.Action == actionCommit:
+		err = t.commit()
+	case step.Action == actionRollback:
+		err = t.rollback()
+	case step.Exec != "":
+		affected, err = t.exec(step.Exec, params...)
+	case step.Query != "":
+		rows, err = t.query(step.Query, params...)
+	case step.Execute != "":
+		rows, err = t.execute(isolation.Prepared{Name: step.Execute}, params...)
+	case step.Script != "":
+		err = env.exec(name, step.Script)
+	}
+	if err = step.check(rows, affected, err); err != nil {
+		return err
+	}
+	if step.Query != "" || step.Execute != "" {
+		env.setRows(rows)
+		if err = env.bind(step.Tx, step.Bind, rows); err != nil {
+			return err
+		}
+	}
+	if step.Exec != "" {
+		env.setAffected(affected)
+	}
+	if step.Assert != "" {
+		ok, err := env.truthExpanded(name, step.Assert)
+		if err == nil && !ok {
+			err = fmt.Errorf("assertion failed: %s", step.Assert)
+		}
+		if err != nil {
+			return err
+		}
+		logger.Info("assertion passed", zap.String("assert", step.Assert))
+	}
+	return nil
+}
+
+// replay откатывает прерванную транзакцию и заново выполняет ее шаги, начиная с begin.
+// Шаги script, привязанные к транзакции, тоже повторяются, поэтому переменные,
+// вычисленные из прочитанных строк, обновляются.
+func (y *yamlScenario) replay(env *scriptEnv, txs map[string]*transaction, levels map[string]string, tx string, steps []int, logger *zap.Logger) error {
+	// После ошибки commit транзакция уже завершена, и откат вернет sql.ErrTxDone
+	ignoreError(logger, "rollback", txs[tx].tx.Rollback())
+	for _, i := range steps {
+		if err := y.runStep(env, txs, levels, i, logger); err != nil {
+			return fmt.Errorf("replay step %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// check сверяет результат шага с ожиданием.
+func (s yamlStep) check(rows [][]any, affected int64, err error) error {
+	if s.Expect == nil {
+		return err
+	}
+	if s.Expect.Error != "" {
+		if err == nil {
+			return fmt.Errorf("expected error %s, got none", s.Expect.Error)
+		}
+		if code := errorCode(err); code != s.Expect.Error {
+			return fmt.Errorf("expected error %s, got %s: %w", s.Expect.Error, code, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if s.Expect.Rows != nil && !reflect.DeepEqual(normalizeRows(s.Expect.Rows), normalizeRows(rows)) {
+		return fmt.Errorf("expected rows %v, got %v", s.Expect.Rows, rows)
+	}
+	if s.Expect.Affected != nil && *s.Expect.Affected != affected {
+		return fmt.Errorf("expected %d affected rows, got %d", *s.Expect.Affected, affected)
+	}
+	return nil
+}
+
+func normalizeRows(rows [][]any) [][]string {
+	normalized := make([][]string, len(rows))
+	for i, row := range rows {
+		normalized[i] = make([]string, len(row))
+		for j, v := range row {
+			normalized[i][j] = fmt.Sprint(v)
+		}
+	}
+	return normalized
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+const defaultDSN = "user=postgres password=postgres dbname=postgres sslmode=disable"
+
+// dsnPreset описывает требования управляемого провайдера Postgres к параметрам подключения.
+type dsnPreset struct {
+	// hostSuffixes - домены провайдера; пустой список - любой хост.
+	hostSuffixes []string
+	// apply дополняет и проверяет параметры, возвращает предупреждения.
+	apply func(params map[string]string) ([]string, error)
+}
+
+var dsnPresets = map[string]dsnPreset{
+	"rds": {
+		hostSuffixes: []string{".rds.amazonaws.com"},
+		apply: func(params map[string]string) ([]string, error) {
+			// Начиная с Postgres 15 в RDS по умолчанию включен rds.force_ssl
+			if err := requireSSL(params); err != nil {
+				return nil, err
+			}
+			if params["sslmode"] == "verify-full" && params["sslrootcert"] == "" {
+				return nil, fmt.Errorf("sslmode=verify-full requires sslrootcert with the RDS CA bundle")
+			}
+			return nil, nil
+		},
+	},
+	"cloudsql": {
+		apply: func(params map[string]string) ([]string, error) {
+			// Cloud SQL Auth Proxy слушает локально и сам шифрует трафик
+			host := params["host"]
+			if host == "localhost" || host == "127.0.0.1" || strings.HasPrefix(host, "/cloudsql/") {
+				setDefault(params, "sslmode", "disable")
+				return nil, nil
+			}
+			if err := requireSSL(params); err != nil {
+				return nil, err
+			}
+			return []string{"connecting to a Cloud SQL public IP directly, consider the Cloud SQL Auth Proxy"}, nil
+		},
+	},
+	"neon": {
+		hostSuffixes: []string{".neon.tech"},
+		apply: func(params map[string]string) ([]string, error) {
+			if err := requireSSL(params); err != nil {
+				return nil, err
+			}
+			var warnings []string
+			// lib/pq не поддерживает channel_binding и передал бы его серверу как GUC
+			if _, ok := params["channel_binding"]; ok {
+				delete(params, "channel_binding")
+				warnings = append(warnings, "channel_binding is not supported by the driver and was removed")
+			}
+			// Без SNI Neon определяет endpoint по параметру options
+			if _, ok := params["options"]; !ok {
+				endpoint := strings.TrimSuffix(strings.SplitN(params["host"], ".", 2)[0], "-pooler")
+				params["options"] = "endpoint=" + endpoint
+			}
+			return warnings, nil
+		},
+	},
+	"supabase": {
+		hostSuffixes: []string{".supabase.co", ".pooler.supabase.com"},
+		apply: func(params map[string]string) ([]string, error) {
+			if err := requireSSL(params); err != nil {
+				return nil, err
+			}
+			if !strings.HasSuffix(params["host"], ".pooler.supabase.com") {
+				return nil, nil
+			}
+			// Пулер Supabase (Supavisor) различает проекты по имени пользователя
+			if !strings.Contains(params["user"], ".") {
+				return nil, fmt.Errorf("supabase pooler requires user in the form postgres.<project-ref>")
+			}
+			if params["port"] == "6543" {
+				return []string{"port 6543 is the transaction pooler, session state and SET TRANSACTION may not behave as expected; use 5432 for session mode"}, nil
+			}
+			return nil, nil
+		},
+	},
+}
+
+// resolveDSN разбирает DSN (URL или key=value), применяет пресет провайдера
+// и проверяет обязательные параметры.
+func resolveDSN(dsn, preset string, logger *zap.Logger) (string, error) {
+	params, err := parseDSN(dsn)
+	if err != nil {
+		logger.Error("failed to parse dsn", zap.Error(err))
+		return "", err
+	}
+	if preset != "" {
+		p, ok := dsnPresets[preset]
+		if !ok {
+			return "", fmt.Errorf("unknown dsn preset %q", preset)
+		}
+		for _, required := range []string{"host", "user", "password", "dbname"} {
+			if params[required] == "" {
+				return "", fmt.Errorf("dsn preset %s: %s is required", preset, required)
+			}
+		}
+		if len(p.hostSuffixes) > 0 && !hasAnySuffix(params["host"], p.hostSuffixes) {
+			return "", fmt.Errorf("dsn preset %s: host %q does not look like %s", preset, params["host"], strings.Join(p.hostSuffixes, " or "))
+		}
+		setDefault(params, "port", "5432")
+		warnings, err := p.apply(params)
+		if err != nil {
+			return "", fmt.Errorf("dsn preset %s: %w", preset, err)
+		}
+		for _, w := range warnings {
+			logger.Warn(w, zap.String("preset", preset))
+		}
+	}
+
+	resolved := formatDSN(params)
+	redacted := make(map[string]string, len(params))
+	for k, v := range params {
+		redacted[k] = v
+	}
+	if _, ok := redacted["password"]; ok {
+		redacted["password"] = "***"
+	}
+	logger.Info("dsn resolved", zap.String("dsn", formatDSN(redacted)), zap.String("preset", preset))
+	return resolved, nil
+}
+
+func parseDSN(dsn string) (map[string]string, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		var err error
+		if dsn, err = pq.ParseURL(dsn); err != nil {
+			return nil, err
+		}
+	}
+
+	params := make(map[string]string)
+	s := strings.TrimSpace(dsn)
+	for s != "" {
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("malformed dsn near %q", s)
+		}
+		key := strings.TrimSpace(s[:eq])
+		s = strings.TrimLeft(s[eq+1:], " ")
+
+		var value strings.Builder
+		if strings.HasPrefix(s, "'") {
+			i := 1
+			for ; i < len(s) && s[i] != '\''; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				value.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, fmt.Errorf("unterminated quoted value for %q", key)
+			}
+			s = s[i+1:]
+		} else {
+			end := strings.IndexAny(s, " \t\n")
+			if end < 0 {
+				end = len(s)
+			}
+			value.WriteString(s[:end])
+			s = s[end:]
+		}
+		params[key] = value.String()
+		s = strings.TrimSpace(s)
+	}
+	return params, nil
+}
+
+func formatDSN(params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v := params[k]
+		if v == "" || strings.ContainsAny(v, " '\\\t\n") {
+			v = "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+		}
+		parts = append(parts, k+"="+v)
+	}
+	return strings.Join(parts, " ")
+}
+
+func requireSSL(params map[string]string) error {
+	setDefault(params, "sslmode", "require")
+	switch params["sslmode"] {
+	case "require", "verify-ca", "verify-full":
+		return nil
+	default:
+		return fmt.Errorf("sslmode=%s is not allowed, use require, verify-ca or verify-full", params["sslmode"])
+	}
+}
+
+func setDefault(params map[string]string, key, value string) {
+	if _, ok := params[key]; !ok {
+		params[key] = value
+	}
+}
+
+func hasAnySuffix(host string, suffixes []string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// errorClass - классификация ошибки базы данных по SQLSTATE.
+type errorClass struct {
+	Code        string
+	Name        string
+	Retryable   bool
+	Explanation string
+	// Backend и Native - СУБД и ее собственный код ошибки, если он переведен
+	// в SQLSTATE PostgreSQL; для PostgreSQL пусто
+	Backend string
+	Native  string
+}
+
+var errorClasses = map[string]errorClass{
+	"40001": {Name: "serialization_failure", Retryable: true,
+		Explanation: "transaction conflicts with a concurrent one and was aborted to keep the schedule serializable, retry it"},
+	"40P01": {Name: "deadlock_detected", Retryable: true,
+		Explanation: "transactions wait for each other's locks, one of them was aborted to break the cycle"},
+	"40003": {Name: "statement_completion_unknown",
+		Explanation: "the connection broke during commit and the outcome is unknown, check the data before retrying"},
+	"55P03": {Name: "lock_not_available",
+		Explanation: "lock was not acquired within lock_timeout or NOWAIT was used"},
+	"57014": {Name: "query_canceled",
+		Explanation: "statement was canceled, usually by statement_timeout"},
+	"23505": {Name: "unique_violation",
+		Explanation: "a concurrent transaction committed the same key first"},
+	"23503": {Name: "foreign_key_violation",
+		Explanation: "the referenced row is missing or still referenced, a concurrent transaction may have deleted or inserted it"},
+	"23514": {Name: "check_violation",
+		Explanation: "the new row version violates a CHECK constraint"},
+	"25P02": {Name: "in_failed_sql_transaction",
+		Explanation: "an earlier statement failed, the transaction accepts only ROLLBACK"},
+	"53200": {Name: "out_of_shared_memory",
+		Explanation: "the shared lock table is full; for SERIALIZABLE raise max_pred_locks_per_transaction or keep transactions shorter"},
+	"72000": {Name: "snapshot_too_old",
+		Explanation: "the snapshot is older than old_snapshot_threshold and the data it needs may have been vacuumed away"},
+}
+
+// Другие СУБД распознаются по ошибкам их драйверов: сценарии выполняются на
+// PostgreSQL, а к SQL Server подключается только подкоманда rcsi через
+// драйвер из плагина.
+const (
+	backendMySQL     = "mysql"
+	backendSQLServer = "sqlserver"
+	backendOracle    = "oracle"
+)
+
+// dialectCodes переводит коды ошибок других СУБД в SQLSTATE PostgreSQL, чтобы
+// повторы и вердикты не зависели от СУБД. CockroachDB отвечает по протоколу
+// PostgreSQL и сам возвращает 40001 для ошибок, требующих повтора, и 40003
+// для фиксации с неизвестным исходом.
+var dialectCodes = map[string]map[string]string{
+	backendMySQL: {
+		"1213": "40P01", // ER_LOCK_DEADLOCK
+		"1205": "55P03", // ER_LOCK_WAIT_TIMEOUT
+		"3572": "55P03", // ER_LOCK_NOWAIT
+		"1062": "23505", // ER_DUP_ENTRY
+		"1451": "23503", // ER_ROW_IS_REFERENCED_2
+		"1452": "23503", // ER_NO_REFERENCED_ROW_2
+		"3819": "23514", // ER_CHECK_CONSTRAINT_VIOLATED
+		"3024": "57014", // ER_QUERY_TIMEOUT
+	},
+	backendSQLServer: {
+		"1205": "40P01", // жертва взаимоблокировки
+		"3960": "40001", // конфликт обновления в SNAPSHOT
+		"1222": "55P03", // превышен LOCK_TIMEOUT
+		"2627": "23505", // нарушение PRIMARY KEY или UNIQUE
+		"2601": "23505", // дубликат в уникальном индексе
+		"547":  "23503", // конфликт ограничения, кроме CHECK: см. sqlServerCheckConflict
+		"3930": "25P02", // транзакция не может быть зафиксирована
+	},
+	backendOracle: {
+		"ORA-08177": "40001", // can't serialize access for this transaction
+		"ORA-00060": "40P01", // deadlock detected while waiting for resource
+		"ORA-00054": "55P03", // resource busy and acquire with NOWAIT specified
+		"ORA-30006": "55P03", // resource busy; acquire with WAIT timeout expired
+		"ORA-00001": "23505", // unique constraint violated
+		"ORA-02290": "23514", // check constraint violated
+		"ORA-02291": "23503", // integrity constraint violated - parent key not found
+		"ORA-02292": "23503", // integrity constraint violated - child record found
+		"ORA-01013": "57014", // user requested cancel of current operation
+		"ORA-01555": "72000", // snapshot too old
+	},
+}
+
+// mysqlErrorPattern - начало текста ошибки драйвера MySQL: "Error 1213 (40001): ...".
+var mysqlErrorPattern = regexp.MustCompile(`^Error (\d+)(?: \(\w+\))?: `)
+
+// nativeError возвращает СУБД и собственный код ошибки. Драйверы других СУБД
+// распознаются по методам их ошибок, без зависимости от самих драйверов.
+func nativeError(err error) (backend, code string) {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return backendPostgres, string(pqErr.Code)
+	}
+	// Драйверы на pgx и другие драйверы протокола PostgreSQL
+	var sqlState interface{ SQLState() string }
+	if errors.As(err, &sqlState) {
+		return backendPostgres, sqlState.SQLState()
+	}
+	// github.com/microsoft/go-mssqldb
+	var mssql interface{ SQLErrorNumber() int32 }
+	if errors.As(err, &mssql) {
+		return backendSQLServer, strconv.Itoa(int(mssql.SQLErrorNumber()))
+	}
+	// github.com/godror/godror
+	var oracle interface{ Code() int }
+	if errors.As(err, &oracle) {
+		return backendOracle, fmt.Sprintf("ORA-%05d", oracle.Code())
+	}
+	// github.com/go-sql-driver/mysql: у MySQLError нет методов, только текст с номером
+	if err != nil {
+		if m := mysqlErrorPattern.FindStringSubmatch(err.Error()); m != nil {
+			return backendMySQL, m[1]
+		}
+	}
+	return "", ""
+}
+
+// sqlServerCheckConflict - текст ошибки SQL Server 547 о нарушении CHECK.
+// Тот же номер получают конфликты внешнего ключа, и чаще всего это они:
+// "The INSERT statement conflicted with the FOREIGN KEY constraint ...".
+const sqlServerCheckConflict = "conflicted with the CHECK constraint"
+
+// errorCode возвращает SQLSTATE PostgreSQL ошибки любой поддерживаемой СУБД.
+func errorCode(err error) string {
+	backend, code := nativeError(err)
+	if backend == backendPostgres {
+		return code
+	}
+	if backend == backendSQLServer && code == "547" && strings.Contains(err.Error(), sqlServerCheckConflict) {
+		return "23514"
+	}
+	return dialectCodes[backend][code]
+}
+
+// classifyError возвращает класс ошибки; для неизвестных кодов заполнен только Code.
+func classifyError(err error) errorClass {
+	code := errorCode(err)
+	class := errorClasses[code]
+	class.Code = code
+	if class.Name == "" && code != "" {
+		class.Name = "sqlstate_" + code
+	}
+	if backend, native := nativeError(err); backend != backendPostgres && native != "" {
+		class.Backend, class.Native = backend, native
+		if code == "" {
+			class.Name = backend + "_" + native
+		}
+	}
+	return class
+}
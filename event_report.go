@@ -0,0 +1,112 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+const (
+	eventInitialRows = 100
+	// eventReportQueries - сколько раз отчет перечитывает агрегаты
+	eventReportQueries = 4
+	// eventBatchRows - сколько событий писатели добавляют между запросами отчета
+	eventBatchRows = 25
+)
+
+var eventMigrations = []string{
+	`DROP TABLE IF EXISTS event;`,
+	`CREATE TABLE event (
+           id BIGSERIAL PRIMARY KEY,
+           kind TEXT NOT NULL,
+           amount INT NOT NULL,
+           created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+         );`,
+	fmt.Sprintf(`INSERT INTO event (kind, amount) SELECT 'payment', 10 FROM generate_series(1, %d);`, eventInitialRows),
+}
+
+// eventReportVariant - уровень изоляции транзакции отчета и ожидаемая
+// стабильность его агрегатов.
+type eventReportVariant struct {
+	name  string
+	level sql.IsolationLevel
+	// stable - все запросы отчета возвращают одинаковые агрегаты
+	stable bool
+}
+
+var eventReportVariants = []eventReportVariant{
+	// Каждый запрос READ COMMITTED видит события, добавленные к его началу
+	{name: "read_committed", level: sql.LevelReadCommitted, stable: false},
+	// Отчет REPEATABLE READ считает по снимку первого запроса
+	{name: "repeatable_read", level: sql.LevelRepeatableRead, stable: true},
+}
+
+// eventReport моделирует аналитический отчет по таблице, в которую только
+// добавляются строки: пока отчет в tx1 несколько раз считает агрегаты, писатели
+// фиксируют новые события. Вставки не блокируют чтение ни на одном уровне,
+// разница только в том, какой снимок видит каждый запрос отчета.
+func eventReport(db *sqlx.DB, logger *zap.Logger) error {
+	for _, v := range eventReportVariants {
+		if err := migrate(db, logger, eventMigrations); err != nil {
+			return err
+		}
+		if err := runEventReportVariant(db, logger.With(zap.String("variant", v.name)), v); err != nil {
+			return fmt.Errorf("%s: %w", v.name, err)
+		}
+	}
+	return nil
+}
+
+func runEventReportVariant(db *sqlx.DB, logger *zap.Logger, v eventReportVariant) (err error) {
+	// Проверка количества событий после завершения транзакций: вставки не потеряны
+	defer checkPostconditions(db, logger, &err,
+		expectValue("events", "SELECT COUNT(*) FROM event;", int64(eventInitialRows+(eventReportQueries-1)*eventBatchRows)))
+
+	// Запуск транзакции отчета
+	tx1 := newTransaction(db, logger.With(zap.String("tx", "tx1")))
+	if err = tx1.begin(); err != nil {
+		return err
+	}
+	if err = tx1.setLevel(v.level); err != nil {
+		return err
+	}
+
+	var first []any
+	stable := true
+	for i := 0; i < eventReportQueries; i++ {
+		// Писатель добавляет пачку событий в отдельной транзакции
+		if i > 0 {
+			tx2 := newTransaction(db, logger.With(zap.String("tx", "tx2")))
+			if err = tx2.begin(); err != nil {
+				return err
+			}
+			if _, err = tx2.exec("INSERT INTO event (kind, amount) SELECT 'payment', 10 FROM generate_series(1, $1);", eventBatchRows); err != nil {
+				return err
+			}
+			if err = tx2.commit(); err != nil {
+				return err
+			}
+		}
+
+		rows, err := tx1.query("SELECT COUNT(*), SUM(amount), MAX(id) FROM event;")
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			first = rows[0]
+		} else if fmt.Sprint(rows[0]) != fmt.Sprint(first) {
+			stable = false
+		}
+	}
+	if err = tx1.commit(); err != nil {
+		return err
+	}
+
+	logger.Info("report aggregates", zap.Bool("stable", stable))
+	if stable != v.stable {
+		return fmt.Errorf("report aggregates stable = %t, expected %t", stable, v.stable)
+	}
+	return nil
+}
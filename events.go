@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	eventStep    = "step"
+	eventVerdict = "verdict"
+)
+
+// event - сообщение о шаге сценария или его итоге.
+type event struct {
+	Time     time.Time      `json:"time"`
+	Kind     string         `json:"kind"`
+	Scenario string         `json:"scenario"`
+	Tx       string         `json:"tx,omitempty"`
+	Message  string         `json:"message,omitempty"`
+	Fields   map[string]any `json:"fields,omitempty"`
+	Result   *runResult     `json:"result,omitempty"`
+}
+
+type eventPublisher interface {
+	publish(payload []byte) error
+	close() error
+}
+
+// natsPublisher публикует события в subject NATS.
+type natsPublisher struct {
+	conn    *nats.Conn
+	subject string
+}
+
+func (p *natsPublisher) publish(payload []byte) error {
+	return p.conn.Publish(p.subject, payload)
+}
+
+func (p *natsPublisher) close() error {
+	return p.conn.Drain()
+}
+
+// kafkaRESTPublisher публикует события в топик Kafka через REST Proxy (API v2).
+type kafkaRESTPublisher struct {
+	client *http.Client
+	url    string
+}
+
+func (p *kafkaRESTPublisher) publish(payload []byte) error {
+	body, err := json.Marshal(map[string]any{
+		"records": []map[string]json.RawMessage{{"value": payload}},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Post(p.url, "application/vnd.kafka.json.v2+json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("kafka rest proxy: %s", resp.Status)
+	}
+	return nil
+}
+
+func (p *kafkaRESTPublisher) close() error {
+	return nil
+}
+
+// filePublisher записывает события в файл по одному JSON на строку; такую
+// запись запуска воспроизводит подкоманда replay.
+type filePublisher struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func (p *filePublisher) publish(payload []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err := p.file.Write(append(payload, '\n'))
+	return err
+}
+
+func (p *filePublisher) close() error {
+	return p.file.Close()
+}
+
+// eventQueueSize - события, ожидающие публикации; при заполненной очереди
+// запись лога ждет публикующую горутину.
+const eventQueueSize = 1024
+
+// errEventsClosed - событие отправлено после закрытия потока.
+var errEventsClosed = errors.New("event stream is closed")
+
+// eventStream сериализует события и отправляет их в выбранный брокер.
+// Публикует отдельная горутина, чтобы запись лога сценария не ждала ответа
+// брокера; close дожидается публикации всех событий очереди.
+type eventStream struct {
+	publisher eventPublisher
+	logger    *zap.Logger
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan []byte
+	// done закрывается, когда публикующая горутина опустошила закрытую очередь
+	done chan struct{}
+	// failed - события, которые не удалось опубликовать, err - первая ошибка
+	failed int
+	err    error
+}
+
+func newEventStream(publisher eventPublisher, logger *zap.Logger) *eventStream {
+	s := &eventStream{
+		publisher: publisher,
+		logger:    logger,
+		queue:     make(chan []byte, eventQueueSize),
+		done:      make(chan struct{}),
+	}
+	go s.publish()
+	return s
+}
+
+// publish публикует события очереди по порядку. В лог попадает только первая
+// ошибка: при недоступном брокере отказывает каждое событие.
+func (s *eventStream) publish() {
+	defer close(s.done)
+	for payload := range s.queue {
+		if err := s.publisher.publish(payload); err != nil {
+			if s.failed == 0 {
+				s.logger.Error("failed to publish event", zap.Error(err))
+				s.err = err
+			}
+			s.failed++
+		}
+	}
+}
+
+// eventsFilePath возвращает путь записи file:run.jsonl или file:///tmp/run.jsonl.
+func eventsFilePath(u *url.URL) string {
+	if u.Opaque != "" {
+		return u.Opaque
+	}
+	return u.Path
+}
+
+// openEventStream подключается к nats://host:4222/subject или kafka-rest://proxy:8082/topic
+// либо создает файл записи запуска file:run.jsonl.
+func openEventStream(target string, logger *zap.Logger) (*eventStream, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		logger.Error("failed to parse events target", zap.Error(err), zap.String("target", target))
+		return nil, err
+	}
+	if u.Scheme == "file" {
+		path := eventsFilePath(u)
+		f, err := os.Create(path)
+		if err != nil {
+			logger.Error("failed to create events file", zap.Error(err), zap.String("path", path))
+			return nil, err
+		}
+		logger.Info("events enabled", zap.String("scheme", u.Scheme), zap.String("path", path))
+		return newEventStream(&filePublisher{file: f}, logger), nil
+	}
+	topic := strings.TrimPrefix(u.Path, "/")
+	if topic == "" {
+		return nil, fmt.Errorf("events target %q: subject or topic is required", target)
+	}
+
+	var publisher eventPublisher
+	switch u.Scheme {
+	case "nats":
+		conn, err := nats.Connect((&url.URL{Scheme: u.Scheme, User: u.User, Host: u.Host}).String())
+		if err != nil {
+			logger.Error("failed to connect to nats", zap.Error(err), zap.String("host", u.Host))
+			return nil, err
+		}
+		publisher = &natsPublisher{conn: conn, subject: topic}
+	case "kafka-rest":
+		endpoint := url.URL{Scheme: "http", Host: u.Host, Path: "/topics/" + topic}
+		publisher = &kafkaRESTPublisher{client: &http.Client{Timeout: 10 * time.Second}, url: endpoint.String()}
+	default:
+		return nil, fmt.Errorf("events target %q: unsupported scheme %q", target, u.Scheme)
+	}
+	logger.Info("events enabled", zap.String("scheme", u.Scheme), zap.String("host", u.Host), zap.String("topic", topic))
+	return newEventStream(publisher, logger), nil
+}
+
+func (s *eventStream) emit(e event) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return errEventsClosed
+	}
+	s.queue <- payload
+	return nil
+}
+
+func (s *eventStream) verdict(r runResult) error {
+	err := s.emit(event{Time: time.Now(), Kind: eventVerdict, Scenario: r.Scenario, Result: &r})
+	if err != nil {
+		s.logger.Error("failed to publish verdict", zap.Error(err), zap.String("scenario", r.Scenario))
+		return err
+	}
+	return nil
+}
+
+// close публикует оставшиеся в очереди события и закрывает брокер.
+// Возвращает и ошибку публикации, которая до этого попала только в лог.
+func (s *eventStream) close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+	<-s.done
+	var published error
+	if s.failed > 0 {
+		published = fmt.Errorf("%d events were not published: %w", s.failed, s.err)
+	}
+	return errors.Join(published, s.publisher.close())
+}
+
+// core возвращает zapcore.Core, публикующий каждую запись лога сценария как событие шага.
+func (s *eventStream) core() zapcore.Core {
+	return &eventCore{LevelEnabler: zapcore.InfoLevel, stream: s}
+}
+
+type eventCore struct {
+	zapcore.LevelEnabler
+	stream *eventStream
+	fields []zapcore.Field
+}
+
+func (c *eventCore) With(fields []zapcore.Field) zapcore.Core {
+	return &eventCore{
+		LevelEnabler: c.LevelEnabler,
+		stream:       c.stream,
+		fields:       append(append([]zapcore.Field(nil), c.fields...), fields...),
+	}
+}
+
+func (c *eventCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c *eventCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	enc := zapcore.NewMapObjectEncoder()
+	for _, f := range c.fields {
+		f.AddTo(enc)
+	}
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+	// Публикуются только записи, относящиеся к сценарию
+	scenario, ok := enc.Fields["problem"].(string)
+	if !ok {
+		return nil
+	}
+	tx, _ := enc.Fields["tx"].(string)
+	delete(enc.Fields, "problem")
+	delete(enc.Fields, "tx")
+
+	return c.stream.emit(event{
+		Time:     entry.Time,
+		Kind:     eventStep,
+		Scenario: scenario,
+		Tx:       tx,
+		Message:  entry.Message,
+		Fields:   enc.Fields,
+	})
+}
+
+func (c *eventCore) Sync() error {
+	return nil
+}
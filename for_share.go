@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+// forShareQueue показывает очередь на блокировку строки: tx1 и tx2 берут FOR SHARE
+// одновременно, UPDATE в tx3 ждет обе. tx4 с FOR SHARE приходит после tx3, но
+// получает блокировку сразу: совместимая разделяемая блокировка не встает в очередь
+// за ожидающим писателем, поэтому писатель ждет, пока не завершатся все читатели.
+func forShareQueue(db *sqlx.DB, logger *zap.Logger) (err error) {
+	const shareQuery = "SELECT balance FROM person WHERE id = $1 FOR SHARE;"
+	txs := make([]*transaction, 4)
+	for i := range txs {
+		txs[i] = newTransaction(db, logger.With(zap.String("tx", fmt.Sprintf("tx%d", i+1))))
+		if err = txs[i].begin(); err != nil {
+			return err
+		}
+	}
+	tx1, tx2, tx3, tx4 := txs[0], txs[1], txs[2], txs[3]
+
+	// Порядок, в котором транзакции получили блокировку строки
+	var mu sync.Mutex
+	var order []string
+	grant := func(name string) {
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, name)
+		logger.Info("row lock granted", zap.String("tx", name), zap.Int("position", len(order)))
+	}
+
+	// Разделяемые блокировки совместимы, tx1 и tx2 не ждут друг друга
+	for _, step := range []struct {
+		t    *transaction
+		name string
+	}{{tx1, "tx1"}, {tx2, "tx2"}} {
+		if _, err = step.t.query(shareQuery, 1); err != nil {
+			return err
+		}
+		grant(step.name)
+	}
+
+	// UPDATE требует исключительную блокировку и ждет читателей
+	tx3PID, err := tx3.backendPID()
+	if err != nil {
+		return err
+	}
+	tx4PID, err := tx4.backendPID()
+	if err != nil {
+		return err
+	}
+	tx3Done := runAsync(func() error {
+		if _, err := tx3.exec("UPDATE person SET balance = balance + 100 WHERE id = $1;", 1); err != nil {
+			return err
+		}
+		grant("tx3")
+		return nil
+	})
+	if err = waitBlocked(tx3, tx3PID, tx3Done); err != nil {
+		return err
+	}
+	ignoreError(logger, "print locks", printLocks(monitorDB(db), logger))
+
+	// Новый читатель проходит мимо ожидающего писателя
+	tx4Done := runAsync(func() error {
+		if _, err := tx4.query(shareQuery, 1); err != nil {
+			return err
+		}
+		grant("tx4")
+		return nil
+	})
+	tx4Granted, err := finished(tx4, tx4PID, tx4Done)
+	if err != nil {
+		return err
+	}
+	tx4.logger.Info("share lock requested after the waiting update", zap.Bool("granted_immediately", tx4Granted))
+
+	// Писатель получает блокировку только после фиксации всех читателей,
+	// которые держат разделяемую блокировку
+	readers := []*transaction{tx1, tx2}
+	if tx4Granted {
+		readers = append(readers, tx4)
+	}
+	tx3Granted := false
+	for _, t := range readers {
+		if err = t.commit(); err != nil {
+			return err
+		}
+		if !tx3Granted {
+			if tx3Granted, err = finished(tx3, tx3PID, tx3Done); err != nil {
+				return err
+			}
+			tx3.logger.Info("update after reader commit", zap.Bool("granted", tx3Granted))
+		}
+	}
+	if !tx3Granted {
+		if err = <-tx3Done; err != nil {
+			return err
+		}
+	}
+	if err = tx3.commit(); err != nil {
+		return err
+	}
+	// Читатель, вставший в очередь за писателем, получает блокировку после него
+	if !tx4Granted {
+		if err = <-tx4Done; err != nil {
+			return err
+		}
+		if err = tx4.commit(); err != nil {
+			return err
+		}
+	}
+	logger.Info("lock grant order", zap.Strings("order", order))
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+// forUpdateRereadVariant - уровень изоляции tx1 и момент фиксации конкурирующего UPDATE.
+type forUpdateRereadVariant struct {
+	name  string
+	level sql.IsolationLevel
+	// blocked - tx2 фиксируется, пока SELECT FOR UPDATE в tx1 ждет блокировку строки;
+	// иначе tx2 фиксируется до SELECT FOR UPDATE
+	blocked bool
+	// locked - баланс, который возвращает SELECT FOR UPDATE; 0 - ожидается ошибка code
+	locked int64
+	code   string
+	// balance - итоговый баланс person 1
+	balance int64
+}
+
+var forUpdateRereadVariants = []forUpdateRereadVariant{
+	// Новый снимок оператора видит зафиксированную версию строки
+	{name: "read_committed", level: sql.LevelReadCommitted, locked: 500, balance: 400},
+	// После ожидания блокировки строка перечитывается в последней версии (EvalPlanQual)
+	{name: "read_committed_blocked", level: sql.LevelReadCommitted, blocked: true, locked: 500, balance: 400},
+	// Строка изменена после снимка транзакции: блокировка невозможна без нарушения снимка
+	{name: "repeatable_read", level: sql.LevelRepeatableRead, code: "40001", balance: 500},
+	{name: "repeatable_read_blocked", level: sql.LevelRepeatableRead, blocked: true, code: "40001", balance: 500},
+}
+
+// forUpdateReread показывает, что при READ COMMITTED SELECT FOR UPDATE внутри
+// транзакции возвращает более новую версию строки, чем обычный SELECT той же
+// транзакции: tx1 видит баланс 1000, а заблокированная строка уже содержит 500.
+// Решение, принятое по первому чтению, становится несогласованным с
+// заблокированными данными. REPEATABLE READ вместо этого прерывает tx1 ошибкой
+// сериализации.
+func forUpdateReread(db *sqlx.DB, logger *zap.Logger) error {
+	for _, v := range forUpdateRereadVariants {
+		if err := migrate(db, logger, personMigrations); err != nil {
+			return err
+		}
+		if err := runForUpdateRereadVariant(db, logger.With(zap.String("variant", v.name)), v); err != nil {
+			return fmt.Errorf("%s: %w", v.name, err)
+		}
+	}
+	return nil
+}
+
+func runForUpdateRereadVariant(db *sqlx.DB, logger *zap.Logger, v forUpdateRereadVariant) (err error) {
+	// Проверка баланса после завершения транзакций: списание tx1 выполнено от
+	// заблокированной версии строки или отклонено
+	defer verifyFinalBalance(db, logger, &err, 1, v.balance)
+
+	// Запуск транзакций
+	tx1 := newTransaction(db, logger.With(zap.String("tx", "tx1")))
+	if err = tx1.begin(); err != nil {
+		return err
+	}
+	if err = tx1.setLevel(v.level); err != nil {
+		return err
+	}
+	tx2 := newTransaction(db, logger.With(zap.String("tx", "tx2")))
+	if err = tx2.begin(); err != nil {
+		return err
+	}
+
+	// Обычное чтение в 1 транзакции
+	seen, err := tx1.queryBalance("SELECT balance FROM person WHERE id = $1;", 1)
+	if err != nil {
+		return err
+	}
+
+	// 2 транзакция меняет баланс
+	if err = tx2.updateUser(1, 500); err != nil {
+		return err
+	}
+	if !v.blocked {
+		if err = tx2.commit(); err != nil {
+			return err
+		}
+	}
+
+	// Чтение с блокировкой в 1 транзакции; в варианте blocked оно ждет tx2
+	var locked int64
+	pid, err := tx1.backendPID()
+	if err != nil {
+		return err
+	}
+	lockDone := runAsync(func() error {
+		var err error
+		locked, err = tx1.queryBalance("SELECT balance FROM person WHERE id = $1 FOR UPDATE;", 1)
+		return err
+	})
+	if v.blocked {
+		ok, err := finished(tx1, pid, lockDone)
+		if !ok && err != nil {
+			return err
+		}
+		if ok {
+			return fmt.Errorf("SELECT FOR UPDATE did not wait for tx2: %v", err)
+		}
+		ignoreError(logger, "print locks", printLocks(monitorDB(db), logger))
+		if err = tx2.commit(); err != nil {
+			return err
+		}
+	}
+	if err = <-lockDone; err != nil {
+		tx1.logger.Info("lock rejected", zap.String("code", errorCode(err)))
+		if errorCode(err) != v.code {
+			return err
+		}
+		return tx1.rollback()
+	}
+	if v.code != "" {
+		return fmt.Errorf("expected error %s, SELECT FOR UPDATE returned balance %d", v.code, locked)
+	}
+
+	logger.Info("row versions within one transaction",
+		zap.Int64("plain_select", seen), zap.Int64("select_for_update", locked), zap.Bool("inconsistent", seen != locked))
+	if locked != v.locked {
+		return fmt.Errorf("SELECT FOR UPDATE returned balance %d, expected %d", locked, v.locked)
+	}
+
+	// Списание от заблокированной версии строки
+	if _, err = tx1.withdraw(1, 100); err != nil {
+		return err
+	}
+	return tx1.commit()
+}
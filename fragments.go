@@ -0,0 +1,101 @@
+package main
+
+import (
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+// Фрагменты - повторяющиеся части сценариев с двумя транзакциями над person.
+// Сценарий собирается из них так:
+//
+//	func scenario(db *sqlx.DB, logger *zap.Logger) (err error) {
+//		defer verifyFinalBalance(db, logger, &err, 1, 10)
+//		tx1, tx2, err := beginPair(db, logger, sql.LevelReadCommitted)
+//		if err != nil {
+//			return err
+//		}
+//		if err = tx1.writeAndCommit(1, 100_000); err != nil {
+//			return err
+//		}
+//		...
+//		return commitPair(tx1, tx2)
+//	}
+//
+// Сценарий, в котором сервер может отклонить одну из транзакций, завершается
+// concurrentCommitPair.
+
+// beginTx начинает транзакцию name на уровне level.
+func beginTx(db *sqlx.DB, logger *zap.Logger, name string, level sql.IsolationLevel) (*transaction, error) {
+	t := newTransaction(db, logger.With(zap.String("tx", name)))
+	if err := t.begin(); err != nil {
+		return nil, err
+	}
+	if err := t.setLevel(level); err != nil {
+		ignoreError(t.logger, "rollback", t.rollback())
+		return nil, err
+	}
+	return t, nil
+}
+
+// beginPair начинает транзакции tx1 и tx2 на уровне level, tx1 - первой.
+func beginPair(db *sqlx.DB, logger *zap.Logger, level sql.IsolationLevel) (tx1, tx2 *transaction, err error) {
+	if tx1, err = beginTx(db, logger, "tx1", level); err != nil {
+		return nil, nil, err
+	}
+	if tx2, err = beginTx(db, logger, "tx2", level); err != nil {
+		// tx1 уже открыта, и вызывающий ее не получит
+		ignoreError(tx1.logger, "rollback", tx1.rollback())
+		return nil, nil, err
+	}
+	return tx1, tx2, nil
+}
+
+// commitPair фиксирует первую транзакцию, затем вторую.
+func commitPair(first, second *transaction) error {
+	if err := first.commit(); err != nil {
+		return err
+	}
+	return second.commit()
+}
+
+// concurrentCommitPair фиксирует конкурирующие транзакции first и second по
+// очереди и сообщает, зафиксированы ли обе. Отказ сервера зафиксировать одну
+// из них из-за конфликта (Retryable) - исход сценария, а не ошибка.
+func concurrentCommitPair(first, second *transaction) (bool, error) {
+	committed1, err := hermitageCommit(first)
+	if err != nil {
+		return false, err
+	}
+	committed2, err := hermitageCommit(second)
+	if err != nil {
+		return false, err
+	}
+	return committed1 && committed2, nil
+}
+
+// verifyFinalBalance проверяет через монитор баланс пользователя id после
+// шагов сценария; вызывается через defer с именованным результатом, как
+// checkPostconditions.
+func verifyFinalBalance(db *sqlx.DB, logger *zap.Logger, err *error, id int, want int64) {
+	checkPostconditions(db, logger, err, expectBalance(id, want))
+}
+
+// writeAndCommit записывает баланс пользователя и фиксирует транзакцию.
+func (t *transaction) writeAndCommit(id, balance int) error {
+	if err := t.updateUser(id, balance); err != nil {
+		return err
+	}
+	return t.commit()
+}
+
+// readBalance выводит баланс пользователя в каждой из транзакций по очереди.
+func readBalance(id int, txs ...*transaction) error {
+	for _, t := range txs {
+		if err := t.printUserBalance(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
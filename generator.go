@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"go.starlark.net/starlark"
+)
+
+// dataSeed - начальное значение генераторов данных: одинаковый seed дает
+// одинаковые данные нагрузок и сгенерированных таблиц.
+var dataSeed int64 = 1
+
+// zipfExponent - перекос распределения zipf: ключ 1 выбирается чаще всех.
+const zipfExponent = 1.1
+
+var (
+	fixtureFirstNames = []string{"alice", "bob", "carol", "dave", "erin", "frank", "grace", "heidi", "ivan", "judy", "mallory", "oscar", "peggy", "trent", "victor", "walter"}
+	fixtureLastNames  = []string{"ivanov", "smirnov", "kuznetsov", "popov", "sokolov", "lebedev", "kozlov", "novikov", "morozov", "petrov", "volkov", "solovyov"}
+	fixtureDomains    = []string{"example.com", "example.org", "example.net"}
+)
+
+// generator выдает детерминированную последовательность значений для seed.
+// Генератор не безопасен для параллельного использования: каждому worker - свой.
+type generator struct {
+	rng   *rand.Rand
+	zipfs map[int64]*rand.Zipf
+}
+
+// newGenerator создает генератор, последовательность которого зависит только
+// от parts, например от dataSeed, номера worker и номера итерации.
+func newGenerator(parts ...int64) *generator {
+	var seed uint64
+	for _, p := range parts {
+		seed = splitmix64(seed ^ uint64(p))
+	}
+	return &generator{rng: rand.New(rand.NewSource(int64(seed))), zipfs: make(map[int64]*rand.Zipf)}
+}
+
+// splitmix64 перемешивает биты, чтобы соседние seed давали несвязанные последовательности.
+func splitmix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// generatorField выдает одно значение; n - верхняя граница числовых полей.
+type generatorField func(g *generator, n int64) any
+
+// generatorFields - поля, доступные по имени в gen(field, n). Новое поле
+// достаточно добавить сюда.
+var generatorFields = map[string]generatorField{
+	// name - имя и фамилия из фикстур
+	"name": func(g *generator, _ int64) any {
+		return pick(g, fixtureFirstNames) + " " + pick(g, fixtureLastNames)
+	},
+	// email - адрес с числовым суффиксом, уникальный с высокой вероятностью
+	"email": func(g *generator, _ int64) any {
+		return fmt.Sprintf("%s.%s%d@%s", pick(g, fixtureFirstNames), pick(g, fixtureLastNames), g.rng.Intn(10000), pick(g, fixtureDomains))
+	},
+	// uuid - идентификатор в формате UUID версии 4
+	"uuid": func(g *generator, _ int64) any {
+		var b [16]byte
+		g.rng.Read(b[:])
+		b[6] = b[6]&0x0f | 0x40
+		b[8] = b[8]&0x3f | 0x80
+		return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+	},
+	// uniform - ключ от 1 до n с равными вероятностями
+	"uniform": func(g *generator, n int64) any {
+		return g.rng.Int63n(n) + 1
+	},
+	// zipf - ключ от 1 до n, малые ключи выбираются чаще: горячие строки нагрузки
+	"zipf": func(g *generator, n int64) any {
+		z, ok := g.zipfs[n]
+		if !ok {
+			z = rand.NewZipf(g.rng, zipfExponent, 1, uint64(n-1))
+			g.zipfs[n] = z
+		}
+		return int64(z.Uint64()) + 1
+	},
+	// balance - сумма от 0 до n; при -balance-type numeric - с копейками
+	"balance": func(g *generator, n int64) any {
+		if balanceType == balanceNumeric {
+			return float64(g.rng.Int63n(n*100+1)) / 100
+		}
+		return g.rng.Int63n(n + 1)
+	},
+}
+
+func pick(g *generator, list []string) string {
+	return list[g.rng.Intn(len(list))]
+}
+
+// value возвращает следующее значение поля field.
+func (g *generator) value(field string, n int64) (any, error) {
+	f, ok := generatorFields[field]
+	if !ok {
+		return nil, fmt.Errorf("unknown generator field %q, expected one of %s", field, strings.Join(generatorFieldNames(), ", "))
+	}
+	switch field {
+	case "uniform", "zipf", "balance":
+		if n < 1 {
+			return nil, fmt.Errorf("generator field %s requires a positive bound, got %d", field, n)
+		}
+	}
+	return f(g, n), nil
+}
+
+func generatorFieldNames() []string {
+	names := make([]string, 0, len(generatorFields))
+	for name := range generatorFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// builtin возвращает функцию Starlark gen(field, n=0) для скриптов и args шаблонов.
+func (g *generator) builtin() *starlark.Builtin {
+	return starlark.NewBuiltin("gen", func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var field string
+		var n int64
+		if err := starlark.UnpackArgs(b.Name(), args, kwargs, "field", &field, "n?", &n); err != nil {
+			return nil, err
+		}
+		v, err := g.value(field, n)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", b.Name(), err)
+		}
+		return toStarlark(v), nil
+	})
+}
+
+// sqlUniform возвращает SQL выражение с детерминированным значением от 0 до
+// n-1 для строки key: большие таблицы заполняются на сервере, без передачи
+// значений, и при одинаковом dataSeed получают одинаковые данные.
+func sqlUniform(key string, n int64) string {
+	return fmt.Sprintf("(hashint8extended((%s)::BIGINT, %d) & x'7fffffffffffffff'::BIGINT) %% %d", key, dataSeed, n)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+const ginItems = 10000
+
+var ginMigrations = []string{
+	`DROP TABLE IF EXISTS item;`,
+	`CREATE TABLE item (
+           id SERIAL PRIMARY KEY,
+           tags TEXT[] NOT NULL
+         );`,
+	fmt.Sprintf(`INSERT INTO item (tags) SELECT ARRAY['tag' || g] FROM generate_series(1, %d) AS g;`, ginItems),
+}
+
+// ginVariant - индекс, по которому транзакции ищут строки со своей меткой.
+type ginVariant struct {
+	name string
+	// index - определение индекса по tags, пусто - без индекса
+	index string
+	// committed - сколько транзакций успешно фиксируется
+	committed int
+}
+
+var ginVariants = []ginVariant{
+	// Последовательное сканирование блокирует всю таблицу
+	{name: "seq_scan", committed: 1},
+	// Поиск блокирует страницы дерева GIN с искомым ключом, вставка проверяет
+	// страницу, куда попадает ее ключ: далекие ключи лежат на разных страницах
+	{name: "gin", index: `CREATE INDEX item_tags ON item USING GIN (tags) WITH (fastupdate = off);`, committed: 2},
+	// Вставка в список ожидания GIN проверяет метастраницу индекса, которую
+	// блокирует любой поиск: для SSI это равносильно блокировке всего индекса
+	{name: "gin_fastupdate", index: `CREATE INDEX item_tags ON item USING GIN (tags) WITH (fastupdate = on);`, committed: 1},
+}
+
+// ginPredicateLocks показывает предикатные блокировки SERIALIZABLE с индексом
+// GIN. Каждая транзакция считает строки со своей меткой и добавляет еще одну:
+// метки разные, и транзакции логически не конфликтуют. Без индекса и с
+// fastupdate одна из них прерывается ошибкой сериализации, с fastupdate = off
+// блокировки страниц дерева GIN разделяют их, и фиксируются обе.
+func ginPredicateLocks(db *sqlx.DB, logger *zap.Logger) error {
+	for _, v := range ginVariants {
+		if err := runGINVariant(db, logger.With(zap.String("variant", v.name)), v); err != nil {
+			return fmt.Errorf("%s: %w", v.name, err)
+		}
+	}
+	return nil
+}
+
+func runGINVariant(db *sqlx.DB, logger *zap.Logger, v ginVariant) (err error) {
+	prepare := []string{
+		fmt.Sprintf(`DELETE FROM item WHERE id > %d;`, ginItems),
+		`DROP INDEX IF EXISTS item_tags;`,
+	}
+	if v.index != "" {
+		prepare = append(prepare, v.index)
+	}
+	prepare = append(prepare, `ANALYZE item;`)
+	if err = migrate(db, logger, prepare); err != nil {
+		return err
+	}
+
+	// Проверка числа строк после завершения транзакций
+	defer checkPostconditions(db, logger, &err,
+		expectValue("items", "SELECT COUNT(*) FROM item;", ginItems+v.committed))
+
+	// Запуск транзакций; enable_seqscan = off исключает выбор сканирования таблицы по статистике
+	tx1 := newTransaction(db, logger.With(zap.String("tx", "tx1")))
+	if err = tx1.begin(); err != nil {
+		return err
+	}
+	if err = tx1.setLevel(sql.LevelSerializable); err != nil {
+		return err
+	}
+	tx2 := newTransaction(db, logger.With(zap.String("tx", "tx2")))
+	if err = tx2.begin(); err != nil {
+		return err
+	}
+	if err = tx2.setLevel(sql.LevelSerializable); err != nil {
+		return err
+	}
+	steps := []struct {
+		t   *transaction
+		tag string
+	}{{tx1, "tag1"}, {tx2, fmt.Sprintf("tag%d", ginItems)}}
+	if v.index != "" {
+		for _, step := range steps {
+			if err = step.t.setLocal("enable_seqscan", "off"); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Каждая транзакция читает строки только со своей меткой
+	for _, step := range steps {
+		rows, err := step.t.query("SELECT COUNT(*) FROM item WHERE tags @> ARRAY[$1::text];", step.tag)
+		if err != nil {
+			return err
+		}
+		step.t.logger.Info("items counted", zap.String("tag", step.tag), zap.Any("count", rows[0][0]))
+	}
+	if err = printPredicateLocks(tx1); err != nil {
+		return err
+	}
+	aborted := make(map[*transaction]bool)
+	for _, step := range steps {
+		if _, err = step.t.exec("INSERT INTO item (tags) VALUES (ARRAY[$1::text]);", step.tag); err != nil {
+			step.t.logger.Info("insert rejected", zap.String("code", errorCode(err)))
+			if errorCode(err) != "40001" {
+				return err
+			}
+			if err = step.t.rollback(); err != nil {
+				return err
+			}
+			aborted[step.t] = true
+		}
+	}
+
+	// Фиксация; при конфликте прерывается транзакция, фиксирующаяся второй
+	for _, step := range steps {
+		if aborted[step.t] {
+			continue
+		}
+		if err = step.t.commit(); err != nil {
+			if errorCode(err) != "40001" {
+				return err
+			}
+			step.t.logger.Info("commit rejected", zap.String("code", errorCode(err)))
+		}
+	}
+	return nil
+}
@@ -3,9 +3,21 @@ module transactionIsolation
 go 1.22
 
 require (
+	github.com/fsnotify/fsnotify v1.7.0
 	github.com/jmoiron/sqlx v1.3.5
 	github.com/lib/pq v1.2.0
+	github.com/mattn/go-sqlite3 v1.14.22
+	github.com/nats-io/nats.go v1.37.0
+	go.starlark.net v0.0.0-20231121155337-90ade8b19d09
 	go.uber.org/zap v1.27.0
+	golang.org/x/crypto v0.18.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
-require go.uber.org/multierr v1.10.0 // indirect
+require (
+	github.com/klauspost/compress v1.18.0 // indirect
+	github.com/nats-io/nkeys v0.4.7 // indirect
+	github.com/nats-io/nuid v1.0.1 // indirect
+	go.uber.org/multierr v1.10.0 // indirect
+	golang.org/x/sys v0.20.0 // indirect
+)
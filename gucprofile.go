@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// gucProfile - параметры сервера, которые транзакция устанавливает через
+// SET LOCAL сразу после begin: имя параметра -> значение.
+type gucProfile map[string]string
+
+// gucAny в файле профилей означает любой сценарий или любую транзакцию.
+const gucAny = "*"
+
+// gucProfiles - профили из файла -guc-profiles: сценарий -> транзакция ->
+// параметры. Профиль закрепляет форму плана, например enable_indexscan = off
+// для tx1, от которой зависят предикатные блокировки и ложные конфликты SSI,
+// чтобы сценарий одинаково воспроизводился на серверах с разной статистикой
+// и настройками:
+//
+//	ssi_false_positive:
+//	  tx1: {enable_indexscan: "off", enable_bitmapscan: "off"}
+//	"*":
+//	  "*": {random_page_cost: "1.1"}
+var gucProfiles map[string]map[string]gucProfile
+
+// loadGUCProfiles читает файл профилей -guc-profiles.
+func loadGUCProfiles(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var profiles map[string]map[string]gucProfile
+	if err = yaml.Unmarshal(data, &profiles); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for scenario, txs := range profiles {
+		for tx, profile := range txs {
+			if err = profile.validate(); err != nil {
+				return fmt.Errorf("%s: %s.%s: %w", path, scenario, tx, err)
+			}
+		}
+	}
+	gucProfiles = profiles
+	return nil
+}
+
+func (p gucProfile) validate() error {
+	for name := range p {
+		if name == "" || strings.ContainsAny(name, " \t\n;'\"") {
+			return fmt.Errorf("invalid parameter name %q", name)
+		}
+	}
+	return nil
+}
+
+// merge возвращает параметры p, дополненные и переопределенные параметрами override.
+func (p gucProfile) merge(override gucProfile) gucProfile {
+	if len(override) == 0 {
+		return p
+	}
+	merged := make(gucProfile, len(p)+len(override))
+	for name, value := range p {
+		merged[name] = value
+	}
+	for name, value := range override {
+		merged[name] = value
+	}
+	return merged
+}
+
+// names возвращает имена параметров по алфавиту: порядок SET LOCAL одинаков
+// от запуска к запуску.
+func (p gucProfile) names() []string {
+	names := make([]string, 0, len(p))
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// setLocalSQL возвращает операторы SET LOCAL профиля, каждый с новой строки.
+func (p gucProfile) setLocalSQL() string {
+	var b strings.Builder
+	for _, name := range p.names() {
+		fmt.Fprintf(&b, "\nSET LOCAL %s = %s;", pq.QuoteIdentifier(name), pq.QuoteLiteral(p[name]))
+	}
+	return b.String()
+}
+
+// gucProfileFor возвращает параметры транзакции tx сценария scenario:
+// settings, заданные самим сценарием, затем профили файла от общих к
+// частным - "*"."*", "*".tx, scenario."*", scenario.tx.
+func gucProfileFor(scenario, tx string, settings gucProfile) gucProfile {
+	profile := settings
+	for _, s := range []string{gucAny, scenario} {
+		for _, t := range []string{gucAny, tx} {
+			profile = profile.merge(gucProfiles[s][t])
+		}
+	}
+	return profile
+}
+
+// applyGUCProfile устанавливает параметры профиля транзакции. Параметры,
+// которые сценарий меняет сам через setLocal после begin, переопределяют профиль.
+func (t *transaction) applyGUCProfile() error {
+	var scenario, tx string
+	if t.tag != nil {
+		scenario, tx = t.tag.scenario, t.tag.tx
+	}
+	profile := gucProfileFor(scenario, tx, t.settings)
+	for _, name := range profile.names() {
+		if err := t.setLocal(name, profile[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkGUCProfiles проверяет, что сценарии профилей зарегистрированы, а
+// параметры есть на сервере: на сервере другой версии профиль с неизвестным
+// параметром иначе прервал бы каждую транзакцию сценария. Параметры с точкой
+// в имени - параметры расширений и пользовательские, сервер их не проверяет.
+func checkGUCProfiles(db *sqlx.DB, logger *zap.Logger) error {
+	if len(gucProfiles) == 0 {
+		return nil
+	}
+	var known []string
+	if err := db.Select(&known, "SELECT name FROM pg_settings;"); err != nil {
+		logger.Error("failed to read server settings", zap.Error(err))
+		return err
+	}
+	settings := make(map[string]bool, len(known))
+	for _, name := range known {
+		settings[name] = true
+	}
+	for scenario, txs := range gucProfiles {
+		if _, ok := isolationProblems[scenario]; !ok && scenario != gucAny {
+			return fmt.Errorf("guc profile: unknown scenario %q", scenario)
+		}
+		for tx, profile := range txs {
+			for name := range profile {
+				if !strings.Contains(name, ".") && !settings[strings.ToLower(name)] {
+					return fmt.Errorf("guc profile %s.%s: unknown parameter %q", scenario, tx, name)
+				}
+			}
+		}
+	}
+	logger.Info("guc profiles loaded", zap.Int("scenarios", len(gucProfiles)))
+	return nil
+}
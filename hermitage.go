@@ -0,0 +1,359 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+// Порт тестов Hermitage (https://github.com/ept/hermitage) для PostgreSQL.
+// Каждый тест регистрируется отдельным сценарием для каждого уровня изоляции:
+// hermitage/<тест>/<уровень>. Сценарий завершается ошибкой, если наличие
+// аномалии не совпадает с ожидаемым для уровня.
+
+var hermitageMigrations = []string{
+	`DROP TABLE IF EXISTS test;`,
+	`CREATE TABLE test (
+           id INT PRIMARY KEY,
+           value INT NOT NULL
+         );`,
+	`INSERT INTO test VALUES (1, 10), (2, 20);`,
+}
+
+var hermitageLevels = []sql.IsolationLevel{
+	sql.LevelReadCommitted,
+	sql.LevelRepeatableRead,
+	sql.LevelSerializable,
+}
+
+// hermitageTest - тест Hermitage: run выполняет шаги двух транзакций и
+// сообщает, наблюдалась ли аномалия.
+type hermitageTest struct {
+	name        string
+	description string
+	// anomaly - уровни, на которых PostgreSQL допускает аномалию
+	anomaly map[sql.IsolationLevel]bool
+	run     func(t1, t2 *transaction) (bool, error)
+}
+
+var hermitageTests = []hermitageTest{
+	{name: "g0", description: "write cycles", run: hermitageG0},
+	{name: "g1a", description: "aborted reads", run: hermitageG1a},
+	{name: "g1b", description: "intermediate reads", run: hermitageG1b},
+	{name: "g1c", description: "circular information flow", run: hermitageG1c},
+	{name: "g_single", description: "read skew",
+		anomaly: map[sql.IsolationLevel]bool{sql.LevelReadCommitted: true},
+		run:     hermitageGSingle},
+	{name: "g2_item", description: "write skew",
+		anomaly: map[sql.IsolationLevel]bool{sql.LevelReadCommitted: true, sql.LevelRepeatableRead: true},
+		run:     hermitageG2Item},
+	{name: "g2", description: "anti-dependency cycles",
+		anomaly: map[sql.IsolationLevel]bool{sql.LevelReadCommitted: true, sql.LevelRepeatableRead: true},
+		run:     hermitageG2},
+	{name: "pmp", description: "predicate-many-preceders",
+		anomaly: map[sql.IsolationLevel]bool{sql.LevelReadCommitted: true},
+		run:     hermitagePMP},
+}
+
+// hermitageScenarios возвращает сценарии всех тестов Hermitage для всех уровней.
+func hermitageScenarios() map[string]scenario {
+	scenarios := make(map[string]scenario, len(hermitageTests)*len(hermitageLevels))
+	for _, test := range hermitageTests {
+		for _, level := range hermitageLevels {
+			name := "hermitage/" + test.name + "/" + strings.ReplaceAll(strings.ToLower(level.String()), " ", "_")
+			anomaly := test.anomaly[level]
+			scenarios[name] = scenario{level: level, migrations: hermitageMigrations, problem: hermitageProblem(test, level), namespace: "hermitage",
+				description: "Hermitage " + test.name + ": " + test.description, tags: []string{"hermitage", test.name}, anomaly: &anomaly}
+		}
+	}
+	return scenarios
+}
+
+func hermitageProblem(test hermitageTest, level sql.IsolationLevel) isolationProblem {
+	return func(db *sqlx.DB, logger *zap.Logger) error {
+		logger = logger.With(zap.String("anomaly", test.description))
+
+		// Запуск транзакций
+		t1 := newTransaction(db, logger.With(zap.String("tx", "tx1")))
+		if err := t1.begin(); err != nil {
+			return err
+		}
+		if err := t1.setLevel(level); err != nil {
+			return err
+		}
+		t2 := newTransaction(db, logger.With(zap.String("tx", "tx2")))
+		if err := t2.begin(); err != nil {
+			return err
+		}
+		if err := t2.setLevel(level); err != nil {
+			return err
+		}
+
+		anomaly, err := test.run(t1, t2)
+		if err != nil {
+			return err
+		}
+		expected := test.anomaly[level]
+		logger.Info("hermitage result", zap.Bool("anomaly", anomaly), zap.Bool("expected", expected))
+		if anomaly != expected {
+			return fmt.Errorf("%s at %s: anomaly %t, expected %t", test.name, level, anomaly, expected)
+		}
+		return nil
+	}
+}
+
+func hermitageRead(t *transaction, id int) (int64, error) {
+	rows, err := t.query("SELECT value FROM test WHERE id = $1;", id)
+	if err != nil {
+		return 0, err
+	}
+	value := rows[0][0].(int64)
+	t.logger.Info("value read", zap.Int("id", id), zap.Int64("value", value))
+	return value, nil
+}
+
+func hermitageWrite(t *transaction, id, value int) error {
+	_, err := t.exec("UPDATE test SET value = $1 WHERE id = $2;", value, id)
+	return err
+}
+
+// hermitageAbort откатывает транзакцию, прерванную сервером из-за конфликта.
+// Прочие ошибки возвращаются без изменений.
+func hermitageAbort(t *transaction, err error) error {
+	if !classifyError(err).Retryable {
+		return err
+	}
+	t.logger.Info("tx aborted by server", zap.String("code", errorCode(err)))
+	return t.rollback()
+}
+
+// hermitageCommit фиксирует транзакцию и сообщает, удалось ли это.
+func hermitageCommit(t *transaction) (bool, error) {
+	err := t.commit()
+	if err == nil {
+		return true, nil
+	}
+	if classifyError(err).Retryable {
+		t.logger.Info("commit rejected", zap.String("code", errorCode(err)))
+		return false, nil
+	}
+	return false, err
+}
+
+// G0: запись 2 транзакции ждет 1, итоговые значения должны принадлежать одной транзакции.
+func hermitageG0(t1, t2 *transaction) (bool, error) {
+	if err := hermitageWrite(t1, 1, 11); err != nil {
+		return false, err
+	}
+	pid, err := t2.backendPID()
+	if err != nil {
+		return false, err
+	}
+	t2Done := runAsync(func() error {
+		return hermitageWrite(t2, 1, 12)
+	})
+	if err = waitBlocked(t2, pid, t2Done); err != nil {
+		return false, err
+	}
+	if err := hermitageWrite(t1, 2, 21); err != nil {
+		return false, err
+	}
+	if err := t1.commit(); err != nil {
+		return false, err
+	}
+	err = <-t2Done
+	if err == nil {
+		err = hermitageWrite(t2, 2, 22)
+	}
+	if err != nil {
+		if err = hermitageAbort(t2, err); err != nil {
+			return false, err
+		}
+	} else if _, err = hermitageCommit(t2); err != nil {
+		return false, err
+	}
+
+	var values []int64
+	if err = t1.db.Select(&values, "SELECT value FROM test ORDER BY id;"); err != nil {
+		return false, err
+	}
+	t1.logger.Info("final values", zap.Int64s("values", values))
+	consistent := values[0] == 11 && values[1] == 21 || values[0] == 12 && values[1] == 22
+	return !consistent, nil
+}
+
+// G1a: 2 транзакция не должна видеть запись откаченной 1 транзакции.
+func hermitageG1a(t1, t2 *transaction) (bool, error) {
+	if err := hermitageWrite(t1, 1, 101); err != nil {
+		return false, err
+	}
+	before, err := hermitageRead(t2, 1)
+	if err != nil {
+		return false, err
+	}
+	if err = t1.rollback(); err != nil {
+		return false, err
+	}
+	after, err := hermitageRead(t2, 1)
+	if err != nil {
+		return false, err
+	}
+	if err = t2.commit(); err != nil {
+		return false, err
+	}
+	return before == 101 || after == 101, nil
+}
+
+// G1b: 2 транзакция не должна видеть промежуточное значение 1 транзакции.
+func hermitageG1b(t1, t2 *transaction) (bool, error) {
+	if err := hermitageWrite(t1, 1, 101); err != nil {
+		return false, err
+	}
+	before, err := hermitageRead(t2, 1)
+	if err != nil {
+		return false, err
+	}
+	if err = hermitageWrite(t1, 1, 11); err != nil {
+		return false, err
+	}
+	if err = t1.commit(); err != nil {
+		return false, err
+	}
+	after, err := hermitageRead(t2, 1)
+	if err != nil {
+		return false, err
+	}
+	if err = t2.commit(); err != nil {
+		return false, err
+	}
+	return before == 101 || after == 101, nil
+}
+
+// G1c: транзакции не должны видеть незафиксированные записи друг друга.
+func hermitageG1c(t1, t2 *transaction) (bool, error) {
+	if err := hermitageWrite(t1, 1, 11); err != nil {
+		return false, err
+	}
+	if err := hermitageWrite(t2, 2, 22); err != nil {
+		return false, err
+	}
+	v2, err := hermitageRead(t1, 2)
+	if err != nil {
+		return false, err
+	}
+	v1, err := hermitageRead(t2, 1)
+	if err != nil {
+		return false, err
+	}
+	if err = t1.commit(); err != nil {
+		return false, err
+	}
+	if err = t2.commit(); err != nil {
+		return false, err
+	}
+	return v2 == 22 || v1 == 11, nil
+}
+
+// G-single: 1 транзакция читает строки до и после фиксации 2, сумма расходится.
+func hermitageGSingle(t1, t2 *transaction) (bool, error) {
+	v1, err := hermitageRead(t1, 1)
+	if err != nil {
+		return false, err
+	}
+	if _, err = hermitageRead(t2, 1); err != nil {
+		return false, err
+	}
+	if _, err = hermitageRead(t2, 2); err != nil {
+		return false, err
+	}
+	if err = hermitageWrite(t2, 1, 12); err != nil {
+		return false, err
+	}
+	if err = hermitageWrite(t2, 2, 18); err != nil {
+		return false, err
+	}
+	if err = t2.commit(); err != nil {
+		return false, err
+	}
+	v2, err := hermitageRead(t1, 2)
+	if err != nil {
+		return false, err
+	}
+	if err = t1.commit(); err != nil {
+		return false, err
+	}
+	return v1+v2 != 30, nil
+}
+
+// G2-item: обе транзакции читают обе строки и изменяют разные, фиксация обеих - аномалия.
+func hermitageG2Item(t1, t2 *transaction) (bool, error) {
+	for _, t := range []*transaction{t1, t2} {
+		for _, id := range []int{1, 2} {
+			if _, err := hermitageRead(t, id); err != nil {
+				return false, err
+			}
+		}
+	}
+	if err := hermitageWrite(t1, 1, 11); err != nil {
+		return false, err
+	}
+	if err := hermitageWrite(t2, 2, 21); err != nil {
+		return false, hermitageAbort(t2, err)
+	}
+	return concurrentCommitPair(t1, t2)
+}
+
+// G2: обе транзакции проверяют предикат и вставляют строки, ему удовлетворяющие.
+func hermitageG2(t1, t2 *transaction) (bool, error) {
+	const predicateQuery = "SELECT id, value FROM test WHERE value % 3 = 0;"
+	for _, t := range []*transaction{t1, t2} {
+		rows, err := t.query(predicateQuery)
+		if err != nil {
+			return false, err
+		}
+		t.logger.Info("predicate read", zap.Int("rows", len(rows)))
+	}
+	if _, err := t1.exec("INSERT INTO test VALUES ($1, $2);", 3, 30); err != nil {
+		return false, err
+	}
+	if _, err := t2.exec("INSERT INTO test VALUES ($1, $2);", 4, 42); err != nil {
+		return false, hermitageAbort(t2, err)
+	}
+	return concurrentCommitPair(t1, t2)
+}
+
+// hermitageRow - строка таблицы test.
+type hermitageRow struct {
+	ID    int `db:"id"`
+	Value int `db:"value"`
+}
+
+// PMP: повторное чтение по предикату видит строку, вставленную другой транзакцией после первого чтения.
+func hermitagePMP(t1, t2 *transaction) (bool, error) {
+	const predicateQuery = "SELECT id, value FROM test WHERE value % 3 = 0 ORDER BY id;"
+	var before, after []hermitageRow
+	if err := t1.selectRows(&before, predicateQuery); err != nil {
+		return false, err
+	}
+	if _, err := t2.exec("INSERT INTO test VALUES ($1, $2);", 3, 30); err != nil {
+		return false, err
+	}
+	if err := t2.commit(); err != nil {
+		return false, err
+	}
+	if err := t1.selectRows(&after, predicateQuery); err != nil {
+		return false, err
+	}
+	if err := t1.commit(); err != nil {
+		return false, err
+	}
+	appeared := false
+	for _, row := range after {
+		appeared = appeared || row.ID == 3
+	}
+	t1.logger.Info("predicate reread", zap.Any("before", before), zap.Any("after", after), zap.Bool("appeared", appeared))
+	return appeared, nil
+}
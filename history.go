@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"go.uber.org/zap"
+)
+
+const (
+	verdictOK      = "ok"
+	verdictError   = "error"
+	verdictSkipped = "skipped"
+	verdictTimeout = "timeout"
+	// verdictXFail и verdictXPass - ожидаемая аннотацией xfail ошибка и
+	// успешный запуск вопреки ей
+	verdictXFail = "xfail"
+	verdictXPass = "xpass"
+)
+
+// runResult описывает результат одного запуска сценария.
+type runResult struct {
+	// Metadata - условия запуска, в историю не сохраняется
+	Metadata      *runMetadata `db:"-" json:"metadata,omitempty"`
+	StartedAt     time.Time    `db:"started_at" json:"started_at"`
+	Scenario      string       `db:"scenario" json:"scenario"`
+	Level         string       `db:"level" json:"level"`
+	Backend       string       `db:"backend" json:"backend"`
+	ServerVersion string       `db:"server_version" json:"server_version"`
+	Verdict       string       `db:"verdict" json:"verdict"`
+	MigrationMs   int64        `db:"migration_ms" json:"migration_ms"`
+	DurationMs    int64        `db:"duration_ms" json:"duration_ms"`
+	Error         string       `db:"error" json:"error,omitempty"`
+	// Statements - статистика pg_stat_statements, в историю не сохраняется
+	Statements []statementStat `db:"-" json:"statements,omitempty"`
+}
+
+func newRunResult(name string, s scenario, serverVersion string, started time.Time, migration, duration time.Duration, err error) runResult {
+	result := runResult{
+		StartedAt:     started,
+		Scenario:      name,
+		Level:         s.level.String(),
+		Backend:       backendPostgres,
+		ServerVersion: serverVersion,
+		Verdict:       verdictOK,
+		MigrationMs:   migration.Milliseconds(),
+		DurationMs:    duration.Milliseconds(),
+	}
+	if err != nil {
+		result.Verdict = verdictError
+		switch {
+		case errors.Is(err, errScenarioSkipped):
+			result.Verdict = verdictSkipped
+		case errors.Is(err, errScenarioTimeout):
+			result.Verdict = verdictTimeout
+		case errors.Is(err, errExpectedFailure):
+			result.Verdict = verdictXFail
+		case errors.Is(err, errUnexpectedPass):
+			result.Verdict = verdictXPass
+		}
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// history хранит результаты запусков в локальном файле SQLite.
+type history struct {
+	db     *sqlx.DB
+	logger *zap.Logger
+}
+
+func openHistory(path string, logger *zap.Logger) (*history, error) {
+	db, err := sqlx.Connect("sqlite3", path)
+	if err != nil {
+		logger.Error("failed to open history", zap.Error(err), zap.String("path", path))
+		return nil, err
+	}
+	// SQLite допускает одного писателя, параллельные сценарии пишут по очереди
+	db.SetMaxOpenConns(1)
+	const createQuery = `CREATE TABLE IF NOT EXISTS run_result (
+           id INTEGER PRIMARY KEY AUTOINCREMENT,
+           started_at TIMESTAMP NOT NULL,
+           scenario TEXT NOT NULL,
+           level TEXT NOT NULL,
+           backend TEXT NOT NULL,
+           server_version TEXT NOT NULL,
+           verdict TEXT NOT NULL,
+           migration_ms INTEGER NOT NULL,
+           duration_ms INTEGER NOT NULL,
+           error TEXT NOT NULL
+         );`
+	if _, err = db.Exec(createQuery); err != nil {
+		logger.Error("failed to create history table", zap.Error(err), zap.String("path", path))
+		ignoreError(logger, "close history", db.Close())
+		return nil, err
+	}
+	logger.Info("history opened", zap.String("path", path))
+	return &history{db: db, logger: logger}, nil
+}
+
+func (h *history) append(r runResult) error {
+	const insertQuery = `INSERT INTO run_result
+           (started_at, scenario, level, backend, server_version, verdict, migration_ms, duration_ms, error)
+         VALUES
+           (:started_at, :scenario, :level, :backend, :server_version, :verdict, :migration_ms, :duration_ms, :error);`
+	if _, err := h.db.NamedExec(insertQuery, r); err != nil {
+		h.logger.Error("failed to append history", zap.Error(err), zap.String("scenario", r.Scenario))
+		return err
+	}
+	h.logger.Info("history appended", zap.String("scenario", r.Scenario), zap.String("verdict", r.Verdict))
+	return nil
+}
+
+func (h *history) close() error {
+	return h.db.Close()
+}
+
+// historyTrend - агрегированные результаты сценария для одной версии сервера.
+type historyTrend struct {
+	Scenario      string  `db:"scenario"`
+	Level         string  `db:"level"`
+	Backend       string  `db:"backend"`
+	ServerVersion string  `db:"server_version"`
+	Runs          int     `db:"runs"`
+	Errors        int     `db:"errors"`
+	AvgMs         float64 `db:"avg_ms"`
+	MaxMs         int64   `db:"max_ms"`
+	LastRun       string  `db:"last_run"`
+}
+
+func (h *history) trends(scenario string) ([]historyTrend, error) {
+	const trendsQuery = `SELECT scenario, level, backend, server_version,
+           COUNT(*) AS runs,
+           SUM(CASE WHEN verdict IN ('error', 'timeout', 'xpass') THEN 1 ELSE 0 END) AS errors,
+           AVG(duration_ms) AS avg_ms,
+           MAX(duration_ms) AS max_ms,
+           CAST(MAX(started_at) AS TEXT) AS last_run
+         FROM run_result
+         WHERE ?1 = '' OR scenario = ?1
+         GROUP BY scenario, level, backend, server_version
+         ORDER BY scenario, level, backend, server_version;`
+	var trends []historyTrend
+	if err := h.db.Select(&trends, trendsQuery, scenario); err != nil {
+		h.logger.Error("failed to read history", zap.Error(err))
+		return nil, err
+	}
+	return trends, nil
+}
+
+// averageRuns возвращает среднюю длительность запуска сценариев вместе с
+// миграциями. Пропущенные запуски не учитываются: они не выполняют шагов.
+func (h *history) averageRuns() (map[string]time.Duration, error) {
+	const averageQuery = `SELECT scenario, AVG(migration_ms + duration_ms) AS avg_ms
+         FROM run_result
+         WHERE verdict <> 'skipped'
+         GROUP BY scenario;`
+	var rows []struct {
+		Scenario string  `db:"scenario"`
+		AvgMs    float64 `db:"avg_ms"`
+	}
+	if err := h.db.Select(&rows, averageQuery); err != nil {
+		h.logger.Error("failed to read history", zap.Error(err))
+		return nil, err
+	}
+	averages := make(map[string]time.Duration, len(rows))
+	for _, r := range rows {
+		averages[r.Scenario] = time.Duration(r.AvgMs * float64(time.Millisecond))
+	}
+	return averages, nil
+}
+
+func printTrends(w io.Writer, trends []historyTrend) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCENARIO\tLEVEL\tBACKEND\tSERVER\tRUNS\tERRORS\tAVG MS\tMAX MS\tLAST RUN")
+	for _, t := range trends {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%.1f\t%d\t%s\n",
+			t.Scenario, t.Level, t.Backend, t.ServerVersion, t.Runs, t.Errors, t.AvgMs, t.MaxMs, t.LastRun)
+	}
+	return tw.Flush()
+}
+
+// historyCommand реализует подкоманду history: history [-scenario name] db.sqlite
+func historyCommand(args []string, logger *zap.Logger) error {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	scenarioName := fs.String("scenario", "", "show only the given scenario")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: history [-scenario name] <db.sqlite>")
+	}
+	if _, err := os.Stat(fs.Arg(0)); err != nil {
+		logger.Error("history not found", zap.Error(err), zap.String("path", fs.Arg(0)))
+		return err
+	}
+
+	h, err := openHistory(fs.Arg(0), logger)
+	if err != nil {
+		return err
+	}
+	defer h.close()
+
+	trends, err := h.trends(*scenarioName)
+	if err != nil {
+		return err
+	}
+	return printTrends(os.Stdout, trends)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+var inListMigrations = []string{
+	`DROP TABLE IF EXISTS item;`,
+	`CREATE TABLE item (
+           id INT PRIMARY KEY,
+           qty INT NOT NULL
+         );`,
+	// Строки вставляются по убыванию id: последовательное чтение таблицы
+	// возвращает их в обратном порядке по сравнению с индексом
+	`INSERT INTO item VALUES (3, 1000), (2, 1000), (1, 1000);`,
+}
+
+// inListSleep растягивает захват каждой строки, чтобы захваты двух
+// транзакций чередовались: условие вычисляется для строки до ее блокировки.
+const inListSleep = 0.2
+
+// inListPlan - план, которым транзакция читает строки списка IN.
+type inListPlan struct {
+	name string
+	// settings запрещают другие планы до конца транзакции
+	settings map[string]string
+}
+
+var (
+	// Индекс первичного ключа отдает строки по возрастанию id, значения
+	// списка IN сервер сортирует сам
+	inListIndexScan = inListPlan{name: "index scan", settings: map[string]string{"enable_seqscan": "off", "enable_bitmapscan": "off"}}
+	// Последовательное чтение отдает строки в порядке их расположения в таблице
+	inListSeqScan = inListPlan{name: "seq scan", settings: map[string]string{"enable_indexscan": "off", "enable_bitmapscan": "off"}}
+)
+
+// inListVariant - списки IN, планы и сортировка запросов двух транзакций.
+type inListVariant struct {
+	name  string
+	ids   [2][]int
+	plans [2]inListPlan
+	// orderBy добавляет ORDER BY id: строки сортируются до блокировки
+	orderBy  bool
+	deadlock bool
+}
+
+var inListVariants = []inListVariant{
+	// Списки в разном порядке, но при одинаковом плане строки блокируются в
+	// порядке индекса: порядок значений в IN сам по себе не важен
+	{name: "different_lists", ids: [2][]int{{1, 3}, {3, 1}}, plans: [2]inListPlan{inListIndexScan, inListIndexScan}},
+	// Один и тот же список при разных планах блокирует строки в разном порядке
+	{name: "different_plans", ids: [2][]int{{1, 3}, {1, 3}}, plans: [2]inListPlan{inListIndexScan, inListSeqScan}, deadlock: true},
+	// ORDER BY id задает порядок блокировки независимо от плана
+	{name: "order_by_id", ids: [2][]int{{1, 3}, {3, 1}}, plans: [2]inListPlan{inListIndexScan, inListSeqScan}, orderBy: true},
+}
+
+// inListLockOrder показывает, в каком порядке SELECT ... WHERE id IN (...)
+// FOR UPDATE блокирует строки: в порядке, в котором их отдает план, а не в
+// порядке списка. Две транзакции с разными планами захватывают строки
+// навстречу друг другу и попадают во взаимоблокировку; ORDER BY id сортирует
+// строки до блокировки, и вторая транзакция просто ждет первую.
+func inListLockOrder(db *sqlx.DB, logger *zap.Logger) error {
+	deadlocks := make(map[string]bool, len(inListVariants))
+	for _, v := range inListVariants {
+		if err := migrate(db, logger, inListMigrations); err != nil {
+			return err
+		}
+		deadlock, err := runInListVariant(db, logger.With(zap.String("variant", v.name)), v)
+		if err != nil {
+			return fmt.Errorf("%s: %w", v.name, err)
+		}
+		deadlocks[v.name] = deadlock
+	}
+	logger.Info("deadlocks by IN list locking", zap.Any("deadlock", deadlocks))
+	return nil
+}
+
+func runInListVariant(db *sqlx.DB, logger *zap.Logger, v inListVariant) (deadlock bool, err error) {
+	// Проверка количества: каждая зафиксированная транзакция списывает по 1 с обеих строк
+	committed := 2
+	if v.deadlock {
+		committed = 1
+	}
+	defer checkPostconditions(db, logger, &err,
+		expectValue("qty of item 1", "SELECT qty FROM item WHERE id = 1;", 1000-committed),
+		expectValue("qty of item 3", "SELECT qty FROM item WHERE id = 3;", 1000-committed))
+
+	txs := make([]*transaction, 2)
+	done := make([]<-chan error, 2)
+	for i := range txs {
+		t := newTransaction(db, logger.With(zap.String("tx", fmt.Sprintf("tx%d", i+1))))
+		if err = t.begin(); err != nil {
+			return false, err
+		}
+		for name, value := range v.plans[i].settings {
+			if err = t.setLocal(name, value); err != nil {
+				return false, err
+			}
+		}
+		txs[i] = t
+	}
+
+	// Обе транзакции блокируют строки одновременно
+	for i, t := range txs {
+		query := inListQuery(v.ids[i], v.orderBy)
+		t.logger.Info("locking rows", zap.String("plan", v.plans[i].name), zap.Ints("ids", v.ids[i]))
+		done[i] = runAsync(func() error {
+			if _, err := t.query(query); err != nil {
+				return err
+			}
+			_, err := t.exec("UPDATE item SET qty = qty - 1 WHERE id IN (1, 3);")
+			return err
+		})
+	}
+
+	// Транзакция, захватившая строки, фиксируется сразу, иначе вторая ждала бы ее бесконечно
+	got := 0
+	for remaining := len(txs); remaining > 0; remaining-- {
+		var t *transaction
+		var stepErr error
+		select {
+		case stepErr = <-done[0]:
+			t, done[0] = txs[0], nil
+		case stepErr = <-done[1]:
+			t, done[1] = txs[1], nil
+		}
+		if errorCode(stepErr) == "40P01" {
+			deadlock = true
+			t.logger.Info("deadlock detected, transaction aborted", zap.String("explanation", classifyError(stepErr).Explanation))
+			if err = t.rollback(); err != nil {
+				return deadlock, err
+			}
+			continue
+		}
+		if stepErr != nil {
+			return deadlock, stepErr
+		}
+		if err = t.commit(); err != nil {
+			return deadlock, err
+		}
+		got++
+	}
+	logger.Info("variant finished", zap.Bool("deadlock", deadlock), zap.Int("committed", got))
+	if deadlock != v.deadlock {
+		return deadlock, errors.New("deadlock outcome does not match the plans and ordering")
+	}
+	return deadlock, nil
+}
+
+// inListQuery возвращает запрос, каким его строит ORM: значения списка
+// подставлены в текст запроса.
+func inListQuery(ids []int, orderBy bool) string {
+	values := make([]string, len(ids))
+	for i, id := range ids {
+		values[i] = strconv.Itoa(id)
+	}
+	query := fmt.Sprintf("SELECT id FROM item WHERE id IN (%s) AND pg_sleep(%g) IS NOT NULL", strings.Join(values, ", "), inListSleep)
+	if orderBy {
+		query += " ORDER BY id"
+	}
+	return query + " FOR UPDATE;"
+}
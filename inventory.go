@@ -0,0 +1,151 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+var inventoryMigrations = []string{
+	`DROP TABLE IF EXISTS product;`,
+	`CREATE TABLE IF NOT EXISTS product (
+           id INT PRIMARY KEY,
+           quantity INT NOT NULL
+         );`,
+	`INSERT INTO product VALUES (1, 1);`,
+}
+
+// inventoryVariant - способ защиты остатка от ухода в минус.
+type inventoryVariant struct {
+	name        string
+	level       sql.IsolationLevel
+	check       bool // CHECK (quantity >= 0)
+	conditional bool // UPDATE ... WHERE quantity >= $1 с проверкой числа измененных строк
+	retry       bool // повтор транзакции при ошибке сериализации
+	quantity    int  // итоговый остаток
+}
+
+var inventoryVariants = []inventoryVariant{
+	{name: "check_then_update", level: sql.LevelReadCommitted, quantity: -1},
+	{name: "check_constraint", level: sql.LevelReadCommitted, check: true},
+	{name: "conditional_update", level: sql.LevelReadCommitted, conditional: true},
+	{name: "serializable_retry", level: sql.LevelSerializable, retry: true},
+}
+
+func inventoryOversell(db *sqlx.DB, logger *zap.Logger) error {
+	for _, v := range inventoryVariants {
+		if err := runInventoryVariant(db, logger.With(zap.String("variant", v.name)), v); err != nil {
+			return fmt.Errorf("%s: %w", v.name, err)
+		}
+	}
+	return nil
+}
+
+func runInventoryVariant(db *sqlx.DB, logger *zap.Logger, v inventoryVariant) (err error) {
+	prepare := []string{
+		`UPDATE product SET quantity = 1 WHERE id = 1;`,
+		`ALTER TABLE product DROP CONSTRAINT IF EXISTS quantity_non_negative;`,
+	}
+	if v.check {
+		prepare = append(prepare, `ALTER TABLE product ADD CONSTRAINT quantity_non_negative CHECK (quantity >= 0);`)
+	}
+	if err := migrate(db, logger, prepare); err != nil {
+		return err
+	}
+
+	// Проверка остатка после завершения транзакций
+	defer checkPostconditions(db, logger, &err, expectValue("quantity", "SELECT quantity FROM product WHERE id = 1;", v.quantity))
+
+	// Обе покупки проверяют остаток и списывают товар
+	tx1 := newTransaction(db, logger.With(zap.String("tx", "tx1")))
+	if err := tx1.begin(); err != nil {
+		return err
+	}
+	if err := tx1.setLevel(v.level); err != nil {
+		return err
+	}
+	tx2 := newTransaction(db, logger.With(zap.String("tx", "tx2")))
+	if err := tx2.begin(); err != nil {
+		return err
+	}
+	if err := tx2.setLevel(v.level); err != nil {
+		return err
+	}
+
+	if _, err := purchase(tx1, v, 1, 1); err != nil {
+		return err
+	}
+	// tx2 ждет блокировку строки, занятую tx1
+	pid, err := tx2.backendPID()
+	if err != nil {
+		return err
+	}
+	tx2Done := runAsync(func() error {
+		_, err := purchase(tx2, v, 1, 1)
+		return err
+	})
+	if err = waitBlocked(tx2, pid, tx2Done); err != nil {
+		return err
+	}
+	if err := tx1.commit(); err != nil {
+		return err
+	}
+
+	err = <-tx2Done
+	if err == nil {
+		err = tx2.commit()
+	} else {
+		tx2.logger.Info("purchase rejected", zap.String("code", errorCode(err)))
+		if rerr := tx2.rollback(); rerr != nil {
+			return rerr
+		}
+	}
+	if errorCode(err) == "40001" && v.retry {
+		// Повтор видит актуальный остаток и отказывает в покупке
+		tx3 := newTransaction(db, logger.With(zap.String("tx", "tx2_retry")))
+		if err = tx3.begin(); err != nil {
+			return err
+		}
+		if err = tx3.setLevel(v.level); err != nil {
+			return err
+		}
+		if _, err = purchase(tx3, v, 1, 1); err != nil {
+			return err
+		}
+		return tx3.commit()
+	}
+	switch errorCode(err) {
+	case "", "23514", "40001":
+		return nil
+	default:
+		return err
+	}
+}
+
+// purchase списывает quantity единиц товара, если остатка хватает.
+func purchase(t *transaction, v inventoryVariant, productID, quantity int) (bool, error) {
+	if v.conditional {
+		affected, err := t.exec("UPDATE product SET quantity = quantity - $1 WHERE id = $2 AND quantity >= $1;", quantity, productID)
+		if err != nil {
+			return false, err
+		}
+		t.logger.Info("purchase", zap.Bool("sold", affected == 1))
+		return affected == 1, nil
+	}
+
+	rows, err := t.query("SELECT quantity FROM product WHERE id = $1;", productID)
+	if err != nil {
+		return false, err
+	}
+	if rows[0][0].(int64) < int64(quantity) {
+		t.logger.Info("purchase", zap.Bool("sold", false))
+		return false, nil
+	}
+	if _, err = t.exec("UPDATE product SET quantity = quantity - $1 WHERE id = $2;", quantity, productID); err != nil {
+		return false, err
+	}
+	t.logger.Info("purchase", zap.Bool("sold", true))
+	return true, nil
+}
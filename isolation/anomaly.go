@@ -0,0 +1,295 @@
+package isolation
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Anomaly - аномалия чередования двух транзакций из A Critique of ANSI SQL
+// Isolation Levels с чередованием, в котором она проявляется, и уровнями,
+// на которых ее допускает СУБД.
+type Anomaly struct {
+	// Name - имя аномалии в отчетах: dirty_read, lost_update, ...
+	Name string
+	// Code - обозначение из статьи: P1, P2, P3, P4, A5B
+	Code string
+	// ANSI - уровни, которым стандарт SQL-92 разрешает аномалию; nil -
+	// стандарт аномалию не определяет
+	ANSI map[sql.IsolationLevel]bool
+
+	// possible - уровни, на которых аномалию допускает СУБД; для SQLServer -
+	// с READ_COMMITTED_SNAPSHOT OFF
+	possible map[Dialect]map[sql.IsolationLevel]bool
+	run      func(ctx context.Context, t1, t2 *session, target Target) (bool, error)
+}
+
+var (
+	// DirtyRead (P1): tx1 читает изменение tx2 до его фиксации.
+	DirtyRead = Anomaly{Name: "dirty_read", Code: "P1",
+		ANSI: map[sql.IsolationLevel]bool{sql.LevelReadUncommitted: true},
+		possible: map[Dialect]map[sql.IsolationLevel]bool{
+			Postgres:  {},
+			MySQL:     {sql.LevelReadUncommitted: true},
+			SQLServer: {sql.LevelReadUncommitted: true},
+		},
+		run: dirtyRead}
+	// NonRepeatableRead (P2): повторное чтение строки в tx1 видит изменение,
+	// зафиксированное tx2.
+	NonRepeatableRead = Anomaly{Name: "non_repeatable_read", Code: "P2",
+		ANSI: map[sql.IsolationLevel]bool{sql.LevelReadUncommitted: true, sql.LevelReadCommitted: true},
+		possible: map[Dialect]map[sql.IsolationLevel]bool{
+			Postgres:  {sql.LevelReadUncommitted: true, sql.LevelReadCommitted: true},
+			MySQL:     {sql.LevelReadUncommitted: true, sql.LevelReadCommitted: true},
+			SQLServer: {sql.LevelReadUncommitted: true, sql.LevelReadCommitted: true},
+		},
+		run: nonRepeatableRead}
+	// Phantom (P3): повторное чтение по предикату в tx1 видит строку,
+	// вставленную tx2.
+	Phantom = Anomaly{Name: "phantom", Code: "P3",
+		ANSI: map[sql.IsolationLevel]bool{sql.LevelReadUncommitted: true, sql.LevelReadCommitted: true, sql.LevelRepeatableRead: true},
+		possible: map[Dialect]map[sql.IsolationLevel]bool{
+			Postgres:  {sql.LevelReadUncommitted: true, sql.LevelReadCommitted: true},
+			MySQL:     {sql.LevelReadUncommitted: true, sql.LevelReadCommitted: true},
+			SQLServer: {sql.LevelReadUncommitted: true, sql.LevelReadCommitted: true, sql.LevelRepeatableRead: true},
+		},
+		run: phantom}
+	// LostUpdate (P4): обе транзакции читают значение и записывают
+	// увеличенное, прибавка tx1 теряется.
+	LostUpdate = Anomaly{Name: "lost_update", Code: "P4",
+		possible: map[Dialect]map[sql.IsolationLevel]bool{
+			Postgres:  {sql.LevelReadUncommitted: true, sql.LevelReadCommitted: true},
+			MySQL:     {sql.LevelReadUncommitted: true, sql.LevelReadCommitted: true, sql.LevelRepeatableRead: true},
+			SQLServer: {sql.LevelReadUncommitted: true, sql.LevelReadCommitted: true},
+		},
+		run: lostUpdate}
+	// WriteSkew (A5B): обе транзакции читают сумму двух строк и меняют разные
+	// строки, каждая - исходя из суммы, которую другая уже изменила.
+	WriteSkew = Anomaly{Name: "write_skew", Code: "A5B",
+		possible: map[Dialect]map[sql.IsolationLevel]bool{
+			Postgres:  {sql.LevelReadUncommitted: true, sql.LevelReadCommitted: true, sql.LevelRepeatableRead: true},
+			MySQL:     {sql.LevelReadUncommitted: true, sql.LevelReadCommitted: true, sql.LevelRepeatableRead: true},
+			SQLServer: {sql.LevelReadUncommitted: true, sql.LevelReadCommitted: true, sql.LevelSnapshot: true},
+		},
+		run: writeSkew}
+)
+
+// Anomalies возвращает все аномалии в порядке обозначений.
+func Anomalies() []Anomaly {
+	return []Anomaly{DirtyRead, NonRepeatableRead, Phantom, LostUpdate, WriteSkew}
+}
+
+// Possible сообщает, допускает ли dialect аномалию на уровне level.
+func (a Anomaly) Possible(level sql.IsolationLevel, dialect Dialect) bool {
+	return a.possible[dialect][level]
+}
+
+func (a Anomaly) String() string {
+	return a.Code + " " + a.Name
+}
+
+// Target - строки схемы вызывающего, на которых выполняется чередование.
+// Чередования фиксируют изменения, поэтому строки должны быть тестовыми.
+type Target struct {
+	// Table - таблица, возможно со схемой; Key - столбец ее первичного ключа
+	Table string
+	Key   string
+	// Column - целочисленный столбец, который чередования читают и меняют
+	Column string
+	// IDs - ключи двух существующих строк; WriteSkew меняет обе, остальные
+	// аномалии - первую
+	IDs [2]any
+	// Insert вставляет в Table новую строку для Phantom: предикат
+	// чередования - вся таблица
+	Insert string
+}
+
+func (t Target) validate(a Anomaly) error {
+	if t.Table == "" || t.Key == "" || t.Column == "" || t.IDs[0] == nil {
+		return errors.New("isolation: Target.Table, Key, Column and IDs[0] are required")
+	}
+	if a.Code == WriteSkew.Code && t.IDs[1] == nil {
+		return fmt.Errorf("isolation: %s needs Target.IDs[1]", a)
+	}
+	if a.Code == Phantom.Code && t.Insert == "" {
+		return fmt.Errorf("isolation: %s needs Target.Insert", a)
+	}
+	return nil
+}
+
+func (t Target) readSQL() string {
+	return fmt.Sprintf("SELECT %s FROM %s WHERE %s = $1", pq.QuoteIdentifier(t.Column), quoteTable(t.Table), pq.QuoteIdentifier(t.Key))
+}
+
+func (t Target) writeSQL() string {
+	return fmt.Sprintf("UPDATE %s SET %s = $2 WHERE %s = $1", quoteTable(t.Table), pq.QuoteIdentifier(t.Column), pq.QuoteIdentifier(t.Key))
+}
+
+func (t Target) sumSQL() string {
+	return fmt.Sprintf("SELECT SUM(%s)::BIGINT FROM %s WHERE %s IN ($1, $2)", pq.QuoteIdentifier(t.Column), quoteTable(t.Table), pq.QuoteIdentifier(t.Key))
+}
+
+func (t Target) countSQL() string {
+	return "SELECT COUNT(*) FROM " + quoteTable(t.Table)
+}
+
+// quoteTable заключает в кавычки имя таблицы и ее схемы.
+func quoteTable(table string) string {
+	parts := strings.Split(table, ".")
+	for i, part := range parts {
+		parts[i] = pq.QuoteIdentifier(part)
+	}
+	return strings.Join(parts, ".")
+}
+
+// session - транзакция чередования на отдельном подключении.
+type session struct {
+	tx *sql.Tx
+}
+
+func (s *session) value(ctx context.Context, query string, args ...any) (int64, error) {
+	var v int64
+	err := s.tx.QueryRowContext(ctx, query, args...).Scan(&v)
+	return v, err
+}
+
+func (s *session) exec(ctx context.Context, query string, args ...any) error {
+	_, err := s.tx.ExecContext(ctx, query, args...)
+	return err
+}
+
+// commit фиксирует транзакцию и сообщает, удалось ли это: отказ сервера
+// зафиксировать транзакцию (Retryable) - не ошибка чередования, а вердикт.
+func (s *session) commit() (bool, error) {
+	err := s.tx.Commit()
+	if err == nil {
+		return true, nil
+	}
+	if Retryable(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// async выполняет шаг, который может ждать блокировку другой транзакции.
+func async(step func() error) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- step()
+	}()
+	return done
+}
+
+func dirtyRead(ctx context.Context, t1, t2 *session, target Target) (bool, error) {
+	before, err := t1.value(ctx, target.readSQL(), target.IDs[0])
+	if err != nil {
+		return false, err
+	}
+	if err = t2.exec(ctx, target.writeSQL(), target.IDs[0], before+1); err != nil {
+		return false, err
+	}
+	read, err := t1.value(ctx, target.readSQL(), target.IDs[0])
+	if err != nil {
+		return false, err
+	}
+	if err = t2.tx.Rollback(); err != nil {
+		return false, err
+	}
+	_, err = t1.commit()
+	return read != before, err
+}
+
+func nonRepeatableRead(ctx context.Context, t1, t2 *session, target Target) (bool, error) {
+	before, err := t1.value(ctx, target.readSQL(), target.IDs[0])
+	if err != nil {
+		return false, err
+	}
+	if err = t2.exec(ctx, target.writeSQL(), target.IDs[0], before+1); err != nil {
+		return false, err
+	}
+	if _, err = t2.commit(); err != nil {
+		return false, err
+	}
+	after, err := t1.value(ctx, target.readSQL(), target.IDs[0])
+	if err != nil {
+		return false, err
+	}
+	_, err = t1.commit()
+	return before != after, err
+}
+
+func phantom(ctx context.Context, t1, t2 *session, target Target) (bool, error) {
+	before, err := t1.value(ctx, target.countSQL())
+	if err != nil {
+		return false, err
+	}
+	if err = t2.exec(ctx, target.Insert); err != nil {
+		return false, err
+	}
+	if _, err = t2.commit(); err != nil {
+		return false, err
+	}
+	after, err := t1.value(ctx, target.countSQL())
+	if err != nil {
+		return false, err
+	}
+	_, err = t1.commit()
+	return before != after, err
+}
+
+func lostUpdate(ctx context.Context, t1, t2 *session, target Target) (bool, error) {
+	read1, err := t1.value(ctx, target.readSQL(), target.IDs[0])
+	if err != nil {
+		return false, err
+	}
+	read2, err := t2.value(ctx, target.readSQL(), target.IDs[0])
+	if err != nil {
+		return false, err
+	}
+	if err = t1.exec(ctx, target.writeSQL(), target.IDs[0], read1+1); err != nil {
+		return false, err
+	}
+	// Запись tx2 ждет tx1; после фиксации tx1 она либо затирает ее, либо отклоняется
+	t2Done := async(func() error {
+		return t2.exec(ctx, target.writeSQL(), target.IDs[0], read2+2)
+	})
+	committed1, err := t1.commit()
+	if werr := <-t2Done; err == nil {
+		err = werr
+	}
+	if err != nil {
+		return false, err
+	}
+	committed2, err := t2.commit()
+	return committed1 && committed2, err
+}
+
+func writeSkew(ctx context.Context, t1, t2 *session, target Target) (bool, error) {
+	var totals [2]int64
+	for i, t := range []*session{t1, t2} {
+		total, err := t.value(ctx, target.sumSQL(), target.IDs[0], target.IDs[1])
+		if err != nil {
+			return false, err
+		}
+		totals[i] = total
+	}
+	for i, t := range []*session{t1, t2} {
+		current, err := t.value(ctx, target.readSQL(), target.IDs[i])
+		if err != nil {
+			return false, err
+		}
+		if err = t.exec(ctx, target.writeSQL(), target.IDs[i], current-totals[i]); err != nil {
+			return false, err
+		}
+	}
+	committed1, err := t1.commit()
+	if err != nil {
+		return false, err
+	}
+	committed2, err := t2.commit()
+	return committed1 && committed2, err
+}
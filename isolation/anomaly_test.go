@@ -0,0 +1,125 @@
+package isolation
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestTargetValidate(t *testing.T) {
+	full := Target{Table: "account", Key: "id", Column: "balance", IDs: [2]any{1, 2}, Insert: "INSERT INTO account VALUES (3, 0)"}
+	tests := []struct {
+		name    string
+		anomaly Anomaly
+		change  func(*Target)
+		ok      bool
+	}{
+		{"complete", WriteSkew, func(*Target) {}, true},
+		{"no table", LostUpdate, func(t *Target) { t.Table = "" }, false},
+		{"no key", LostUpdate, func(t *Target) { t.Key = "" }, false},
+		{"no column", LostUpdate, func(t *Target) { t.Column = "" }, false},
+		{"no first id", LostUpdate, func(t *Target) { t.IDs[0] = nil }, false},
+		{"one id", LostUpdate, func(t *Target) { t.IDs[1] = nil }, true},
+		{"one id for write skew", WriteSkew, func(t *Target) { t.IDs[1] = nil }, false},
+		{"no insert", NonRepeatableRead, func(t *Target) { t.Insert = "" }, true},
+		{"no insert for phantom", Phantom, func(t *Target) { t.Insert = "" }, false},
+	}
+	for _, tt := range tests {
+		target := full
+		tt.change(&target)
+		if err := target.validate(tt.anomaly); (err == nil) != tt.ok {
+			t.Errorf("%s: validate(%s) = %v, want ok %t", tt.name, tt.anomaly, err, tt.ok)
+		}
+	}
+}
+
+func TestQuoteTable(t *testing.T) {
+	tests := []struct{ table, want string }{
+		{"account", `"account"`},
+		{"public.account", `"public"."account"`},
+		{"Mixed.Case", `"Mixed"."Case"`},
+		{`odd"name`, `"odd""name"`},
+	}
+	for _, tt := range tests {
+		if got := quoteTable(tt.table); got != tt.want {
+			t.Errorf("quoteTable(%q) = %s, want %s", tt.table, got, tt.want)
+		}
+	}
+}
+
+func TestTargetSQL(t *testing.T) {
+	target := Target{Table: "bank.account", Key: "id", Column: "balance"}
+	if got, want := target.readSQL(), `SELECT "balance" FROM "bank"."account" WHERE "id" = $1`; got != want {
+		t.Errorf("readSQL() = %s, want %s", got, want)
+	}
+	if got, want := target.writeSQL(), `UPDATE "bank"."account" SET "balance" = $2 WHERE "id" = $1`; got != want {
+		t.Errorf("writeSQL() = %s, want %s", got, want)
+	}
+}
+
+func TestPossible(t *testing.T) {
+	rc, rr, ser := sql.LevelReadCommitted, sql.LevelRepeatableRead, sql.LevelSerializable
+	tests := []struct {
+		anomaly Anomaly
+		level   sql.IsolationLevel
+		want    bool
+	}{
+		{DirtyRead, sql.LevelReadUncommitted, false},
+		{NonRepeatableRead, rc, true},
+		{NonRepeatableRead, rr, false},
+		// ANSI допускает фантомы на REPEATABLE READ, снимок Postgres - нет
+		{Phantom, rr, false},
+		{LostUpdate, rc, true},
+		{LostUpdate, rr, false},
+		{WriteSkew, rr, true},
+		{WriteSkew, ser, false},
+	}
+	for _, tt := range tests {
+		if got := tt.anomaly.Possible(tt.level, Postgres); got != tt.want {
+			t.Errorf("%s.Possible(%s) = %t, want %t", tt.anomaly, tt.level, got, tt.want)
+		}
+	}
+	for _, a := range Anomalies() {
+		if a.Possible(ser, Postgres) {
+			t.Errorf("%s is possible at %s", a, ser)
+		}
+		if a.Possible(rc, Dialect("unknown")) {
+			t.Errorf("%s is possible for an unknown dialect", a)
+		}
+	}
+}
+
+func TestPossibleDialects(t *testing.T) {
+	tests := []struct {
+		anomaly Anomaly
+		level   sql.IsolationLevel
+		dialect Dialect
+		want    bool
+	}{
+		{DirtyRead, sql.LevelReadUncommitted, MySQL, true},
+		{DirtyRead, sql.LevelReadUncommitted, SQLServer, true},
+		// UPDATE в REPEATABLE READ InnoDB не проверяет снимок и затирает чужую запись
+		{LostUpdate, sql.LevelRepeatableRead, MySQL, true},
+		// Разделяемые блокировки REPEATABLE READ приводят к взаимоблокировке
+		{LostUpdate, sql.LevelRepeatableRead, SQLServer, false},
+		{Phantom, sql.LevelRepeatableRead, SQLServer, true},
+		{WriteSkew, sql.LevelSnapshot, SQLServer, true},
+		{WriteSkew, sql.LevelSnapshot, Postgres, false},
+	}
+	for _, tt := range tests {
+		if got := tt.anomaly.Possible(tt.level, tt.dialect); got != tt.want {
+			t.Errorf("%s.Possible(%s, %s) = %t, want %t", tt.anomaly, tt.level, tt.dialect, got, tt.want)
+		}
+	}
+	for _, d := range Dialects() {
+		for _, a := range Anomalies() {
+			if a.Possible(sql.LevelSerializable, d) {
+				t.Errorf("%s is possible at SERIALIZABLE in %s", a, d)
+			}
+			for level := range a.possible[d] {
+				if !Supported(level, d) {
+					t.Errorf("%s is possible at %s, which %s does not support", a, level, d)
+				}
+			}
+		}
+	}
+}
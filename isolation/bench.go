@@ -0,0 +1,147 @@
+package isolation
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+// Workload - транзакция, стоимость которой измеряет BenchmarkWorkload на
+// схеме вызывающего.
+type Workload struct {
+	DB    *sql.DB
+	Level sql.IsolationLevel
+	// Setup выполняется перед измерением, Teardown - по его завершении; testing
+	// повторяет benchmark с растущим b.N, поэтому Setup должен быть идемпотентным
+	Setup    []string
+	Teardown []string
+	// Tx - тело транзакции; BEGIN, COMMIT и ROLLBACK выполняет BenchmarkWorkload
+	Tx func(ctx context.Context, tx *sql.Tx) error
+	// MaxRetries - сколько раз повторять транзакцию после Retryable ошибки;
+	// 0 - DefaultMaxRetries, отрицательное значение - не повторять
+	MaxRetries int
+	// Parallelism - горутин на GOMAXPROCS (b.SetParallelism); 0 - транзакции
+	// выполняются последовательно
+	Parallelism int
+}
+
+// DefaultMaxRetries - число повторов, если Workload.MaxRetries не задан.
+const DefaultMaxRetries = 10
+
+// Retryable сообщает, что транзакцию прервал конфликт сериализации (40001)
+// или взаимоблокировка (40P01) и ее можно повторить.
+func Retryable(err error) bool {
+	var code string
+	var pqErr *pq.Error
+	var sqlState interface{ SQLState() string }
+	switch {
+	case errors.As(err, &pqErr):
+		code = string(pqErr.Code)
+	case errors.As(err, &sqlState):
+		code = sqlState.SQLState()
+	}
+	return code == "40001" || code == "40P01"
+}
+
+// BenchmarkWorkload выполняет w.Tx b.N раз на уровне w.Level, повторяя
+// прерванные транзакции, и сообщает метрики aborts/op (повторы на одну
+// успешную транзакцию) и failures/op (транзакции, не прошедшие за MaxRetries).
+//
+//	func BenchmarkTransfer(b *testing.B) {
+//		isolation.BenchmarkWorkload(b, isolation.Workload{
+//			DB:    db,
+//			Level: sql.LevelSerializable,
+//			Tx:    transfer,
+//		})
+//	}
+func BenchmarkWorkload(b *testing.B, w Workload) {
+	b.Helper()
+	if w.DB == nil || w.Tx == nil {
+		b.Fatal("isolation: Workload.DB and Workload.Tx are required")
+	}
+	for _, query := range w.Setup {
+		if _, err := w.DB.Exec(query); err != nil {
+			b.Fatalf("isolation: setup %q: %v", query, err)
+		}
+	}
+	b.Cleanup(func() {
+		for _, query := range w.Teardown {
+			if _, err := w.DB.Exec(query); err != nil {
+				b.Errorf("isolation: teardown %q: %v", query, err)
+			}
+		}
+	})
+
+	maxRetries := w.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = DefaultMaxRetries
+	}
+	var aborts, failures atomic.Int64
+	ctx := context.Background()
+	run := func() {
+		for attempt := 0; ; attempt++ {
+			err := runTx(ctx, w)
+			if err == nil {
+				return
+			}
+			if !Retryable(err) {
+				b.Error(err)
+				return
+			}
+			aborts.Add(1)
+			if attempt >= maxRetries {
+				failures.Add(1)
+				return
+			}
+		}
+	}
+
+	b.ResetTimer()
+	if w.Parallelism > 0 {
+		b.SetParallelism(w.Parallelism)
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				run()
+			}
+		})
+	} else {
+		for i := 0; i < b.N; i++ {
+			run()
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(aborts.Load())/float64(b.N), "aborts/op")
+	b.ReportMetric(float64(failures.Load())/float64(b.N), "failures/op")
+}
+
+// BenchmarkLevels запускает BenchmarkWorkload как под-benchmark для каждого
+// уровня levels, по умолчанию - для всех уровней PostgreSQL, кроме READ
+// UNCOMMITTED.
+func BenchmarkLevels(b *testing.B, w Workload, levels ...sql.IsolationLevel) {
+	b.Helper()
+	if len(levels) == 0 {
+		levels = []sql.IsolationLevel{sql.LevelReadCommitted, sql.LevelRepeatableRead, sql.LevelSerializable}
+	}
+	for _, level := range levels {
+		w.Level = level
+		b.Run(level.String(), func(b *testing.B) {
+			BenchmarkWorkload(b, w)
+		})
+	}
+}
+
+func runTx(ctx context.Context, w Workload) error {
+	tx, err := w.DB.BeginTx(ctx, &sql.TxOptions{Isolation: w.Level})
+	if err != nil {
+		return err
+	}
+	if err = w.Tx(ctx, tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
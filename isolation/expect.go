@@ -0,0 +1,187 @@
+package isolation
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// DefaultExpectTimeout ограничивает чередование, если Expectation.Within не
+// вызван: шаг, ждущий блокировку, которую никто не отпустит, прерывается.
+const DefaultExpectTimeout = 30 * time.Second
+
+// Observe выполняет чередование аномалии a, обе транзакции на уровне level,
+// на строках target и сообщает, проявилась ли аномалия. Отказ сервера
+// выполнить шаг или фиксацию из-за конфликта (Retryable) означает, что
+// аномалия предотвращена, и ошибкой не считается.
+func Observe(ctx context.Context, db *sql.DB, a Anomaly, level sql.IsolationLevel, target Target) (bool, error) {
+	if a.run == nil {
+		return false, errors.New("isolation: unknown anomaly, use one of Anomalies()")
+	}
+	if err := target.validate(a); err != nil {
+		return false, err
+	}
+	t1, err := begin(ctx, db, level)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = t1.tx.Rollback() }()
+	t2, err := begin(ctx, db, level)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = t2.tx.Rollback() }()
+	observed, err := a.run(ctx, t1, t2, target)
+	if Retryable(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("isolation: %s at %s: %w", a, level, err)
+	}
+	return observed, nil
+}
+
+func begin(ctx context.Context, db *sql.DB, level sql.IsolationLevel) (*session, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: level})
+	if err != nil {
+		return nil, fmt.Errorf("isolation: begin %s: %w", level, err)
+	}
+	return &session{tx: tx}, nil
+}
+
+// Expectation - проверка поведения аномалии в тесте вызывающего:
+//
+//	func TestTransferIsolation(t *testing.T) {
+//		isolation.Expect(t, db).
+//			Anomaly(isolation.LostUpdate).
+//			AtLevel(sql.LevelReadCommitted).
+//			Occurs()
+//		isolation.Expect(t, db).
+//			Anomaly(isolation.LostUpdate).
+//			On(isolation.Target{Table: "account", Key: "id", Column: "balance", IDs: [2]any{1, 2}}).
+//			AtLevel(sql.LevelRepeatableRead).
+//			DoesNotOccur()
+//	}
+//
+// Без On чередование выполняется на временной таблице, которую Expect
+// создает в db и удаляет по завершении теста.
+type Expectation struct {
+	t       testing.TB
+	db      *sql.DB
+	anomaly Anomaly
+	level   sql.IsolationLevel
+	target  *Target
+	timeout time.Duration
+}
+
+// Expect начинает проверку аномалии на базе db.
+func Expect(t testing.TB, db *sql.DB) *Expectation {
+	return &Expectation{t: t, db: db, timeout: DefaultExpectTimeout}
+}
+
+// Anomaly выбирает проверяемую аномалию.
+func (e *Expectation) Anomaly(a Anomaly) *Expectation {
+	e.anomaly = a
+	return e
+}
+
+// AtLevel задает уровень изоляции обеих транзакций; без него - уровень
+// сервера по умолчанию.
+func (e *Expectation) AtLevel(level sql.IsolationLevel) *Expectation {
+	e.level = level
+	return e
+}
+
+// On выполняет чередование на строках схемы вызывающего.
+func (e *Expectation) On(target Target) *Expectation {
+	e.target = &target
+	return e
+}
+
+// Within ограничивает время чередования.
+func (e *Expectation) Within(timeout time.Duration) *Expectation {
+	e.timeout = timeout
+	return e
+}
+
+// Occurs проверяет, что аномалия проявляется, и сообщает, выполнено ли ожидание.
+func (e *Expectation) Occurs() bool {
+	e.t.Helper()
+	return e.expect(true, "expected %s to occur at %s, but the server prevented it")
+}
+
+// DoesNotOccur проверяет, что аномалия предотвращена, и сообщает, выполнено
+// ли ожидание.
+func (e *Expectation) DoesNotOccur() bool {
+	e.t.Helper()
+	return e.expect(false, "expected %s not to occur at %s, but it was observed")
+}
+
+// MatchesDialect проверяет, что аномалия проявляется ровно на тех уровнях,
+// на которых ее допускает dialect, - например, что прокси или пул
+// подключений перед сервером не ослабляет изоляцию.
+func (e *Expectation) MatchesDialect(dialect Dialect) bool {
+	e.t.Helper()
+	if e.level == sql.LevelDefault {
+		e.t.Fatal("isolation: MatchesDialect needs AtLevel")
+	}
+	if e.anomaly.Possible(e.level, dialect) {
+		return e.expect(true, "expected %s to occur at %s as in "+string(dialect)+", but the server prevented it")
+	}
+	return e.expect(false, "expected %s not to occur at %s as in "+string(dialect)+", but it was observed")
+}
+
+func (e *Expectation) expect(want bool, format string) bool {
+	e.t.Helper()
+	if e.db == nil {
+		e.t.Fatal("isolation: Expect needs a database")
+	}
+	target := e.target
+	if target == nil {
+		scratch := e.scratch()
+		target = &scratch
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+	observed, err := Observe(ctx, e.db, e.anomaly, e.level, *target)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	if observed != want {
+		e.t.Errorf("isolation: "+format, e.anomaly, e.level)
+		return false
+	}
+	return true
+}
+
+// scratchTables нумерует временные таблицы Expect, чтобы параллельные тесты
+// одного и разных процессов не делили строки.
+var scratchTables atomic.Int64
+
+// scratch создает таблицу с двумя строками для чередования без On.
+func (e *Expectation) scratch() Target {
+	e.t.Helper()
+	table := fmt.Sprintf("isolation_expect_%d_%d", os.Getpid(), scratchTables.Add(1))
+	target := Target{Table: table, Key: "id", Column: "value", IDs: [2]any{1, 2},
+		Insert: "INSERT INTO " + quoteTable(table) + " VALUES (3, 100)"}
+	setup := []string{
+		"CREATE TABLE " + quoteTable(table) + " (id INT PRIMARY KEY, value BIGINT NOT NULL)",
+		"INSERT INTO " + quoteTable(table) + " VALUES (1, 100), (2, 100)",
+	}
+	e.t.Cleanup(func() {
+		if _, err := e.db.Exec("DROP TABLE IF EXISTS " + quoteTable(table)); err != nil {
+			e.t.Errorf("isolation: drop %s: %v", table, err)
+		}
+	})
+	for _, query := range setup {
+		if _, err := e.db.Exec(query); err != nil {
+			e.t.Fatalf("isolation: setup %q: %v", query, err)
+		}
+	}
+	return target
+}
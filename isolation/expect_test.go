@@ -0,0 +1,200 @@
+package isolation
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingTB запоминает сообщения и функции Cleanup проверки вместо того,
+// чтобы завершать тест, который ее вызывает.
+type recordingTB struct {
+	testing.TB
+	fatal    string
+	errors   []string
+	cleanups []func()
+}
+
+func (r *recordingTB) Helper() {}
+
+func (r *recordingTB) Fatal(args ...any) {
+	r.fatal = fmt.Sprint(args...)
+	runtime.Goexit()
+}
+
+func (r *recordingTB) Fatalf(format string, args ...any) {
+	r.fatal = fmt.Sprintf(format, args...)
+	runtime.Goexit()
+}
+
+func (r *recordingTB) Errorf(format string, args ...any) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (r *recordingTB) Cleanup(f func()) {
+	r.cleanups = append(r.cleanups, f)
+}
+
+// run выполняет f в отдельной горутине, как testing, чтобы Fatal ее завершал.
+func (r *recordingTB) run(f func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	<-done
+}
+
+func (r *recordingTB) cleanup() {
+	for i := len(r.cleanups) - 1; i >= 0; i-- {
+		r.cleanups[i]()
+	}
+}
+
+// recordingConnector открывает подключения, которые запоминают операторы и
+// отклоняют те, что начинаются с fail.
+type recordingConnector struct {
+	mu      sync.Mutex
+	queries []string
+	fail    string
+}
+
+func (c *recordingConnector) Connect(context.Context) (driver.Conn, error) {
+	return recordingConn{c}, nil
+}
+
+func (c *recordingConnector) Driver() driver.Driver {
+	return nil
+}
+
+func (c *recordingConnector) executed() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.queries...)
+}
+
+type recordingConn struct {
+	c *recordingConnector
+}
+
+func (conn recordingConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	conn.c.mu.Lock()
+	defer conn.c.mu.Unlock()
+	conn.c.queries = append(conn.c.queries, query)
+	if conn.c.fail != "" && strings.HasPrefix(query, conn.c.fail) {
+		return nil, errors.New("rejected")
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (recordingConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("prepare is not supported")
+}
+
+func (recordingConn) Close() error {
+	return nil
+}
+
+func (recordingConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions are not supported")
+}
+
+func TestMatchesDialectNeedsLevel(t *testing.T) {
+	connector := &recordingConnector{}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	tb := &recordingTB{}
+	tb.run(func() {
+		Expect(tb, db).Anomaly(LostUpdate).MatchesDialect(Postgres)
+		t.Error("MatchesDialect without AtLevel returned")
+	})
+	if !strings.Contains(tb.fatal, "needs AtLevel") {
+		t.Errorf("fatal = %q, want a missing AtLevel message", tb.fatal)
+	}
+	if queries := connector.executed(); len(queries) != 0 {
+		t.Errorf("MatchesDialect without AtLevel executed %q", queries)
+	}
+}
+
+func TestExpectNeedsDatabase(t *testing.T) {
+	tb := &recordingTB{}
+	tb.run(func() {
+		Expect(tb, nil).Anomaly(LostUpdate).Occurs()
+	})
+	if !strings.Contains(tb.fatal, "needs a database") {
+		t.Errorf("fatal = %q, want a missing database message", tb.fatal)
+	}
+}
+
+func TestObserveUnknownAnomaly(t *testing.T) {
+	if _, err := Observe(context.Background(), nil, Anomaly{Name: "custom"}, sql.LevelSerializable, Target{}); err == nil {
+		t.Error("Observe accepted an anomaly without an interleaving")
+	}
+}
+
+func TestScratchDropsTable(t *testing.T) {
+	connector := &recordingConnector{}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	tb := &recordingTB{}
+	var target Target
+	tb.run(func() {
+		target = Expect(tb, db).scratch()
+	})
+	if tb.fatal != "" {
+		t.Fatalf("scratch failed: %s", tb.fatal)
+	}
+	if err := target.validate(WriteSkew); err != nil {
+		t.Fatal(err)
+	}
+	if err := target.validate(Phantom); err != nil {
+		t.Fatal(err)
+	}
+	tb.cleanup()
+	queries := connector.executed()
+	if want := "DROP TABLE IF EXISTS " + quoteTable(target.Table); queries[len(queries)-1] != want {
+		t.Errorf("last query = %q, want %q", queries[len(queries)-1], want)
+	}
+	if len(tb.errors) != 0 {
+		t.Errorf("cleanup reported %q", tb.errors)
+	}
+}
+
+func TestScratchTablesDiffer(t *testing.T) {
+	db := sql.OpenDB(&recordingConnector{})
+	defer db.Close()
+	tb := &recordingTB{}
+	var first, second Target
+	tb.run(func() {
+		first = Expect(tb, db).scratch()
+		second = Expect(tb, db).scratch()
+	})
+	if first.Table == second.Table {
+		t.Errorf("both scratch tables are %s", first.Table)
+	}
+}
+
+func TestScratchDropsTableAfterFailedSetup(t *testing.T) {
+	connector := &recordingConnector{fail: "INSERT"}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	tb := &recordingTB{}
+	tb.run(func() {
+		Expect(tb, db).scratch()
+		t.Error("scratch returned after a failed setup")
+	})
+	if !strings.Contains(tb.fatal, "setup") {
+		t.Errorf("fatal = %q, want a setup failure", tb.fatal)
+	}
+	tb.cleanup()
+	queries := connector.executed()
+	if !strings.HasPrefix(queries[len(queries)-1], "DROP TABLE IF EXISTS ") {
+		t.Errorf("queries = %q, want the scratch table dropped", queries)
+	}
+}
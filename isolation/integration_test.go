@@ -0,0 +1,60 @@
+package isolation
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+)
+
+// testDSNEnv - переменная с DSN сервера Postgres для интеграционных тестов;
+// без нее они пропускаются.
+const testDSNEnv = "ISOLATION_TEST_DSN"
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skip(testDSNEnv + " is not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	if err = db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// TestMatchesPostgres проверяет, что каждая аномалия проявляется на сервере
+// ровно на тех уровнях, на которых ее допускает Postgres.
+func TestMatchesPostgres(t *testing.T) {
+	db := openTestDB(t)
+	for _, a := range Anomalies() {
+		for _, level := range Levels(Postgres) {
+			t.Run(a.Name+"/"+level.String(), func(t *testing.T) {
+				Expect(t, db).Anomaly(a).AtLevel(level).Within(10 * time.Second).MatchesDialect(Postgres)
+			})
+		}
+	}
+}
+
+// TestScratchTableDropped проверяет, что временная таблица Expect удаляется
+// по завершении теста.
+func TestScratchTableDropped(t *testing.T) {
+	db := openTestDB(t)
+	var table string
+	t.Run("expect", func(t *testing.T) {
+		e := Expect(t, db)
+		table = e.scratch().Table
+	})
+	var exists bool
+	if err := db.QueryRow("SELECT to_regclass($1) IS NOT NULL", quoteTable(table)).Scan(&exists); err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Errorf("scratch table %s was not dropped", table)
+	}
+}
@@ -0,0 +1,185 @@
+// Package isolation разбирает и проверяет названия уровней изоляции
+// транзакций для поддерживаемых СУБД, измеряет их стоимость на схеме
+// вызывающего из go test -bench (BenchmarkWorkload, BenchmarkLevels, Prepared)
+// и проверяет в его тестах, какие аномалии допускает уровень (Expect, Observe).
+//
+//	level, err := isolation.ParseLevel("Repeatable-Read", isolation.Postgres)
+//	var unknown *isolation.UnknownLevelError
+//	if errors.As(err, &unknown) && unknown.Suggestion != "" {
+//		fmt.Println("did you mean", unknown.Suggestion)
+//	}
+package isolation
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Dialect - СУБД, для которой проверяется уровень изоляции.
+type Dialect string
+
+const (
+	// Postgres поддерживает все четыре уровня стандарта; READ UNCOMMITTED
+	// ведет себя как READ COMMITTED.
+	Postgres Dialect = "postgres"
+	// MySQL (InnoDB) поддерживает четыре уровня стандарта; REPEATABLE READ
+	// читает снимок, но UPDATE видит последние зафиксированные строки.
+	MySQL Dialect = "mysql"
+	// SQLServer добавляет к уровням стандарта SNAPSHOT; READ COMMITTED
+	// читает снимок при READ_COMMITTED_SNAPSHOT ON.
+	SQLServer Dialect = "sqlserver"
+)
+
+var supported = map[Dialect][]sql.IsolationLevel{
+	Postgres: {
+		sql.LevelReadUncommitted,
+		sql.LevelReadCommitted,
+		sql.LevelRepeatableRead,
+		sql.LevelSerializable,
+	},
+	MySQL: {
+		sql.LevelReadUncommitted,
+		sql.LevelReadCommitted,
+		sql.LevelRepeatableRead,
+		sql.LevelSerializable,
+	},
+	SQLServer: {
+		sql.LevelReadUncommitted,
+		sql.LevelReadCommitted,
+		sql.LevelRepeatableRead,
+		sql.LevelSnapshot,
+		sql.LevelSerializable,
+	},
+}
+
+// Dialects возвращает поддерживаемые СУБД по имени.
+func Dialects() []Dialect {
+	return []Dialect{MySQL, Postgres, SQLServer}
+}
+
+// ParseDialect разбирает имя СУБД без учета регистра; postgresql и mssql -
+// синонимы postgres и sqlserver.
+func ParseDialect(name string) (Dialect, error) {
+	switch d := Dialect(strings.ToLower(strings.TrimSpace(name))); d {
+	case Postgres, MySQL, SQLServer:
+		return d, nil
+	case "postgresql":
+		return Postgres, nil
+	case "mssql":
+		return SQLServer, nil
+	default:
+		return "", fmt.Errorf("unknown dialect %q, expected %s, %s or %s", name, MySQL, Postgres, SQLServer)
+	}
+}
+
+// names - нормализованные названия и сокращения уровней.
+var names = map[string]sql.IsolationLevel{
+	"readuncommitted": sql.LevelReadUncommitted,
+	"ru":              sql.LevelReadUncommitted,
+	"readcommitted":   sql.LevelReadCommitted,
+	"rc":              sql.LevelReadCommitted,
+	"repeatableread":  sql.LevelRepeatableRead,
+	"rr":              sql.LevelRepeatableRead,
+	"snapshot":        sql.LevelSnapshot,
+	"serializable":    sql.LevelSerializable,
+	"ser":             sql.LevelSerializable,
+	"linearizable":    sql.LevelLinearizable,
+}
+
+// UnknownLevelError - название не соответствует ни одному уровню изоляции.
+type UnknownLevelError struct {
+	Name string
+	// Suggestion - ближайшее известное название или пустая строка
+	Suggestion string
+}
+
+func (e *UnknownLevelError) Error() string {
+	if e.Suggestion != "" {
+		return fmt.Sprintf("unknown isolation level %q, did you mean %q?", e.Name, e.Suggestion)
+	}
+	return fmt.Sprintf("unknown isolation level %q", e.Name)
+}
+
+// UnsupportedLevelError - уровень известен, но не поддерживается СУБД.
+type UnsupportedLevelError struct {
+	Level   sql.IsolationLevel
+	Dialect Dialect
+}
+
+func (e *UnsupportedLevelError) Error() string {
+	return fmt.Sprintf("isolation level %s is not supported by %s", e.Level, e.Dialect)
+}
+
+// ParseLevel разбирает название уровня без учета регистра, пробелов, дефисов
+// и подчеркиваний ("read committed", "READ_COMMITTED", "ReadCommitted", "rc")
+// и проверяет, что уровень поддерживается dialect.
+func ParseLevel(name string, dialect Dialect) (sql.IsolationLevel, error) {
+	key := normalize(name)
+	level, ok := names[key]
+	if !ok {
+		return sql.LevelDefault, &UnknownLevelError{Name: name, Suggestion: suggest(key, dialect)}
+	}
+	if !Supported(level, dialect) {
+		return sql.LevelDefault, &UnsupportedLevelError{Level: level, Dialect: dialect}
+	}
+	return level, nil
+}
+
+// Supported сообщает, поддерживает ли dialect уровень level.
+func Supported(level sql.IsolationLevel, dialect Dialect) bool {
+	for _, l := range supported[dialect] {
+		if l == level {
+			return true
+		}
+	}
+	return false
+}
+
+// Levels возвращает уровни, поддерживаемые dialect, от слабого к сильному.
+func Levels(dialect Dialect) []sql.IsolationLevel {
+	return append([]sql.IsolationLevel(nil), supported[dialect]...)
+}
+
+func normalize(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || r == '-' || r == '_' {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, name)
+}
+
+// suggest возвращает название поддерживаемого уровня, ближайшее к key по
+// расстоянию Левенштейна, если оно не дальше трети длины названия.
+func suggest(key string, dialect Dialect) string {
+	best, bestDistance := "", len(key)/3+1
+	for _, level := range supported[dialect] {
+		candidate := strings.ToLower(level.String())
+		if d := distance(key, normalize(candidate)); d < bestDistance {
+			best, bestDistance = candidate, d
+		}
+	}
+	return best
+}
+
+func distance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
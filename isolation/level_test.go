@@ -0,0 +1,128 @@
+package isolation
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		name string
+		want sql.IsolationLevel
+	}{
+		{"read committed", sql.LevelReadCommitted},
+		{"READ_COMMITTED", sql.LevelReadCommitted},
+		{"ReadCommitted", sql.LevelReadCommitted},
+		{"rc", sql.LevelReadCommitted},
+		{"Repeatable-Read", sql.LevelRepeatableRead},
+		{"read uncommitted", sql.LevelReadUncommitted},
+		{" Serializable ", sql.LevelSerializable},
+		{"ser", sql.LevelSerializable},
+	}
+	for _, tt := range tests {
+		got, err := ParseLevel(tt.name, Postgres)
+		if err != nil {
+			t.Errorf("ParseLevel(%q): %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseLevel(%q) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseLevelUnknown(t *testing.T) {
+	tests := []struct {
+		name       string
+		suggestion string
+	}{
+		{"serialisable", "serializable"},
+		{"read comitted", "read committed"},
+		{"strict", ""},
+	}
+	for _, tt := range tests {
+		_, err := ParseLevel(tt.name, Postgres)
+		var unknown *UnknownLevelError
+		if !errors.As(err, &unknown) {
+			t.Errorf("ParseLevel(%q) error = %v, want *UnknownLevelError", tt.name, err)
+			continue
+		}
+		if unknown.Name != tt.name || unknown.Suggestion != tt.suggestion {
+			t.Errorf("ParseLevel(%q) = %+v, want suggestion %q", tt.name, unknown, tt.suggestion)
+		}
+	}
+}
+
+func TestParseLevelUnsupported(t *testing.T) {
+	for _, name := range []string{"snapshot", "linearizable"} {
+		_, err := ParseLevel(name, Postgres)
+		var unsupported *UnsupportedLevelError
+		if !errors.As(err, &unsupported) || unsupported.Dialect != Postgres {
+			t.Errorf("ParseLevel(%q) error = %v, want *UnsupportedLevelError", name, err)
+		}
+	}
+	if _, err := ParseLevel("rc", Dialect("oracle")); err == nil {
+		t.Error("ParseLevel with an unknown dialect succeeded")
+	}
+}
+
+func TestLevels(t *testing.T) {
+	levels := Levels(Postgres)
+	if len(levels) != 4 || levels[0] != sql.LevelReadUncommitted || levels[3] != sql.LevelSerializable {
+		t.Fatalf("Levels(Postgres) = %v", levels)
+	}
+	// Levels возвращает копию: изменение не затрагивает поддерживаемые уровни
+	levels[0] = sql.LevelSnapshot
+	if Supported(sql.LevelSnapshot, Postgres) {
+		t.Error("Levels result aliases the supported levels")
+	}
+}
+
+func TestParseLevelDialects(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialect Dialect
+		want    sql.IsolationLevel
+		ok      bool
+	}{
+		{"snapshot", SQLServer, sql.LevelSnapshot, true},
+		{"snapshot", MySQL, sql.LevelDefault, false},
+		{"repeatable read", MySQL, sql.LevelRepeatableRead, true},
+		{"read uncommitted", SQLServer, sql.LevelReadUncommitted, true},
+		{"linearizable", SQLServer, sql.LevelDefault, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseLevel(tt.name, tt.dialect)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseLevel(%q, %s) = %s, %v", tt.name, tt.dialect, got, err)
+		}
+	}
+}
+
+func TestParseDialect(t *testing.T) {
+	tests := []struct {
+		name string
+		want Dialect
+	}{
+		{"postgres", Postgres},
+		{"PostgreSQL", Postgres},
+		{" MySQL ", MySQL},
+		{"sqlserver", SQLServer},
+		{"mssql", SQLServer},
+	}
+	for _, tt := range tests {
+		got, err := ParseDialect(tt.name)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseDialect(%q) = %s, %v, want %s", tt.name, got, err, tt.want)
+		}
+	}
+	if _, err := ParseDialect("oracle"); err == nil {
+		t.Error("ParseDialect accepted oracle")
+	}
+	for _, d := range Dialects() {
+		if len(Levels(d)) == 0 {
+			t.Errorf("Levels(%s) is empty", d)
+		}
+	}
+}
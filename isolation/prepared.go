@@ -0,0 +1,169 @@
+package isolation
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Prepared - оператор, подготовленный на сервере SQL командой PREPARE и
+// выполняемый командой EXECUTE внутри транзакции Workload.Tx. В отличие от
+// (*sql.Tx).Prepare, оператор живет до конца сеанса, а не транзакции, поэтому
+// при plan_cache_mode = auto после пяти выполнений сервер может перейти на
+// общий (generic) план, как в приложениях с долгоживущими подключениями:
+//
+//	var transfer = isolation.Prepared{
+//		Name:      "transfer",
+//		Statement: "UPDATE account SET balance = balance + $2 WHERE id = $1",
+//		Types:     []string{"int", "bigint"},
+//	}
+//
+//	func tx(ctx context.Context, tx *sql.Tx) error {
+//		_, err := transfer.Exec(ctx, tx, 1, -100)
+//		return err
+//	}
+//
+// Выбор плана не меняет видимость: EXECUTE читает снимок транзакции так же,
+// как тот же запрос без PREPARE.
+type Prepared struct {
+	Name string
+	// Statement - текст запроса с параметрами $1, $2, ...
+	Statement string
+	// Types - типы параметров; пусто - сервер выводит их из запроса
+	Types []string
+}
+
+// PrepareSQL возвращает команду PREPARE оператора.
+func (p Prepared) PrepareSQL() string {
+	var types string
+	if len(p.Types) > 0 {
+		types = "(" + strings.Join(p.Types, ", ") + ")"
+	}
+	return fmt.Sprintf("PREPARE %s%s AS %s", pq.QuoteIdentifier(p.Name), types, strings.TrimSuffix(strings.TrimSpace(p.Statement), ";"))
+}
+
+// ExecuteSQL возвращает команду EXECUTE с аргументами args, подставленными
+// литералами: параметры протокола в EXECUTE не передаются.
+func (p Prepared) ExecuteSQL(args ...any) (string, error) {
+	if len(args) == 0 {
+		return "EXECUTE " + pq.QuoteIdentifier(p.Name), nil
+	}
+	literals := make([]string, len(args))
+	for i, arg := range args {
+		literal, err := Literal(arg)
+		if err != nil {
+			return "", fmt.Errorf("isolation: execute %q argument %d: %w", p.Name, i+1, err)
+		}
+		literals[i] = literal
+	}
+	return fmt.Sprintf("EXECUTE %s(%s)", pq.QuoteIdentifier(p.Name), strings.Join(literals, ", ")), nil
+}
+
+// DeallocateSQL возвращает команду DEALLOCATE оператора.
+func (p Prepared) DeallocateSQL() string {
+	return "DEALLOCATE " + pq.QuoteIdentifier(p.Name)
+}
+
+// Exec выполняет оператор в транзакции tx, подготавливая его, если сеанс
+// транзакции еще не знает оператора.
+func (p Prepared) Exec(ctx context.Context, tx *sql.Tx, args ...any) (sql.Result, error) {
+	query, err := p.ExecuteSQL(args...)
+	if err != nil {
+		return nil, err
+	}
+	if err = p.ensure(ctx, tx); err != nil {
+		return nil, err
+	}
+	return tx.ExecContext(ctx, query)
+}
+
+// Query выполняет запрос в транзакции tx, подготавливая его, если сеанс
+// транзакции еще не знает оператора.
+func (p Prepared) Query(ctx context.Context, tx *sql.Tx, args ...any) (*sql.Rows, error) {
+	query, err := p.ExecuteSQL(args...)
+	if err != nil {
+		return nil, err
+	}
+	if err = p.ensure(ctx, tx); err != nil {
+		return nil, err
+	}
+	return tx.QueryContext(ctx, query)
+}
+
+// ensure подготавливает оператор в сеансе tx. Пул отдает транзакции разные
+// подключения, поэтому наличие оператора проверяется по pg_prepared_statements
+// при каждом выполнении; PREPARE существующего оператора прервал бы транзакцию.
+func (p Prepared) ensure(ctx context.Context, tx *sql.Tx) error {
+	var exists bool
+	const existsQuery = "SELECT EXISTS (SELECT 1 FROM pg_prepared_statements WHERE name = $1)"
+	if err := tx.QueryRowContext(ctx, existsQuery, p.Name).Scan(&exists); err != nil {
+		return fmt.Errorf("isolation: prepared statement %q: %w", p.Name, err)
+	}
+	if exists {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, p.PrepareSQL()); err != nil {
+		return fmt.Errorf("isolation: prepare %q: %w", p.Name, err)
+	}
+	return nil
+}
+
+// Literal возвращает значение v литералом SQL: NULL, строка в кавычках,
+// []byte как bytea в шестнадцатеричной записи, TRUE или FALSE, число как
+// есть. driver.Valuer заменяется своим значением. Для других типов
+// возвращается ошибка: их текст мог бы изменить смысл оператора.
+func Literal(v any) (string, error) {
+	if valuer, ok := v.(driver.Valuer); ok {
+		value, err := valuer.Value()
+		if err != nil {
+			return "", fmt.Errorf("isolation: literal of %T: %w", v, err)
+		}
+		v = value
+	}
+	switch v := v.(type) {
+	case nil:
+		return "NULL", nil
+	case string:
+		return pq.QuoteLiteral(v), nil
+	case []byte:
+		return pq.QuoteLiteral(`\x`+hex.EncodeToString(v)) + "::bytea", nil
+	case time.Time:
+		return pq.QuoteLiteral(v.Format(time.RFC3339Nano)), nil
+	case bool:
+		if v {
+			return "TRUE", nil
+		}
+		return "FALSE", nil
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprint(v), nil
+	case float32:
+		return floatLiteral(float64(v), 32), nil
+	case float64:
+		return floatLiteral(v, 64), nil
+	default:
+		return "", fmt.Errorf("isolation: unsupported literal type %T", v)
+	}
+}
+
+// floatLiteral записывает NaN и бесконечности строками, которые принимает
+// float8, а конечные значения - без потери точности.
+func floatLiteral(f float64, bitSize int) string {
+	switch {
+	case math.IsNaN(f):
+		return "'NaN'::float8"
+	case math.IsInf(f, 1):
+		return "'Infinity'::float8"
+	case math.IsInf(f, -1):
+		return "'-Infinity'::float8"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, bitSize)
+	}
+}
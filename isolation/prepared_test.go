@@ -0,0 +1,69 @@
+package isolation
+
+import (
+	"database/sql/driver"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+type cents int64
+
+func (c cents) Value() (driver.Value, error) {
+	return int64(c) / 100, nil
+}
+
+func TestLiteral(t *testing.T) {
+	tests := []struct {
+		v    any
+		want string
+	}{
+		{nil, "NULL"},
+		{"it's", `'it''s'`},
+		{[]byte{0x01, 0xab}, ` E'\\x01ab'::bytea`},
+		{true, "TRUE"},
+		{false, "FALSE"},
+		{-5, "-5"},
+		{uint8(7), "7"},
+		{int64(1) << 40, "1099511627776"},
+		{0.1, "0.1"},
+		{float32(0.5), "0.5"},
+		{math.NaN(), "'NaN'::float8"},
+		{math.Inf(-1), "'-Infinity'::float8"},
+		{time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), "'2024-01-02T03:04:05Z'"},
+		{cents(1200), "12"},
+	}
+	for _, tt := range tests {
+		got, err := Literal(tt.v)
+		if err != nil {
+			t.Errorf("Literal(%#v): %v", tt.v, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Literal(%#v) = %s, want %s", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestLiteralUnsupported(t *testing.T) {
+	for _, v := range []any{[]int{1}, struct{}{}, map[string]int{}} {
+		if got, err := Literal(v); err == nil {
+			t.Errorf("Literal(%#v) = %s, want an error", v, got)
+		}
+	}
+}
+
+func TestExecuteSQL(t *testing.T) {
+	p := Prepared{Name: "transfer"}
+	got, err := p.ExecuteSQL(1, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `EXECUTE "transfer"(1, 'a')`; got != want {
+		t.Errorf("ExecuteSQL() = %s, want %s", got, want)
+	}
+	if _, err = p.ExecuteSQL(1, []string{"a"}); err == nil || !strings.Contains(err.Error(), "argument 2") {
+		t.Errorf("ExecuteSQL with a slice argument: %v", err)
+	}
+}
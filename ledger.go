@@ -0,0 +1,155 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+const (
+	ledgerWorkers  = 8
+	ledgerDeposits = 100
+)
+
+var ledgerMigrations = []string{
+	`DROP VIEW IF EXISTS wallet_balance;`,
+	`DROP TABLE IF EXISTS wallet_entry;`,
+	`DROP TABLE IF EXISTS wallet;`,
+	`CREATE TABLE wallet (
+           id INT PRIMARY KEY,
+           balance BIGINT NOT NULL
+         );`,
+	// Журнал только дополняется: баланс - сумма проводок, строки не изменяются
+	`CREATE TABLE wallet_entry (
+           id BIGSERIAL PRIMARY KEY,
+           wallet_id INT NOT NULL REFERENCES wallet (id),
+           amount BIGINT NOT NULL
+         );`,
+	`CREATE VIEW wallet_balance AS
+           SELECT w.id AS wallet_id, COALESCE(SUM(e.amount), 0) AS balance
+           FROM wallet w LEFT JOIN wallet_entry e ON e.wallet_id = w.id
+           GROUP BY w.id;`,
+	`INSERT INTO wallet VALUES (1, 0);`,
+}
+
+// depositModel зачисляет 1 на кошелек в одной транзакции.
+type depositModel func(tx *transaction) error
+
+var depositModels = []struct {
+	name    string
+	deposit depositModel
+	// balanceQuery читает итоговый баланс кошелька 1
+	balanceQuery string
+	// lossless - модель не теряет зачисления
+	lossless bool
+}{
+	{"update_in_place", depositInPlace, "SELECT balance FROM wallet WHERE id = 1;", false},
+	{"update_in_place_for_update", depositInPlaceForUpdate, "SELECT balance FROM wallet WHERE id = 1;", true},
+	{"append_only_ledger", depositLedger, "SELECT balance FROM wallet_balance WHERE wallet_id = 1;", true},
+}
+
+// walletLedger сравнивает баланс, хранимый в строке кошелька, с балансом как
+// суммой журнала проводок. Чтение и запись баланса в строке при READ COMMITTED
+// теряют зачисления конкурентов, FOR UPDATE исключает потерю ценой очереди на
+// блокировке строки. В журнале транзакции только вставляют новые строки: им
+// нечего перезаписывать, и потерянное обновление исключено самой моделью без
+// блокировок и повторов.
+func walletLedger(db *sqlx.DB, logger *zap.Logger) error {
+	for _, m := range depositModels {
+		modelLogger := logger.With(zap.String("model", m.name))
+		suiteProgress.setStep("model " + m.name)
+		if err := migrate(db, modelLogger, []string{`DELETE FROM wallet_entry;`, `UPDATE wallet SET balance = 0;`}); err != nil {
+			return err
+		}
+
+		// Логи отдельных зачислений отключены: их сотни на каждую модель
+		workerLogger := zap.NewNop()
+		var latency atomic.Int64
+		var wg sync.WaitGroup
+		errs := make(chan error, ledgerWorkers)
+		started := time.Now()
+		for range ledgerWorkers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < ledgerDeposits; i++ {
+					depositStarted := time.Now()
+					err := runDeposit(db, workerLogger, m.deposit)
+					latency.Add(int64(time.Since(depositStarted)))
+					if err != nil {
+						errs <- err
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		elapsed := time.Since(started)
+		close(errs)
+		if err := <-errs; err != nil {
+			modelLogger.Error("model failed", zap.Error(err))
+			return fmt.Errorf("%s: %w", m.name, err)
+		}
+
+		var balance int
+		if err := db.Get(&balance, m.balanceQuery); err != nil {
+			modelLogger.Error("failed to read balance", zap.Error(err))
+			return err
+		}
+		expected := ledgerWorkers * ledgerDeposits
+		modelLogger.Info("model finished",
+			zap.Int("workers", ledgerWorkers),
+			zap.Int("expected", expected),
+			zap.Int("balance", balance),
+			zap.Int("lost_deposits", expected-balance),
+			zap.Duration("elapsed", elapsed),
+			zap.Float64("deposits_per_sec", float64(expected)/elapsed.Seconds()),
+		)
+		recordBenchmark(newBenchmarkResult("wallet_ledger", m.name, sql.LevelReadCommitted.String(),
+			expected, 0, elapsed, time.Duration(latency.Load())))
+		if m.lossless && balance != expected {
+			return fmt.Errorf("%s: balance is %d, expected %d", m.name, balance, expected)
+		}
+	}
+	return nil
+}
+
+func runDeposit(db *sqlx.DB, logger *zap.Logger, deposit depositModel) error {
+	tx := newTransaction(db, logger)
+	if err := tx.begin(); err != nil {
+		return err
+	}
+	if err := deposit(tx); err != nil {
+		ignoreError(logger, "rollback", tx.rollback())
+		return err
+	}
+	return tx.commit()
+}
+
+func depositInPlace(tx *transaction) error {
+	rows, err := tx.query("SELECT balance FROM wallet WHERE id = 1;")
+	if err != nil {
+		return err
+	}
+	_, err = tx.exec("UPDATE wallet SET balance = $1 WHERE id = 1;", rows[0][0].(int64)+1)
+	return err
+}
+
+func depositInPlaceForUpdate(tx *transaction) error {
+	rows, err := tx.query("SELECT balance FROM wallet WHERE id = 1 FOR UPDATE;")
+	if err != nil {
+		return err
+	}
+	_, err = tx.exec("UPDATE wallet SET balance = $1 WHERE id = 1;", rows[0][0].(int64)+1)
+	return err
+}
+
+func depositLedger(tx *transaction) error {
+	_, err := tx.exec("INSERT INTO wallet_entry (wallet_id, amount) VALUES (1, 1);")
+	return err
+}
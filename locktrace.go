@@ -0,0 +1,204 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Отметки начала и завершения транзакции в истории шагов.
+const (
+	traceBegin    = "BEGIN"
+	traceCommit   = "COMMIT"
+	traceRollback = "ROLLBACK"
+)
+
+// lockTraceQuery возвращает блокировки сессии, которая выполняет оператор с
+// меткой $1: взятые и ожидаемые, а для ожидаемых - application_name сессий,
+// которые их удерживают. Строчные блокировки сервер хранит в самих строках,
+// поэтому ожидание чужой строки видно как ожидание transactionid ее владельца.
+const lockTraceQuery = `SELECT concat_ws(' ', l.locktype, l.relation::regclass::text, 'page ' || l.page,
+           'tuple ' || l.tuple, 'xid ' || l.transactionid) AS object,
+         l.mode, l.granted,
+         CASE WHEN NOT l.granted THEN
+           (SELECT string_agg(b.application_name, ',' ORDER BY b.pid)
+              FROM pg_stat_activity b
+              WHERE b.pid = ANY (pg_blocking_pids(w.pid)))
+         END AS blocked_by
+     FROM pg_stat_activity w
+     JOIN pg_locks l ON l.pid = w.pid
+     WHERE w.datname = current_database() AND w.state = 'active'
+       AND left(w.query, length($1)) = $1 AND l.locktype <> 'virtualxid'
+     ORDER BY l.granted DESC, object;`
+
+// tracedLock - блокировка из снимка pg_locks ждущего оператора.
+type tracedLock struct {
+	Object    string  `db:"object"`
+	Mode      string  `db:"mode"`
+	Granted   bool    `db:"granted"`
+	BlockedBy *string `db:"blocked_by"`
+}
+
+// traceEvent - оператор транзакции в истории шагов сценария.
+type traceEvent struct {
+	tx       string
+	query    string
+	started  time.Time
+	finished time.Time
+	code     string
+	// locks - снимок блокировок сессии, если оператор ждал дольше blockedThreshold
+	locks []tracedLock
+}
+
+// blockers возвращает имена транзакций, удерживавших ожидаемые оператором блокировки.
+func (e *traceEvent) blockers() []string {
+	var names []string
+	for _, l := range e.locks {
+		if l.Granted || l.BlockedBy == nil {
+			continue
+		}
+		for _, name := range strings.Split(*l.BlockedBy, ",") {
+			// application_name сессии сценария заканчивается именем транзакции
+			names = append(names, name[strings.LastIndex(name, ":")+1:])
+		}
+	}
+	return names
+}
+
+// lockTrace - история операторов транзакций сценария со снимками блокировок,
+// по которой восстанавливается порядок захвата блокировок при взаимоблокировке.
+type lockTrace struct {
+	mu     sync.Mutex
+	events []*traceEvent
+}
+
+// add записывает начало оператора. BEGIN отбрасывает предыдущие операторы
+// транзакции: в цикл ожиданий входят только блокировки текущей попытки.
+func (tr *lockTrace) add(tx, query string) *traceEvent {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if query == traceBegin {
+		kept := tr.events[:0]
+		for _, e := range tr.events {
+			if e.tx != tx {
+				kept = append(kept, e)
+			}
+		}
+		tr.events = kept
+	}
+	e := &traceEvent{tx: tx, query: query, started: time.Now()}
+	tr.events = append(tr.events, e)
+	return e
+}
+
+func (tr *lockTrace) finish(e *traceEvent, code string) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	e.finished = time.Now()
+	e.code = code
+}
+
+func (tr *lockTrace) capture(e *traceEvent, locks []tracedLock) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	e.locks = locks
+}
+
+// report выводит операторы участников взаимоблокировки в порядке их начала:
+// какие блокировки держала каждая транзакция и чьих блокировок она ждала.
+// Участники - жертва и транзакции, которых ждали операторы участников.
+func (tr *lockTrace) report(victim string, logger *zap.Logger) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	participants := map[string]bool{victim: true}
+	for changed := true; changed; {
+		changed = false
+		for _, e := range tr.events {
+			if !participants[e.tx] {
+				continue
+			}
+			for _, tx := range e.blockers() {
+				if !participants[tx] {
+					participants[tx] = true
+					changed = true
+				}
+			}
+		}
+	}
+
+	var waits []string
+	order := 0
+	for _, e := range tr.events {
+		if !participants[e.tx] {
+			continue
+		}
+		order++
+		fields := []zap.Field{zap.Int("order", order), zap.String("tx", e.tx), zap.String("statement", e.query)}
+		var holds, waitsFor []string
+		for _, l := range e.locks {
+			if l.Granted {
+				holds = append(holds, l.Object+" "+l.Mode)
+			} else {
+				waitsFor = append(waitsFor, l.Object+" "+l.Mode)
+			}
+		}
+		if len(holds) > 0 {
+			fields = append(fields, zap.Strings("holds", holds))
+		}
+		if len(waitsFor) > 0 {
+			blockers := e.blockers()
+			fields = append(fields, zap.Strings("waits_for", waitsFor), zap.Strings("held_by", blockers))
+			waits = append(waits, e.tx+" waits for "+strings.Join(blockers, ","))
+		}
+		if e.finished.IsZero() {
+			fields = append(fields, zap.Bool("pending", true))
+		} else {
+			fields = append(fields, zap.Duration("duration", e.finished.Sub(e.started).Round(time.Millisecond)))
+		}
+		if e.code != "" {
+			fields = append(fields, zap.String("code", e.code))
+		}
+		logger.Info("deadlock trace", fields...)
+	}
+	logger.Info("deadlock cycle", zap.String("victim", victim), zap.Strings("waits", waits))
+}
+
+// traceStatement записывает оператор в историю шагов сценария. Если оператор
+// выполняется дольше blockedThreshold, монитор снимает блокировки его сессии.
+// Возвращенная функция завершает запись, а при взаимоблокировке выводит
+// порядок захвата блокировок ее участниками.
+func (t *transaction) traceStatement(query string) func(err error) {
+	if t.tag == nil || !monitorAccess.locks {
+		return func(error) {}
+	}
+	trace := t.tag.trace
+	e := trace.add(t.tag.tx, query)
+	prefix := t.tag.commentPrefix()
+	timer := time.AfterFunc(blockedThreshold, func() {
+		var locks []tracedLock
+		if err := monitorDB(t.db).Select(&locks, lockTraceQuery, prefix); err != nil {
+			t.logger.Error("failed to capture locks", zap.Error(err))
+			return
+		}
+		trace.capture(e, locks)
+	})
+	return func(err error) {
+		timer.Stop()
+		code := errorCode(err)
+		trace.finish(e, code)
+		if code == "40P01" {
+			trace.report(t.tag.tx, t.logger)
+		}
+	}
+}
+
+// traceMark записывает в историю начало или завершение транзакции.
+func (t *transaction) traceMark(mark string) {
+	if t.tag == nil {
+		return
+	}
+	t.tag.trace.finish(t.tag.trace.add(t.tag.tx, mark), "")
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// logReplay - описание окна конкуренции из журнала сервера приложения:
+//
+//	name: checkout
+//	log: postgresql.log
+//	from: "2024-05-01 10:00:00"
+//	to: "2024-05-01 10:00:05"
+//	level: read committed
+//	setup:
+//	  - CREATE TABLE orders (...);
+//
+// Журнал пишется с log_statement = all и log_line_prefix, в начале которого
+// время и идентификатор сеанса, по умолчанию '%m [%p] '. Другой префикс
+// задается line_prefix - регулярным выражением с группами time и session.
+type logReplay struct {
+	Name string `yaml:"name"`
+	// Log - файл журнала; относительный путь отсчитывается от файла описания
+	Log        string `yaml:"log"`
+	LinePrefix string `yaml:"line_prefix"`
+	// From и To - границы окна; транзакции, начатые в окне, воспроизводятся целиком
+	From  string `yaml:"from"`
+	To    string `yaml:"to"`
+	Level string `yaml:"level"`
+	// Setup - схема и данные, на которых воспроизводится окно
+	Setup []string `yaml:"setup"`
+
+	prefix *regexp.Regexp
+	from   time.Time
+	to     time.Time
+}
+
+// defaultLogLinePrefix разбирает префикс '%m [%p] ': время с миллисекундами,
+// часовой пояс и pid серверного процесса.
+const defaultLogLinePrefix = `^(?P<time>\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}(?:\.\d+)?)(?: [A-Za-z+\-0-9]+)? \[(?P<session>[^\]]+)\]`
+
+// logTimeLayout - формат времени в журнале и в границах окна.
+const logTimeLayout = "2006-01-02 15:04:05.999999"
+
+// Сообщения журнала после префикса: оператор простого протокола или
+// расширенного с его параметрами следующей строкой DETAIL.
+var (
+	logStatementPattern  = regexp.MustCompile(`^\s*LOG:\s+(?:duration: [\d.]+ ms\s+)?(?:statement|execute [^:]+): (.*)$`)
+	logParametersPattern = regexp.MustCompile(`^\s*DETAIL:\s+parameters: (.*)$`)
+	logParameterPattern  = regexp.MustCompile(`\$(\d+) = ('(?:[^']|'')*'|NULL)`)
+)
+
+func readLogReplay(file string) (*logReplay, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r logReplay
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err = decoder.Decode(&r); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	if err = r.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	if !filepath.IsAbs(r.Log) {
+		r.Log = filepath.Join(filepath.Dir(file), r.Log)
+	}
+	return &r, nil
+}
+
+func (r *logReplay) validate() error {
+	if r.Name == "" || r.Log == "" {
+		return errors.New("name and log are required")
+	}
+	if r.Level == "" {
+		r.Level = "read committed"
+	}
+	if _, err := parseLevel(r.Level); err != nil {
+		return err
+	}
+	prefix := r.LinePrefix
+	if prefix == "" {
+		prefix = defaultLogLinePrefix
+	}
+	var err error
+	if r.prefix, err = regexp.Compile(prefix); err != nil {
+		return fmt.Errorf("line_prefix: %w", err)
+	}
+	if r.prefix.SubexpIndex("time") < 0 || r.prefix.SubexpIndex("session") < 0 {
+		return errors.New("line_prefix must have named groups time and session")
+	}
+	if r.From != "" {
+		if r.from, err = time.Parse(logTimeLayout, r.From); err != nil {
+			return fmt.Errorf("from: %w", err)
+		}
+	}
+	if r.To != "" {
+		if r.to, err = time.Parse(logTimeLayout, r.To); err != nil {
+			return fmt.Errorf("to: %w", err)
+		}
+	}
+	if !r.from.IsZero() && !r.to.IsZero() && r.to.Before(r.from) {
+		return fmt.Errorf("to %s is before from %s", r.To, r.From)
+	}
+	return nil
+}
+
+// Виды записей журнала, восстановленных в транзакции.
+const (
+	logBegin     = "begin"
+	logCommit    = "commit"
+	logRollback  = "rollback"
+	logStatement = "statement"
+)
+
+// logEntry - оператор сеанса из журнала с подставленными параметрами.
+type logEntry struct {
+	time    time.Time
+	session string
+	kind    string
+	query   string
+}
+
+// readServerLog читает операторы журнала в порядке записи. Строки без
+// префикса продолжают многострочный оператор предыдущей записи.
+func (r *logReplay) readServerLog() ([]logEntry, error) {
+	f, err := os.Open(r.Log)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []logEntry
+	// last - последняя запись сеанса для строки DETAIL с параметрами
+	last := make(map[string]int)
+	current := -1
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		m := r.prefix.FindStringSubmatchIndex(text)
+		if m == nil {
+			if current >= 0 {
+				entries[current].query += "\n" + strings.TrimPrefix(text, "\t")
+			}
+			continue
+		}
+		current = -1
+		session := text[m[2*r.prefix.SubexpIndex("session")]:m[2*r.prefix.SubexpIndex("session")+1]]
+		message := text[m[1]:]
+		if p := logParametersPattern.FindStringSubmatch(message); p != nil {
+			if i, ok := last[session]; ok {
+				entries[i].query = bindLogParameters(entries[i].query, p[1])
+			}
+			continue
+		}
+		s := logStatementPattern.FindStringSubmatch(message)
+		if s == nil {
+			continue
+		}
+		at, err := time.Parse(logTimeLayout, text[m[2*r.prefix.SubexpIndex("time")]:m[2*r.prefix.SubexpIndex("time")+1]])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", r.Log, line, err)
+		}
+		entries = append(entries, logEntry{time: at, session: session, query: s[1]})
+		current = len(entries) - 1
+		last[session] = current
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		entries[i].kind = logEntryKind(entries[i].query)
+	}
+	return entries, nil
+}
+
+// bindLogParameters подставляет параметры из DETAIL: parameters: $1 = '1', ...
+// Значения в журнале уже записаны литералами SQL.
+func bindLogParameters(query, parameters string) string {
+	values := make(map[string]string)
+	for _, p := range logParameterPattern.FindAllStringSubmatch(parameters, -1) {
+		values[p[1]] = p[2]
+	}
+	return placeholder.ReplaceAllStringFunc(query, func(p string) string {
+		if v, ok := values[p[1:]]; ok {
+			return v
+		}
+		return p
+	})
+}
+
+// logEntryKind отличает управление транзакцией от остальных операторов.
+// Уровень изоляции из BEGIN не сохраняется: окно воспроизводится на уровне описания.
+func logEntryKind(query string) string {
+	words := strings.Fields(strings.ToUpper(strings.TrimRight(strings.TrimSpace(query), ";")))
+	if len(words) == 0 {
+		return logStatement
+	}
+	switch {
+	case words[0] == "BEGIN" || words[0] == "START" && len(words) > 1 && words[1] == "TRANSACTION":
+		return logBegin
+	case words[0] == "COMMIT" && len(words) <= 2 || words[0] == "END":
+		return logCommit
+	case (words[0] == "ROLLBACK" || words[0] == "ABORT") && (len(words) == 1 || words[1] != "TO" && words[1] != "PREPARED"):
+		return logRollback
+	}
+	return logStatement
+}
+
+// window восстанавливает транзакции сеансов и оставляет начатые в окне
+// from..to. Операторы вне явной транзакции становятся транзакциями из одного
+// оператора, как в режиме autocommit.
+func (r *logReplay) window(entries []logEntry) []logEntry {
+	var selected []logEntry
+	// open - сеансы, чья явная транзакция выбрана; inside - сеансы внутри явной транзакции
+	open := make(map[string]bool)
+	inside := make(map[string]bool)
+	for _, e := range entries {
+		inWindow := (r.from.IsZero() || !e.time.Before(r.from)) && (r.to.IsZero() || !e.time.After(r.to))
+		switch {
+		case e.kind == logBegin:
+			inside[e.session] = true
+			open[e.session] = inWindow
+			if inWindow {
+				selected = append(selected, e)
+			}
+		case e.kind == logCommit || e.kind == logRollback:
+			if open[e.session] {
+				selected = append(selected, e)
+			}
+			inside[e.session], open[e.session] = false, false
+		case inside[e.session]:
+			if open[e.session] {
+				selected = append(selected, e)
+			}
+		case inWindow:
+			selected = append(selected,
+				logEntry{time: e.time, session: e.session, kind: logBegin, query: "BEGIN"},
+				e,
+				logEntry{time: e.time, session: e.session, kind: logCommit, query: "COMMIT"})
+		}
+	}
+	// Транзакции, не завершенные в журнале, откатываются в конце окна
+	sessions := make([]string, 0, len(open))
+	for session, ok := range open {
+		if ok {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Strings(sessions)
+	for _, session := range sessions {
+		selected = append(selected, logEntry{session: session, kind: logRollback, query: "ROLLBACK"})
+	}
+	return selected
+}
+
+// logReplayScenarios возвращает сценарии log/<name> для описаний files.
+func logReplayScenarios(files []string, logger *zap.Logger) (map[string]scenario, error) {
+	scenarios := make(map[string]scenario, len(files))
+	for _, file := range files {
+		r, err := readLogReplay(file)
+		if err != nil {
+			logger.Error("failed to load log replay", zap.Error(err), zap.String("file", file))
+			return nil, err
+		}
+		entries, err := r.readServerLog()
+		if err != nil {
+			logger.Error("failed to read server log", zap.Error(err), zap.String("log", r.Log))
+			return nil, err
+		}
+		selected := r.window(entries)
+		if len(selected) == 0 {
+			return nil, fmt.Errorf("%s: no transactions start between %q and %q in %s", file, r.From, r.To, r.Log)
+		}
+		level, _ := parseLevel(r.Level)
+		scenarios["log/"+r.Name] = scenario{
+			level:       level,
+			migrations:  r.Setup,
+			problem:     logReplayProblem(r, selected, level),
+			namespace:   "log_" + strings.ReplaceAll(r.Name, "-", "_"),
+			description: fmt.Sprintf("replay of %d statements from %s", len(selected), filepath.Base(r.Log)),
+			tags:        []string{"log-replay"},
+			cost:        logReplayCost(selected, level),
+		}
+		logger.Info("server log loaded", zap.String("scenario", "log/"+r.Name), zap.Int("statements", len(entries)), zap.Int("replayed", len(selected)))
+	}
+	return scenarios, nil
+}
+
+// logReplayCost оценивает воспроизведение окна на уровне level и на SERIALIZABLE.
+func logReplayCost(selected []logEntry, level sql.IsolationLevel) scenarioCost {
+	levels := []sql.IsolationLevel{level, sql.LevelSerializable}
+	sessions := make(map[string]bool)
+	var transactions int
+	for _, e := range selected {
+		sessions[e.session] = true
+		if e.kind == logBegin {
+			transactions++
+		}
+	}
+	return scenarioCost{levels: levels, transactions: len(levels) * transactions, sessions: len(sessions)}
+}
+
+// errPossibleAnomaly - окно проходит на выбранном уровне, но SERIALIZABLE его
+// не пропускает: чередование транзакций не эквивалентно никакому
+// последовательному порядку, и на выбранном уровне возможна аномалия.
+var errPossibleAnomaly = errors.New("possible anomaly")
+
+// logReplayProblem воспроизводит окно журнала на уровне level, а затем на
+// SERIALIZABLE с теми же исходными данными. Ошибка сериализации, которой нет
+// на выбранном уровне, означает, что окно содержит цикл зависимостей.
+func logReplayProblem(r *logReplay, entries []logEntry, level sql.IsolationLevel) isolationProblem {
+	return func(db *sqlx.DB, logger *zap.Logger) error {
+		outcome, err := replayLogWindow(db, logger.With(zap.String("level", level.String())), entries, level)
+		if err != nil || level == sql.LevelSerializable {
+			return err
+		}
+		if err = migrate(db, logger, r.Setup); err != nil {
+			return err
+		}
+		serializable, err := replayLogWindow(db, logger.With(zap.String("level", sql.LevelSerializable.String())), entries, sql.LevelSerializable)
+		if err != nil {
+			return err
+		}
+		if serializable.failures["40001"] > outcome.failures["40001"] {
+			return fmt.Errorf("%w at %s: %d of %d transactions commit, serializable aborts %d with serialization failures",
+				errPossibleAnomaly, level, outcome.committed, outcome.total, serializable.failures["40001"])
+		}
+		logger.Info("no anomaly in the replayed window", zap.Int("transactions", outcome.total))
+		return nil
+	}
+}
+
+// logReplayOutcome - итог воспроизведения окна: зафиксированные транзакции
+// и прерванные по SQLSTATE.
+type logReplayOutcome struct {
+	total     int
+	committed int
+	failures  map[string]int
+}
+
+// replaySession выполняет операторы одного сеанса журнала по очереди.
+type replaySession struct {
+	t     *transaction
+	level sql.IsolationLevel
+	// failed - оператор транзакции завершился ошибкой, ее операторы до конца пропускаются
+	failed  bool
+	entries chan replayStep
+}
+
+type replayStep struct {
+	entry logEntry
+	done  chan error
+}
+
+// replayLogWindow отправляет операторы сеансам в порядке журнала. Оператор,
+// ждущий блокировку дольше blockedWait, не задерживает следующие операторы
+// других сеансов, как и в исходном приложении.
+func replayLogWindow(db *sqlx.DB, logger *zap.Logger, entries []logEntry, level sql.IsolationLevel) (logReplayOutcome, error) {
+	outcome := logReplayOutcome{failures: make(map[string]int)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sessions := make(map[string]*replaySession)
+	for _, e := range entries {
+		s, ok := sessions[e.session]
+		if !ok {
+			s = &replaySession{t: newTransaction(db, logger.With(zap.String("tx", "s"+e.session))), level: level, entries: make(chan replayStep, len(entries))}
+			sessions[e.session] = s
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for step := range s.entries {
+					committed, code, err := s.run(step.entry)
+					mu.Lock()
+					switch {
+					case step.entry.kind == logBegin:
+						outcome.total++
+					case committed:
+						outcome.committed++
+					case code != "":
+						outcome.failures[code]++
+					}
+					mu.Unlock()
+					step.done <- err
+				}
+			}()
+		}
+		done := make(chan error, 1)
+		s.entries <- replayStep{entry: e, done: done}
+		select {
+		case err := <-done:
+			if err != nil {
+				logger.Warn("replayed statement failed", zap.String("session", e.session), zap.String("query", e.query), zap.Error(err))
+			}
+		case <-time.After(blockedWait):
+		}
+	}
+	for _, s := range sessions {
+		close(s.entries)
+	}
+	wg.Wait()
+	codes := make([]string, 0, len(outcome.failures))
+	for code := range outcome.failures {
+		codes = append(codes, code+"="+strconv.Itoa(outcome.failures[code]))
+	}
+	sort.Strings(codes)
+	logger.Info("log window replayed", zap.Int("transactions", outcome.total), zap.Int("committed", outcome.committed), zap.Strings("failures", codes))
+	return outcome, nil
+}
+
+// run выполняет запись журнала. Возвращает, зафиксирована ли транзакция, и
+// SQLSTATE, если транзакция прервана.
+func (s *replaySession) run(e logEntry) (committed bool, code string, err error) {
+	switch e.kind {
+	case logBegin:
+		s.failed = false
+		if err = s.t.begin(); err == nil {
+			err = s.t.setLevel(s.level)
+		}
+	case logCommit:
+		if s.failed {
+			return false, "", s.t.rollback()
+		}
+		if err = s.t.commit(); err == nil {
+			return true, "", nil
+		}
+	case logRollback:
+		return false, "", s.t.rollback()
+	default:
+		if s.failed {
+			return false, "", nil
+		}
+		_, err = s.t.exec(e.query)
+	}
+	if err != nil && !s.failed {
+		s.failed = e.kind != logCommit
+		return false, errorCode(err), err
+	}
+	return false, "", err
+}
@@ -1,15 +1,28 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+	"transactionIsolation/persondb"
 )
 
-func connect(logger *zap.Logger) (*sqlx.DB, error) {
-	db, err := sqlx.Connect("postgres", "user=postgres password=postgres dbname=postgres sslmode=disable")
+const backendPostgres = "postgres"
+
+func connect(driverName, dsn string, logger *zap.Logger) (*sqlx.DB, error) {
+	db, err := sqlx.Connect(driverName, dsn)
 	if err != nil {
 		logger.Error("failed to connect to db", zap.Error(err))
 		return nil, err
@@ -24,18 +37,50 @@ func connect(logger *zap.Logger) (*sqlx.DB, error) {
 	return db, nil
 }
 
-func migrate(db *sqlx.DB, logger *zap.Logger) error {
-	migrations := []string{
-		`DROP TABLE IF EXISTS person;`,
-		`CREATE TABLE IF NOT EXISTS person (
+func serverVersion(db *sqlx.DB, logger *zap.Logger) (string, error) {
+	var version string
+	if err := db.Get(&version, "SHOW server_version;"); err != nil {
+		logger.Error("failed to get server version", zap.Error(err))
+		return "", err
+	}
+	logger.Info("server version", zap.String("server_version", version))
+	return version, nil
+}
+
+// serverVersionNum возвращает версию сервера в формате server_version_num.
+func serverVersionNum(db *sqlx.DB, logger *zap.Logger) (int, error) {
+	var version int
+	if err := db.Get(&version, "SHOW server_version_num;"); err != nil {
+		logger.Error("failed to get server version", zap.Error(err))
+		return 0, err
+	}
+	return version, nil
+}
+
+// requireServerVersion пропускает сценарий, если сервер старше minVersion (в формате server_version_num).
+func requireServerVersion(db *sqlx.DB, logger *zap.Logger, minVersion int, feature string) error {
+	version, err := serverVersionNum(db, logger)
+	if err != nil {
+		return err
+	}
+	if version < minVersion {
+		return fmt.Errorf("%w: %s requires server_version_num >= %d, got %d", errScenarioSkipped, feature, minVersion, version)
+	}
+	return nil
+}
+
+var personMigrations = []string{
+	`DROP TABLE IF EXISTS person;`,
+	`CREATE TABLE IF NOT EXISTS person (
            id SERIAL PRIMARY KEY,
            balance BIGINT NOT NULL
          );`,
-		`INSERT INTO person VALUES (1, 1000);`,
-		`INSERT INTO person VALUES (2, 1000);`,
-	}
+	`INSERT INTO person VALUES (1, 1000);`,
+	`INSERT INTO person VALUES (2, 1000);`,
+}
 
-	for _, m := range migrations {
+func migrate(db *sqlx.DB, logger *zap.Logger, migrations []string) error {
+	for _, m := range withBalanceType(migrations) {
 		_, err := db.Exec(m)
 		if err != nil {
 			logger.Error("failed to execute migration", zap.Error(err), zap.String("migration", m))
@@ -51,26 +96,126 @@ type transaction struct {
 	db     *sqlx.DB
 	tx     *sql.Tx
 	logger *zap.Logger
+	// tag помечает операторы транзакции, nil - без меток
+	tag *statementTag
+	// conn - выделенное подключение сеанса, nil - транзакция берет любое подключение пула
+	conn *sql.Conn
+	// open - транзакция начата и еще не завершена
+	open bool
+	// pid - серверный процесс транзакции, найденный проверкой -pid-audit
+	pid int
+	// settings - параметры сервера, которые сценарий задает транзакции при
+	// каждом begin; профили -guc-profiles их переопределяют
+	settings gucProfile
+	// locals - параметры, заданные setLocal с начала транзакции; setLevel с
+	// -begin-options начинает транзакцию заново и задает их повторно
+	locals []localSetting
+	// statements - операторы с начала транзакции, кроме SET и SHOW
+	statements int
+	// ctx - контекст шагов сценария; его отмена по -timeout прерывает операторы
+	ctx context.Context
+}
+
+// localSetting - параметр сервера, заданный SET LOCAL.
+type localSetting struct {
+	name, value string
 }
 
 func newTransaction(db *sqlx.DB, logger *zap.Logger) *transaction {
-	return &transaction{db: db, logger: logger}
+	return &transaction{db: db, logger: logger, tag: statementTagOf(logger), ctx: scenarioContext(db)}
+}
+
+// newSessionTransaction создает транзакцию на выделенном подключении: все ее
+// begin выполняются в одном сеансе, и объекты сеанса, например курсоры WITH
+// HOLD, доступны после фиксации. Подключение освобождается closeSession.
+func newSessionTransaction(db *sqlx.DB, logger *zap.Logger) (*transaction, error) {
+	conn, err := db.Conn(scenarioContext(db))
+	if err != nil {
+		logger.Error("failed to get connection", zap.Error(err))
+		return nil, err
+	}
+	t := newTransaction(db, logger)
+	t.conn = conn
+	return t, nil
 }
 
 func (t *transaction) begin() error {
-	tx1, err := t.db.Begin()
+	return t.beginTx(nil)
+}
+
+// beginTx начинает транзакцию с параметрами opts, nil - параметры по
+// умолчанию, и задает ей application_name и параметры профиля.
+func (t *transaction) beginTx(opts *sql.TxOptions) error {
+	if err := t.start(opts); err != nil {
+		return err
+	}
+	if err := t.setApplicationName(); err != nil {
+		return err
+	}
+	return t.applyGUCProfile()
+}
+
+// start начинает транзакцию с параметрами opts без параметров сервера.
+func (t *transaction) start(opts *sql.TxOptions) error {
+	var tx1 *sql.Tx
+	var err error
+	if t.conn != nil {
+		tx1, err = t.conn.BeginTx(t.ctx, opts)
+	} else {
+		tx1, err = t.db.BeginTx(t.ctx, opts)
+	}
 	if err != nil {
 		t.logger.Error("failed to begin tx", zap.Error(err))
 		return err
 	}
 	t.logger.Info("tx started")
 	t.tx = tx1
+	t.open = true
+	t.locals, t.statements = nil, 0
+	t.observeEnd(outcomeOpen, nil)
+	t.traceMark(traceBegin)
+	return nil
+}
+
+// closeSession возвращает выделенное подключение в пул.
+func (t *transaction) closeSession() error {
+	if err := t.conn.Close(); err != nil {
+		t.logger.Error("failed to close session", zap.Error(err))
+		return err
+	}
+	t.logger.Info("session closed")
 	return nil
 }
 
 func (t *transaction) setLevel(level sql.IsolationLevel) error {
+	if beginOptions {
+		// Вместо SET TRANSACTION транзакция начинается заново с уровнем в
+		// BEGIN. Перезапуск теряет только параметры SET LOCAL, они задаются
+		// повторно; изменения операторов он потерял бы молча
+		if t.statements > 0 {
+			err := fmt.Errorf("%w: %d statements ran before it", errLevelAfterStatements, t.statements)
+			t.logger.Error("failed to restart tx with isolation level", zap.Error(err))
+			return err
+		}
+		locals := t.locals
+		if err := t.tx.Rollback(); err != nil {
+			t.logger.Error("failed to restart tx with isolation level", zap.Error(err))
+			return err
+		}
+		if err := t.start(&sql.TxOptions{Isolation: level}); err != nil {
+			return err
+		}
+		for _, l := range locals {
+			if err := t.setLocal(l.name, l.value); err != nil {
+				return err
+			}
+		}
+		t.logger.Info("isolation level set in BEGIN", zap.String("isolation_level", level.String()))
+		t.printLevel()
+		return nil
+	}
 	var isolationLevelQuery = "SET TRANSACTION ISOLATION LEVEL " + level.String() + ";"
-	if _, err := t.tx.Exec(isolationLevelQuery); err != nil {
+	if _, err := t.tx.ExecContext(t.ctx, t.sql(isolationLevelQuery)); err != nil {
 		t.logger.Error("failed to set isolation level", zap.Error(err))
 		return err
 	}
@@ -79,10 +224,53 @@ func (t *transaction) setLevel(level sql.IsolationLevel) error {
 	return nil
 }
 
+// setLocal меняет параметр сервера до конца транзакции, например work_mem,
+// lock_timeout, statement_timeout или enable_seqscan. SET не берет снимок,
+// поэтому setLocal можно вызывать и до setLevel.
+func (t *transaction) setLocal(name, value string) error {
+	setQuery := "SET LOCAL " + pq.QuoteIdentifier(name) + " = " + pq.QuoteLiteral(value) + ";"
+	if _, err := t.tx.ExecContext(t.ctx, t.sql(setQuery)); err != nil {
+		t.logger.Error("failed to set parameter", zap.Error(err), zap.String("name", name), zap.String("value", value))
+		return err
+	}
+	t.locals = append(t.locals, localSetting{name, value})
+	t.logger.Info("parameter set for transaction", zap.String("name", name), zap.String("value", value))
+	return nil
+}
+
+// setConstraints переключает проверку отложенных (DEFERRABLE) ограничений names,
+// пусто - всех, на момент фиксации или обратно на конец оператора до конца
+// транзакции. Переключение на IMMEDIATE сразу выполняет накопленные проверки
+// и возвращает их ошибку.
+func (t *transaction) setConstraints(deferred bool, names ...string) error {
+	target := "ALL"
+	if len(names) > 0 {
+		quoted := make([]string, len(names))
+		for i, name := range names {
+			quoted[i] = pq.QuoteIdentifier(name)
+		}
+		target = strings.Join(quoted, ", ")
+	}
+	mode := "IMMEDIATE"
+	if deferred {
+		mode = "DEFERRED"
+	}
+	setQuery := "SET CONSTRAINTS " + target + " " + mode + ";"
+	started := time.Now()
+	_, err := t.tx.ExecContext(t.ctx, t.sql(setQuery))
+	t.observe(started, 0, 0, err)
+	if err != nil {
+		t.logger.Error("failed to set constraints", zap.Error(err), zap.String("constraints", target), zap.String("mode", mode))
+		return err
+	}
+	t.logger.Info("constraints set", zap.String("constraints", target), zap.String("mode", mode))
+	return nil
+}
+
 func (t *transaction) printLevel() error {
 	var isolationLevelQuery = "SHOW transaction_isolation;"
 	var isolationLevel string
-	if err := t.tx.QueryRow(isolationLevelQuery).Scan(&isolationLevel); err != nil {
+	if err := t.tx.QueryRowContext(t.ctx, t.sql(isolationLevelQuery)).Scan(&isolationLevel); err != nil {
 		t.logger.Error("failed to get isolation level", zap.Error(err))
 		return err
 	}
@@ -92,7 +280,7 @@ func (t *transaction) printLevel() error {
 
 func (t *transaction) updateUser(id, balance int) error {
 	const updateQuery = "UPDATE person SET balance = $1 WHERE id = $2;"
-	if _, err := t.tx.Exec(updateQuery, balance, id); err != nil {
+	if _, err := t.tx.ExecContext(t.ctx, t.sql(updateQuery), balance, id); err != nil {
 		t.logger.Error("failed to update balance", zap.Error(err), zap.Int("balance", balance))
 		return err
 	}
@@ -102,7 +290,7 @@ func (t *transaction) updateUser(id, balance int) error {
 
 func (t *transaction) insertUser(id, balance int) error {
 	const insertQuery = "INSERT INTO person VALUES ($1, $2);"
-	if _, err := t.tx.Exec(insertQuery, id, balance); err != nil {
+	if _, err := t.tx.ExecContext(t.ctx, t.sql(insertQuery), id, balance); err != nil {
 		t.logger.Error("failed to insert user", zap.Error(err), zap.Int("id", id), zap.Int("balance", balance))
 		return err
 	}
@@ -113,7 +301,7 @@ func (t *transaction) insertUser(id, balance int) error {
 func (t *transaction) printUsersCount() error {
 	const readQuery = "SELECT COUNT(*) FROM person;"
 	var count int
-	if err := t.tx.QueryRow(readQuery).Scan(&count); err != nil {
+	if err := t.tx.QueryRowContext(t.ctx, t.sql(readQuery)).Scan(&count); err != nil {
 		t.logger.Error("failed to get count", zap.Error(err))
 		return err
 	}
@@ -123,18 +311,35 @@ func (t *transaction) printUsersCount() error {
 
 func (t *transaction) printUserBalance(id int) error {
 	const readQuery = "SELECT balance FROM person WHERE id = $1;"
-	var balance int
-	if err := t.tx.QueryRow(readQuery, id).Scan(&balance); err != nil {
+	balance, err := t.queryRowValue(readQuery, id)
+	if err != nil {
 		t.logger.Error("failed to get balance", zap.Error(err), zap.Int("id", id))
 		return err
 	}
-	t.logger.Info("balance read", zap.Int("balance", balance), zap.Int("id", id))
+	t.logger.Info("balance read", zap.Any("balance", balance), zap.Int("id", id))
 	return nil
 }
 
+// withdraw атомарно списывает amount с баланса и возвращает новый баланс.
+func (t *transaction) withdraw(id, amount int) (int, error) {
+	const withdrawQuery = "UPDATE person SET balance = balance - $1 WHERE id = $2 RETURNING balance;"
+	value, err := t.queryRowValue(withdrawQuery, amount, id)
+	if err != nil {
+		t.logger.Error("failed to withdraw", zap.Error(err), zap.Int("id", id), zap.Int("amount", amount))
+		return 0, err
+	}
+	balance, err := balanceValue(value)
+	if err != nil {
+		t.logger.Error("failed to withdraw", zap.Error(err), zap.Int("id", id), zap.Int("amount", amount))
+		return 0, err
+	}
+	t.logger.Info("balance withdrawn", zap.Int("id", id), zap.Int("amount", amount), zap.Int64("balance", balance))
+	return int(balance), nil
+}
+
 func (t *transaction) deleteUser(id int) error {
 	const deleteQuery = "DELETE FROM person WHERE id = $1;"
-	if _, err := t.tx.Exec(deleteQuery, id); err != nil {
+	if _, err := t.tx.ExecContext(t.ctx, t.sql(deleteQuery), id); err != nil {
 		t.logger.Error("failed to delete user", zap.Error(err), zap.Int("id", id))
 		return err
 	}
@@ -142,8 +347,187 @@ func (t *transaction) deleteUser(id int) error {
 	return nil
 }
 
+func (t *transaction) exec(query string, args ...any) (int64, error) {
+	started := time.Now()
+	traced := t.traceStatement(query)
+	res, err := t.tx.ExecContext(t.ctx, t.sql(query), args...)
+	traced(err)
+	t.captureStep(query, err)
+	if err != nil {
+		t.observe(started, 0, 0, err)
+		t.logger.Error("failed to execute statement", zap.Error(err), zap.String("query", query), zap.Any("args", args))
+		return 0, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		t.logger.Error("failed to get rows affected", zap.Error(err), zap.String("query", query))
+		return 0, err
+	}
+	t.observe(started, 0, affected, nil)
+	t.logger.Info("statement executed", zap.String("query", query), zap.Any("args", args), zap.Int64("rows_affected", affected))
+	return affected, t.auditPID(query)
+}
+
+func (t *transaction) query(query string, args ...any) ([][]any, error) {
+	started := time.Now()
+	traced := t.traceStatement(query)
+	rows, err := t.tx.QueryContext(t.ctx, t.sql(query), args...)
+	traced(err)
+	t.captureStep(query, err)
+	if err != nil {
+		t.observe(started, 0, 0, err)
+		t.logger.Error("failed to execute query", zap.Error(err), zap.String("query", query), zap.Any("args", args))
+		return nil, err
+	}
+	result, err := t.readRows(rows, query, args)
+	t.observe(started, int64(len(result)), 0, err)
+	if err != nil {
+		return nil, err
+	}
+	return result, t.auditPID(query)
+}
+
+// queryRowValue читает первое значение первой строки запроса, декодированное
+// decodeColumn. Как и QueryRow, оператор не записывается шагом сценария.
+func (t *transaction) queryRowValue(query string, args ...any) (any, error) {
+	rows, err := t.tx.QueryContext(t.ctx, t.sql(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	result, err := t.readRows(rows, query, args)
+	if err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return result[0][0], nil
+}
+
+// readRows читает и закрывает результат запроса query.
+func (t *transaction) readRows(rows *sql.Rows, query string, args []any) ([][]any, error) {
+	defer rows.Close()
+
+	columns, err := rows.ColumnTypes()
+	if err != nil {
+		t.logger.Error("failed to get columns", zap.Error(err), zap.String("query", query))
+		return nil, err
+	}
+	var result [][]any
+	for rows.Next() {
+		row := make([]any, len(columns))
+		dest := make([]any, len(columns))
+		for i := range row {
+			dest[i] = &row[i]
+		}
+		if err = rows.Scan(dest...); err != nil {
+			t.logger.Error("failed to scan row", zap.Error(err), zap.String("query", query))
+			return nil, err
+		}
+		for i, v := range row {
+			if b, ok := v.([]byte); ok {
+				v = string(b)
+			}
+			if row[i], err = decodeColumn(columns[i], v); err != nil {
+				t.logger.Error("failed to decode value", zap.Error(err), zap.String("query", query))
+				return nil, err
+			}
+		}
+		result = append(result, row)
+	}
+	if err = rows.Err(); err != nil {
+		t.logger.Error("failed to read rows", zap.Error(err), zap.String("query", query))
+		return nil, err
+	}
+	t.logger.Info("query executed", zap.String("query", query), zap.Any("args", args), zap.Any("rows", result))
+	return result, nil
+}
+
+// selectRows читает все строки запроса в dest - указатель на срез структур или
+// скалярных значений, как sqlx.Select. Колонки сопоставляются с полями по тегу db
+// или имени поля в нижнем регистре.
+func (t *transaction) selectRows(dest any, query string, args ...any) error {
+	tx := &sqlx.Tx{Tx: t.tx, Mapper: t.db.Mapper}
+	started := time.Now()
+	traced := t.traceStatement(query)
+	err := sqlx.SelectContext(t.ctx, tx, dest, t.sql(query), args...)
+	traced(err)
+	t.captureStep(query, err)
+	t.observe(started, rowCount(dest), 0, err)
+	if err != nil {
+		t.logger.Error("failed to select rows", zap.Error(err), zap.String("query", query), zap.Any("args", args))
+		return err
+	}
+	t.logger.Info("rows selected", zap.String("query", query), zap.Any("args", args), zap.Any("rows", reflect.ValueOf(dest).Elem().Interface()))
+	return nil
+}
+
+// selectPersons возвращает строки person, подходящие под условие where, в
+// порядке id. Пустое условие читает всю таблицу.
+func (t *transaction) selectPersons(where string, args ...any) ([]persondb.Person, error) {
+	query := "SELECT id, balance FROM person"
+	if where != "" {
+		query += " WHERE " + where
+	}
+	var persons []persondb.Person
+	if err := t.selectRows(&persons, query+" ORDER BY id;", args...); err != nil {
+		return nil, err
+	}
+	return persons, nil
+}
+
+// rowsetDiff возвращает id строк, которые появились в after и исчезли из него по сравнению с before.
+func rowsetDiff(before, after []persondb.Person) (appeared, disappeared []int32) {
+	seen := make(map[int32]bool, len(before))
+	for _, p := range before {
+		seen[p.ID] = true
+	}
+	for _, p := range after {
+		if !seen[p.ID] {
+			appeared = append(appeared, p.ID)
+		}
+		delete(seen, p.ID)
+	}
+	for _, p := range before {
+		if seen[p.ID] {
+			disappeared = append(disappeared, p.ID)
+		}
+	}
+	return appeared, disappeared
+}
+
+// queries возвращает сгенерированный sqlc слой доступа, работающий внутри транзакции.
+func (t *transaction) queries() *persondb.Queries {
+	if t.tag != nil {
+		return persondb.New(taggedTx{t})
+	}
+	return persondb.New(t.db).WithTx(t.tx)
+}
+
+// assertSees проверяет, что запрос в транзакции возвращает ровно строки want.
+// Значения сравниваются в текстовом виде, как в YAML сценариях.
+func (t *transaction) assertSees(want [][]any, query string, args ...any) error {
+	rows, err := t.query(query, args...)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(normalizeRows(rows), normalizeRows(want)) {
+		err = fmt.Errorf("%s: got %v, expected %v", query, rows, want)
+		t.logger.Error("assertion failed", zap.Error(err))
+		return err
+	}
+	t.logger.Info("assertion passed", zap.String("query", query), zap.Any("rows", rows))
+	return nil
+}
+
 func (t *transaction) rollback() error {
-	if err := t.tx.Rollback(); err != nil {
+	t.open = false
+	t.releasePID()
+	t.observeEnd(outcomeRolledBack, nil)
+	t.traceMark(traceRollback)
+	err := t.tx.Rollback()
+	t.captureStep(traceRollback, err)
+	if err != nil {
 		t.logger.Error("failed to rollback tx", zap.Error(err))
 		return err
 	}
@@ -152,7 +536,13 @@ func (t *transaction) rollback() error {
 }
 
 func (t *transaction) commit() error {
-	if err := t.tx.Commit(); err != nil {
+	t.open = false
+	t.releasePID()
+	err := t.tx.Commit()
+	t.observeEnd(outcomeCommitted, err)
+	t.traceMark(traceCommit)
+	t.captureStep(traceCommit, err)
+	if err != nil {
 		t.logger.Error("failed to commit tx", zap.Error(err))
 		return err
 	}
@@ -162,11 +552,143 @@ func (t *transaction) commit() error {
 
 type isolationProblem func(db *sqlx.DB, logger *zap.Logger) error
 
-var isolationProblems = map[string]isolationProblem{
-	//"dirty_read":          dirtyRead,
-	//"non_repeatable_read": nonRepeatableRead,
-	"phantom_read": phantomRead,
-	//"lost_update":         lostUpdate,
+type scenario struct {
+	level      sql.IsolationLevel
+	migrations []string
+	problem    isolationProblem
+	// namespace - схема, в которой сценарий создает свои таблицы; пусто - схема по умолчанию.
+	// Сценарии из разных схем не мешают друг другу и могут выполняться параллельно.
+	namespace string
+	// seeded - сценарий работает с дополнительными строками person из флагов -seed-*
+	seeded bool
+	// randomized - запуск со случайным порядком шагов для -probability, nil - не поддерживается
+	randomized randomizedProblem
+	// shrink сокращает порядок шагов запуска с аномалией для -shrink, nil - не поддерживается
+	shrink shrinkProblem
+	// after - сценарии, которые должны выполниться раньше этого, если выбраны вместе с ним
+	after []string
+	// skip и xfail - СУБД и версии, на которых сценарий пропускается или должен
+	// завершиться ошибкой
+	skip  []backendAnnotation
+	xfail []backendAnnotation
+	// final - ожидаемое итоговое состояние таблиц, которое runner проверяет
+	// через монитор после шагов сценария
+	final []postcondition
+	// peer - сценарий пишет и во вторую базу -second-database
+	peer bool
+	// description и tags - описание и метки сценария для каталога list
+	description string
+	tags        []string
+	// anomaly - должна ли наблюдаться аномалия на уровне level; nil - сценарий
+	// проверяет свои утверждения, а не наличие аномалии
+	anomaly *bool
+	// cost - оценка запуска для -budget; нулевые поля - значения по умолчанию
+	cost scenarioCost
+}
+
+var isolationProblems = map[string]scenario{
+	"dirty_read":                {level: sql.LevelReadUncommitted, migrations: personMigrations, problem: dirtyRead, final: []postcondition{expectBalance(1, 1000)}},
+	"non_repeatable_read":       {level: sql.LevelReadCommitted, migrations: personMigrations, problem: nonRepeatableRead, final: []postcondition{expectBalance(1, 100_000)}},
+	"phantom_read":              {level: sql.LevelReadCommitted, migrations: personMigrations, problem: phantomRead, seeded: true, final: []postcondition{expectPersonCount(1)}},
+	"lost_update":               {level: sql.LevelReadCommitted, migrations: personMigrations, problem: lostUpdate, final: []postcondition{expectBalance(1, 10)}},
+	"lost_update_sqlc":          {level: sql.LevelReadCommitted, migrations: personMigrations, problem: lostUpdateSQLC, final: []postcondition{expectBalance(1, 500)}},
+	"counter_increments":        {level: sql.LevelReadCommitted, migrations: counterMigrations, problem: counterIncrementStrategies, namespace: "counter"},
+	"double_booking":            {level: sql.LevelReadCommitted, migrations: bookingMigrations, problem: doubleBooking, namespace: "booking"},
+	"inventory_oversell":        {level: sql.LevelReadCommitted, migrations: inventoryMigrations, problem: inventoryOversell, namespace: "inventory"},
+	"update_returning":          {level: sql.LevelReadCommitted, migrations: personMigrations, problem: updateReturning},
+	"serializable_locking":      {level: sql.LevelSerializable, migrations: personMigrations, problem: serializableLocking},
+	"snapshot_too_old":          {level: sql.LevelRepeatableRead, migrations: personMigrations, problem: snapshotTooOld},
+	"partitioned_phantom":       {level: sql.LevelRepeatableRead, migrations: partitionedMigrations, problem: partitionedPhantom, namespace: "orders"},
+	"matview_refresh":           {level: sql.LevelReadCommitted, migrations: matviewMigrations, problem: matviewRefresh},
+	"trigger_summary":           {level: sql.LevelReadCommitted, migrations: triggerSummaryMigrations, problem: triggerSummary},
+	"cursor_stability":          {level: sql.LevelReadCommitted, migrations: cursorMigrations, problem: cursorStability},
+	"merge_concurrency":         {level: sql.LevelReadCommitted, migrations: personMigrations, problem: mergeConcurrency},
+	"rc_polling":                {level: sql.LevelReadCommitted, migrations: personMigrations, problem: readCommittedPolling},
+	"own_writes":                {level: sql.LevelReadCommitted, migrations: personMigrations, problem: ownWrites},
+	"ssi_false_positive":        {level: sql.LevelSerializable, migrations: ssiMigrations, problem: ssiFalsePositive, namespace: "ssi"},
+	"for_share_queue":           {level: sql.LevelReadCommitted, migrations: personMigrations, problem: forShareQueue, final: []postcondition{expectBalance(1, 1100)}},
+	"multixact":                 {level: sql.LevelReadCommitted, migrations: personMigrations, problem: multixact, final: []postcondition{expectBalance(1, 1000), expectBalance(2, 1000)}},
+	"event_report":              {level: sql.LevelRepeatableRead, migrations: eventMigrations, problem: eventReport, namespace: "events"},
+	"deferred_constraint":       {level: sql.LevelReadCommitted, migrations: deferredConstraintMigrations, problem: deferredConstraint, namespace: "projects"},
+	"deferred_foreign_key":      {level: sql.LevelReadCommitted, migrations: deferredForeignKeyMigrations, problem: deferredForeignKey, namespace: "deferred_fk"},
+	"pooler_pitfalls":           {level: sql.LevelReadCommitted, problem: poolerPitfallsScenario, namespace: "pooler"},
+	"in_list_lock_order":        {level: sql.LevelReadCommitted, migrations: inListMigrations, problem: inListLockOrder, namespace: "in_list"},
+	"xid_age":                   {level: sql.LevelRepeatableRead, migrations: xidAgeMigrations, problem: xidAge, namespace: "xid"},
+	"prepared_snapshot":         {level: sql.LevelRepeatableRead, migrations: preparedMigrations, problem: preparedSnapshot, namespace: "prepared"},
+	"cross_database":            {level: sql.LevelReadCommitted, migrations: crossDatabaseMigrations, problem: crossDatabase, namespace: "crossdb", peer: true},
+	"deadlock_order":            {level: sql.LevelReadCommitted, migrations: personMigrations, problem: deadlockOrder},
+	"advisory_lock_scope":       {level: sql.LevelReadCommitted, migrations: personMigrations, problem: advisoryLockScope},
+	"for_update_reread":         {level: sql.LevelReadCommitted, migrations: personMigrations, problem: forUpdateReread},
+	"held_cursor":               {level: sql.LevelReadCommitted, migrations: cursorMigrations, problem: heldCursor},
+	"tenant_isolation":          {level: sql.LevelReadCommitted, migrations: tenantMigrations, problem: tenantIsolation, namespace: "tenants"},
+	"wallet_ledger":             {level: sql.LevelReadCommitted, migrations: ledgerMigrations, problem: walletLedger, namespace: "ledger"},
+	"gin_predicate_locks":       {level: sql.LevelSerializable, migrations: ginMigrations, problem: ginPredicateLocks, namespace: "gin"},
+	"predicate_lock_escalation": {level: sql.LevelSerializable, migrations: predicateMigrations, problem: predicateLockEscalation, namespace: "predlocks"},
+	"money_rounding":            {level: sql.LevelReadCommitted, migrations: moneyRoundingMigrations, problem: moneyRounding, namespace: "money"},
+}
+
+// registerScenarios добавляет к встроенным сценариям Hermitage, ANSI, YAML
+// сценарии из scenariosDir, нагрузки workloads, окна журналов сервера
+// logReplays и наборы из плагинов plugins. Возвращает YAML сценарии, которые
+// -watch перезагружает при изменении файлов.
+func registerScenarios(scenariosDir string, workloads, logReplays, plugins []string, logger *zap.Logger) (map[string]scenario, error) {
+	if err := addScenarios(hermitageScenarios()); err != nil {
+		return nil, err
+	}
+	if err := addScenarios(ansiScenarios()); err != nil {
+		return nil, err
+	}
+	var custom map[string]scenario
+	if scenariosDir != "" {
+		var err error
+		if custom, err = loadYAMLScenarios(scenariosDir, logger); err != nil {
+			return nil, err
+		}
+		if err = addScenarios(custom); err != nil {
+			return nil, err
+		}
+	}
+	benchmarkWorkloads, err := workloadScenarios(workloads, logger)
+	if err != nil {
+		return nil, err
+	}
+	if err = addScenarios(benchmarkWorkloads); err != nil {
+		return nil, err
+	}
+	replays, err := logReplayScenarios(logReplays, logger)
+	if err != nil {
+		return nil, err
+	}
+	if err = addScenarios(replays); err != nil {
+		return nil, err
+	}
+	if err = loadPlugins(plugins, logger); err != nil {
+		return nil, err
+	}
+	packs, err := packScenarios(logger)
+	if err != nil {
+		return nil, err
+	}
+	if err = addScenarios(packs); err != nil {
+		return nil, err
+	}
+	return custom, nil
+}
+
+func addScenarios(scenarios map[string]scenario) error {
+	for name, s := range scenarios {
+		if _, ok := isolationProblems[name]; ok {
+			return fmt.Errorf("scenario %q already exists", name)
+		}
+		isolationProblems[name] = s
+	}
+	names := make([]string, 0, len(scenarios))
+	for name := range scenarios {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	register(names)
+	return nil
 }
 
 func main() {
@@ -177,185 +699,522 @@ func main() {
 	if err != nil {
 		log.Fatalln(err)
 	}
-	defer logger.Sync()
+	defer func() {
+		// Отложенные вызовы выполняются в обратном порядке: к этому моменту
+		// runner закрыл пулы, и ошибки их закрытия уже собраны
+		err := strictErrors("")
+		if serr := syncLogger(logger); serr != nil {
+			err = errors.Join(err, fmt.Errorf("strict: logger sync: %w", serr))
+		}
+		if err != nil && strictMode {
+			log.Fatalln(err)
+		}
+	}()
 
-	db, err := connect(logger)
-	if err != nil {
-		log.Fatalln(err)
+	if len(os.Args) > 1 && os.Args[1] == "history" {
+		if err = historyCommand(os.Args[2:], logger); err != nil {
+			log.Fatalln(err)
+		}
+		return
 	}
-	for name, problem := range isolationProblems {
-		if err = migrate(db, logger.With(zap.String("problem", name))); err != nil {
+	if len(os.Args) > 1 && os.Args[1] == "new-scenario" {
+		if err = newScenarioCommand(os.Args[2:], logger); err != nil {
 			log.Fatalln(err)
 		}
-		if err = problem(db, logger.With(zap.String("problem", name))); err != nil {
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "diff-runs" {
+		if err = diffRunsCommand(os.Args[2:], logger); err != nil {
 			log.Fatalln(err)
 		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "view" {
+		if err = viewCommand(os.Args[2:], logger); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "isolation-defaults" {
+		if err = isolationDefaultsCommand(os.Args[2:], logger); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "decide" {
+		if err = decideCommand(os.Args[2:], logger); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "export-psql" {
+		if err = exportPSQLCommand(os.Args[2:], logger); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "list" {
+		if err = listCommand(os.Args[2:], logger); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify-manifest" {
+		if err = verifyManifestCommand(os.Args[2:], logger); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err = replayCommand(os.Args[2:], logger); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "rcsi" {
+		if err = rcsiCommand(os.Args[2:], logger); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "sweep" {
+		if err = sweepCommand(os.Args[2:], logger); err != nil {
+			log.Fatalln(err)
+		}
+		return
 	}
-}
 
-func phantomRead(db *sqlx.DB, logger *zap.Logger) error {
-	// Проверка количества записей после завершения транзакций
+	historyPath := flag.String("history", "", "append run results to the given SQLite file")
+	scenariosDir := flag.String("scenarios", "", "load additional YAML scenarios from the given directory")
+	selected := flag.String("run", "", "comma separated scenarios to run, all by default")
+	audit := flag.Bool("audit", false, "record committed changes with triggers and verify final state against them")
+	watch := flag.Bool("watch", false, "re-run the selected scenarios whenever YAML scenarios or the -guc-profiles file change")
+	parallel := flag.Bool("parallel", false, "run scenarios from different namespaces concurrently")
+	statStatementsFlag := flag.Bool("stat-statements", false, "reset and report pg_stat_statements around each scenario when the extension is installed")
+	exportSQL := flag.String("export-sql", "", "write each scenario's statements per session into .sql files under the given directory")
+	flag.Int64Var(&seed.balance, "seed-balance", seed.balance, "balance of the generated person rows")
+	flag.IntVar(&seed.rows, "seed-rows", seed.rows, "number of extra person rows generated for seeded scenarios")
+	flag.StringVar(&seed.pattern, "seed-pattern", seed.pattern, "balances of the generated rows: constant, sequential or random")
+	flag.BoolVar(&printTxSummary, "tx-summary", printTxSummary, "print statements, rows read and written, retries, blocked time and outcome of each transaction to stderr after every scenario")
+	flag.StringVar(&manualTx, "manual", "", "transaction of YAML scenarios to run by hand: print its statements for an external psql session and wait for Enter instead of executing them")
+	flag.BoolVar(&beginOptions, "begin-options", false, "set the isolation level in BEGIN instead of SET TRANSACTION and skip scenarios that need session state, for targets behind pgbouncer in transaction pooling mode")
+	flag.BoolVar(&pidAudit.enabled, "pid-audit", false, "check after every statement that it ran on the backend of its own transaction and that no two open transactions share a backend")
+	flag.IntVar(&counterWorkers, "counter-workers", counterWorkers, "number of goroutines incrementing the counter concurrently in counter_increments")
+	flag.BoolVar(&predicateExhaustion, "predicate-exhaustion", false, "run the exhaustion variant of predicate_lock_escalation, which fills the server-wide predicate lock table; refused while sessions of other clients are connected")
+	flag.BoolVar(&strictMode, "strict", false, "fail the run on errors that are otherwise ignored: rollbacks, deferred cleanup, session and pool close, logger sync")
+	flag.StringVar(&secondDatabase, "second-database", "", "another database on the same server for cross-database scenarios; they are skipped when empty")
+	flag.StringVar(&targetSchema, "schema", "", "create and use this schema instead of the default search_path; namespaced scenarios use <schema>_<namespace>")
+	flag.Int64Var(&dataSeed, "data-seed", dataSeed, "seed of generated data: -seed-pattern random balances and gen() values in scripts and workloads")
+	flag.StringVar(&balanceType, "balance-type", balanceType, "type of person.balance: bigint or numeric (NUMERIC(18,2))")
+	flag.StringVar(&runOrder.mode, "order", runOrder.mode, "order of independent scenarios: name, registration or random")
+	flag.Int64Var(&runOrder.seed, "seed", 0, "seed for -order random, 0 picks one and logs it")
+	chartsDir := flag.String("charts", "", "write benchmark charts (SVG and Vega-Lite) to the given directory")
+	ansiReport := flag.Bool("ansi", false, "run every ANSI phenomenon at every isolation level name and print what the standard allows next to what PostgreSQL provides instead of running scenarios")
+	ansiJSON := flag.String("ansi-json", "", "with -ansi, also write the comparison with the ANSI SQL-92 table to this JSON file")
+	matrix := flag.Bool("matrix", false, "print the visibility matrix of writer and reader operations per isolation level instead of running scenarios")
+	var plugins stringList
+	flag.Var(&plugins, "plugin", "load a scenario pack built with -buildmode=plugin (repeatable)")
+	var workloads stringList
+	flag.Var(&workloads, "workload", "add a benchmark scenario workload/<name> running a weighted workload spec (decide format) or the built-in smallbank at every isolation level (repeatable)")
+	var logReplays stringList
+	flag.Var(&logReplays, "log-replay", "add a scenario log/<name> replaying a contention window of a log_statement = all server log at a chosen level and at serializable (repeatable)")
+	dsnFlag := flag.String("dsn", defaultDSN, "connection string, key=value or postgres:// URL")
+	preset := flag.String("preset", "", "managed provider preset: rds, cloudsql, neon or supabase")
+	var tunnel sshTunnelConfig
+	flag.StringVar(&tunnel.host, "ssh", "", "connect through the ssh bastion [user@]host[:port]")
+	flag.StringVar(&tunnel.jump, "ssh-jump", "", "jump host [user@]host[:port] in front of the bastion")
+	flag.StringVar(&tunnel.key, "ssh-key", "", "private key for ssh, ssh-agent is used when empty")
+	flag.StringVar(&tunnel.knownHosts, "ssh-known-hosts", "~/.ssh/known_hosts", "known_hosts file for ssh host key verification")
+	flag.BoolVar(&tunnel.insecure, "ssh-insecure", false, "skip ssh host key verification")
+	archiveDir := flag.String("archive", "", "after each scenario dump the tables it changed as CSV under the given directory")
+	archiveStats := flag.Bool("archive-stats", false, "with -archive also write pg_stat_user_tables deltas")
+	flag.BoolVar(&captureStepStates, "step-states", false, "with -archive also save table contents, locks and open transactions after every statement to steps.json for the view timeline")
+	probability := flag.Int("probability", 0, "run scenarios with an anomaly check this many times per isolation level with random step timing and report how often the anomaly manifested")
+	jitter := flag.Duration("jitter", 20*time.Millisecond, "maximum random pause between steps for -probability")
+	shrinkDir := flag.String("shrink", "", "with -probability shrink the first anomalous interleaving per scenario and level to a minimal step order and save it as a YAML scenario under the given directory")
+	force := flag.Bool("force", false, "run migrations even if the database has tables not created by scenarios or large scenario tables")
+	cleanup := flag.Bool("cleanup", true, "roll back prepared transactions and terminate sessions holding advisory locks left by interrupted runs before running scenarios")
+	progressFlag := flag.Bool("progress", false, "show a progress line with the current scenario, step, elapsed time and ETA on stdout")
+	timeout := flag.Duration("timeout", 0, "wall-clock budget per scenario; on expiry its sessions are terminated and the run continues with the next scenario")
+	gucProfilesPath := flag.String("guc-profiles", "", "YAML file of per-transaction server parameters (scenario: {tx: {name: value}}, * matches any) applied with SET LOCAL at every begin")
+	flag.DurationVar(&longTxThreshold, "long-tx", longTxThreshold, "warn about transactions a scenario keeps open longer than this, since they hold back freezing and xid wraparound protection; 0 disables")
+	manifestPath := flag.String("manifest", "", "after a completed run write this manifest.json listing the history, events, SQL, archive, chart, report and shrink artifacts with SHA-256 hashes")
+	estimateOnly := flag.Bool("estimate", false, "print the estimated runs, duration, transactions and peak sessions of the selected run and exit without connecting")
+	var budget runBudget
+	flag.DurationVar(&budget.duration, "budget", defaultBudgetDuration, "ask for confirmation before a run estimated to take longer than this; 0 disables")
+	flag.IntVar(&budget.transactions, "budget-transactions", defaultBudgetTransactions, "ask for confirmation before a run estimated to open more transactions than this; 0 disables")
+	flag.BoolVar(&budget.confirmed, "yes", false, "start a run over -budget without asking")
+	eventsTarget := flag.String("events", "", "publish step and verdict events to nats://host:4222/subject or kafka-rest://proxy:8082/topic, or record them to file:run.jsonl for replay")
+	flag.Parse()
+
+	// Манифест записывается последним, после закрытия истории и записи событий
+	manifest := newRunManifest(*manifestPath)
+	manifestLogger := logger
 	defer func() {
-		tx3Logger := logger.With(zap.String("tx", "tx3"))
-		tx3 := newTransaction(db, tx3Logger)
-		if err := tx3.begin(); err != nil {
-			return
+		if err := manifest.write(manifestLogger); err != nil {
+			log.Fatalln(err)
 		}
-		if err := tx3.printUsersCount(); err != nil {
-			return
+	}()
+	manifest.add(*historyPath, artifactHistory)
+	manifest.addEvents(*eventsTarget)
+	manifest.add(*exportSQL, artifactSQL)
+	manifest.add(*archiveDir, artifactDump)
+	manifest.add(*chartsDir, artifactReport)
+	manifest.add(*ansiJSON, artifactReport)
+	manifest.add(*shrinkDir, artifactScenario)
+
+	var events *eventStream
+	if *eventsTarget != "" {
+		if events, err = openEventStream(*eventsTarget, logger); err != nil {
+			log.Fatalln(err)
 		}
-		if err := tx3.commit(); err != nil {
-			return
+		// Неудачное закрытие файла или NATS теряет записанные события
+		defer ignoreDeferred(logger, "close events", events.close)
+		logger = logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+			return zapcore.NewTee(core, events.core())
+		}))
+	}
+
+	logger = withStatementTags(logger)
+
+	if err = seed.validate(); err != nil {
+		log.Fatalln(err)
+	}
+	if err = validateBalanceType(balanceType); err != nil {
+		log.Fatalln(err)
+	}
+	if err = validateCounterWorkers(counterWorkers); err != nil {
+		log.Fatalln(err)
+	}
+	if err = runOrder.validate(); err != nil {
+		log.Fatalln(err)
+	}
+	if runOrder.mode == orderRandom && runOrder.seed == 0 {
+		runOrder.seed = time.Now().UnixNano()
+	}
+	if runOrder.mode == orderRandom {
+		// С этим seed порядок можно повторить
+		logger.Info("random scenario order", zap.Int64("seed", runOrder.seed))
+	}
+	if *watch && *scenariosDir == "" {
+		log.Fatalln("-watch requires -scenarios")
+	}
+	// pg_stat_statements общий для всего сервера, параллельные сценарии сбрасывали бы статистику друг друга
+	if *parallel && *statStatementsFlag {
+		log.Fatalln("-stat-statements cannot be combined with -parallel")
+	}
+	if *archiveStats && *archiveDir == "" {
+		log.Fatalln("-archive-stats requires -archive")
+	}
+	if captureStepStates && *archiveDir == "" {
+		log.Fatalln("-step-states requires -archive")
+	}
+	if *parallel && *exportSQL != "" {
+		log.Fatalln("-export-sql cannot be combined with -parallel")
+	}
+	// Подсказки ручных шагов идут по одной и ждут ввода
+	if *shrinkDir != "" && *probability == 0 {
+		log.Fatalln("-shrink requires -probability")
+	}
+	if manualTx != "" && (*scenariosDir == "" || *parallel || *probability > 0) {
+		log.Fatalln("-manual requires -scenarios and cannot be combined with -parallel or -probability")
+	}
+	if *gucProfilesPath != "" {
+		if err = loadGUCProfiles(*gucProfilesPath); err != nil {
+			log.Fatalln(err)
 		}
-	}()
+	}
+	custom, err := registerScenarios(*scenariosDir, workloads, logReplays, plugins, logger)
+	if err != nil {
+		log.Fatalln(err)
+	}
 
-	// Запуск первой транзакции
-	tx1Logger := logger.With(zap.String("tx", "tx1"))
-	tx1 := newTransaction(db, tx1Logger)
-	if err := tx1.begin(); err != nil {
-		return err
+	var hist *history
+	if *historyPath != "" {
+		if hist, err = openHistory(*historyPath, logger); err != nil {
+			log.Fatalln(err)
+		}
+		defer ignoreDeferred(logger, "close history", hist.close)
 	}
-	if err := tx1.setLevel(sql.LevelReadCommitted); err != nil {
-		return err
+
+	names, err := selectScenarios(*selected)
+	if err != nil {
+		log.Fatalln(err)
 	}
-	// Запуск второй транзакции
-	tx2Logger := logger.With(zap.String("tx", "tx2"))
-	tx2 := newTransaction(db, tx2Logger)
-	if err := tx2.begin(); err != nil {
-		return err
+	// Оценка не требует подключения, поэтому тяжелый запуск можно отменить до
+	// первого обращения к серверу
+	var averages map[string]time.Duration
+	if hist != nil {
+		if averages, err = hist.averageRuns(); err != nil {
+			log.Fatalln(err)
+		}
 	}
-	if err := tx2.setLevel(sql.LevelReadCommitted); err != nil {
-		return err
+	var estimate *runEstimate
+	switch {
+	case *matrix:
+		estimate = estimateCells("visibility matrix", len(matrixWriters)*len(matrixReaders), matrixLevels, 1)
+	case *ansiReport:
+		estimate = estimateCells("ansi report", len(ansiPhenomena), ansiLevels, 1)
+	case *probability > 0:
+		estimate = estimateProbability(names, *probability)
+	default:
+		estimate = estimateScenarios(names, *parallel, averages)
+	}
+	if *estimateOnly {
+		if err = estimate.print(os.Stdout); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	heavy := *matrix || *ansiReport || *probability > 0 || selectsBenchmarks(names)
+	if err = checkBudget(estimate, budget, heavy, logger); err != nil {
+		log.Fatalln(err)
 	}
 
-	// Чтение количества записей в 1 транзакции
-	if err := tx1.printUsersCount(); err != nil {
-		return err
+	dsn, err := resolveDSN(*dsnFlag, *preset, logger)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if dsn, err = withTargetSchema(dsn); err != nil {
+		log.Fatalln(err)
+	}
+	driverName := "postgres"
+	if tunnel.host != "" {
+		sshClients, err := openSSHTunnel(tunnel, logger)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer ignoreDeferred(logger, "close ssh tunnel", sshClients.Close)
+		driverName = driverPostgresSSH
+	}
+	monitorDriver := driverName
+	var capture *sqlCapture
+	if *exportSQL != "" {
+		capture = &sqlCapture{}
+		if driverName, err = registerCaptureDriver(driverName, capture); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	// Сессии сценариев в схеме по умолчанию помечаются, чтобы монитор мог отключить их по таймауту
+	params, err := parseDSN(dsn)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	params["application_name"] = scenarioApplicationName("")
+	db, err := connect(driverName, formatDSN(params), logger)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	// search_path уже указывает на схему, поэтому после создания она используется сразу
+	if err = createTargetSchema(db, logger); err != nil {
+		log.Fatalln(err)
+	}
+	meta, err := collectMetadata(db, logger)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	manifest.setMetadata(meta)
+	if err = checkTransactionPooling(db, logger); err != nil {
+		log.Fatalln(err)
+	}
+	if err = checkGUCProfiles(db, logger); err != nil {
+		log.Fatalln(err)
+	}
+	if meta.Degraded, err = checkMonitorAccess(db, logger); err != nil {
+		log.Fatalln(err)
+	}
+	// Без pg_terminate_backend зависший сценарий нечем остановить
+	if *timeout > 0 && !monitorAccess.terminate {
+		logger.Warn("-timeout disabled: the connecting role cannot call pg_terminate_backend", zap.Duration("timeout", *timeout))
+		*timeout = 0
 	}
 
-	// Добавление записи во 2 транзакции
-	if err := tx2.insertUser(3, 1000); err != nil {
-		return err
+	// Миграции удаляют таблицы: база, похожая на рабочую, используется только с -force
+	if !*force {
+		if err = checkSafeTarget(db, logger); err != nil {
+			log.Fatalln(err)
+		}
 	}
-	if err := tx2.commit(); err != nil {
-		return err
+	// Прерванный запуск оставляет подготовленные транзакции и сессии с блокировками
+	if *cleanup {
+		if err = cleanupLeftovers(db, logger); err != nil {
+			log.Fatalln(err)
+		}
 	}
 
-	// Чтение количества записей в 1 транзакции
-	if err := tx1.printUsersCount(); err != nil {
-		return err
+	if *progressFlag {
+		suiteProgress = newProgress(os.Stdout)
 	}
-	if err := tx1.commit(); err != nil {
-		return err
+	if *matrix {
+		suiteProgress.addTotal(matrixCells())
+		cells, err := buildVisibilityMatrix(db, logger)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		suiteProgress.close()
+		if err = meta.print(os.Stdout); err != nil {
+			log.Fatalln(err)
+		}
+		if err = printVisibilityMatrix(os.Stdout, cells); err != nil {
+			log.Fatalln(err)
+		}
+		return
 	}
-	return nil
-}
 
-func nonRepeatableRead(db *sqlx.DB, logger *zap.Logger) error {
-	// Проверка баланса после завершения транзакций
-	defer func() {
-		tx3Logger := logger.With(zap.String("tx", "tx3"))
-		tx3 := newTransaction(db, tx3Logger)
-		if err := tx3.begin(); err != nil {
-			return
+	if *ansiReport {
+		suiteProgress.addTotal(len(ansiPhenomena) * len(ansiLevels))
+		cells, err := buildANSIReport(db, logger)
+		if err != nil {
+			log.Fatalln(err)
 		}
-		if err := tx3.printUserBalance(1); err != nil {
-			return
+		suiteProgress.close()
+		if err = meta.print(os.Stdout); err != nil {
+			log.Fatalln(err)
 		}
-		if err := tx3.commit(); err != nil {
-			return
+		if err = printANSIReport(os.Stdout, cells); err != nil {
+			log.Fatalln(err)
 		}
-	}()
+		if *ansiJSON != "" {
+			if err = writeANSIReportJSON(*ansiJSON, meta, cells); err != nil {
+				log.Fatalln(err)
+			}
+		}
+		return
+	}
 
-	// Запуск первой транзакции
-	tx1Logger := logger.With(zap.String("tx", "tx1"))
-	tx1 := newTransaction(db, tx1Logger)
-	if err := tx1.begin(); err != nil {
-		return err
+	r := &runner{db: db, driverName: driverName, monitorDriver: monitorDriver, dsn: dsn, serverVersion: meta.ServerVersion, meta: meta, hist: hist, events: events, audit: *audit, timeout: *timeout, capture: capture, exportDir: *exportSQL, archiveDir: *archiveDir, archiveStats: *archiveStats, shrinkDir: *shrinkDir, logger: logger}
+	defer r.close()
+	if r.versionNum, err = serverVersionNum(db, logger); err != nil {
+		log.Fatalln(err)
 	}
-	if err := tx1.setLevel(sql.LevelReadCommitted); err != nil {
-		return err
+	if *statStatementsFlag {
+		monitor, err := r.monitor("", logger)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if r.stats, err = openStatStatements(monitor, logger); err != nil {
+			log.Fatalln(err)
+		}
 	}
-	// Запуск второй транзакции
-	tx2Logger := logger.With(zap.String("tx", "tx2"))
-	tx2 := newTransaction(db, tx2Logger)
-	if err := tx2.begin(); err != nil {
-		return err
+	if *probability > 0 {
+		if err = r.anomalyProbability(os.Stdout, names, *probability, *jitter); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	suiteProgress.addTotal(len(names))
+	if *parallel {
+		err = r.runParallel(names)
+		if err != nil && !*watch {
+			log.Fatalln(err)
+		}
+	} else {
+		for _, name := range names {
+			err = r.run(name, isolationProblems[name])
+			if err != nil && !*watch {
+				log.Fatalln(err)
+			}
+		}
 	}
-	if err := tx2.setLevel(sql.LevelReadCommitted); err != nil {
+	suiteProgress.close()
+	if *chartsDir != "" {
+		if err = writeBenchmarkCharts(*chartsDir, meta); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if *watch {
+		if err = watchScenarios(r, *scenariosDir, *gucProfilesPath, *selected, custom, logger); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func phantomRead(db *sqlx.DB, logger *zap.Logger) error {
+	// Запуск транзакций
+	tx1, tx2, err := beginPair(db, logger, sql.LevelReadCommitted)
+	if err != nil {
 		return err
 	}
 
-	// Чтение баланса в 1 транзакции
-	userID := 1
-	newBalance1 := 100_000
-	if err := tx1.printUserBalance(userID); err != nil {
+	// Чтение количества записей в 1 транзакции; строки -seed-* не входят в предикат,
+	// чтобы в выборке были только исходные записи и фантом
+	if err := tx1.printUsersCount(); err != nil {
+		return err
+	}
+	before, err := tx1.selectPersons("id < $1", seedFirstID)
+	if err != nil {
 		return err
 	}
 
-	// Обновление баланса во 2 транзакции
-	if err := tx2.updateUser(userID, newBalance1); err != nil {
+	// Добавление записи во 2 транзакции
+	if err := tx2.insertUser(3, 1000); err != nil {
 		return err
 	}
 	if err := tx2.commit(); err != nil {
 		return err
 	}
 
-	// Чтение баланса в 1 транзакции
-	if err := tx1.printUserBalance(userID); err != nil {
+	// Чтение количества записей в 1 транзакции
+	if err := tx1.printUsersCount(); err != nil {
+		return err
+	}
+	after, err := tx1.selectPersons("id < $1", seedFirstID)
+	if err != nil {
 		return err
 	}
 	if err := tx1.commit(); err != nil {
 		return err
 	}
+
+	// При READ COMMITTED повторное чтение видит ровно строку tx2
+	appeared, disappeared := rowsetDiff(before, after)
+	logger.Info("phantom rows", zap.Any("appeared", appeared), zap.Any("disappeared", disappeared))
+	if !reflect.DeepEqual(appeared, []int32{3}) || len(disappeared) != 0 {
+		return fmt.Errorf("expected phantom row 3, appeared %v, disappeared %v", appeared, disappeared)
+	}
 	return nil
 }
 
-func dirtyRead(db *sqlx.DB, logger *zap.Logger) error {
-	// Проверка баланса после завершения транзакций
-	defer func() {
-		tx3Logger := logger.With(zap.String("tx", "tx3"))
-		tx3 := newTransaction(db, tx3Logger)
-		if err := tx3.begin(); err != nil {
-			return
-		}
-		if err := tx3.printUserBalance(1); err != nil {
-			return
-		}
-		if err := tx3.commit(); err != nil {
-			return
-		}
-	}()
+func nonRepeatableRead(db *sqlx.DB, logger *zap.Logger) error {
+	// Запуск транзакций
+	tx1, tx2, err := beginPair(db, logger, sql.LevelReadCommitted)
+	if err != nil {
+		return err
+	}
 
-	// Запуск первой транзакции
-	tx1Logger := logger.With(zap.String("tx", "tx1"))
-	tx1 := newTransaction(db, tx1Logger)
-	if err := tx1.begin(); err != nil {
+	// Чтение баланса в 1 транзакции
+	userID := 1
+	if err := readBalance(userID, tx1); err != nil {
 		return err
 	}
-	if err := tx1.setLevel(sql.LevelReadUncommitted); err != nil {
+
+	// Обновление баланса во 2 транзакции
+	if err := tx2.writeAndCommit(userID, 100_000); err != nil {
 		return err
 	}
 
-	// Запуск второй транзакции
-	tx2Logger := logger.With(zap.String("tx", "tx2"))
-	tx2 := newTransaction(db, tx2Logger)
-	if err := tx2.begin(); err != nil {
+	// Чтение баланса в 1 транзакции
+	if err := readBalance(userID, tx1); err != nil {
 		return err
 	}
-	if err := tx2.setLevel(sql.LevelReadUncommitted); err != nil {
+	return tx1.commit()
+}
+
+func dirtyRead(db *sqlx.DB, logger *zap.Logger) error {
+	// Запуск транзакций
+	tx1, tx2, err := beginPair(db, logger, sql.LevelReadUncommitted)
+	if err != nil {
 		return err
 	}
 
 	// Обновление баланса в 1 транзакции
-	newBalance := 100_000
 	userID := 1
-	if err := tx1.updateUser(userID, newBalance); err != nil {
+	if err := tx1.updateUser(userID, 100_000); err != nil {
 		return err
 	}
 
 	// Чтение баланса во 2 транзакции
-	if err := tx2.printUserBalance(userID); err != nil {
+	if err := readBalance(userID, tx2); err != nil {
 		return err
 	}
 
@@ -363,72 +1222,77 @@ func dirtyRead(db *sqlx.DB, logger *zap.Logger) error {
 	if err := tx1.rollback(); err != nil {
 		return err
 	}
-	if err := tx2.commit(); err != nil {
-		return err
-	}
-	return nil
+	return tx2.commit()
 }
 
 func lostUpdate(db *sqlx.DB, logger *zap.Logger) error {
-	// Проверка баланса после завершения транзакций
-	defer func() {
-		tx3Logger := logger.With(zap.String("tx", "tx3"))
-		tx3 := newTransaction(db, tx3Logger)
-		if err := tx3.begin(); err != nil {
-			return
-		}
-		if err := tx3.printUserBalance(1); err != nil {
-			return
-		}
-		if err := tx3.commit(); err != nil {
-			return
-		}
-	}()
-
-	// Запуск первой транзакции
-	tx1Logger := logger.With(zap.String("tx", "tx1"))
-	tx1 := newTransaction(db, tx1Logger)
-	if err := tx1.begin(); err != nil {
+	// Запуск транзакций
+	tx1, tx2, err := beginPair(db, logger, sql.LevelReadCommitted)
+	if err != nil {
 		return err
 	}
-	if err := tx1.setLevel(sql.LevelReadCommitted); err != nil {
+
+	// Чтение баланса
+	userID := 1
+	if err := readBalance(userID, tx1, tx2); err != nil {
 		return err
 	}
 
-	// Запуск второй транзакции
-	tx2Logger := logger.With(zap.String("tx", "tx2"))
-	tx2 := newTransaction(db, tx2Logger)
-	if err := tx2.begin(); err != nil {
+	// Обновление баланса в 1 транзакции
+	if err := tx1.writeAndCommit(userID, 100_000); err != nil {
 		return err
 	}
-	if err := tx2.setLevel(sql.LevelReadCommitted); err != nil {
+
+	// Обновление баланса во 2 транзакции
+	return tx2.writeAndCommit(userID, 10)
+}
+
+// lostUpdateSQLC - потерянное обновление через типизированные запросы sqlc,
+// так же, как его допускают сервисы с генерируемым слоем доступа к данным.
+func lostUpdateSQLC(db *sqlx.DB, logger *zap.Logger) error {
+	ctx := scenarioContext(db)
+
+	// Запуск транзакций
+	tx1, tx2, err := beginPair(db, logger, sql.LevelReadCommitted)
+	if err != nil {
 		return err
 	}
+	tx1Logger, tx2Logger := tx1.logger, tx2.logger
 
-	// Чтение баланса
-	userID := 1
-	if err := tx1.printUserBalance(userID); err != nil {
+	// Чтение баланса в обеих транзакциях
+	var userID int32 = 1
+	balance1, err := tx1.queries().GetBalance(ctx, userID)
+	if err != nil {
+		tx1Logger.Error("failed to get balance", zap.Error(err))
 		return err
 	}
-	if err := tx2.printUserBalance(userID); err != nil {
+	tx1Logger.Info("balance read", zap.Stringer("balance", balance1))
+	balance2, err := tx2.queries().GetBalance(ctx, userID)
+	if err != nil {
+		tx2Logger.Error("failed to get balance", zap.Error(err))
 		return err
 	}
+	tx2Logger.Info("balance read", zap.Stringer("balance", balance2))
 
-	// Обновление баланса в 1 транзакции
-	newBalance1 := 100_000
-	if err := tx1.updateUser(userID, newBalance1); err != nil {
+	// Списание в 1 транзакции
+	params1 := persondb.UpdateBalanceParams{ID: userID, Balance: balance1 - persondb.Units(300)}
+	if err = tx1.queries().UpdateBalance(ctx, params1); err != nil {
+		tx1Logger.Error("failed to update balance", zap.Error(err))
 		return err
 	}
-	if err := tx1.commit(); err != nil {
+	tx1Logger.Info("balance updated", zap.Stringer("balance", params1.Balance))
+	if err = tx1.commit(); err != nil {
 		return err
 	}
 
-	// Обновление баланса во 2 транзакции
-	newBalance2 := 10
-	if err := tx2.updateUser(userID, newBalance2); err != nil {
+	// Списание во 2 транзакции по устаревшему значению
+	params2 := persondb.UpdateBalanceParams{ID: userID, Balance: balance2 - persondb.Units(500)}
+	if err = tx2.queries().UpdateBalance(ctx, params2); err != nil {
+		tx2Logger.Error("failed to update balance", zap.Error(err))
 		return err
 	}
-	if err := tx2.commit(); err != nil {
+	tx2Logger.Info("balance updated", zap.Stringer("balance", params2.Balance))
+	if err = tx2.commit(); err != nil {
 		return err
 	}
 	return nil
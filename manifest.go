@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Виды артефактов запуска в манифесте.
+const (
+	artifactHistory  = "history"
+	artifactEvents   = "events"
+	artifactSQL      = "sql"
+	artifactDump     = "dump"
+	artifactReport   = "report"
+	artifactScenario = "scenario"
+)
+
+// manifestArtifact - файл, созданный запуском. Path задан относительно
+// каталога манифеста, если файл лежит в нем, иначе абсолютным путем.
+type manifestArtifact struct {
+	Path   string `json:"path"`
+	Kind   string `json:"kind"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// runManifest - manifest.json запуска: параметры, сведения о сервере и все
+// артефакты с хешами SHA-256, чтобы архив запуска можно было проверить
+// командой verify-manifest и сослаться на него из статьи или тикета.
+type runManifest struct {
+	Metadata   *runMetadata       `json:"metadata,omitempty"`
+	Args       []string           `json:"args"`
+	FinishedAt time.Time          `json:"finished_at"`
+	Artifacts  []manifestArtifact `json:"artifacts"`
+
+	// path - файл манифеста; sources - файлы и каталоги артефактов по видам
+	path    string
+	sources []artifactSource
+}
+
+type artifactSource struct {
+	path string
+	kind string
+}
+
+// newRunManifest создает манифест, который будет записан в path; при пустом
+// path возвращает nil, и методы манифеста ничего не делают.
+func newRunManifest(path string) *runManifest {
+	if path == "" {
+		return nil
+	}
+	return &runManifest{Args: os.Args[1:], path: path}
+}
+
+// add отмечает файл или каталог path с артефактами вида kind; пустой path пропускается.
+func (m *runManifest) add(path, kind string) {
+	if m == nil || path == "" {
+		return
+	}
+	m.sources = append(m.sources, artifactSource{path: path, kind: kind})
+}
+
+// setMetadata запоминает сведения о запуске и сервере.
+func (m *runManifest) setMetadata(meta *runMetadata) {
+	if m != nil {
+		m.Metadata = meta
+	}
+}
+
+// addEvents отмечает запись событий, если -events пишет в файл.
+func (m *runManifest) addEvents(target string) {
+	if m == nil {
+		return
+	}
+	if u, err := url.Parse(target); err == nil && u.Scheme == "file" {
+		m.add(eventsFilePath(u), artifactEvents)
+	}
+}
+
+// write хеширует артефакты и сохраняет манифест. Вызывается после закрытия
+// истории и записи событий, чтобы хеши относились к окончательным файлам.
+func (m *runManifest) write(logger *zap.Logger) error {
+	if m == nil {
+		return nil
+	}
+	dir, err := filepath.Abs(filepath.Dir(m.path))
+	if err != nil {
+		return err
+	}
+	self, err := filepath.Abs(m.path)
+	if err != nil {
+		return err
+	}
+	m.Artifacts = nil
+	// Каталоги артефактов могут вкладываться друг в друга, файл учитывается один раз
+	seen := make(map[string]bool)
+	for _, src := range m.sources {
+		err := filepath.WalkDir(src.path, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			abs, err := filepath.Abs(path)
+			if err != nil || abs == self || seen[abs] {
+				return err
+			}
+			seen[abs] = true
+			artifact, err := hashArtifact(abs)
+			if err != nil {
+				return err
+			}
+			artifact.Kind = src.kind
+			artifact.Path = manifestPath(dir, abs)
+			m.Artifacts = append(m.Artifacts, artifact)
+			return nil
+		})
+		// Артефакт, который запуск не успел создать, например пустой -shrink, не ошибка
+		if errors.Is(err, fs.ErrNotExist) {
+			logger.Warn("artifact not found", zap.String("path", src.path), zap.String("kind", src.kind))
+			continue
+		}
+		if err != nil {
+			logger.Error("failed to hash artifact", zap.Error(err), zap.String("path", src.path))
+			return err
+		}
+	}
+	sort.Slice(m.Artifacts, func(i, j int) bool { return m.Artifacts[i].Path < m.Artifacts[j].Path })
+	m.FinishedAt = time.Now().UTC()
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(m.path, append(data, '\n'), 0o644); err != nil {
+		logger.Error("failed to write manifest", zap.Error(err), zap.String("path", m.path))
+		return err
+	}
+	logger.Info("manifest written", zap.String("path", m.path), zap.Int("artifacts", len(m.Artifacts)))
+	return nil
+}
+
+// manifestPath возвращает путь abs относительно каталога манифеста dir или
+// abs, если файл лежит вне его.
+func manifestPath(dir, abs string) string {
+	rel, err := filepath.Rel(dir, abs)
+	if err != nil || !filepath.IsLocal(rel) {
+		return abs
+	}
+	return filepath.ToSlash(rel)
+}
+
+// hashArtifact возвращает размер и SHA-256 файла path.
+func hashArtifact(path string) (manifestArtifact, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return manifestArtifact{}, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return manifestArtifact{}, err
+	}
+	return manifestArtifact{Size: size, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// verifyManifestCommand реализует подкоманду verify-manifest manifest.json:
+// пересчитывает хеши артефактов и сообщает об измененных и пропавших файлах.
+func verifyManifestCommand(args []string, logger *zap.Logger) error {
+	flags := flag.NewFlagSet("verify-manifest", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: verify-manifest <manifest.json>")
+	}
+	data, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	var m runManifest
+	if err = json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("%s: %w", flags.Arg(0), err)
+	}
+	dir := filepath.Dir(flags.Arg(0))
+	failed := 0
+	for _, a := range m.Artifacts {
+		path := filepath.FromSlash(a.Path)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		got, err := hashArtifact(path)
+		switch {
+		case err != nil:
+			logger.Error("artifact unreadable", zap.String("path", a.Path), zap.Error(err))
+			failed++
+		case got.SHA256 != a.SHA256 || got.Size != a.Size:
+			logger.Error("artifact changed", zap.String("path", a.Path), zap.String("expected", a.SHA256), zap.String("got", got.SHA256))
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%s: %d of %d artifacts do not match", flags.Arg(0), failed, len(m.Artifacts))
+	}
+	logger.Info("manifest verified", zap.String("path", flags.Arg(0)), zap.Int("artifacts", len(m.Artifacts)))
+	return nil
+}
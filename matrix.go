@@ -0,0 +1,181 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+
+	"transactionIsolation/isolation"
+)
+
+// Значения ячеек матрицы видимости
+const (
+	visibilityUncommitted = "uncommitted" // читатель видит незафиксированное изменение
+	visibilityCommitted   = "committed"   // читатель видит изменение после фиксации
+	visibilitySnapshot    = "snapshot"    // читатель не видит изменение до конца транзакции
+	visibilityUnaffected  = "-"           // изменение не влияет на результат чтения
+)
+
+// matrixWriter - изменение, которое выполняет пишущая транзакция.
+type matrixWriter struct {
+	name  string
+	query string
+	id    int // строка, которую затрагивает изменение
+}
+
+var matrixWriters = []matrixWriter{
+	{name: "update", query: "UPDATE person SET balance = 2000 WHERE id = 1;", id: 1},
+	{name: "insert", query: "INSERT INTO person VALUES (3, 1000);", id: 3},
+	{name: "delete", query: "DELETE FROM person WHERE id = 2;", id: 2},
+}
+
+// matrixReader - чтение, возвращающее одно значение.
+type matrixReader struct {
+	name  string
+	query string
+	point bool // запрос читает строку writer.id
+}
+
+var matrixReaders = []matrixReader{
+	{name: "count", query: "SELECT COUNT(*) FROM person;"},
+	{name: "point_read", query: "SELECT COALESCE(SUM(balance), -1) FROM person WHERE id = $1;", point: true},
+	{name: "predicate_read", query: "SELECT COALESCE(SUM(balance), 0) FROM person WHERE balance >= 500;"},
+}
+
+var matrixLevels = isolation.Levels(isolation.Postgres)
+
+// visibilityCell - результат одного сочетания изменения, чтения и уровня.
+type visibilityCell struct {
+	writer, reader string
+	level          sql.IsolationLevel
+	visibility     string
+}
+
+// matrixCells - количество ячеек матрицы видимости.
+func matrixCells() int {
+	return len(matrixWriters) * len(matrixReaders) * len(matrixLevels)
+}
+
+// buildVisibilityMatrix выполняет все сочетания изменения, чтения и уровня
+// изоляции читателя. Читатель получает снимок, затем читает после изменения
+// и после его фиксации.
+func buildVisibilityMatrix(db *sqlx.DB, logger *zap.Logger) ([]visibilityCell, error) {
+	var cells []visibilityCell
+	for _, w := range matrixWriters {
+		for _, r := range matrixReaders {
+			for _, level := range matrixLevels {
+				cellLogger := logger.With(zap.String("writer", w.name), zap.String("reader", r.name), zap.Stringer("level", level))
+				suiteProgress.begin(fmt.Sprintf("%s/%s %s", w.name, r.name, level))
+				visibility, err := visibilityOf(db, cellLogger, w, r, level)
+				suiteProgress.end()
+				if err != nil {
+					return nil, fmt.Errorf("%s/%s/%s: %w", w.name, r.name, level, err)
+				}
+				cellLogger.Info("visibility", zap.String("visibility", visibility))
+				cells = append(cells, visibilityCell{writer: w.name, reader: r.name, level: level, visibility: visibility})
+			}
+		}
+	}
+	return cells, nil
+}
+
+func visibilityOf(db *sqlx.DB, logger *zap.Logger, w matrixWriter, r matrixReader, level sql.IsolationLevel) (string, error) {
+	if err := migrate(db, zap.NewNop(), personMigrations); err != nil {
+		return "", err
+	}
+	var args []any
+	if r.point {
+		args = append(args, w.id)
+	}
+	read := func(t *transaction) (string, error) {
+		rows, err := t.query(r.query, args...)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprint(rows[0][0]), nil
+	}
+
+	// Читатель получает снимок до изменения
+	reader := newTransaction(db, logger.With(zap.String("tx", "reader")))
+	if err := reader.begin(); err != nil {
+		return "", err
+	}
+	if err := reader.setLevel(level); err != nil {
+		return "", err
+	}
+	before, err := read(reader)
+	if err != nil {
+		return "", err
+	}
+
+	// Изменение без фиксации
+	writer := newTransaction(db, logger.With(zap.String("tx", "writer")))
+	if err = writer.begin(); err != nil {
+		return "", err
+	}
+	if _, err = writer.exec(w.query); err != nil {
+		return "", err
+	}
+	uncommitted, err := read(reader)
+	if err != nil {
+		return "", err
+	}
+	if err = writer.commit(); err != nil {
+		return "", err
+	}
+	committed, err := read(reader)
+	if err != nil {
+		return "", err
+	}
+	if err = reader.commit(); err != nil {
+		return "", err
+	}
+
+	// Значение после завершения обеих транзакций показывает, влияет ли изменение на чтение
+	final := newTransaction(db, logger.With(zap.String("tx", "tx3")))
+	if err = final.begin(); err != nil {
+		return "", err
+	}
+	after, err := read(final)
+	if err != nil {
+		return "", err
+	}
+	if err = final.commit(); err != nil {
+		return "", err
+	}
+
+	switch {
+	case after == before:
+		return visibilityUnaffected, nil
+	case uncommitted != before:
+		return visibilityUncommitted, nil
+	case committed != before:
+		return visibilityCommitted, nil
+	default:
+		return visibilitySnapshot, nil
+	}
+}
+
+// printVisibilityMatrix выводит матрицу: строки - изменение и чтение, столбцы - уровни изоляции.
+func printVisibilityMatrix(w io.Writer, cells []visibilityCell) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprint(tw, "WRITER\tREADER")
+	for _, level := range matrixLevels {
+		fmt.Fprintf(tw, "\t%s", level)
+	}
+	fmt.Fprintln(tw)
+	for i, c := range cells {
+		if i%len(matrixLevels) == 0 {
+			fmt.Fprintf(tw, "%s\t%s", c.writer, c.reader)
+		}
+		fmt.Fprintf(tw, "\t%s", c.visibility)
+		if i%len(matrixLevels) == len(matrixLevels)-1 {
+			fmt.Fprintln(tw)
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+var matviewMigrations = append(append([]string{`DROP MATERIALIZED VIEW IF EXISTS person_balance;`}, personMigrations...),
+	`CREATE MATERIALIZED VIEW person_balance AS SELECT id, balance FROM person;`,
+	// Уникальный индекс обязателен для REFRESH ... CONCURRENTLY
+	`CREATE UNIQUE INDEX person_balance_id ON person_balance (id);`,
+)
+
+// matviewVariant - способ обновления материализованного представления.
+type matviewVariant struct {
+	name    string
+	refresh string
+}
+
+var matviewVariants = []matviewVariant{
+	{name: "refresh", refresh: "REFRESH MATERIALIZED VIEW person_balance;"},
+	{name: "refresh_concurrently", refresh: "REFRESH MATERIALIZED VIEW CONCURRENTLY person_balance;"},
+}
+
+// matviewRefresh показывает, что видят читатели представления во время его обновления:
+// обычный REFRESH берет ACCESS EXCLUSIVE и блокирует чтение до конца транзакции,
+// REFRESH CONCURRENTLY берет EXCLUSIVE и позволяет читать старое содержимое.
+func matviewRefresh(db *sqlx.DB, logger *zap.Logger) error {
+	// Представление зависит от person и мешает миграциям следующих сценариев
+	defer func() {
+		if err := migrate(db, logger, []string{`DROP MATERIALIZED VIEW IF EXISTS person_balance;`}); err != nil {
+			return
+		}
+	}()
+
+	for _, v := range matviewVariants {
+		if err := runMatviewVariant(db, logger.With(zap.String("variant", v.name)), v); err != nil {
+			return fmt.Errorf("%s: %w", v.name, err)
+		}
+	}
+	return nil
+}
+
+func runMatviewVariant(db *sqlx.DB, logger *zap.Logger, v matviewVariant) error {
+	prepare := []string{
+		`UPDATE person SET balance = 1000;`,
+		`REFRESH MATERIALIZED VIEW person_balance;`,
+		// Изменение, которое станет видно в представлении только после обновления
+		`UPDATE person SET balance = 500 WHERE id = 1;`,
+	}
+	if err := migrate(db, logger, prepare); err != nil {
+		return err
+	}
+
+	// Обновление представления в 1 транзакции, блокировка держится до commit
+	tx1 := newTransaction(db, logger.With(zap.String("tx", "tx1")))
+	if err := tx1.begin(); err != nil {
+		return err
+	}
+	if _, err := tx1.exec(v.refresh); err != nil {
+		return err
+	}
+	pid, err := tx1.backendPID()
+	if err != nil {
+		return err
+	}
+	if monitorAccess.locks {
+		var modes []string
+		if err = monitorDB(db).Select(&modes, `SELECT mode FROM pg_locks
+         WHERE relation = 'person_balance'::regclass AND pid = $1 AND granted
+         ORDER BY mode;`, pid); err != nil {
+			tx1.logger.Error("failed to read locks", zap.Error(err))
+			return err
+		}
+		for _, mode := range modes {
+			tx1.logger.Info("lock held", zap.String("mode", mode))
+		}
+	}
+
+	// Чтение представления во 2 транзакции
+	tx2 := newTransaction(db, logger.With(zap.String("tx", "tx2")))
+	if err = tx2.begin(); err != nil {
+		return err
+	}
+	if err = tx2.setLevel(sql.LevelReadCommitted); err != nil {
+		return err
+	}
+	var balance int64
+	tx2PID, err := tx2.backendPID()
+	if err != nil {
+		return err
+	}
+	tx2Done := runAsync(func() error {
+		var err error
+		balance, err = tx2.queryBalance("SELECT balance FROM person_balance WHERE id = $1;", 1)
+		return err
+	})
+	read, err := finished(tx2, tx2PID, tx2Done)
+	if err != nil {
+		return err
+	}
+	blocked := !read
+	if blocked {
+		tx2.logger.Info("reader blocked by refresh")
+		if err = tx1.commit(); err != nil {
+			return err
+		}
+		if err = <-tx2Done; err != nil {
+			return err
+		}
+	}
+	tx2.logger.Info("balance read from view", zap.Int64("balance", balance), zap.Bool("blocked", blocked), zap.Bool("stale", balance != 500))
+
+	if !blocked {
+		if err = tx1.commit(); err != nil {
+			return err
+		}
+	}
+	return tx2.commit()
+}
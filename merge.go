@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+const (
+	mergeQuery = `MERGE INTO person p
+         USING (VALUES ($1::int, $2::bigint)) AS s (id, amount) ON p.id = s.id
+         WHEN MATCHED THEN UPDATE SET balance = p.balance + s.amount
+         WHEN NOT MATCHED THEN INSERT (id, balance) VALUES (s.id, s.amount);`
+	upsertQuery = `INSERT INTO person (id, balance) VALUES ($1, $2)
+         ON CONFLICT (id) DO UPDATE SET balance = person.balance + EXCLUDED.balance;`
+)
+
+// mergeVariant - оператор и ключ, на котором сталкиваются транзакции.
+type mergeVariant struct {
+	name  string
+	query string
+	id    int
+	// balance - итоговый баланс ключа после обеих транзакций
+	balance int64
+}
+
+var mergeVariants = []mergeVariant{
+	{name: "merge_existing_key", query: mergeQuery, id: 1, balance: 1300},
+	{name: "merge_new_key", query: mergeQuery, id: 3, balance: 100},
+	{name: "on_conflict_new_key", query: upsertQuery, id: 3, balance: 300},
+}
+
+// mergeConcurrency сравнивает параллельные MERGE с INSERT ... ON CONFLICT.
+// MERGE не обрабатывает конфликт уникального ключа: если обе транзакции не нашли
+// строку, вторая получает unique_violation, тогда как ON CONFLICT переходит к UPDATE.
+// Для существующей строки вторая транзакция ждет первую и обновляет новую версию.
+func mergeConcurrency(db *sqlx.DB, logger *zap.Logger) error {
+	if err := requireServerVersion(db, logger, 150000, "MERGE"); err != nil {
+		return err
+	}
+	for _, v := range mergeVariants {
+		if err := runMergeVariant(db, logger.With(zap.String("variant", v.name)), v); err != nil {
+			return fmt.Errorf("%s: %w", v.name, err)
+		}
+	}
+	return nil
+}
+
+func runMergeVariant(db *sqlx.DB, logger *zap.Logger, v mergeVariant) (err error) {
+	if err := migrate(db, logger, []string{`UPDATE person SET balance = 1000;`, `DELETE FROM person WHERE id > 2;`}); err != nil {
+		return err
+	}
+
+	// Проверка баланса после завершения транзакций
+	defer verifyFinalBalance(db, logger, &err, v.id, v.balance)
+
+	// Запуск транзакций
+	tx1 := newTransaction(db, logger.With(zap.String("tx", "tx1")))
+	if err := tx1.begin(); err != nil {
+		return err
+	}
+	tx2 := newTransaction(db, logger.With(zap.String("tx", "tx2")))
+	if err := tx2.begin(); err != nil {
+		return err
+	}
+
+	// Обе транзакции зачисляют сумму на один ключ, 2 транзакция ждет 1
+	if _, err := tx1.exec(v.query, v.id, 100); err != nil {
+		return err
+	}
+	pid, err := tx2.backendPID()
+	if err != nil {
+		return err
+	}
+	tx2Done := runAsync(func() error {
+		_, err := tx2.exec(v.query, v.id, 200)
+		return err
+	})
+	if err = waitBlocked(tx2, pid, tx2Done); err != nil {
+		return err
+	}
+	if err := tx1.commit(); err != nil {
+		return err
+	}
+	if err := <-tx2Done; err != nil {
+		class := classifyError(err)
+		tx2.logger.Info("statement rejected", zap.String("code", class.Code), zap.String("explanation", class.Explanation))
+		return tx2.rollback()
+	}
+	return tx2.commit()
+}
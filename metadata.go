@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime/debug"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// metadataSettings - параметры сервера, от которых зависят результаты сценариев:
+// уровень по умолчанию, ожидание блокировок, укрупнение предикатных блокировок
+// SSI и snapshot too old.
+var metadataSettings = []string{
+	"deadlock_timeout",
+	"default_transaction_isolation",
+	"lock_timeout",
+	"max_connections",
+	"max_pred_locks_per_page",
+	"max_pred_locks_per_relation",
+	"max_pred_locks_per_transaction",
+	"old_snapshot_threshold",
+	"synchronous_commit",
+}
+
+// settingUnavailable - значение параметра, которого нет в этой версии сервера.
+const settingUnavailable = "(not available)"
+
+// runMetadata описывает условия запуска: без них архивные результаты нельзя
+// сравнить с результатами другого сервера или другой версии инструмента.
+type runMetadata struct {
+	ToolVersion   string            `json:"tool_version"`
+	ServerVersion string            `json:"server_version,omitempty"`
+	Schema        string            `json:"schema,omitempty"`
+	Settings      map[string]string `json:"settings,omitempty"`
+	DataSeed      int64             `json:"data_seed"`
+	OrderSeed     int64             `json:"order_seed,omitempty"`
+	StartedAt     time.Time         `json:"started_at"`
+	// Degraded - возможности, отключенные из-за прав роли подключения
+	Degraded []string `json:"degraded,omitempty"`
+}
+
+// collectMetadata читает версию и параметры сервера; при db == nil заполняет
+// только сведения об инструменте и seed, например для отчета по нескольким серверам.
+func collectMetadata(db *sqlx.DB, logger *zap.Logger) (*runMetadata, error) {
+	m := &runMetadata{ToolVersion: toolVersion(), Schema: targetSchema, DataSeed: dataSeed, StartedAt: time.Now().UTC()}
+	if runOrder.mode == orderRandom {
+		m.OrderSeed = runOrder.seed
+	}
+	if db == nil {
+		return m, nil
+	}
+	var err error
+	if m.ServerVersion, err = serverVersion(db, logger); err != nil {
+		return nil, err
+	}
+	var settings []struct {
+		Name    string `db:"name"`
+		Setting string `db:"setting"`
+	}
+	const settingsQuery = `SELECT name, current_setting(name) AS setting FROM pg_settings WHERE name = ANY($1);`
+	if err = db.Select(&settings, settingsQuery, pq.Array(metadataSettings)); err != nil {
+		logger.Error("failed to read settings", zap.Error(err))
+		return nil, err
+	}
+	m.Settings = make(map[string]string, len(metadataSettings))
+	for _, name := range metadataSettings {
+		m.Settings[name] = settingUnavailable
+	}
+	fields := make([]zap.Field, 0, len(settings))
+	for _, s := range settings {
+		m.Settings[s.Name] = s.Setting
+		fields = append(fields, zap.String(s.Name, s.Setting))
+	}
+	logger.Info("server settings", fields...)
+	return m, nil
+}
+
+// toolVersion возвращает версию модуля и ревизию, из которой собран инструмент.
+func toolVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	version := info.Main.Version
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			version += " " + s.Value
+		case "vcs.modified":
+			if s.Value == "true" {
+				version += " (modified)"
+			}
+		}
+	}
+	return version
+}
+
+// lines возвращает пары "ключ: значение" в постоянном порядке.
+func (m *runMetadata) lines() []string {
+	lines := []string{"tool_version: " + m.ToolVersion}
+	if m.ServerVersion != "" {
+		lines = append(lines, "server_version: "+m.ServerVersion)
+	}
+	if m.Schema != "" {
+		lines = append(lines, "schema: "+m.Schema)
+	}
+	names := make([]string, 0, len(m.Settings))
+	for name := range m.Settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		lines = append(lines, name+": "+m.Settings[name])
+	}
+	lines = append(lines, fmt.Sprintf("data_seed: %d", m.DataSeed))
+	if m.OrderSeed != 0 {
+		lines = append(lines, fmt.Sprintf("order_seed: %d", m.OrderSeed))
+	}
+	lines = append(lines, "started_at: "+m.StartedAt.Format(time.RFC3339))
+	for _, note := range m.Degraded {
+		lines = append(lines, "degraded: "+note)
+	}
+	return lines
+}
+
+// print выводит блок метаданных перед текстовым отчетом.
+func (m *runMetadata) print(w io.Writer) error {
+	for _, line := range m.lines() {
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Типы столбца person.balance
+const (
+	balanceBigint  = "bigint"
+	balanceNumeric = "numeric"
+)
+
+// balanceType - тип person.balance, задается флагом -balance-type. NUMERIC
+// показывает округление и блокировки с типом, которым обычно хранят деньги.
+var balanceType = balanceBigint
+
+var balanceColumnTypes = map[string]string{
+	balanceBigint:  "BIGINT",
+	balanceNumeric: "NUMERIC(18,2)",
+}
+
+func validateBalanceType(name string) error {
+	if _, ok := balanceColumnTypes[name]; !ok {
+		return fmt.Errorf("unknown balance type %q, expected %s or %s", name, balanceBigint, balanceNumeric)
+	}
+	return nil
+}
+
+// withBalanceType добавляет после создания таблицы person изменение типа
+// balance, если выбран не BIGINT. Изменение выполняется до вставки строк и
+// до создания зависящих от столбца представлений, поэтому так работают все
+// сценарии с таблицей person, включая YAML и наборы сценариев.
+func withBalanceType(migrations []string) []string {
+	if balanceType == balanceBigint {
+		return migrations
+	}
+	alter := "ALTER TABLE person ALTER COLUMN balance TYPE " + balanceColumnTypes[balanceType] + ";"
+	result := make([]string, 0, len(migrations)+1)
+	for _, m := range migrations {
+		result = append(result, m)
+		if demoTables([]string{m})["person"] {
+			result = append(result, alter)
+		}
+	}
+	return result
+}
+
+// decodeColumn приводит значение NUMERIC, которое lib/pq возвращает текстом,
+// к int64 при нулевой дробной части и к float64 иначе. Так сравнения и
+// Starlark работают с balance одинаково для BIGINT и NUMERIC(18,2).
+// Остальные значения возвращаются без изменений.
+func decodeColumn(column *sql.ColumnType, v any) (any, error) {
+	text, ok := v.(string)
+	if !ok || column.DatabaseTypeName() != "NUMERIC" {
+		return v, nil
+	}
+	if whole, fraction, found := strings.Cut(text, "."); !found || strings.Trim(fraction, "0") == "" {
+		return strconv.ParseInt(whole, 10, 64)
+	}
+	return strconv.ParseFloat(text, 64)
+}
+
+// balanceValue возвращает баланс, декодированный decodeColumn, как int64.
+// Баланс NUMERIC с копейками - ошибка, а не паника: сценарии с целыми
+// суммами не должны молча отбрасывать дробную часть. Суммы с копейками
+// читает moneyValue.
+func balanceValue(v any) (int64, error) {
+	switch v := v.(type) {
+	case int64:
+		return v, nil
+	case float64:
+		return 0, fmt.Errorf("balance %v has a fractional part", v)
+	default:
+		return 0, fmt.Errorf("unexpected balance %v of type %T", v, v)
+	}
+}
+
+// moneyValue возвращает сумму, декодированную decodeColumn, с копейками.
+func moneyValue(v any) (float64, error) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	default:
+		return 0, fmt.Errorf("unexpected amount %v of type %T", v, v)
+	}
+}
+
+// queryBalance читает баланс из первой строки запроса транзакции t.
+func (t *transaction) queryBalance(query string, args ...any) (int64, error) {
+	rows, err := t.query(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	if len(rows) == 0 {
+		return 0, fmt.Errorf("%s: %w", query, sql.ErrNoRows)
+	}
+	return balanceValue(rows[0][0])
+}
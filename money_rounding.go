@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+var moneyRoundingMigrations = []string{
+	`DROP TABLE IF EXISTS account;`,
+	`CREATE TABLE account (
+           id INT PRIMARY KEY,
+           balance NUMERIC(18,2) NOT NULL
+         );`,
+	`INSERT INTO account VALUES (1, 1000.10);`,
+}
+
+// moneyDeposit - зачисление каждой транзакции: полкопейки, которые NUMERIC(18,2)
+// округляет при каждой записи.
+const moneyDeposit = 0.125
+
+// moneyRoundingVariant - способ, которым транзакции зачисляют moneyDeposit.
+type moneyRoundingVariant struct {
+	name string
+	// atomic - сервер прибавляет сумму в UPDATE, иначе приложение вычисляет
+	// новый баланс в float64 по прочитанному
+	atomic bool
+	// balance - итоговый баланс; без округления и потерь было бы 1000.35
+	balance string
+}
+
+var moneyRoundingVariants = []moneyRoundingVariant{
+	// Обе транзакции записывают 1000.225, округленное до 1000.23: одно зачисление потеряно
+	{name: "read_modify_write", balance: "1000.23"},
+	// Каждое зачисление округляется отдельно: 1000.225 -> 1000.23, 1000.355 -> 1000.36
+	{name: "atomic", atomic: true, balance: "1000.36"},
+}
+
+// moneyRounding показывает зачисления с копейками на столбец NUMERIC(18,2)
+// при READ COMMITTED. Баланс читается через decodeColumn как float64, и сумма,
+// вычисленная в приложении, содержит погрешность двоичной дроби, которую
+// сервер убирает округлением при записи. Округление каждой транзакции
+// отдельно дает лишнюю копейку даже без потерянного обновления.
+func moneyRounding(db *sqlx.DB, logger *zap.Logger) error {
+	for _, v := range moneyRoundingVariants {
+		if err := runMoneyRoundingVariant(db, logger.With(zap.String("variant", v.name)), v); err != nil {
+			return fmt.Errorf("%s: %w", v.name, err)
+		}
+	}
+	return nil
+}
+
+func runMoneyRoundingVariant(db *sqlx.DB, logger *zap.Logger, v moneyRoundingVariant) (err error) {
+	if err = migrate(db, logger, []string{`UPDATE account SET balance = 1000.10;`}); err != nil {
+		return err
+	}
+
+	// Проверка баланса после завершения транзакций
+	defer checkPostconditions(db, logger, &err,
+		expectValue("account balance", "SELECT balance FROM account WHERE id = 1;", v.balance))
+
+	// Запуск транзакций
+	tx1 := newTransaction(db, logger.With(zap.String("tx", "tx1")))
+	if err = tx1.begin(); err != nil {
+		return err
+	}
+	tx2 := newTransaction(db, logger.With(zap.String("tx", "tx2")))
+	if err = tx2.begin(); err != nil {
+		return err
+	}
+
+	if v.atomic {
+		// Зачисление tx2 ждет tx1 и прибавляется к ее округленному результату
+		if _, err = tx1.exec("UPDATE account SET balance = balance + $1 WHERE id = 1;", moneyDeposit); err != nil {
+			return err
+		}
+		pid, err := tx2.backendPID()
+		if err != nil {
+			return err
+		}
+		tx2Done := runAsync(func() error {
+			_, err := tx2.exec("UPDATE account SET balance = balance + $1 WHERE id = 1;", moneyDeposit)
+			return err
+		})
+		if err = waitBlocked(tx2, pid, tx2Done); err != nil {
+			return err
+		}
+		if err = tx1.commit(); err != nil {
+			return err
+		}
+		if err = <-tx2Done; err != nil {
+			return err
+		}
+		return tx2.commit()
+	}
+
+	// Обе транзакции читают баланс и вычисляют новый в приложении
+	var computed [2]float64
+	for i, t := range []*transaction{tx1, tx2} {
+		rows, err := t.query("SELECT balance FROM account WHERE id = 1;")
+		if err != nil {
+			return err
+		}
+		balance, err := moneyValue(rows[0][0])
+		if err != nil {
+			return err
+		}
+		computed[i] = balance + moneyDeposit
+		t.logger.Info("deposit computed", zap.Float64("read", balance), zap.Float64("computed", computed[i]))
+	}
+	for i, t := range []*transaction{tx1, tx2} {
+		if _, err = t.exec("UPDATE account SET balance = $1 WHERE id = 1;", computed[i]); err != nil {
+			return err
+		}
+		if err = t.commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+// monitorApplicationName отличает подключение монитора в pg_stat_activity.
+const monitorApplicationName = "transaction_isolation_monitor"
+
+// scenarioApplicationName - application_name сессий сценариев схемы namespace,
+// по нему монитор находит сессии, которые нужно отключить.
+func scenarioApplicationName(namespace string) string {
+	if namespace == "" {
+		return "transaction_isolation"
+	}
+	return "transaction_isolation/" + namespace
+}
+
+// monitors связывает пул подключений сценария с подключением монитора.
+// Монитор - единственное отдельное подключение, через которое выполняются
+// проверки и снимки состояния, поэтому наблюдение не занимает сессии пула
+// сценария и не попадает в записываемый трафик.
+var monitors = struct {
+	mu   sync.Mutex
+	byDB map[*sqlx.DB]*sqlx.DB
+}{byDB: make(map[*sqlx.DB]*sqlx.DB)}
+
+// openMonitor открывает подключение монитора с тем же DSN, что и у сценария.
+func openMonitor(driverName, dsn string, logger *zap.Logger) (*sqlx.DB, error) {
+	params, err := parseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	params["application_name"] = monitorApplicationName
+	db, err := connect(driverName, formatDSN(params), logger.With(zap.String("tx", "monitor")))
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+func registerMonitor(db, monitor *sqlx.DB) {
+	monitors.mu.Lock()
+	defer monitors.mu.Unlock()
+	monitors.byDB[db] = monitor
+}
+
+// monitorDB возвращает монитор пула сценария или сам пул, если монитор не открыт.
+func monitorDB(db *sqlx.DB) *sqlx.DB {
+	monitors.mu.Lock()
+	defer monitors.mu.Unlock()
+	if monitor, ok := monitors.byDB[db]; ok {
+		return monitor
+	}
+	return db
+}
+
+// lockInfo - блокировка, взятая или ожидаемая сессией сценария.
+type lockInfo struct {
+	PID      int     `db:"pid"`
+	LockType string  `db:"locktype"`
+	Relation *string `db:"relation"`
+	Mode     string  `db:"mode"`
+	Granted  bool    `db:"granted"`
+	State    *string `db:"state"`
+	Query    *string `db:"query"`
+}
+
+// printLocks выводит снимок pg_locks для всех сессий текущей базы, кроме монитора.
+func printLocks(monitor *sqlx.DB, logger *zap.Logger) error {
+	if !monitorAccess.locks {
+		return nil
+	}
+	const locksQuery = `SELECT l.pid, l.locktype, l.relation::regclass::text AS relation, l.mode, l.granted, a.state, a.query
+         FROM pg_locks l
+         JOIN pg_stat_activity a ON a.pid = l.pid
+         WHERE a.datname = current_database() AND l.pid <> pg_backend_pid()
+           AND l.locktype <> 'virtualxid'
+         ORDER BY l.pid, l.granted DESC, l.locktype;`
+	var locks []lockInfo
+	if err := monitor.Select(&locks, locksQuery); err != nil {
+		logger.Error("failed to read locks", zap.Error(err))
+		return err
+	}
+	for _, l := range locks {
+		logger.Info("lock",
+			zap.Int("pid", l.PID),
+			zap.String("locktype", l.LockType),
+			zap.Stringp("relation", l.Relation),
+			zap.String("mode", l.Mode),
+			zap.Bool("granted", l.Granted),
+			zap.Stringp("state", l.State),
+			zap.Stringp("query", l.Query),
+		)
+	}
+	return nil
+}
+
+// terminateSessions отключает сессии с application_name, в том числе помеченные
+// именем транзакции (application_name:tx1); сервер откатывает их транзакции.
+func terminateSessions(monitor *sqlx.DB, applicationName string, logger *zap.Logger) error {
+	if !monitorAccess.terminate {
+		logger.Warn("sessions not terminated: the connecting role cannot call pg_terminate_backend", zap.String("application_name", applicationName))
+		return nil
+	}
+	const terminateQuery = `SELECT pid FROM pg_stat_activity
+         WHERE datname = current_database()
+           AND (application_name = $1 OR left(application_name, length($1) + 1) = $1 || ':')
+           AND pid <> pg_backend_pid() AND pg_terminate_backend(pid);`
+	var pids []int
+	if err := monitor.Select(&pids, terminateQuery, applicationName); err != nil {
+		logger.Error("failed to terminate sessions", zap.Error(err), zap.String("application_name", applicationName))
+		return err
+	}
+	logger.Info("sessions terminated", zap.String("application_name", applicationName), zap.Ints("pids", pids))
+	return nil
+}
+
+// backendPID возвращает pid серверного процесса транзакции, по которому
+// монитор находит ее блокировки.
+func (t *transaction) backendPID() (int, error) {
+	var pid int
+	if err := t.tx.QueryRowContext(t.ctx, t.sql("SELECT pg_backend_pid();")).Scan(&pid); err != nil {
+		t.logger.Error("failed to get backend pid", zap.Error(err))
+		return 0, err
+	}
+	return pid, nil
+}
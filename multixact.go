@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+// multixact показывает, как строка хранит своих блокирующих: одна транзакция
+// записывается в xmax напрямую, а при второй разделяемой блокировке xmax
+// заменяется идентификатором MultiXact со списком участников. После фиксации
+// xmax остается заполненным, но блокировкой уже не является.
+func multixact(db *sqlx.DB, logger *zap.Logger) (err error) {
+	monitor := monitorDB(db)
+	monitorLogger := logger.With(zap.String("tx", "monitor"))
+	xids := make(map[uint64]string)
+	if err = explainXmax(monitor, monitorLogger, "no lockers", xids); err != nil {
+		return err
+	}
+
+	// Первая разделяемая блокировка
+	tx1 := newTransaction(db, logger.With(zap.String("tx", "tx1")))
+	if err = tx1.begin(); err != nil {
+		return err
+	}
+	if _, err = tx1.query("SELECT balance FROM person WHERE id = $1 FOR SHARE;", 1); err != nil {
+		return err
+	}
+	if err = recordXid(tx1, "tx1", xids); err != nil {
+		return err
+	}
+	if err = explainXmax(monitor, monitorLogger, "one locker", xids); err != nil {
+		return err
+	}
+
+	// Вторая разделяемая блокировка той же строки
+	tx2 := newTransaction(db, logger.With(zap.String("tx", "tx2")))
+	if err = tx2.begin(); err != nil {
+		return err
+	}
+	if _, err = tx2.query("SELECT balance FROM person WHERE id = $1 FOR SHARE;", 1); err != nil {
+		return err
+	}
+	if err = recordXid(tx2, "tx2", xids); err != nil {
+		return err
+	}
+	if err = explainXmax(monitor, monitorLogger, "two lockers", xids); err != nil {
+		return err
+	}
+
+	if err = commitPair(tx1, tx2); err != nil {
+		return err
+	}
+	if err = explainXmax(monitor, monitorLogger, "lockers committed", xids); err != nil {
+		return err
+	}
+
+	var age int64
+	if err = monitor.Get(&age, "SELECT mxid_age(datminmxid) FROM pg_database WHERE datname = current_database();"); err != nil {
+		monitorLogger.Error("failed to read multixact age", zap.Error(err))
+		return err
+	}
+	monitorLogger.Info("multixact age of the database", zap.Int64("mxid_age", age),
+		zap.String("explanation", "every new set of lockers allocates a MultiXactId; VACUUM freezes them like xids, autovacuum_multixact_freeze_max_age bounds this age"))
+	return nil
+}
+
+// recordXid запоминает xid транзакции в том виде, в котором он хранится в xmax.
+func recordXid(t *transaction, name string, xids map[uint64]string) error {
+	rows, err := t.query("SELECT txid_current() % 4294967296;")
+	if err != nil {
+		return err
+	}
+	xids[uint64(rows[0][0].(int64))] = name
+	return nil
+}
+
+// explainXmax читает xmax строки через монитор и объясняет его значение.
+func explainXmax(monitor *sqlx.DB, logger *zap.Logger, stage string, xids map[uint64]string) error {
+	var raw string
+	if err := monitor.Get(&raw, "SELECT xmax::text FROM person WHERE id = $1;", 1); err != nil {
+		logger.Error("failed to read xmax", zap.Error(err))
+		return err
+	}
+	xmax, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return err
+	}
+	logger = logger.With(zap.String("stage", stage), zap.Uint64("xmax", xmax))
+
+	if xmax == 0 {
+		logger.Info("xmax decoded", zap.String("explanation", "row is neither locked nor deleted"))
+		return nil
+	}
+	if name, ok := xids[xmax]; ok && len(xids) == 1 {
+		logger.Info("xmax decoded", zap.String("locker", name),
+			zap.String("explanation", "a single locker is stored as its own xid, a lock-only bit in t_infomask tells it from a delete"))
+		return nil
+	}
+
+	var members []struct {
+		Xid  string `db:"xid"`
+		Mode string `db:"mode"`
+	}
+	if err = monitor.Select(&members, "SELECT xid::text AS xid, mode FROM pg_get_multixact_members($1::text::xid);", raw); err != nil {
+		logger.Error("failed to read multixact members", zap.Error(err))
+		return err
+	}
+	for _, m := range members {
+		xid, _ := strconv.ParseUint(m.Xid, 10, 64)
+		logger.Info("multixact member", zap.String("xid", m.Xid), zap.String("tx", xids[xid]), zap.String("mode", m.Mode))
+	}
+	explanation := fmt.Sprintf("xmax is a MultiXactId with %d members; it stays after the lockers finish and is ignored once none of them is running", len(members))
+	logger.Info("xmax decoded", zap.String("explanation", explanation))
+	return nil
+}
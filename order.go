@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+const (
+	orderName         = "name"
+	orderRegistration = "registration"
+	orderRandom       = "random"
+)
+
+// orderConfig задает порядок запуска сценариев, не связанных зависимостями.
+type orderConfig struct {
+	mode string
+	// seed - начальное значение для порядка random, одинаковый seed дает одинаковый порядок
+	seed int64
+}
+
+var runOrder = orderConfig{mode: orderName}
+
+func (c orderConfig) validate() error {
+	switch c.mode {
+	case orderName, orderRegistration, orderRandom:
+		return nil
+	default:
+		return fmt.Errorf("unknown scenario order %q, expected %s, %s or %s", c.mode, orderName, orderRegistration, orderRandom)
+	}
+}
+
+// registered - сценарии в порядке вызовов addScenarios. Встроенные сценарии
+// объявлены в map и порядка не имеют, для orderRegistration они идут первыми по имени.
+var registered []string
+
+// register добавляет names в конец registered. Сценарий, уже записанный под
+// тем же именем, например YAML сценарий, перезагруженный -watch, сохраняет
+// свое место.
+func register(names []string) {
+	known := make(map[string]bool, len(registered))
+	for _, name := range registered {
+		known[name] = true
+	}
+	for _, name := range names {
+		if !known[name] {
+			registered = append(registered, name)
+		}
+	}
+}
+
+// unregister удаляет names из registered.
+func unregister(names []string) {
+	removed := make(map[string]bool, len(names))
+	for _, name := range names {
+		removed[name] = true
+	}
+	kept := registered[:0]
+	for _, name := range registered {
+		if !removed[name] {
+			kept = append(kept, name)
+		}
+	}
+	registered = kept
+}
+
+// ranks возвращает позицию каждого сценария в порядке c.mode.
+func (c orderConfig) ranks(names []string) map[string]int {
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+	switch c.mode {
+	case orderRegistration:
+		position := make(map[string]int, len(registered))
+		for i, name := range registered {
+			position[name] = i + 1
+		}
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return position[sorted[i]] < position[sorted[j]]
+		})
+	case orderRandom:
+		rand.New(rand.NewSource(c.seed)).Shuffle(len(sorted), func(i, j int) {
+			sorted[i], sorted[j] = sorted[j], sorted[i]
+		})
+	}
+	ranks := make(map[string]int, len(sorted))
+	for i, name := range sorted {
+		ranks[name] = i
+	}
+	return ranks
+}
+
+// orderScenarios упорядочивает выбранные сценарии так, чтобы каждый шел после
+// сценариев из его after. Зависимости, которые не выбраны, только проверяются
+// на существование. Среди готовых к запуску сценариев первым идет раньший в
+// порядке runOrder, поэтому порядок не зависит от обхода map.
+func orderScenarios(names []string) ([]string, error) {
+	selected := make(map[string]bool, len(names))
+	for _, name := range names {
+		selected[name] = true
+	}
+	pending := make(map[string]int, len(names))
+	dependents := make(map[string][]string)
+	for name := range selected {
+		pending[name] = 0
+		for _, dep := range isolationProblems[name].after {
+			if _, ok := isolationProblems[dep]; !ok {
+				return nil, fmt.Errorf("scenario %q depends on unknown scenario %q", name, dep)
+			}
+			if !selected[dep] {
+				continue
+			}
+			pending[name]++
+			dependents[dep] = append(dependents[dep], name)
+		}
+	}
+
+	var ready []string
+	for name, n := range pending {
+		if n == 0 {
+			ready = append(ready, name)
+		}
+	}
+	ranks := runOrder.ranks(names)
+	ordered := make([]string, 0, len(selected))
+	for len(ready) > 0 {
+		sort.Slice(ready, func(i, j int) bool {
+			return ranks[ready[i]] < ranks[ready[j]]
+		})
+		name := ready[0]
+		ready = ready[1:]
+		ordered = append(ordered, name)
+		for _, next := range dependents[name] {
+			if pending[next]--; pending[next] == 0 {
+				ready = append(ready, next)
+			}
+		}
+	}
+	if len(ordered) != len(selected) {
+		var cycle []string
+		for name, n := range pending {
+			if n > 0 {
+				cycle = append(cycle, name)
+			}
+		}
+		sort.Strings(cycle)
+		return nil, fmt.Errorf("scenario dependencies form a cycle: %s", strings.Join(cycle, ", "))
+	}
+	return ordered, nil
+}
+
+// parallelGroups делит упорядоченные сценарии на группы, которые можно
+// выполнять одновременно. Сценарии одной схемы попадают в одну группу, а
+// зависимость между схемами объединяет их группы. Внутри группы порядок
+// сохраняется.
+func parallelGroups(names []string) [][]string {
+	parent := make(map[string]string)
+	var root func(ns string) string
+	root = func(ns string) string {
+		p, ok := parent[ns]
+		if !ok || p == ns {
+			parent[ns] = ns
+			return ns
+		}
+		parent[ns] = root(p)
+		return parent[ns]
+	}
+	selected := make(map[string]bool, len(names))
+	for _, name := range names {
+		selected[name] = true
+	}
+	for _, name := range names {
+		s := isolationProblems[name]
+		for _, dep := range s.after {
+			if selected[dep] {
+				parent[root(isolationProblems[dep].namespace)] = root(s.namespace)
+			}
+		}
+	}
+
+	index := make(map[string]int)
+	var groups [][]string
+	for _, name := range names {
+		r := root(isolationProblems[name].namespace)
+		i, ok := index[r]
+		if !ok {
+			i = len(groups)
+			index[r] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], name)
+	}
+	return groups
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+const ownWritesQuery = "SELECT id, balance FROM person ORDER BY id;"
+
+var (
+	ownWritesBefore = [][]any{{1, 1000}, {2, 1000}}
+	ownWritesAfter  = [][]any{{1, 1500}, {3, 700}}
+)
+
+// ownWritesVariant - уровень изоляции и то, что видит tx2 после фиксации tx1.
+type ownWritesVariant struct {
+	name  string
+	level sql.IsolationLevel
+	// afterCommit - строки, которые tx2 видит после фиксации tx1
+	afterCommit [][]any
+}
+
+var ownWritesVariants = []ownWritesVariant{
+	{name: "read_committed", level: sql.LevelReadCommitted, afterCommit: ownWritesAfter},
+	{name: "repeatable_read", level: sql.LevelRepeatableRead, afterCommit: ownWritesBefore},
+	{name: "serializable", level: sql.LevelSerializable, afterCommit: ownWritesBefore},
+}
+
+// ownWrites проверяет положительные гарантии на каждом уровне: транзакция
+// видит свои незафиксированные изменения, в том числе после отката к точке
+// сохранения, а другие транзакции их не видят.
+func ownWrites(db *sqlx.DB, logger *zap.Logger) error {
+	for _, v := range ownWritesVariants {
+		if err := migrate(db, logger, personMigrations); err != nil {
+			return err
+		}
+		if err := runOwnWritesVariant(db, logger.With(zap.String("variant", v.name)), v); err != nil {
+			return fmt.Errorf("%s: %w", v.name, err)
+		}
+	}
+	return nil
+}
+
+func runOwnWritesVariant(db *sqlx.DB, logger *zap.Logger, v ownWritesVariant) error {
+	// Запуск транзакций
+	tx1 := newTransaction(db, logger.With(zap.String("tx", "tx1")))
+	if err := tx1.begin(); err != nil {
+		return err
+	}
+	if err := tx1.setLevel(v.level); err != nil {
+		return err
+	}
+	tx2 := newTransaction(db, logger.With(zap.String("tx", "tx2")))
+	if err := tx2.begin(); err != nil {
+		return err
+	}
+	if err := tx2.setLevel(v.level); err != nil {
+		return err
+	}
+	if err := tx2.assertSees(ownWritesBefore, ownWritesQuery); err != nil {
+		return err
+	}
+
+	// Изменения в 1 транзакции видны ей самой до фиксации
+	if err := tx1.updateUser(1, 1500); err != nil {
+		return err
+	}
+	if err := tx1.insertUser(3, 700); err != nil {
+		return err
+	}
+	if err := tx1.deleteUser(2); err != nil {
+		return err
+	}
+	if err := tx1.assertSees(ownWritesAfter, ownWritesQuery); err != nil {
+		return err
+	}
+
+	// Откат к точке сохранения возвращает только изменения после нее
+	if _, err := tx1.exec("SAVEPOINT before_reset;"); err != nil {
+		return err
+	}
+	if _, err := tx1.exec("UPDATE person SET balance = 0;"); err != nil {
+		return err
+	}
+	if _, err := tx1.exec("ROLLBACK TO SAVEPOINT before_reset;"); err != nil {
+		return err
+	}
+	if err := tx1.assertSees(ownWritesAfter, ownWritesQuery); err != nil {
+		return err
+	}
+
+	// Незафиксированные изменения не видны 2 транзакции
+	if err := tx2.assertSees(ownWritesBefore, ownWritesQuery); err != nil {
+		return err
+	}
+	if err := tx1.commit(); err != nil {
+		return err
+	}
+
+	// После фиксации изменения видны 2 транзакции только при READ COMMITTED
+	if err := tx2.assertSees(v.afterCommit, ownWritesQuery); err != nil {
+		return err
+	}
+	return tx2.commit()
+}
@@ -0,0 +1,78 @@
+// Package pack позволяет подключать к общему запускателю внешние наборы
+// сценариев: собственные схемы, данные и инварианты организации.
+//
+// Набор регистрирует себя в init:
+//
+//	func init() {
+//		pack.Register(pack.Pack{
+//			Name: "acme",
+//			Scenarios: []pack.Scenario{
+//				{Name: "overdraft", Level: sql.LevelReadCommitted, Migrations: migrations, Run: overdraft},
+//			},
+//		})
+//	}
+//
+// и подключается либо пустым импортом в packs.go, либо собирается как Go плагин
+// (go build -buildmode=plugin) и загружается флагом -plugin.
+package pack
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+// Scenario - сценарий из внешнего набора.
+type Scenario struct {
+	Name  string
+	Level sql.IsolationLevel
+	// Migrations выполняются перед каждым запуском сценария.
+	Migrations []string
+	// Namespace - схема Postgres для таблиц сценария; пусто - схема по умолчанию.
+	Namespace string
+	// Description - описание сценария в каталоге list.
+	Description string
+	Run         func(db *sqlx.DB, logger *zap.Logger) error
+}
+
+// Pack - именованный набор сценариев.
+type Pack struct {
+	Name      string
+	Scenarios []Scenario
+}
+
+var (
+	mu    sync.Mutex
+	packs []Pack
+)
+
+// Register регистрирует набор сценариев. Повторная регистрация набора с тем же
+// именем приводит к панике, как и в database/sql.Register.
+func Register(p Pack) {
+	mu.Lock()
+	defer mu.Unlock()
+	if p.Name == "" {
+		panic("pack: Register pack without name")
+	}
+	for _, registered := range packs {
+		if registered.Name == p.Name {
+			panic(fmt.Sprintf("pack: Register called twice for pack %q", p.Name))
+		}
+	}
+	for _, s := range p.Scenarios {
+		if s.Name == "" || s.Run == nil {
+			panic(fmt.Sprintf("pack: scenario without name or Run in pack %q", p.Name))
+		}
+	}
+	packs = append(packs, p)
+}
+
+// Registered возвращает все зарегистрированные наборы.
+func Registered() []Pack {
+	mu.Lock()
+	defer mu.Unlock()
+	return append([]Pack(nil), packs...)
+}
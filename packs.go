@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"plugin"
+	"strings"
+
+	"go.uber.org/zap"
+	"transactionIsolation/pack"
+)
+
+// Наборы сценариев, собираемые вместе с программой, подключаются пустым импортом:
+//
+//	import _ "example.com/acme/isolation-pack"
+
+// stringList - флаг, который можно указать несколько раз.
+type stringList []string
+
+var _ flag.Value = (*stringList)(nil)
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// loadPlugins открывает Go плагины; наборы сценариев регистрируются в их init.
+func loadPlugins(paths []string, logger *zap.Logger) error {
+	for _, path := range paths {
+		if _, err := plugin.Open(path); err != nil {
+			logger.Error("failed to load plugin", zap.Error(err), zap.String("path", path))
+			return err
+		}
+		logger.Info("plugin loaded", zap.String("path", path))
+	}
+	return nil
+}
+
+// packScenarios возвращает сценарии зарегистрированных наборов под именами pack/scenario.
+func packScenarios(logger *zap.Logger) (map[string]scenario, error) {
+	scenarios := make(map[string]scenario)
+	for _, p := range pack.Registered() {
+		for _, s := range p.Scenarios {
+			name := p.Name + "/" + s.Name
+			if _, ok := scenarios[name]; ok {
+				return nil, fmt.Errorf("duplicate scenario %q", name)
+			}
+			scenarios[name] = scenario{level: s.Level, migrations: s.Migrations, problem: s.Run, namespace: s.Namespace,
+				description: s.Description, tags: []string{"pack", p.Name}}
+		}
+		logger.Info("scenario pack registered", zap.String("pack", p.Name), zap.Int("scenarios", len(p.Scenarios)))
+	}
+	return scenarios, nil
+}
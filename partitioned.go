@@ -0,0 +1,129 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+var partitionedMigrations = []string{
+	`DROP TABLE IF EXISTS orders;`,
+	`CREATE TABLE orders (
+           id INT NOT NULL,
+           person_id INT NOT NULL,
+           amount INT NOT NULL,
+           created_on DATE NOT NULL,
+           PRIMARY KEY (id, created_on)
+         ) PARTITION BY RANGE (created_on);`,
+	`CREATE TABLE orders_2024_h1 PARTITION OF orders FOR VALUES FROM ('2024-01-01') TO ('2024-07-01');`,
+	`CREATE TABLE orders_2024_h2 PARTITION OF orders FOR VALUES FROM ('2024-07-01') TO ('2025-01-01');`,
+	`INSERT INTO orders VALUES (1, 1, 100, '2024-02-01');`,
+	`INSERT INTO orders VALUES (2, 2, 200, '2024-03-01');`,
+}
+
+// partitionedVariant - уровень изоляции, при котором проверяется фантом между секциями.
+type partitionedVariant struct {
+	name  string
+	level sql.IsolationLevel
+	// write - обе транзакции пишут в разные секции на основе прочитанной суммы
+	write bool
+}
+
+var partitionedVariants = []partitionedVariant{
+	{name: "read_committed", level: sql.LevelReadCommitted},
+	{name: "repeatable_read", level: sql.LevelRepeatableRead},
+	{name: "serializable", level: sql.LevelSerializable, write: true},
+}
+
+// partitionedPhantom показывает, что снимок и предикатные блокировки
+// распространяются на все секции: строка, вставленная в другую секцию,
+// является фантомом для запроса по всей таблице.
+func partitionedPhantom(db *sqlx.DB, logger *zap.Logger) error {
+	for _, v := range partitionedVariants {
+		if err := runPartitionedVariant(db, logger.With(zap.String("variant", v.name)), v); err != nil {
+			return fmt.Errorf("%s: %w", v.name, err)
+		}
+	}
+	return nil
+}
+
+func runPartitionedVariant(db *sqlx.DB, logger *zap.Logger, v partitionedVariant) (err error) {
+	if err := migrate(db, logger, []string{`DELETE FROM orders WHERE id > 2;`}); err != nil {
+		return err
+	}
+
+	// Проверка заказов после завершения транзакций: заказ tx2 во второй секции
+	// зафиксирован, заказ tx1 при SERIALIZABLE отклоняется
+	defer checkPostconditions(db, logger, &err,
+		expectValue("orders in second half", "SELECT COUNT(*) FROM orders_2024_h2;", 1),
+		expectValue("orders", "SELECT COUNT(*) FROM orders;", 3),
+	)
+
+	// Запуск транзакций
+	tx1 := newTransaction(db, logger.With(zap.String("tx", "tx1")))
+	if err := tx1.begin(); err != nil {
+		return err
+	}
+	if err := tx1.setLevel(v.level); err != nil {
+		return err
+	}
+	tx2 := newTransaction(db, logger.With(zap.String("tx", "tx2")))
+	if err := tx2.begin(); err != nil {
+		return err
+	}
+	if err := tx2.setLevel(v.level); err != nil {
+		return err
+	}
+
+	// Первое чтение в 1 транзакции затрагивает только первую секцию данных
+	var before, after int64
+	before, err = ordersTotal(tx1)
+	if err != nil {
+		return err
+	}
+
+	// Вторая транзакция читает ту же сумму и вставляет заказ во вторую секцию
+	if v.write {
+		if _, err = ordersTotal(tx2); err != nil {
+			return err
+		}
+	}
+	if _, err = tx2.exec("INSERT INTO orders VALUES ($1, $2, $3, $4);", 3, 1, 300, "2024-08-01"); err != nil {
+		return err
+	}
+	if err = tx2.commit(); err != nil {
+		return err
+	}
+
+	// Повторное чтение в 1 транзакции
+	after, err = ordersTotal(tx1)
+	if err != nil {
+		return err
+	}
+	logger.Info("phantom across partitions", zap.Int64("before", before), zap.Int64("after", after), zap.Bool("phantom", before != after))
+
+	if v.write {
+		// Запись в первую секцию на основе устаревшей суммы образует цикл rw-зависимостей
+		if _, err = tx1.exec("INSERT INTO orders VALUES ($1, $2, $3, $4);", 4, 2, int(before), "2024-04-01"); err != nil {
+			tx1.logger.Info("insert rejected", zap.String("code", errorCode(err)))
+			return tx1.rollback()
+		}
+	}
+	if err = tx1.commit(); err != nil {
+		tx1.logger.Info("commit rejected", zap.String("code", errorCode(err)))
+		return nil
+	}
+	return nil
+}
+
+func ordersTotal(t *transaction) (int64, error) {
+	rows, err := t.query("SELECT COALESCE(SUM(amount), 0) FROM orders WHERE created_on >= '2024-01-01';")
+	if err != nil {
+		return 0, err
+	}
+	total := rows[0][0].(int64)
+	t.logger.Info("orders total", zap.Int64("total", total))
+	return total, nil
+}
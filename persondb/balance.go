@@ -0,0 +1,77 @@
+package persondb
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Balance - баланс person в сотых долях. Столбец balance бывает BIGINT или
+// NUMERIC(18,2) (-balance-type): lib/pq возвращает NUMERIC текстом, и без
+// этого типа сгенерированные запросы не смогли бы прочитать копейки.
+// sqlc.yaml подставляет Balance для person.balance.
+type Balance int64
+
+// Units возвращает баланс в целых единицах.
+func Units(n int64) Balance {
+	return Balance(n * 100)
+}
+
+// Scan читает BIGINT и NUMERIC с не более чем двумя знаками после точки.
+func (b *Balance) Scan(src any) error {
+	switch v := src.(type) {
+	case int64:
+		*b = Units(v)
+		return nil
+	case []byte:
+		return b.parse(string(v))
+	case string:
+		return b.parse(v)
+	default:
+		return fmt.Errorf("persondb: cannot scan %T into Balance", src)
+	}
+}
+
+func (b *Balance) parse(text string) error {
+	whole, fraction, _ := strings.Cut(text, ".")
+	if len(fraction) > 2 {
+		return fmt.Errorf("persondb: balance %s has more than two decimal places", text)
+	}
+	units, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return fmt.Errorf("persondb: balance %s: %w", text, err)
+	}
+	var cents int64
+	if fraction != "" {
+		if cents, err = strconv.ParseInt(fraction+strings.Repeat("0", 2-len(fraction)), 10, 64); err != nil {
+			return fmt.Errorf("persondb: balance %s: %w", text, err)
+		}
+	}
+	if strings.HasPrefix(whole, "-") {
+		cents = -cents
+	}
+	*b = Balance(units*100 + cents)
+	return nil
+}
+
+// Value передает целый баланс числом, чтобы его принимал и BIGINT, и
+// NUMERIC, а дробный - текстом для NUMERIC.
+func (b Balance) Value() (driver.Value, error) {
+	if b%100 == 0 {
+		return int64(b / 100), nil
+	}
+	return b.String(), nil
+}
+
+func (b Balance) String() string {
+	sign := ""
+	cents := int64(b)
+	if cents < 0 {
+		sign, cents = "-", -cents
+	}
+	if cents%100 == 0 {
+		return sign + strconv.FormatInt(cents/100, 10)
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
@@ -0,0 +1,5 @@
+// Package persondb - типизированный слой доступа к таблице person,
+// сгенерированный sqlc из schema.sql и query.sql.
+package persondb
+
+//go:generate sqlc generate
@@ -0,0 +1,14 @@
+-- name: GetBalance :one
+SELECT balance FROM person WHERE id = $1;
+
+-- name: UpdateBalance :exec
+UPDATE person SET balance = $2 WHERE id = $1;
+
+-- name: InsertPerson :exec
+INSERT INTO person (id, balance) VALUES ($1, $2);
+
+-- name: DeletePerson :exec
+DELETE FROM person WHERE id = $1;
+
+-- name: CountPersons :one
+SELECT COUNT(*) FROM person;
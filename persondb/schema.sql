@@ -0,0 +1,4 @@
+CREATE TABLE person (
+  id SERIAL PRIMARY KEY,
+  balance BIGINT NOT NULL
+);
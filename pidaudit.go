@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// errPIDAudit означает, что оператор транзакции выполнился не на ее серверном
+// процессе или две открытые транзакции делят один процесс.
+var errPIDAudit = errors.New("backend pid audit failed")
+
+// pidAudit сопоставляет серверные процессы с открытыми транзакциями. В режиме
+// -pid-audit после каждого оператора exec и query транзакция сверяет
+// pg_backend_pid с процессом, на котором выполнился ее первый оператор.
+var pidAudit = struct {
+	enabled bool
+	mu      sync.Mutex
+	owners  map[int]*transaction
+}{owners: make(map[int]*transaction)}
+
+// snapshotFreeCommands не берут снимок: проверка pid после них взяла бы снимок
+// REPEATABLE READ раньше, чем его возьмет сценарий, и изменила бы результат.
+var snapshotFreeCommands = []string{"SET", "RESET", "SHOW", "LOCK", "BEGIN", "SAVEPOINT", "RELEASE"}
+
+// auditPID проверяет серверный процесс транзакции после оператора query.
+func (t *transaction) auditPID(query string) error {
+	if !pidAudit.enabled {
+		return nil
+	}
+	command := strings.ToUpper(strings.TrimSpace(query))
+	for _, c := range snapshotFreeCommands {
+		if strings.HasPrefix(command, c+" ") || command == c || command == c+";" {
+			return nil
+		}
+	}
+	var pid int
+	if err := t.tx.QueryRowContext(t.ctx, t.sql("SELECT pg_backend_pid();")).Scan(&pid); err != nil {
+		// Прерванная транзакция отклоняет и этот запрос, ошибку вернет следующий оператор сценария
+		t.logger.Info("backend pid audit skipped", zap.String("code", errorCode(err)))
+		return nil
+	}
+
+	pidAudit.mu.Lock()
+	defer pidAudit.mu.Unlock()
+	if t.pid == 0 {
+		if owner, ok := pidAudit.owners[pid]; ok && owner != t {
+			err := fmt.Errorf("%w: backend %d already runs another open transaction", errPIDAudit, pid)
+			t.logger.Error("backend shared between transactions", zap.Error(err), zap.String("query", query))
+			return err
+		}
+		t.pid = pid
+		pidAudit.owners[pid] = t
+		return nil
+	}
+	if pid != t.pid {
+		err := fmt.Errorf("%w: statement ran on backend %d, transaction started on backend %d", errPIDAudit, pid, t.pid)
+		t.logger.Error("statement moved to another backend", zap.Error(err), zap.String("query", query))
+		return err
+	}
+	return nil
+}
+
+// releasePID освобождает серверный процесс завершенной транзакции.
+func (t *transaction) releasePID() {
+	if !pidAudit.enabled || t.pid == 0 {
+		return
+	}
+	pidAudit.mu.Lock()
+	defer pidAudit.mu.Unlock()
+	if pidAudit.owners[t.pid] == t {
+		delete(pidAudit.owners, t.pid)
+	}
+	t.pid = 0
+}
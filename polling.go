@@ -0,0 +1,97 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+const (
+	pollCount    = 10
+	pollInterval = 100 * time.Millisecond
+	// pollCommitEvery - tx2 фиксирует новое значение перед каждым pollCommitEvery-м опросом
+	pollCommitEvery = 3
+)
+
+// pollingVariant - уровень изоляции опрашивающей транзакции и ожидаемое
+// количество различных значений, которые она увидит.
+type pollingVariant struct {
+	name     string
+	level    sql.IsolationLevel
+	distinct int
+}
+
+var pollingVariants = []pollingVariant{
+	// Каждый запрос READ COMMITTED получает новый снимок
+	{name: "read_committed", level: sql.LevelReadCommitted, distinct: 1 + (pollCount-1)/pollCommitEvery},
+	// Снимок REPEATABLE READ берется первым запросом и не меняется
+	{name: "repeatable_read", level: sql.LevelRepeatableRead, distinct: 1},
+}
+
+// readCommittedPolling показывает снимки уровня оператора: tx1 опрашивает
+// баланс в цикле, пока другие транзакции фиксируют новые значения.
+func readCommittedPolling(db *sqlx.DB, logger *zap.Logger) error {
+	for _, v := range pollingVariants {
+		if err := migrate(db, logger, []string{"UPDATE person SET balance = 1000 WHERE id = 1;"}); err != nil {
+			return err
+		}
+		if err := runPollingVariant(db, logger.With(zap.String("variant", v.name)), v); err != nil {
+			return fmt.Errorf("%s: %w", v.name, err)
+		}
+	}
+	return nil
+}
+
+func runPollingVariant(db *sqlx.DB, logger *zap.Logger, v pollingVariant) error {
+	// Запуск опрашивающей транзакции
+	tx1 := newTransaction(db, logger.With(zap.String("tx", "tx1")))
+	if err := tx1.begin(); err != nil {
+		return err
+	}
+	if err := tx1.setLevel(v.level); err != nil {
+		return err
+	}
+
+	started := time.Now()
+	seen := make(map[int64]bool)
+	for i := 0; i < pollCount; i++ {
+		// Фиксация нового значения в отдельной транзакции
+		if i > 0 && i%pollCommitEvery == 0 {
+			tx2 := newTransaction(db, logger.With(zap.String("tx", "tx2")))
+			if err := tx2.begin(); err != nil {
+				return err
+			}
+			if err := tx2.updateUser(1, 1000+i); err != nil {
+				return err
+			}
+			if err := tx2.commit(); err != nil {
+				return err
+			}
+		}
+
+		balance, err := tx1.queryBalance("SELECT balance FROM person WHERE id = $1;", 1)
+		if err != nil {
+			return err
+		}
+		seen[balance] = true
+		tx1.logger.Info("balance polled",
+			zap.Int("poll", i+1),
+			zap.Duration("elapsed", time.Since(started)),
+			zap.Time("observed_at", time.Now()),
+			zap.Int64("balance", balance),
+		)
+		time.Sleep(pollInterval)
+	}
+	if err := tx1.commit(); err != nil {
+		return err
+	}
+
+	tx1.logger.Info("polling finished", zap.Int("distinct_values", len(seen)), zap.Int("expected", v.distinct))
+	if len(seen) != v.distinct {
+		return fmt.Errorf("observed %d distinct values, expected %d", len(seen), v.distinct)
+	}
+	return nil
+}
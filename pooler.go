@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+// errTransactionPooling - цель находится за пулером в режиме transaction
+// pooling (pgbouncer pool_mode = transaction).
+var errTransactionPooling = errors.New("target is behind a transaction pooler")
+
+// transactionPooling - detectTransactionPooling нашел пулер транзакций перед
+// сервером. Каждая транзакция и каждый оператор вне транзакции могут попасть
+// на другой серверный процесс, поэтому состояние сеанса между ними теряется.
+var transactionPooling bool
+
+// beginOptions задает уровень изоляции в самом BEGIN (BeginTx с
+// sql.TxOptions) вместо отдельного SET TRANSACTION: так транзакция не
+// зависит от операторов, которые пулер может отправить отдельно.
+var beginOptions bool
+
+// errLevelAfterStatements означает, что с -begin-options уровень изоляции
+// задается после операторов транзакции: новая транзакция с уровнем в BEGIN
+// потеряла бы их изменения и снимок.
+var errLevelAfterStatements = errors.New("isolation level must be set before any statement of the transaction with -begin-options")
+
+// noteStatement учитывает оператор транзакции для проверки
+// errLevelAfterStatements. SET, RESET и SHOW не берут снимок и не меняют
+// данные, поэтому после них уровень еще можно задать.
+func (t *transaction) noteStatement(query string) {
+	if words := strings.Fields(query); len(words) > 0 {
+		switch strings.ToUpper(words[0]) {
+		case "SET", "RESET", "SHOW":
+			return
+		}
+	}
+	t.statements++
+}
+
+// poolerProbes - сколько операторов вне транзакции проверяет detectTransactionPooling.
+const poolerProbes = 5
+
+// poolerProbeSetting - параметр сеанса, по которому проверяется сохранение состояния.
+const poolerProbeSetting = "transaction_isolation.pooler_probe"
+
+// detectTransactionPooling проверяет на одном клиентском подключении, что
+// операторы вне транзакции выполняются одним серверным процессом и видят
+// параметр, установленный в сеансе первым из них. При прямом подключении и
+// пулинге сеансов это так; пулер транзакций отдает каждый оператор свободному
+// серверному подключению. С одним серверным подключением в пуле пулер не
+// обнаруживается, но и состояние сеанса тогда не теряется.
+func detectTransactionPooling(db *sqlx.DB, logger *zap.Logger) (bool, error) {
+	ctx := context.Background()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		logger.Error("failed to get connection", zap.Error(err))
+		return false, err
+	}
+	defer ignoreDeferred(logger, "release connection", conn.Close)
+
+	var first int
+	const setQuery = "SELECT pg_backend_pid() FROM set_config($1, 'on', false);"
+	if err = conn.GetContext(ctx, &first, setQuery, poolerProbeSetting); err != nil {
+		logger.Error("failed to probe pooler", zap.Error(err))
+		return false, err
+	}
+	// Параметр сбрасывается, чтобы серверное подключение вернулось в пул чистым
+	defer ignoreDeferred(logger, "reset pooler probe", func() error {
+		_, err := conn.ExecContext(ctx, "SELECT set_config($1, '', false);", poolerProbeSetting)
+		return err
+	})
+	for i := 0; i < poolerProbes; i++ {
+		var probe struct {
+			PID     int    `db:"pid"`
+			Setting string `db:"setting"`
+		}
+		const probeQuery = "SELECT pg_backend_pid() AS pid, COALESCE(current_setting($1, true), '') AS setting;"
+		if err = conn.GetContext(ctx, &probe, probeQuery, poolerProbeSetting); err != nil {
+			logger.Error("failed to probe pooler", zap.Error(err))
+			return false, err
+		}
+		if probe.PID != first || probe.Setting != "on" {
+			logger.Info("transaction pooling detected", zap.Int("pid", first), zap.Int("probe_pid", probe.PID),
+				zap.String("probe_setting", probe.Setting))
+			return true, nil
+		}
+	}
+	logger.Info("session state survives between statements", zap.Int("pid", first))
+	return false, nil
+}
+
+// checkTransactionPooling останавливает запуск за пулером транзакций, если
+// не выбран режим -begin-options.
+func checkTransactionPooling(db *sqlx.DB, logger *zap.Logger) error {
+	var err error
+	if transactionPooling, err = detectTransactionPooling(db, logger); err != nil || !transactionPooling {
+		return err
+	}
+	if beginOptions {
+		logger.Info("transaction pooling: isolation level is set in BEGIN, scenarios that need session state are skipped")
+		return nil
+	}
+	err = fmt.Errorf("%w: statements outside a transaction run on different server backends, so session state "+
+		"(SET, session advisory locks, WITH HOLD cursors, temporary tables) is lost between transactions; "+
+		"connect to PostgreSQL directly, switch pgbouncer to pool_mode = session, or rerun with -begin-options", errTransactionPooling)
+	logger.Error("transaction pooling detected", zap.Error(err))
+	return err
+}
+
+// requireSessionState пропускает сценарий, которому нужно состояние сеанса
+// между транзакциями, за пулером транзакций.
+func requireSessionState(feature string) error {
+	if transactionPooling {
+		return fmt.Errorf("%w: %s needs session state, which a transaction pooler does not keep", errScenarioSkipped, feature)
+	}
+	return nil
+}
+
+// poolerPitfall - состояние сеанса, установленное вне транзакции и
+// проверяемое в следующих транзакциях того же клиентского подключения.
+type poolerPitfall struct {
+	name string
+	set  string
+	// check возвращает true, если состояние сеанса сохранилось
+	check string
+	reset string
+}
+
+var poolerPitfalls = []poolerPitfall{
+	// Уровень изоляции сеанса по умолчанию вместо уровня каждой транзакции
+	{name: "session_characteristics",
+		set:   "SET SESSION CHARACTERISTICS AS TRANSACTION ISOLATION LEVEL SERIALIZABLE;",
+		check: "SELECT current_setting('transaction_isolation') = 'serializable';",
+		reset: "RESET default_transaction_isolation;"},
+	{name: "session_setting",
+		set:   "SET lock_timeout = '1234ms';",
+		check: "SELECT current_setting('lock_timeout') = '1234ms';",
+		reset: "RESET lock_timeout;"},
+	// Блокировка остается на серверном подключении, которое пулер отдаст другому клиенту
+	{name: "session_advisory_lock",
+		set:   "SELECT pg_advisory_lock(4242);",
+		check: "SELECT EXISTS (SELECT 1 FROM pg_locks WHERE locktype = 'advisory' AND objid = 4242 AND pid = pg_backend_pid());",
+		reset: "SELECT pg_advisory_unlock_all();"},
+	{name: "temporary_table",
+		set:   "CREATE TEMPORARY TABLE pooler_probe (id INT);",
+		check: "SELECT to_regclass('pg_temp.pooler_probe') IS NOT NULL;",
+		reset: "DROP TABLE IF EXISTS pg_temp.pooler_probe;"},
+}
+
+// poolerPitfallsScenario показывает, какое состояние сеанса теряется за
+// пулером транзакций: каждое состояние устанавливается вне транзакции, затем
+// проверяется в нескольких транзакциях того же клиентского подключения. При
+// прямом подключении состояние сохраняется во всех транзакциях; за пулером
+// оно сохраняется, только пока транзакции случайно попадают на тот же
+// серверный процесс.
+func poolerPitfallsScenario(db *sqlx.DB, logger *zap.Logger) error {
+	kept := make(map[string]bool, len(poolerPitfalls))
+	for _, p := range poolerPitfalls {
+		ok, err := runPoolerPitfall(db, logger.With(zap.String("variant", p.name)), p)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p.name, err)
+		}
+		kept[p.name] = ok
+	}
+	logger.Info("session state kept between transactions", zap.Any("kept", kept), zap.Bool("transaction_pooling", transactionPooling))
+	for name, ok := range kept {
+		if !ok && !transactionPooling {
+			return fmt.Errorf("%s: session state lost between transactions, but no transaction pooler was detected", name)
+		}
+	}
+	return nil
+}
+
+func runPoolerPitfall(db *sqlx.DB, logger *zap.Logger, p poolerPitfall) (kept bool, err error) {
+	tx1, err := newSessionTransaction(db, logger.With(zap.String("tx", "tx1")))
+	if err != nil {
+		return false, err
+	}
+	defer ignoreDeferred(logger, "close session", tx1.closeSession)
+	if _, err = tx1.sessionQuery(p.set); err != nil {
+		return false, err
+	}
+	// За пулером сброс может попасть на другой серверный процесс и ничего не изменить
+	defer func() {
+		if _, rerr := tx1.sessionQuery(p.reset); err == nil {
+			err = rerr
+		}
+	}()
+
+	kept = true
+	for i := 0; i < poolerProbes; i++ {
+		if err = tx1.begin(); err != nil {
+			return false, err
+		}
+		var rows [][]any
+		if rows, err = tx1.query(p.check); err != nil {
+			return false, err
+		}
+		if err = tx1.commit(); err != nil {
+			return false, err
+		}
+		kept = kept && rows[0][0] == true
+	}
+	return kept, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+// postcondition проверяет итоговое состояние после завершения транзакций сценария.
+// Ошибка означает, что проверку не удалось выполнить или состояние не совпало с ожидаемым.
+type postcondition func(db *sqlx.DB, logger *zap.Logger) error
+
+// checkPostconditions выполняет проверки через подключение монитора после шагов
+// сценария, даже если шаги завершились ошибкой, и добавляет ошибки проверок
+// к результату сценария.
+// Вызывается через defer с именованным результатом:
+//
+//	func scenario(db *sqlx.DB, logger *zap.Logger) (err error) {
+//		defer checkPostconditions(db, logger, &err, expectValue("balance", query, 200))
+func checkPostconditions(db *sqlx.DB, logger *zap.Logger, err *error, checks ...postcondition) {
+	db = monitorDB(db)
+	logger = logger.With(zap.String("tx", "monitor"))
+	for _, check := range checks {
+		if cerr := check(db, logger); cerr != nil {
+			logger.Error("postcondition failed", zap.Error(cerr))
+			*err = errors.Join(*err, cerr)
+		}
+	}
+}
+
+// expectValue проверяет, что запрос возвращает одно значение, равное want.
+// Значения сравниваются в текстовом виде, как строки в YAML сценариях.
+func expectValue(name, query string, want any) postcondition {
+	return func(db *sqlx.DB, logger *zap.Logger) error {
+		rows, err := monitorQuery(db, query)
+		if err != nil {
+			return fmt.Errorf("postcondition %s: %w", name, err)
+		}
+		if len(rows) == 0 {
+			return fmt.Errorf("postcondition %s: %w", name, sql.ErrNoRows)
+		}
+		got := rows[0][0]
+		logger.Info("postcondition", zap.String("name", name), zap.Any("value", got), zap.Any("expected", want))
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			return fmt.Errorf("postcondition %s: got %v, expected %v", name, got, want)
+		}
+		return nil
+	}
+}
+
+// expectRows проверяет, что запрос возвращает ровно строки want, например
+// итоговое состояние таблицы в порядке первичного ключа.
+func expectRows(name, query string, want [][]any) postcondition {
+	return func(db *sqlx.DB, logger *zap.Logger) error {
+		got, err := monitorQuery(db, query)
+		if err != nil {
+			return fmt.Errorf("postcondition %s: %w", name, err)
+		}
+		logger.Info("postcondition", zap.String("name", name), zap.Any("rows", got), zap.Any("expected", want))
+		if !reflect.DeepEqual(normalizeRows(got), normalizeRows(want)) {
+			return fmt.Errorf("postcondition %s: got %v, expected %v", name, got, want)
+		}
+		return nil
+	}
+}
+
+// monitorQuery читает все строки запроса, декодируя значения так же, как transaction.query.
+func monitorQuery(db *sqlx.DB, query string) ([][]any, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	var result [][]any
+	for rows.Next() {
+		row := make([]any, len(columns))
+		dest := make([]any, len(columns))
+		for i := range row {
+			dest[i] = &row[i]
+		}
+		if err = rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		for i, v := range row {
+			if b, ok := v.([]byte); ok {
+				v = string(b)
+			}
+			if row[i], err = decodeColumn(columns[i], v); err != nil {
+				return nil, err
+			}
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// expectPersonCount проверяет число строк person: две исходные, extra
+// вставленных сценарием и строки -seed-*. Число строк -seed-* известно только
+// после разбора флагов, поэтому оно читается при проверке.
+func expectPersonCount(extra int) postcondition {
+	return func(db *sqlx.DB, logger *zap.Logger) error {
+		return expectValue("persons count", "SELECT COUNT(*) FROM person;", 2+extra+seed.rows)(db, logger)
+	}
+}
+
+// expectBalance проверяет итоговый баланс пользователя.
+func expectBalance(id int, want int64) postcondition {
+	return expectValue(fmt.Sprintf("balance of person %d", id), fmt.Sprintf("SELECT balance FROM person WHERE id = %d;", id), want)
+}
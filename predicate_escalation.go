@@ -0,0 +1,306 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// predicateRowSpacing - расстояние между id читаемых строк: строки из двух
+// целых занимают около 226 на странице, поэтому каждая лежит на своей странице.
+const predicateRowSpacing = 300
+
+// predicateExhaustion (-predicate-exhaustion) включает вариант exhaustion.
+// Общая таблица предикатных блокировок одна на сервер: пока она заполнена,
+// любая SERIALIZABLE транзакция других сеансов получает out of shared memory.
+var predicateExhaustion bool
+
+// predicateExhaustionBatch - сколько таблиц reading_N создает и удаляет одна
+// миграция: каждая таблица держит блокировку до конца транзакции миграции,
+// и создание всех сразу переполнило бы обычную таблицу блокировок.
+const predicateExhaustionBatch = 500
+
+// predicateExhaustionTable - таблицы варианта exhaustion. Их создает цикл на
+// сервере, поэтому checkSafeTarget узнает оставшиеся после прерванного
+// запуска таблицы по generatedDemoTables.
+const predicateExhaustionTable = "reading_%d"
+
+// predicateExhaustionPattern - имена таблиц predicateExhaustionTable.
+var predicateExhaustionPattern = regexp.MustCompile(`^reading_\d+$`)
+
+// errSharedServer означает, что к серверу подключены сеансы не этого запуска.
+var errSharedServer = errors.New("other sessions are connected to the server")
+
+var predicateMigrations = []string{
+	`DROP TABLE IF EXISTS reading;`,
+	`CREATE TABLE reading (
+           id INTEGER PRIMARY KEY,
+           value INTEGER NOT NULL
+         );`,
+}
+
+// predicateSettings - параметры укрупнения предикатных блокировок.
+type predicateSettings struct {
+	PerTransaction int `db:"per_transaction"`
+	PerRelation    int `db:"per_relation"`
+	PerPage        int `db:"per_page"`
+	Connections    int `db:"connections"`
+	Prepared       int `db:"prepared"`
+}
+
+// relationThreshold - сколько блокировок строк и страниц одной таблицы
+// транзакция держит до замены их блокировкой всей таблицы.
+func (s predicateSettings) relationThreshold() int {
+	if s.PerRelation >= 0 {
+		return s.PerRelation
+	}
+	return s.PerTransaction / -s.PerRelation
+}
+
+// capacity - число предикатных блокировок, на которое рассчитана общая таблица.
+func (s predicateSettings) capacity() int {
+	return s.PerTransaction * (s.Connections + s.Prepared)
+}
+
+// predicateVariant - сколько строк таблицы reading читает транзакция и какую
+// самую крупную блокировку на reading это дает.
+type predicateVariant struct {
+	name string
+	rows func(s predicateSettings) []int
+	want string
+}
+
+var predicateVariants = []predicateVariant{
+	// Не больше max_pred_locks_per_page строк одной страницы блокируются по отдельности
+	{name: "tuple", want: "tuple", rows: func(s predicateSettings) []int {
+		return sequentialIDs(max(s.PerPage, 1))
+	}},
+	// Следующая строка той же страницы заменяет их блокировкой страницы
+	{name: "page", want: "page", rows: func(s predicateSettings) []int {
+		return sequentialIDs(s.PerPage + 1)
+	}},
+	// Строки на разных страницах сверх max_pred_locks_per_relation заменяются
+	// блокировкой всей таблицы: теперь конфликтует любая запись в reading
+	{name: "relation", want: "relation", rows: func(s predicateSettings) []int {
+		ids := make([]int, s.relationThreshold()+1)
+		for i := range ids {
+			ids[i] = 1 + i*predicateRowSpacing
+		}
+		return ids
+	}},
+}
+
+func sequentialIDs(n int) []int {
+	ids := make([]int, n)
+	for i := range ids {
+		ids[i] = i + 1
+	}
+	return ids
+}
+
+// predicateLockEscalation показывает укрупнение предикатных блокировок
+// SERIALIZABLE: чем больше строк читает транзакция, тем крупнее ее SIRead
+// блокировки и тем больше ложных ошибок сериализации. Вариант exhaustion
+// (-predicate-exhaustion) читает столько таблиц, что общая таблица блокировок
+// переполняется, и транзакция прерывается ошибкой out of shared memory с
+// подсказкой увеличить max_pred_locks_per_transaction.
+func predicateLockEscalation(db *sqlx.DB, logger *zap.Logger) error {
+	if err := requireLockAccess("predicate lock counting"); err != nil {
+		return err
+	}
+	var s predicateSettings
+	const settingsQuery = `SELECT current_setting('max_pred_locks_per_transaction')::INTEGER AS per_transaction,
+           current_setting('max_pred_locks_per_relation')::INTEGER AS per_relation,
+           current_setting('max_pred_locks_per_page')::INTEGER AS per_page,
+           current_setting('max_connections')::INTEGER AS connections,
+           current_setting('max_prepared_transactions')::INTEGER AS prepared;`
+	if err := db.Get(&s, settingsQuery); err != nil {
+		logger.Error("failed to read predicate lock settings", zap.Error(err))
+		return err
+	}
+	logger.Info("predicate lock settings", zap.Int("max_pred_locks_per_transaction", s.PerTransaction),
+		zap.Int("max_pred_locks_per_relation", s.PerRelation), zap.Int("max_pred_locks_per_page", s.PerPage),
+		zap.Int("relation_threshold", s.relationThreshold()), zap.Int("capacity", s.capacity()))
+
+	rows := (s.relationThreshold() + 2) * predicateRowSpacing
+	if err := migrate(db, logger, []string{
+		`TRUNCATE reading;`,
+		fmt.Sprintf(`INSERT INTO reading (id, value) SELECT g, 0 FROM generate_series(1, %d) AS g;`, rows),
+		`ANALYZE reading;`,
+	}); err != nil {
+		return err
+	}
+	for _, v := range predicateVariants {
+		if err := runPredicateVariant(db, logger.With(zap.String("variant", v.name)), s, v); err != nil {
+			return fmt.Errorf("%s: %w", v.name, err)
+		}
+	}
+	if err := runPredicateExhaustion(db, logger.With(zap.String("variant", "exhaustion")), s); err != nil {
+		return fmt.Errorf("exhaustion: %w", err)
+	}
+	return nil
+}
+
+func runPredicateVariant(db *sqlx.DB, logger *zap.Logger, s predicateSettings, v predicateVariant) error {
+	// Транзакция только читает и откатывается после подсчета блокировок
+	tx := newTransaction(db, logger.With(zap.String("tx", "tx1")))
+	if err := tx.begin(); err != nil {
+		return err
+	}
+	defer ignoreDeferred(logger, "rollback", tx.rollback)
+	if err := tx.setLevel(sql.LevelSerializable); err != nil {
+		return err
+	}
+	// Точечное чтение по индексу блокирует прочитанные строки, а не всю таблицу
+	for _, name := range []string{"enable_seqscan", "enable_bitmapscan"} {
+		if err := tx.setLocal(name, "off"); err != nil {
+			return err
+		}
+	}
+	for _, id := range v.rows(s) {
+		if _, err := tx.query("SELECT value FROM reading WHERE id = $1;", id); err != nil {
+			return err
+		}
+	}
+
+	counts, err := predicateLockCounts(tx, "reading")
+	if err != nil {
+		return err
+	}
+	logger.Info("predicate locks on reading", zap.Int("rows", len(v.rows(s))), zap.Any("locks", counts))
+	got := ""
+	for _, locktype := range []string{"tuple", "page", "relation"} {
+		if counts[locktype] > 0 {
+			got = locktype
+		}
+	}
+	if got != v.want {
+		return fmt.Errorf("coarsest predicate lock is %q, want %q", got, v.want)
+	}
+	return nil
+}
+
+// runPredicateExhaustion читает по строке из отдельных таблиц, пока общая
+// таблица предикатных блокировок не переполнится. Таблица может занять часть
+// свободной разделяемой памяти, поэтому таблиц создается вдвое больше емкости.
+// Вариант выполняется только с -predicate-exhaustion и только если других
+// сеансов на сервере нет: переполнение задевает их транзакции.
+func runPredicateExhaustion(db *sqlx.DB, logger *zap.Logger, s predicateSettings) (err error) {
+	if !predicateExhaustion {
+		logger.Info("exhaustion variant skipped, it makes serializable transactions of every session on the server fail; enable it with -predicate-exhaustion")
+		return nil
+	}
+	if err = checkServerExclusive(monitorDB(db), logger); err != nil {
+		return err
+	}
+	tables := 2 * s.capacity()
+	if err = migrate(db, logger, exhaustionTableBatches(tables, `EXECUTE format('CREATE TABLE IF NOT EXISTS reading_%1$s (id INTEGER)', i);
+               EXECUTE format('INSERT INTO reading_%1$s SELECT 1 WHERE NOT EXISTS (SELECT FROM reading_%1$s)', i);`)); err != nil {
+		return err
+	}
+	defer func() {
+		drop := exhaustionTableBatches(tables, `EXECUTE format('DROP TABLE IF EXISTS reading_%1$s', i);`)
+		if dropErr := migrate(db, logger, drop); err == nil {
+			err = dropErr
+		}
+	}()
+
+	tx := newTransaction(db, logger.With(zap.String("tx", "tx1")))
+	if err = tx.begin(); err != nil {
+		return err
+	}
+	defer ignoreDeferred(logger, "rollback", tx.rollback)
+	if err = tx.setLevel(sql.LevelSerializable); err != nil {
+		return err
+	}
+	// Блокировку таблицы укрупнить некуда: каждая прочитанная таблица - новая запись
+	for i := 1; i <= tables; i++ {
+		if _, err = tx.query(fmt.Sprintf("SELECT id FROM "+predicateExhaustionTable+";", i)); err != nil {
+			class := classifyError(err)
+			if class.Code != "53200" {
+				return err
+			}
+			// Каждое чтение берет и обычную блокировку таблицы, подсказка называет переполненную таблицу
+			var hint string
+			var pqErr *pq.Error
+			if errors.As(err, &pqErr) {
+				hint = pqErr.Hint
+			}
+			logger.Info("predicate lock table exhausted", zap.Int("tables_read", i-1),
+				zap.String("code", class.Code), zap.String("explanation", class.Explanation), zap.String("hint", hint))
+			return nil
+		}
+	}
+	logger.Warn("predicate lock table was not exhausted, shared memory slack absorbed the locks", zap.Int("tables_read", tables))
+	return nil
+}
+
+// exhaustionTableBatches возвращает миграции, которые выполняют body для
+// i от 1 до tables по predicateExhaustionBatch за раз.
+func exhaustionTableBatches(tables int, body string) []string {
+	var batches []string
+	for first := 1; first <= tables; first += predicateExhaustionBatch {
+		last := min(first+predicateExhaustionBatch-1, tables)
+		batches = append(batches, fmt.Sprintf(`DO $$
+           BEGIN
+             FOR i IN %d..%d LOOP
+               %s
+             END LOOP;
+           END $$;`, first, last, body))
+	}
+	return batches
+}
+
+// checkServerExclusive проверяет, что к серверу подключены только сеансы
+// этого запуска: их application_name начинается с scenarioApplicationName.
+func checkServerExclusive(monitor *sqlx.DB, logger *zap.Logger) error {
+	const sessionsQuery = `SELECT COUNT(*) FROM pg_stat_activity
+         WHERE backend_type = 'client backend'
+           AND pid <> pg_backend_pid()
+           AND application_name NOT LIKE $1 || '%';`
+	var others int
+	if err := monitor.Get(&others, sessionsQuery, scenarioApplicationName("")); err != nil {
+		logger.Error("failed to count server sessions", zap.Error(err))
+		return err
+	}
+	if others > 0 {
+		return fmt.Errorf("%w: %d sessions would get out of shared memory while the predicate lock table is full", errSharedServer, others)
+	}
+	return nil
+}
+
+// predicateLockCounts возвращает число SIRead блокировок транзакции на
+// таблице relation по типам tuple, page и relation.
+func predicateLockCounts(t *transaction, relation string) (map[string]int, error) {
+	pid, err := t.backendPID()
+	if err != nil {
+		return nil, err
+	}
+	// Подключение мониторинга может не видеть схему сценария, oid определяет транзакция
+	var oids []int64
+	if err = t.selectRows(&oids, "SELECT $1::regclass::oid;", relation); err != nil {
+		return nil, err
+	}
+	var locks []struct {
+		LockType string `db:"locktype"`
+		Count    int    `db:"count"`
+	}
+	const locksQuery = `SELECT locktype, COUNT(*) AS count
+         FROM pg_locks
+         WHERE mode = 'SIReadLock' AND pid = $1 AND relation = $2
+         GROUP BY locktype;`
+	if err = monitorDB(t.db).Select(&locks, locksQuery, pid, oids[0]); err != nil {
+		t.logger.Error("failed to read predicate locks", zap.Error(err))
+		return nil, err
+	}
+	counts := make(map[string]int, len(locks))
+	for _, l := range locks {
+		counts[l.LockType] = l.Count
+	}
+	return counts, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+
+	"transactionIsolation/isolation"
+)
+
+// prepare подготавливает оператор p в сеансе транзакции: в ней, пока она
+// открыта, и в ее сеансе после завершения. Оператор доступен последующим
+// транзакциям сеанса до deallocate.
+func (t *transaction) prepare(p isolation.Prepared) error {
+	if _, err := t.sessionQuery(p.PrepareSQL() + ";"); err != nil {
+		return err
+	}
+	t.logger.Info("statement prepared", zap.String("statement", p.Name))
+	return nil
+}
+
+// execute выполняет подготовленный оператор p в открытой транзакции,
+// аргументы args подставляются в EXECUTE литералами.
+func (t *transaction) execute(p isolation.Prepared, args ...any) ([][]any, error) {
+	query, err := p.ExecuteSQL(args...)
+	if err != nil {
+		t.logger.Error("failed to build execute", zap.Error(err), zap.String("statement", p.Name))
+		return nil, err
+	}
+	return t.query(query + ";")
+}
+
+// deallocate удаляет подготовленный оператор p из сеанса транзакции.
+func (t *transaction) deallocate(p isolation.Prepared) error {
+	if _, err := t.sessionQuery(p.DeallocateSQL() + ";"); err != nil {
+		return err
+	}
+	t.logger.Info("statement deallocated", zap.String("statement", p.Name))
+	return nil
+}
+
+var preparedMigrations = []string{
+	`DROP TABLE IF EXISTS price;`,
+	`CREATE TABLE price (
+           id INT PRIMARY KEY,
+           amount INT NOT NULL
+         );`,
+	`INSERT INTO price VALUES (1, 1000);`,
+}
+
+var priceStatement = isolation.Prepared{
+	Name:      "price_amount",
+	Statement: "SELECT amount FROM price WHERE id = $1",
+	Types:     []string{"int"},
+}
+
+// preparedExecutions - сколько раз транзакция выполняет оператор до и после
+// чужой фиксации; при plan_cache_mode = auto общий план выбирается после
+// пяти выполнений.
+const preparedExecutions = 6
+
+// preparedVariant - режим выбора плана подготовленного оператора.
+type preparedVariant struct {
+	planCacheMode string
+	// generic - выполнения должны использовать общий план, а не план для значений параметров
+	generic bool
+}
+
+var preparedVariants = []preparedVariant{
+	{planCacheMode: "force_custom_plan"},
+	{planCacheMode: "force_generic_plan", generic: true},
+}
+
+// preparedSnapshot показывает, что план подготовленного оператора и снимок
+// транзакции независимы. План сохраняется в сеансе между транзакциями, а
+// данные EXECUTE читает из снимка текущей транзакции: при REPEATABLE READ
+// повторное выполнение не видит чужую фиксацию и с общим планом, а следующая
+// транзакция видит ее с тем же самым планом.
+func preparedSnapshot(db *sqlx.DB, logger *zap.Logger) error {
+	if err := requireServerVersion(db, logger, 140000, "generic_plans in pg_prepared_statements"); err != nil {
+		return err
+	}
+	if err := requireSessionState("prepared statement"); err != nil {
+		return err
+	}
+	for _, v := range preparedVariants {
+		if err := migrate(db, logger, preparedMigrations); err != nil {
+			return err
+		}
+		if err := runPreparedVariant(db, logger.With(zap.String("variant", v.planCacheMode)), v); err != nil {
+			return fmt.Errorf("%s: %w", v.planCacheMode, err)
+		}
+	}
+	return nil
+}
+
+func runPreparedVariant(db *sqlx.DB, logger *zap.Logger, v preparedVariant) (err error) {
+	defer checkPostconditions(db, logger, &err, expectValue("price amount", "SELECT amount FROM price WHERE id = 1;", 2000))
+
+	tx1, err := newSessionTransaction(db, logger.With(zap.String("tx", "tx1")))
+	if err != nil {
+		return err
+	}
+	defer ignoreDeferred(logger, "close session", tx1.closeSession)
+
+	if err = tx1.begin(); err != nil {
+		return err
+	}
+	if err = tx1.setLevel(sql.LevelRepeatableRead); err != nil {
+		return err
+	}
+	if err = tx1.setLocal("plan_cache_mode", v.planCacheMode); err != nil {
+		return err
+	}
+	if err = tx1.prepare(priceStatement); err != nil {
+		return err
+	}
+	defer func() {
+		if derr := tx1.deallocate(priceStatement); err == nil {
+			err = derr
+		}
+	}()
+	if err = tx1.executeAmount(1000); err != nil {
+		return err
+	}
+
+	tx2, err := beginTx(db, logger, "tx2", sql.LevelReadCommitted)
+	if err != nil {
+		return err
+	}
+	if _, err = tx2.exec("UPDATE price SET amount = 2000 WHERE id = 1;"); err != nil {
+		return err
+	}
+	if err = tx2.commit(); err != nil {
+		return err
+	}
+
+	// Снимок REPEATABLE READ взят первым EXECUTE, план на него не влияет
+	if err = tx1.executeAmount(1000); err != nil {
+		return err
+	}
+	if err = tx1.commit(); err != nil {
+		return err
+	}
+
+	// Новая транзакция того же сеанса выполняет оператор, подготовленный в прошлой
+	if err = tx1.begin(); err != nil {
+		return err
+	}
+	if err = tx1.setLocal("plan_cache_mode", v.planCacheMode); err != nil {
+		return err
+	}
+	if err = tx1.executeAmount(2000); err != nil {
+		return err
+	}
+	if err = tx1.commit(); err != nil {
+		return err
+	}
+
+	rows, err := tx1.sessionQuery("SELECT generic_plans, custom_plans FROM pg_prepared_statements WHERE name = " + pq.QuoteLiteral(priceStatement.Name) + ";")
+	if err != nil {
+		return err
+	}
+	if len(rows) != 1 {
+		return fmt.Errorf("prepared statement %s not found in the session", priceStatement.Name)
+	}
+	generic, custom := rows[0][0].(int64), rows[0][1].(int64)
+	logger.Info("plans used by prepared statement", zap.Int64("generic_plans", generic), zap.Int64("custom_plans", custom))
+	if (generic > 0) != v.generic || (custom > 0) == v.generic {
+		return fmt.Errorf("expected only %s plans, got generic_plans = %d, custom_plans = %d", planKind(v.generic), generic, custom)
+	}
+	return nil
+}
+
+// executeAmount выполняет priceStatement preparedExecutions раз и проверяет,
+// что каждое выполнение вернуло сумму want.
+func (t *transaction) executeAmount(want int) error {
+	query, err := priceStatement.ExecuteSQL(1)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < preparedExecutions; i++ {
+		if err = t.assertSees([][]any{{want}}, query+";"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func planKind(generic bool) string {
+	if generic {
+		return "generic"
+	}
+	return "custom"
+}
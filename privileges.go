@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+// monitorAccess - права роли подключения на то, чем пользуется монитор.
+// На управляемых базах (RDS, Cloud SQL, Supabase) роль приложения часто
+// лишена доступа к pg_locks или права вызывать pg_terminate_backend; такие
+// возможности отключаются до запуска сценариев, а не падают посреди шага.
+var monitorAccess = struct {
+	// locks - чтение pg_locks вместе с pg_stat_activity и pg_blocking_pids:
+	// снимки блокировок, трассировка взаимоблокировок, проверка advisory блокировок
+	locks bool
+	// terminate - pg_terminate_backend: -timeout и отключение сессий прерванных запусков
+	terminate bool
+}{locks: true, terminate: true}
+
+// monitorProbe - запрос, который проверяет доступ к возможности монитора.
+// Запросы ничего не меняют: право на pg_terminate_backend проверяется
+// has_function_privilege, а не вызовом.
+type monitorProbe struct {
+	feature string
+	query   string
+	// disables - что отключается без доступа, для заметки в отчете
+	disables string
+	enabled  *bool
+}
+
+var monitorProbes = []monitorProbe{
+	{feature: "pg_locks",
+		query: `SELECT count(*) >= 0 FROM (SELECT l.pid FROM pg_locks l
+           JOIN pg_stat_activity a ON a.pid = l.pid
+           WHERE cardinality(pg_blocking_pids(l.pid)) >= 0 LIMIT 1) AS probe;`,
+		disables: "lock snapshots, deadlock traces, advisory lock leak checks and scenarios asserting on pg_locks",
+		enabled:  &monitorAccess.locks},
+	{feature: "pg_terminate_backend",
+		query: `SELECT bool_and(has_function_privilege(p.oid, 'EXECUTE'))
+           FROM pg_proc p WHERE p.proname = 'pg_terminate_backend';`,
+		disables: "-timeout and termination of sessions left by interrupted runs",
+		enabled:  &monitorAccess.terminate},
+}
+
+// checkMonitorAccess проверяет права роли на возможности монитора и отключает
+// недоступные. Возвращает заметки об отключенном для отчета; ошибка
+// возвращается только если сервер не ответил по другой причине.
+func checkMonitorAccess(db *sqlx.DB, logger *zap.Logger) ([]string, error) {
+	var notes []string
+	for _, p := range monitorProbes {
+		var ok bool
+		err := db.Get(&ok, p.query)
+		switch {
+		case errorCode(err) == "42501":
+			// insufficient_privilege
+		case err != nil:
+			logger.Error("failed to check monitor access", zap.Error(err), zap.String("feature", p.feature))
+			return nil, err
+		case ok:
+			continue
+		}
+		*p.enabled = false
+		note := fmt.Sprintf("no access to %s: disabled %s", p.feature, p.disables)
+		logger.Warn("monitor feature disabled", zap.String("feature", p.feature), zap.String("disabled", p.disables))
+		notes = append(notes, note)
+	}
+	return notes, nil
+}
+
+// requireLockAccess пропускает сценарий, проверки которого читают pg_locks,
+// если роль подключения не имеет к ним доступа.
+func requireLockAccess(feature string) error {
+	if !monitorAccess.locks {
+		return fmt.Errorf("%w: %s reads pg_locks, which the connecting role cannot access", errScenarioSkipped, feature)
+	}
+	return nil
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.starlark.net/starlark"
+	"go.uber.org/zap"
+
+	"transactionIsolation/isolation"
+)
+
+// randomizedProblem выполняет транзакции сценария одновременно со случайными
+// паузами до jitter между шагами на уровне level и сообщает, проявилась ли
+// аномалия. order - номера шагов сценария в порядке, в котором они начались.
+type randomizedProblem func(db *sqlx.DB, logger *zap.Logger, level sql.IsolationLevel, jitter time.Duration) (anomaly bool, order []int, err error)
+
+// probabilityLevels - уровни, на которых оценивается вероятность аномалии.
+var probabilityLevels = isolation.Levels(isolation.Postgres)
+
+// anomalyStats - сколько случайных запусков сценария на уровне показали аномалию.
+type anomalyStats struct {
+	scenario  string
+	level     sql.IsolationLevel
+	runs      int
+	anomalies int
+}
+
+// wilson возвращает 95% доверительный интервал Уилсона для доли k из n.
+// В отличие от нормального приближения он остается в [0, 1] при долях около 0 и 1.
+func wilson(k, n int) (float64, float64) {
+	if n == 0 {
+		return 0, 1
+	}
+	const z = 1.96
+	p := float64(k) / float64(n)
+	denom := 1 + z*z/float64(n)
+	center := (p + z*z/(2*float64(n))) / denom
+	half := z * math.Sqrt(p*(1-p)/float64(n)+z*z/(4*float64(n)*float64(n))) / denom
+	return math.Max(0, center-half), math.Min(1, center+half)
+}
+
+// anomalyProbability запускает каждый сценарий, поддерживающий случайный порядок
+// шагов, runs раз на каждом уровне изоляции и выводит долю запусков с аномалией.
+func (r *runner) anomalyProbability(w io.Writer, names []string, runs int, jitter time.Duration) error {
+	var stats []anomalyStats
+	for _, name := range names {
+		if isolationProblems[name].randomized != nil {
+			suiteProgress.addTotal(runs * len(probabilityLevels))
+		}
+	}
+	for _, name := range names {
+		s := isolationProblems[name]
+		logger := r.logger.With(zap.String("problem", name))
+		if s.randomized == nil {
+			logger.Info("scenario does not define an anomaly check, skipped")
+			continue
+		}
+		db, err := r.namespaceDB(s.namespace, logger)
+		if err != nil {
+			return err
+		}
+		monitor, err := r.monitor(s.namespace, logger)
+		if err != nil {
+			return err
+		}
+		registerMonitor(db, monitor)
+		migrations := s.migrations
+		if s.seeded {
+			migrations = append(append([]string(nil), migrations...), seed.migrations()...)
+		}
+
+		for _, level := range probabilityLevels {
+			st := anomalyStats{scenario: name, level: level}
+			levelLogger := logger.With(zap.String("level", level.String()))
+			// Логи отдельных запусков отключены, в отчет попадает только итог
+			runLogger := withStatementTags(zap.NewNop()).With(zap.String("problem", name))
+			reset := func() error {
+				return migrate(db, zap.NewNop(), migrations)
+			}
+			shrunk := false
+			for i := 0; i < runs; i++ {
+				suiteProgress.begin(fmt.Sprintf("%s %s run %d", name, level, i+1))
+				if err = reset(); err != nil {
+					levelLogger.Error("failed to reset scenario", zap.Error(err))
+					return err
+				}
+				anomaly, order, err := s.randomized(db, runLogger, level, jitter)
+				if err != nil {
+					levelLogger.Error("randomized run failed", zap.Error(err), zap.Int("run", i+1))
+					return fmt.Errorf("%s: %s: %w", name, level, err)
+				}
+				suiteProgress.end()
+				st.runs++
+				if anomaly {
+					st.anomalies++
+				}
+				// Первый запуск с аномалией на уровне сокращается до минимального порядка шагов
+				if anomaly && !shrunk && r.shrinkDir != "" && s.shrink != nil {
+					shrunk = true
+					file, err := s.shrink(db, levelLogger, level, order, reset, r.shrinkDir)
+					switch {
+					case errors.Is(err, errNotReproducible):
+						levelLogger.Warn("interleaving not shrunk", zap.Error(err), zap.Int("run", i+1))
+					case err != nil:
+						return fmt.Errorf("%s: %s: shrink: %w", name, level, err)
+					default:
+						levelLogger.Info("minimal interleaving saved", zap.String("file", file), zap.Int("run", i+1))
+					}
+				}
+			}
+			levelLogger.Info("anomaly probability", zap.Int("runs", st.runs), zap.Int("anomalies", st.anomalies))
+			stats = append(stats, st)
+		}
+	}
+	suiteProgress.close()
+	if r.meta != nil {
+		if err := r.meta.print(w); err != nil {
+			return err
+		}
+	}
+	return printAnomalyStats(w, stats)
+}
+
+func printAnomalyStats(w io.Writer, stats []anomalyStats) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCENARIO\tLEVEL\tRUNS\tANOMALIES\tRATE\t95% CI")
+	for _, st := range stats {
+		lo, hi := wilson(st.anomalies, st.runs)
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%.1f%%\t%.1f%% - %.1f%%\n", st.scenario, st.level, st.runs, st.anomalies,
+			100*float64(st.anomalies)/float64(st.runs), 100*lo, 100*hi)
+	}
+	return tw.Flush()
+}
+
+// randomizedRun выполняет шаги каждой транзакции YAML сценария в своей горутине,
+// сохраняя их порядок внутри транзакции. Шаг script без tx относится к
+// транзакции предыдущего шага. Проверки expect и assert не выполняются: в
+// случайном порядке шагов они не обязаны выполняться, итог оценивает anomaly.
+func (y *yamlScenario) randomizedRun(db *sqlx.DB, logger *zap.Logger, level sql.IsolationLevel, jitter time.Duration) (bool, []int, error) {
+	steps := make(map[string][]int)
+	for i, owner := range y.stepOwners() {
+		if owner != "" {
+			steps[owner] = append(steps[owner], i)
+		}
+	}
+
+	var mu sync.Mutex
+	committed := make(map[string]bool, len(steps))
+	var order []int
+	started := func(i int) {
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, i)
+	}
+	errs := make(chan error, len(steps))
+	var wg sync.WaitGroup
+	for name, txSteps := range steps {
+		wg.Add(1)
+		go func(name string, txSteps []int) {
+			defer wg.Done()
+			ok, err := y.randomizedTx(db, logger.With(zap.String("tx", name)), name, txSteps, level, jitter, started)
+			if err != nil {
+				errs <- fmt.Errorf("%s: %w", name, err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			committed[name] = ok
+		}(name, txSteps)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return false, nil, err
+	}
+	anomaly, err := y.anomalyHolds(db, logger, committed)
+	return anomaly, order, err
+}
+
+// stepOwners возвращает транзакцию каждого шага. Шаг script без tx относится
+// к транзакции предыдущего шага, шаги до первой транзакции - ни к какой.
+func (y *yamlScenario) stepOwners() []string {
+	owners := make([]string, len(y.Steps))
+	owner := ""
+	for i, step := range y.Steps {
+		if step.Tx != "" {
+			owner = step.Tx
+		}
+		owners[i] = owner
+	}
+	return owners
+}
+
+// anomalyHolds выполняет запрос anomaly вне транзакций сценария и проверяет
+// условие assert; committed - зафиксирована ли каждая транзакция.
+func (y *yamlScenario) anomalyHolds(db *sqlx.DB, logger *zap.Logger, committed map[string]bool) (bool, error) {
+	check := newTransaction(monitorDB(db), logger.With(zap.String("tx", "monitor")))
+	if err := check.begin(); err != nil {
+		return false, err
+	}
+	rows, err := check.query(y.Anomaly.Query)
+	if err != nil {
+		ignoreError(logger, "rollback", check.rollback())
+		return false, err
+	}
+	if err = check.commit(); err != nil {
+		return false, err
+	}
+	env := newScriptEnv(logger)
+	env.setRows(rows)
+	dict := starlark.NewDict(len(committed))
+	for _, tx := range y.Transactions {
+		dict.SetKey(starlark.String(tx.Name), starlark.Bool(committed[tx.Name]))
+	}
+	env.globals["committed"] = dict
+	return env.truth(y.Name+":anomaly", y.Anomaly.Assert)
+}
+
+// randomizedTx выполняет шаги steps одной транзакции со случайными паузами и
+// сообщает о начале каждого через started. Возвращает true, если транзакция
+// зафиксирована. Ошибка оператора прерывает транзакцию, но не запуск: ошибки
+// сериализации и взаимоблокировки в случайном порядке шагов ожидаемы.
+func (y *yamlScenario) randomizedTx(db *sqlx.DB, logger *zap.Logger, name string, steps []int, level sql.IsolationLevel, jitter time.Duration, started func(i int)) (bool, error) {
+	t := newTransaction(db, logger)
+	t.settings = y.transactionSettings(name)
+	defer func() {
+		if t.tx != nil {
+			ignoreError(logger, "rollback", t.tx.Rollback())
+		}
+	}()
+	env := newScriptEnv(logger)
+	delays := newGenerator(dataSeed)
+	committed := false
+	for _, i := range steps {
+		step := y.Steps[i]
+		time.Sleep(time.Duration(rand.Int63n(int64(jitter) + 1)))
+		step.DelayBefore.sleep(delays, t.logger, "before")
+		started(i)
+		ok, err := y.runLooseStep(t, env, name, i, level)
+		if err != nil {
+			if errorCode(err) == "" {
+				return false, err
+			}
+			t.logger.Info("transaction aborted", zap.String("code", errorCode(err)))
+			return false, nil
+		}
+		committed = committed || ok
+		step.DelayAfter.sleep(delays, t.logger, "after")
+	}
+	return committed, nil
+}
+
+// runLooseStep выполняет шаг i транзакции name без проверок expect и assert и
+// сообщает, зафиксировал ли он транзакцию. Ошибка с SQLSTATE означает, что
+// сервер прервал транзакцию; ошибка без кода - ошибку сценария.
+func (y *yamlScenario) runLooseStep(t *transaction, env *scriptEnv, name string, i int, level sql.IsolationLevel) (bool, error) {
+	step := y.Steps[i]
+	stepName := fmt.Sprintf("%s:%s:%d", y.Name, name, i+1)
+	if step.When != "" {
+		ok, err := env.truthExpanded(stepName, step.When)
+		if err != nil {
+			return false, fmt.Errorf("condition: %w", err)
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	params, err := env.params(stepName, step)
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case step.Action == actionBegin:
+		if err = t.begin(); err == nil {
+			err = t.setLevel(level)
+		}
+	case step.Action == actionCommit:
+		if err = t.commit(); err == nil {
+			return true, nil
+		}
+	case step.Action == actionRollback:
+		err = t.rollback()
+	case step.Exec != "":
+		var affected int64
+		if affected, err = t.exec(step.Exec, params...); err == nil {
+			env.setAffected(affected)
+		}
+	case step.Query != "":
+		var rows [][]any
+		if rows, err = t.query(step.Query, params...); err == nil {
+			env.setRows(rows)
+			if err := env.bind(name, step.Bind, rows); err != nil {
+				return false, err
+			}
+		}
+	case step.Execute != "":
+		var rows [][]any
+		if rows, err = t.execute(isolation.Prepared{Name: step.Execute}, params...); err == nil {
+			env.setRows(rows)
+			if err := env.bind(name, step.Bind, rows); err != nil {
+				return false, err
+			}
+		}
+	case step.Script != "":
+		if err := env.exec(stepName, step.Script); err != nil {
+			return false, err
+		}
+	}
+	return false, err
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// progress выводит одну обновляемую строку с ходом длинного запуска: текущий
+// сценарий или ячейку матрицы, шаг, прошедшее время и оценку оставшегося.
+// Строка пишется в stdout, подробные логи остаются в stderr. Методы nil
+// прогресса ничего не делают, поэтому вызывающему коду не нужны проверки.
+type progress struct {
+	mu      sync.Mutex
+	w       io.Writer
+	total   int
+	done    int
+	started time.Time
+	scope   string
+	item    string
+	step    string
+	width   int
+}
+
+// suiteProgress - прогресс текущего запуска, nil без флага -progress.
+var suiteProgress *progress
+
+func newProgress(w io.Writer) *progress {
+	return &progress{w: w, started: time.Now()}
+}
+
+// addTotal увеличивает количество ожидаемых элементов.
+func (p *progress) addTotal(n int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.total += n
+	p.render()
+}
+
+// setScope задает общий префикс элементов, например версию сервера в sweep.
+func (p *progress) setScope(scope string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.scope = scope
+	p.step = ""
+	p.render()
+}
+
+// begin начинает элемент: сценарий, ячейку матрицы или случайный запуск.
+func (p *progress) begin(item string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.item = item
+	p.step = ""
+	p.render()
+}
+
+func (p *progress) setStep(step string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.step = step
+	p.render()
+}
+
+// end завершает текущий элемент.
+func (p *progress) end() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	p.render()
+}
+
+// close переводит строку, чтобы следующий вывод не затер прогресс.
+func (p *progress) close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.render()
+	fmt.Fprintln(p.w)
+}
+
+func (p *progress) render() {
+	elapsed := time.Since(p.started).Round(time.Second)
+	eta := "?"
+	if p.done > 0 && p.total >= p.done {
+		remaining := time.Duration(float64(elapsed) / float64(p.done) * float64(p.total-p.done))
+		eta = remaining.Round(time.Second).String()
+	}
+	line := fmt.Sprintf("[%d/%d]", p.done, p.total)
+	for _, part := range []string{p.scope, p.item, p.step} {
+		if part != "" {
+			line += " " + part
+		}
+	}
+	line += fmt.Sprintf("  elapsed %s  eta %s", elapsed, eta)
+	// Остаток предыдущей, более длинной строки затирается пробелами
+	pad := p.width - len(line)
+	p.width = len(line)
+	if pad < 0 {
+		pad = 0
+	}
+	fmt.Fprintf(p.w, "\r%s%*s", line, pad, "")
+}
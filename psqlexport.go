@@ -0,0 +1,228 @@
+package main
+
+import (
+	"database/sql/driver"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"transactionIsolation/isolation"
+)
+
+// psqlStatement возвращает оператор шага транзакции в виде, пригодном для psql:
+// begin с уровнем level и SET LOCAL параметров profile, параметры params
+// подставлены литералами. Для шагов script возвращает пустую строку.
+func (step yamlStep) psqlStatement(level string, profile gucProfile, params []any) (string, error) {
+	switch {
+	case step.Action == actionBegin && level != "":
+		return "BEGIN ISOLATION LEVEL " + strings.ToUpper(level) + ";" + profile.setLocalSQL(), nil
+	case step.Action == actionBegin:
+		return "BEGIN;" + profile.setLocalSQL(), nil
+	case step.Action != "":
+		return strings.ToUpper(step.Action) + ";", nil
+	case step.Script != "":
+		return "", nil
+	case step.Execute != "":
+		statement, err := isolation.Prepared{Name: step.Execute}.ExecuteSQL(params...)
+		if err != nil {
+			return "", err
+		}
+		return statement + ";", nil
+	}
+	args := make([]driver.NamedValue, len(params))
+	for i, p := range params {
+		args[i] = driver.NamedValue{Ordinal: i + 1, Value: p}
+	}
+	statement, err := inlineArgs(strings.TrimSuffix(strings.TrimSpace(step.Exec+step.Query), ";"), args)
+	if err != nil {
+		return "", err
+	}
+	return statement + ";", nil
+}
+
+// psqlExpectation описывает ожидание шага для подсказки, пусто - без ожиданий.
+func (step yamlStep) psqlExpectation() string {
+	e := step.Expect
+	switch {
+	case e == nil:
+		return ""
+	case e.Error != "":
+		if class := errorClasses[e.Error]; class.Name != "" {
+			return fmt.Sprintf("error %s (%s)", e.Error, class.Name)
+		}
+		return "error " + e.Error
+	case e.Rows != nil:
+		return fmt.Sprintf("rows %v", e.Rows)
+	case e.Affected != nil:
+		return fmt.Sprintf("%d rows affected", *e.Affected)
+	}
+	return ""
+}
+
+// writePSQLScript сохраняет YAML сценарий для ручного запуска в psql: setup.sql,
+// по файлу <tx>.sql на каждую транзакцию с шагами, пронумерованными по общему
+// порядку, и README.md с порядком чередования.
+func (y *yamlScenario) writePSQLScript(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	var searchPath string
+	if y.Namespace != "" {
+		searchPath = fmt.Sprintf("SET search_path TO %s, public;\n\n", y.Namespace)
+	}
+
+	var setup strings.Builder
+	fmt.Fprintf(&setup, "-- %s: run once before the demo\n", y.Name)
+	if y.Namespace != "" {
+		fmt.Fprintf(&setup, "CREATE SCHEMA IF NOT EXISTS %s;\n", y.Namespace)
+	}
+	setup.WriteString(searchPath)
+	migrations := y.Setup
+	if len(migrations) == 0 {
+		migrations = personMigrations
+	}
+	for _, m := range migrations {
+		setup.WriteString(strings.TrimSpace(m) + "\n")
+	}
+	if y.Seeded {
+		setup.WriteString("-- the tool also adds the rows from the -seed-* flags here\n")
+	}
+
+	files := make(map[string]*strings.Builder, len(y.Transactions))
+	levels := make(map[string]string, len(y.Transactions))
+	profiles := make(map[string]gucProfile, len(y.Transactions))
+	for _, tx := range y.Transactions {
+		profiles[tx.Name] = gucProfileFor(y.Name, tx.Name, tx.Settings)
+		files[tx.Name] = &strings.Builder{}
+		fmt.Fprintf(files[tx.Name], "-- %s: terminal %s, run each step when README.md says so\n", y.Name, tx.Name)
+		files[tx.Name].WriteString(searchPath)
+		levels[tx.Name] = tx.Level
+		if tx.Level == "" {
+			levels[tx.Name] = y.Level
+		}
+	}
+
+	var readme strings.Builder
+	fmt.Fprintf(&readme, "# %s\n\n", y.Name)
+	if y.Description != "" {
+		fmt.Fprintf(&readme, "%s\n\n", y.Description)
+	}
+	fmt.Fprintf(&readme, "Run setup.sql once, then open one psql terminal per transaction file and run the steps in the order below.\n")
+	fmt.Fprintf(&readme, "A step that does not return is waiting for a lock: go on with the next step in the other terminal.\n\n")
+	fmt.Fprintf(&readme, "| # | Terminal | Statement | Expect |\n|---|---|---|---|\n")
+	for i, step := range y.Steps {
+		var notes []string
+		if step.When != "" {
+			notes = append(notes, "only if "+step.When)
+		}
+		if step.Args != "" {
+			notes = append(notes, "parameters are computed as "+step.Args+", substitute them by hand")
+		}
+		if step.Retry != nil {
+			notes = append(notes, fmt.Sprintf("on %s: ROLLBACK and repeat %s from BEGIN", strings.Join(step.Retry.On, ", "), step.Tx))
+		}
+		if step.Assert != "" {
+			notes = append(notes, "check "+step.Assert)
+		}
+		if len(step.Bind) > 0 {
+			notes = append(notes, fmt.Sprintf("remember the columns of the first row as %s.%s", step.Tx, strings.Join(step.Bind, ", ")))
+		}
+		if step.Args == "" && strings.Contains(fmt.Sprint(step.Params), "{{") {
+			notes = append(notes, "replace {{tx.name}} with the remembered value")
+		}
+		expect := step.psqlExpectation()
+		statement, err := step.psqlStatement(levels[step.Tx], profiles[step.Tx], step.Params)
+		if err != nil {
+			return fmt.Errorf("%s step %d: %w", y.Name, i+1, err)
+		}
+		if statement == "" {
+			// Starlark выполняется только инструментом, в psql шаг лишь поясняется
+			notes = append(notes, "script: "+step.Script)
+		} else {
+			w := files[step.Tx]
+			fmt.Fprintf(w, "-- step %d\n", i+1)
+			for _, note := range notes {
+				fmt.Fprintf(w, "-- %s\n", note)
+			}
+			if expect != "" {
+				fmt.Fprintf(w, "-- expect %s\n", expect)
+			}
+			fmt.Fprintf(w, "%s\n\n", statement)
+		}
+
+		terminal := step.Tx
+		if terminal == "" {
+			terminal = "-"
+		}
+		cell := "`" + strings.Join(strings.Fields(statement), " ") + "`"
+		if statement == "" {
+			cell = ""
+		}
+		if len(notes) > 0 {
+			cell = strings.TrimSpace(cell + " " + strings.Join(notes, "; "))
+		}
+		fmt.Fprintf(&readme, "| %d | %s | %s | %s |\n", i+1, terminal, strings.ReplaceAll(cell, "|", `\|`), expect)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "setup.sql"), []byte(setup.String()), 0o644); err != nil {
+		return err
+	}
+	for _, tx := range y.Transactions {
+		if err := os.WriteFile(filepath.Join(dir, tx.Name+".sql"), []byte(files[tx.Name].String()), 0o644); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(filepath.Join(dir, "README.md"), []byte(readme.String()), 0o644)
+}
+
+// exportPSQLCommand реализует подкоманду export-psql: сохраняет YAML сценарий
+// как файлы для нескольких терминалов psql, не подключаясь к базе. Сценарии
+// на Go выполняют произвольный код, их операторы записывает -export-sql.
+//
+//	export-psql [-scenarios scenarios] [-out .] <scenario>
+func exportPSQLCommand(args []string, logger *zap.Logger) error {
+	fs := flag.NewFlagSet("export-psql", flag.ContinueOnError)
+	scenariosDir := fs.String("scenarios", "scenarios", "directory with YAML scenarios")
+	out := fs.String("out", ".", "directory for the <scenario> directory with the .sql files")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: export-psql [-scenarios dir] [-out dir] <scenario>")
+	}
+	name := fs.Arg(0)
+
+	var files []string
+	for _, pattern := range []string{"*.yaml", "*.yml"} {
+		matches, err := filepath.Glob(filepath.Join(*scenariosDir, pattern))
+		if err != nil {
+			return err
+		}
+		files = append(files, matches...)
+	}
+	for _, file := range files {
+		y, err := readYAMLScenario(file)
+		if err != nil {
+			logger.Error("failed to load scenario", zap.Error(err), zap.String("file", file))
+			return err
+		}
+		if y.Name != name {
+			continue
+		}
+		dir := filepath.Join(*out, strings.ReplaceAll(name, "/", "_"))
+		if err = y.writePSQLScript(dir); err != nil {
+			logger.Error("failed to export psql script", zap.Error(err), zap.String("dir", dir))
+			return err
+		}
+		logger.Info("psql script exported", zap.String("scenario", name), zap.String("dir", dir))
+		return nil
+	}
+	if _, ok := isolationProblems[name]; ok {
+		return fmt.Errorf("scenario %q is written in Go, record its statements with -export-sql instead", name)
+	}
+	return fmt.Errorf("scenario %q not found in %s", name, *scenariosDir)
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// replayRewind - на сколько событий по умолчанию переходят команды b и f.
+const replayRewind = 10
+
+// readRecordedEvents читает запись запуска -events file:run.jsonl в порядке
+// времени событий. Пустой scenario - события всех сценариев.
+func readRecordedEvents(path, scenario string) ([]event, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []event
+	decoder := json.NewDecoder(f)
+	for {
+		var e event
+		if err = decoder.Decode(&e); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: event %d: %w", path, len(events)+1, err)
+		}
+		if scenario == "" || e.Scenario == scenario {
+			events = append(events, e)
+		}
+	}
+	// Параллельные сценарии дописывают события не строго по времени
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	return events, nil
+}
+
+// formatEvent возвращает строку события со смещением от начала записи.
+func formatEvent(e event, start time.Time) string {
+	offset := fmt.Sprintf("%10s", "+"+e.Time.Sub(start).Round(time.Millisecond).String())
+	if e.Kind == eventVerdict && e.Result != nil {
+		line := fmt.Sprintf("%s  %s  verdict %s", offset, e.Scenario, e.Result.Verdict)
+		if e.Result.Error != "" {
+			line += ": " + e.Result.Error
+		}
+		return line
+	}
+	tx := e.Tx
+	if tx == "" {
+		tx = "-"
+	}
+	keys := make([]string, 0, len(e.Fields))
+	for k := range e.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var fields strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&fields, "  %s=%v", k, e.Fields[k])
+	}
+	return fmt.Sprintf("%s  %s  %s  %s%s", offset, e.Scenario, tx, e.Message, fields.String())
+}
+
+// player воспроизводит записанные события в терминале с паузами, как между
+// событиями запуска, деленными на speed. Паузы длиннее maxGap сокращаются,
+// чтобы ожидания блокировок и deadlock_timeout не растягивали показ.
+type player struct {
+	events []event
+	out    io.Writer
+	speed  float64
+	maxGap time.Duration
+	pos    int
+	paused bool
+}
+
+// command выполняет команду управления: p - пауза или продолжение,
+// b [n] - назад на n событий, f [n] - вперед на n событий без пауз,
+// + и - - скорость вдвое выше или ниже, q - выход. Возвращает false на q.
+func (p *player) command(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return true
+	}
+	n := replayRewind
+	if len(fields) > 1 {
+		if v, err := strconv.Atoi(fields[1]); err == nil && v > 0 {
+			n = v
+		}
+	}
+	switch fields[0] {
+	case "p":
+		p.paused = !p.paused
+		if p.paused {
+			fmt.Fprintf(p.out, "-- paused at event %d/%d\n", p.pos, len(p.events))
+		}
+	case "b":
+		p.pos = max(p.pos-n, 0)
+		fmt.Fprintf(p.out, "-- rewound to event %d/%d\n", p.pos, len(p.events))
+	case "f":
+		start := p.events[0].Time
+		for end := min(p.pos+n, len(p.events)); p.pos < end; p.pos++ {
+			fmt.Fprintln(p.out, formatEvent(p.events[p.pos], start))
+		}
+	case "+":
+		p.speed *= 2
+		fmt.Fprintf(p.out, "-- speed x%g\n", p.speed)
+	case "-":
+		p.speed /= 2
+		fmt.Fprintf(p.out, "-- speed x%g\n", p.speed)
+	case "q":
+		return false
+	default:
+		fmt.Fprintln(p.out, "-- commands: p (pause), b [n] (back), f [n] (forward), + (faster), - (slower), q (quit)")
+	}
+	return true
+}
+
+// wait возвращает паузу перед текущим событием.
+func (p *player) wait() time.Duration {
+	if p.pos == 0 {
+		return 0
+	}
+	gap := p.events[p.pos].Time.Sub(p.events[p.pos-1].Time)
+	return time.Duration(float64(min(gap, p.maxGap)) / p.speed)
+}
+
+// play выводит события до конца записи или команды q. Команды приходят
+// строками из commands; закрытый канал означает, что управления больше нет.
+func (p *player) play(commands <-chan string) {
+	start := p.events[0].Time
+	for p.pos < len(p.events) {
+		if p.paused {
+			if commands == nil {
+				p.paused = false
+				continue
+			}
+			line, ok := <-commands
+			if !ok {
+				commands = nil
+				continue
+			}
+			if !p.command(line) {
+				return
+			}
+			continue
+		}
+		timer := time.NewTimer(p.wait())
+		select {
+		case line, ok := <-commands:
+			timer.Stop()
+			if !ok {
+				commands = nil
+				continue
+			}
+			if !p.command(line) {
+				return
+			}
+			continue
+		case <-timer.C:
+		}
+		fmt.Fprintln(p.out, formatEvent(p.events[p.pos], start))
+		p.pos++
+	}
+}
+
+// replayCommand реализует подкоманду replay: replay [-speed 1] [-scenario name]
+// [-max-gap 2s] [-addr host:port] run.jsonl. Воспроизводит запись -events
+// file:run.jsonl без подключения к базе: в терминале с управлением строками
+// из stdin или, с -addr, на странице с проигрывателем.
+func replayCommand(args []string, logger *zap.Logger) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	speed := fs.Float64("speed", 1, "playback speed relative to the recorded run")
+	scenario := fs.String("scenario", "", "replay only the events of this scenario")
+	maxGap := fs.Duration("max-gap", 2*time.Second, "longest pause between events at speed 1")
+	addr := fs.String("addr", "", "serve a web player on host:port instead of replaying in the terminal")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: replay [-speed 1] [-scenario name] [-max-gap 2s] [-addr host:port] <run.jsonl>")
+	}
+	if *speed <= 0 || *maxGap <= 0 {
+		return fmt.Errorf("-speed and -max-gap must be positive")
+	}
+	events, err := readRecordedEvents(fs.Arg(0), *scenario)
+	if err != nil {
+		logger.Error("failed to read events", zap.Error(err), zap.String("path", fs.Arg(0)))
+		return err
+	}
+	if len(events) == 0 {
+		return fmt.Errorf("%s: no events, record a run with -events file:%s first", fs.Arg(0), fs.Arg(0))
+	}
+
+	if *addr != "" {
+		logger.Info("serving replay", zap.Int("events", len(events)), zap.String("url", "http://"+*addr+"/"))
+		return http.ListenAndServe(*addr, replayHandler(events, *speed, *maxGap, logger))
+	}
+	commands := make(chan string)
+	go func() {
+		defer close(commands)
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			commands <- scanner.Text()
+		}
+	}()
+	p := &player{events: events, out: os.Stdout, speed: *speed, maxGap: *maxGap}
+	p.play(commands)
+	return nil
+}
+
+type replayPage struct {
+	Events []event
+	Lines  []string
+	Speed  float64
+	MaxGap int64
+}
+
+var replayTemplate = template.Must(template.New("replay").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>replay</title>
+<style>
+body { font-family: sans-serif; font-size: 13px; margin: 20px; }
+#log { font-family: monospace; white-space: pre; background: #f4f4f4; padding: 8px; height: 70vh; overflow: auto; }
+#pos { width: 400px; vertical-align: middle; }
+</style>
+</head>
+<body>
+<p>
+<button id="play">pause</button>
+<button id="back">&laquo; 10</button>
+<button id="forward">10 &raquo;</button>
+speed <select id="speed">
+<option>0.25</option><option>0.5</option><option>1</option><option>2</option><option>4</option><option>8</option>
+</select>
+<input id="pos" type="range" min="0" max="{{len .Events}}" value="0">
+<span id="counter"></span>
+</p>
+<div id="log"></div>
+<script>
+const events = {{.Events}};
+const lines = {{.Lines}};
+const maxGap = {{.MaxGap}};
+let pos = 0, paused = false, timer = null, speed = {{.Speed}};
+const log = document.getElementById("log"), slider = document.getElementById("pos");
+document.getElementById("speed").value = String(speed);
+
+function render() {
+  log.textContent = lines.slice(0, pos).join("\n");
+  log.scrollTop = log.scrollHeight;
+  slider.value = pos;
+  document.getElementById("counter").textContent = pos + "/" + events.length;
+}
+function schedule() {
+  clearTimeout(timer);
+  if (paused || pos >= events.length) return;
+  let gap = pos === 0 ? 0 : Date.parse(events[pos].time) - Date.parse(events[pos - 1].time);
+  timer = setTimeout(() => { pos++; render(); schedule(); }, Math.min(gap, maxGap) / speed);
+}
+function seek(p) { pos = Math.max(0, Math.min(events.length, p)); render(); schedule(); }
+
+document.getElementById("play").onclick = (e) => {
+  paused = !paused;
+  e.target.textContent = paused ? "play" : "pause";
+  schedule();
+};
+document.getElementById("back").onclick = () => seek(pos - 10);
+document.getElementById("forward").onclick = () => seek(pos + 10);
+document.getElementById("speed").onchange = (e) => { speed = Number(e.target.value); schedule(); };
+slider.oninput = () => seek(Number(slider.value));
+render();
+schedule();
+</script>
+</body>
+</html>
+`))
+
+// replayHandler отдает страницу проигрывателя записанных событий.
+func replayHandler(events []event, speed float64, maxGap time.Duration, logger *zap.Logger) http.Handler {
+	page := replayPage{Events: events, Speed: speed, MaxGap: maxGap.Milliseconds()}
+	for _, e := range events {
+		page.Lines = append(page.Lines, formatEvent(e, events[0].Time))
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := replayTemplate.Execute(w, page); err != nil {
+			logger.Error("failed to render page", zap.Error(err))
+		}
+	})
+}
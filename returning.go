@@ -0,0 +1,111 @@
+package main
+
+import (
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+// updateReturning сравнивает списание в два запроса (чтение, затем запись
+// вычисленного значения) с одним UPDATE ... RETURNING при READ COMMITTED.
+func updateReturning(db *sqlx.DB, logger *zap.Logger) error {
+	if err := readModifyWriteWithdraw(db, logger.With(zap.String("variant", "read_modify_write"))); err != nil {
+		return err
+	}
+	if err := migrate(db, logger, []string{"UPDATE person SET balance = 1000 WHERE id = 1;"}); err != nil {
+		return err
+	}
+	return returningWithdraw(db, logger.With(zap.String("variant", "update_returning")))
+}
+
+func readModifyWriteWithdraw(db *sqlx.DB, logger *zap.Logger) (err error) {
+	// Проверка баланса после завершения транзакций: корректно 1000 - 300 - 500 = 200,
+	// но tx2 записывает значение, вычисленное до фиксации tx1
+	defer verifyFinalBalance(db, logger, &err, 1, 500)
+
+	// Запуск транзакций
+	tx1 := newTransaction(db, logger.With(zap.String("tx", "tx1")))
+	if err := tx1.begin(); err != nil {
+		return err
+	}
+	if err := tx1.setLevel(sql.LevelReadCommitted); err != nil {
+		return err
+	}
+	tx2 := newTransaction(db, logger.With(zap.String("tx", "tx2")))
+	if err := tx2.begin(); err != nil {
+		return err
+	}
+	if err := tx2.setLevel(sql.LevelReadCommitted); err != nil {
+		return err
+	}
+
+	// Чтение баланса в обеих транзакциях
+	userID := 1
+	balance1, err := tx1.queryBalance("SELECT balance FROM person WHERE id = $1;", userID)
+	if err != nil {
+		return err
+	}
+	balance2, err := tx2.queryBalance("SELECT balance FROM person WHERE id = $1;", userID)
+	if err != nil {
+		return err
+	}
+
+	// Запись вычисленного в приложении баланса
+	if err = tx1.updateUser(userID, int(balance1)-300); err != nil {
+		return err
+	}
+	if err = tx1.commit(); err != nil {
+		return err
+	}
+	if err = tx2.updateUser(userID, int(balance2)-500); err != nil {
+		return err
+	}
+	return tx2.commit()
+}
+
+func returningWithdraw(db *sqlx.DB, logger *zap.Logger) (err error) {
+	// Проверка баланса после завершения транзакций: ожидается 1000 - 300 - 500 = 200
+	defer verifyFinalBalance(db, logger, &err, 1, 200)
+
+	// Запуск транзакций
+	tx1 := newTransaction(db, logger.With(zap.String("tx", "tx1")))
+	if err := tx1.begin(); err != nil {
+		return err
+	}
+	if err := tx1.setLevel(sql.LevelReadCommitted); err != nil {
+		return err
+	}
+	tx2 := newTransaction(db, logger.With(zap.String("tx", "tx2")))
+	if err := tx2.begin(); err != nil {
+		return err
+	}
+	if err := tx2.setLevel(sql.LevelReadCommitted); err != nil {
+		return err
+	}
+
+	// Списание одним запросом: окна между чтением и записью нет
+	userID := 1
+	if _, err := tx1.withdraw(userID, 300); err != nil {
+		return err
+	}
+	// tx2 ждет блокировку строки и перечитывает ее после фиксации tx1
+	pid, err := tx2.backendPID()
+	if err != nil {
+		return err
+	}
+	tx2Done := runAsync(func() error {
+		_, err := tx2.withdraw(userID, 500)
+		return err
+	})
+	if err = waitBlocked(tx2, pid, tx2Done); err != nil {
+		return err
+	}
+	if err := tx1.commit(); err != nil {
+		return err
+	}
+	if err := <-tx2Done; err != nil {
+		return err
+	}
+	return tx2.commit()
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// errScenarioSkipped возвращается сценарием, который невозможно выполнить на этом сервере.
+var errScenarioSkipped = errors.New("scenario skipped")
+
+// errScenarioTimeout означает, что сценарий не уложился в отведенное время.
+var errScenarioTimeout = errors.New("scenario timed out")
+
+// timeoutGrace - сколько ждать завершения сценария после отключения его сессий.
+const timeoutGrace = 5 * time.Second
+
+// runner запускает сценарии и сохраняет их результаты.
+type runner struct {
+	db *sqlx.DB
+	// driverName и dsn нужны для подключений к схемам сценариев,
+	// monitorDriver - для подключений монитора, трафик которых не записывается
+	driverName    string
+	monitorDriver string
+	dsn           string
+	serverVersion string
+	// versionNum - server_version_num для аннотаций skip и xfail, 0 - неизвестна
+	versionNum int
+	// meta добавляется к каждому результату и отчету, nil - без метаданных
+	meta   *runMetadata
+	hist   *history
+	events *eventStream
+	// audit включает триггеры аудита и сверку итогового состояния с ними
+	audit bool
+	// timeout ограничивает время выполнения каждого сценария, 0 - без ограничения
+	timeout time.Duration
+	// stats собирает pg_stat_statements вокруг каждого сценария, если не nil
+	stats *statStatements
+	// capture записывает операторы сценария для экспорта в exportDir, если не nil
+	capture   *sqlCapture
+	exportDir string
+	// archiveDir - каталог для CSV с состоянием таблиц после сценария, пусто - без архива;
+	// archiveStats добавляет изменения счетчиков pg_stat_user_tables
+	archiveDir   string
+	archiveStats bool
+	// shrinkDir - каталог для минимальных порядков шагов с аномалией из
+	// -probability, пусто - без сокращения
+	shrinkDir string
+	logger    *zap.Logger
+
+	mu         sync.Mutex
+	namespaces map[string]*sqlx.DB
+	// monitors - подключения монитора по схемам, "" - схема по умолчанию
+	monitors map[string]*sqlx.DB
+	// peers - пулы второй базы -second-database по схемам
+	peers map[string]*sqlx.DB
+}
+
+func (r *runner) run(name string, s scenario) error {
+	logger := r.logger.With(zap.String("problem", name))
+	started := time.Now()
+	if a := matchAnnotation(s.skip, backendPostgres, r.versionNum); a != nil {
+		err := fmt.Errorf("%w: %s", errScenarioSkipped, a)
+		result := newRunResult(name, s, r.serverVersion, started, 0, 0, err)
+		result.Metadata = r.meta
+		logger.Info("scenario skipped", zap.Error(err))
+		return r.record(result, logger)
+	}
+	suiteProgress.begin(name + " " + s.level.String())
+	defer suiteProgress.end()
+	if r.capture != nil {
+		r.capture.start()
+	}
+	db, err := r.namespaceDB(s.namespace, logger)
+	if err != nil {
+		return err
+	}
+	monitor, err := r.monitor(s.namespace, logger)
+	if err != nil {
+		return err
+	}
+	registerMonitor(db, monitor)
+	if s.peer {
+		peer, err := r.peer(s.namespace, logger)
+		if err != nil {
+			return err
+		}
+		if peer != nil {
+			registerPeer(db, peer)
+		}
+	}
+	migrations := s.migrations
+	if s.seeded {
+		migrations = append(append([]string(nil), migrations...), seed.migrations()...)
+	}
+	if r.audit {
+		migrations = append(append([]string(nil), migrations...), auditMigrations...)
+	}
+	var tableStats map[string]tableStat
+	if r.archiveDir != "" {
+		if tableStats, err = readTableStats(monitor, logger); err != nil {
+			return err
+		}
+	}
+	suiteProgress.setStep("migrations")
+	if err = checkSchema(db, logger, migrations); err != nil {
+		return err
+	}
+	if err = migrate(db, logger, migrations); err != nil {
+		return err
+	}
+	if r.stats != nil {
+		if err = r.stats.reset(); err != nil {
+			return err
+		}
+	}
+	if captureStepStates && r.archiveDir != "" {
+		if states := stepStatesOf(logger); states != nil {
+			states.start(monitor, scenarioApplicationName(s.namespace), scenarioTables(migrations))
+		}
+	}
+	migrated := time.Now()
+	suiteProgress.setStep("steps")
+	err = r.runProblem(s, db, monitor, logger)
+	if len(s.final) > 0 && !errors.Is(err, errScenarioSkipped) && !errors.Is(err, errScenarioTimeout) {
+		suiteProgress.setStep("final state")
+		checkPostconditions(db, logger, &err, s.final...)
+	}
+	if a := matchAnnotation(s.xfail, backendPostgres, r.versionNum); a != nil {
+		err = expectFailure(err, a, logger)
+	}
+	if lerr := checkAdvisoryLocks(db, monitor, s.namespace, logger); err == nil {
+		err = lerr
+	}
+	if serr := strictErrors(name); serr != nil {
+		// Проглоченная ошибка проваливает и пропущенный, и ожидаемо упавший сценарий
+		if errors.Is(err, errScenarioSkipped) || errors.Is(err, errExpectedFailure) || errors.Is(err, errScenarioTimeout) {
+			err = nil
+		}
+		err = errors.Join(err, serr)
+	}
+	if err == nil && r.audit {
+		err = verifyAudit(monitor, logger)
+	}
+	suiteProgress.setStep("results")
+	if err != nil && !errors.Is(err, errScenarioSkipped) && !errors.Is(err, errUnexpectedPass) {
+		// Незавершенные транзакции сценария видны по оставшимся блокировкам
+		ignoreError(logger, "print locks", printLocks(monitor, logger))
+	}
+	if m := scenarioMetricsOf(logger); m != nil {
+		m.warnLongTransactions(logger)
+	}
+	if m := scenarioMetricsOf(logger); printTxSummary && m != nil {
+		// Сводка выводится одной записью, чтобы сводки параллельных сценариев не перемешались
+		var summary bytes.Buffer
+		if serr := m.print(&summary, name); serr != nil {
+			return serr
+		}
+		_, werr := os.Stderr.Write(summary.Bytes())
+		ignoreError(logger, "print transaction summary", werr)
+	}
+	result := newRunResult(name, s, r.serverVersion, started, migrated.Sub(started), time.Since(migrated), err)
+	result.Metadata = r.meta
+	if r.capture != nil {
+		if xerr := exportScenarioSQL(r.capture, r.exportDir, name, logger); xerr != nil {
+			return xerr
+		}
+	}
+	if r.archiveDir != "" {
+		if aerr := archiveState(monitor, r.archiveDir, name, tableStats, r.archiveStats, logger); aerr != nil {
+			return aerr
+		}
+		if states := stepStatesOf(logger); states != nil {
+			if serr := states.write(r.archiveDir, name, logger); serr != nil {
+				return serr
+			}
+		}
+	}
+	if r.stats != nil {
+		var serr error
+		if result.Statements, serr = r.stats.snapshot(); serr != nil {
+			return serr
+		}
+		for _, st := range result.Statements {
+			logger.Info("statement stats", zap.String("query", st.Query), zap.Int64("calls", st.Calls),
+				zap.Float64("total_ms", st.TotalMs), zap.Int64("rows", st.Rows))
+		}
+	}
+	if rerr := r.record(result, logger); rerr != nil {
+		return rerr
+	}
+	if errors.Is(err, errScenarioSkipped) {
+		logger.Info("scenario skipped", zap.Error(err))
+		return nil
+	}
+	if errors.Is(err, errExpectedFailure) {
+		return nil
+	}
+	if errors.Is(err, errScenarioTimeout) {
+		// Результат сохранен, остальные сценарии продолжают выполняться
+		logger.Error("scenario timed out", zap.Error(err))
+		return nil
+	}
+	return err
+}
+
+// record сохраняет результат сценария в архив и историю и публикует вердикт.
+func (r *runner) record(result runResult, logger *zap.Logger) error {
+	if r.archiveDir != "" {
+		if err := archiveResult(r.archiveDir, result, logger); err != nil {
+			return err
+		}
+	}
+	if r.hist != nil {
+		if err := r.hist.append(result); err != nil {
+			return err
+		}
+	}
+	if r.events != nil {
+		if err := r.events.verdict(result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runProblem выполняет шаги сценария в пределах r.timeout. По истечении времени
+// контекст сценария отменяется, а монитор отключает его сессии: сервер
+// откатывает их транзакции, а незавершенные шаги получают ошибку, которая
+// попадает в результат. runProblem возвращается только после завершения шагов,
+// чтобы миграции следующего сценария не пересекались с ними.
+func (r *runner) runProblem(s scenario, db, monitor *sqlx.DB, logger *zap.Logger) error {
+	if r.timeout <= 0 {
+		return s.problem(db, logger)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	registerScenarioContext(db, ctx)
+	defer unregisterScenarioContext(db)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.problem(db, logger)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(r.timeout):
+	}
+
+	logger.Error("scenario timeout expired", zap.Duration("timeout", r.timeout))
+	cancel()
+	ignoreError(logger, "print locks", printLocks(monitor, logger))
+	terminated := terminateSessions(monitor, scenarioApplicationName(s.namespace), logger)
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(timeoutGrace):
+		logger.Error("scenario did not stop after its sessions were terminated, waiting for its steps", zap.Duration("grace", timeoutGrace))
+		err = <-done
+	}
+	if terminated != nil {
+		return terminated
+	}
+	if err == nil {
+		return fmt.Errorf("%w after %s", errScenarioTimeout, r.timeout)
+	}
+	return fmt.Errorf("%w after %s: %v", errScenarioTimeout, r.timeout, err)
+}
+
+// scenarioContexts связывает пул подключений сценария с контекстом его шагов.
+// Транзакции сценария выполняют операторы в этом контексте, и по истечении
+// -timeout отмена прерывает операторы, ждущие ответа сервера.
+var scenarioContexts = struct {
+	mu   sync.Mutex
+	byDB map[*sqlx.DB]context.Context
+}{byDB: make(map[*sqlx.DB]context.Context)}
+
+func registerScenarioContext(db *sqlx.DB, ctx context.Context) {
+	scenarioContexts.mu.Lock()
+	defer scenarioContexts.mu.Unlock()
+	scenarioContexts.byDB[db] = ctx
+}
+
+func unregisterScenarioContext(db *sqlx.DB) {
+	scenarioContexts.mu.Lock()
+	defer scenarioContexts.mu.Unlock()
+	delete(scenarioContexts.byDB, db)
+}
+
+// scenarioContext возвращает контекст шагов сценария с пулом db или
+// context.Background(), если сценарий выполняется без -timeout.
+func scenarioContext(db *sqlx.DB) context.Context {
+	scenarioContexts.mu.Lock()
+	defer scenarioContexts.mu.Unlock()
+	if ctx, ok := scenarioContexts.byDB[db]; ok {
+		return ctx
+	}
+	return context.Background()
+}
+
+// targetSchema - схема из флага -schema, в которой работают сценарии без
+// namespace; пусто - схема по умолчанию из search_path подключения.
+var targetSchema string
+
+// scenarioSchema возвращает схему сценария: namespace или, при -schema,
+// targetSchema и namespace через подчеркивание, чтобы сценарии не создавали
+// схем вне выбранного префикса. Пусто - схема подключения по умолчанию.
+func scenarioSchema(namespace string) string {
+	switch {
+	case targetSchema == "":
+		return namespace
+	case namespace == "":
+		return targetSchema
+	default:
+		return targetSchema + "_" + namespace
+	}
+}
+
+// scenarioSchemas возвращает все схемы, которые используют сценарии при -schema,
+// nil - схема не выбрана.
+func scenarioSchemas() []string {
+	if targetSchema == "" {
+		return nil
+	}
+	seen := map[string]bool{targetSchema: true}
+	schemas := []string{targetSchema}
+	for _, s := range isolationProblems {
+		if schema := scenarioSchema(s.namespace); !seen[schema] {
+			seen[schema] = true
+			schemas = append(schemas, schema)
+		}
+	}
+	sort.Strings(schemas)
+	return schemas
+}
+
+// withTargetSchema добавляет в dsn search_path схемы targetSchema: его
+// наследуют все подключения, которые не задают свою схему.
+func withTargetSchema(dsn string) (string, error) {
+	if targetSchema == "" {
+		return dsn, nil
+	}
+	if strings.HasPrefix(targetSchema, "pg_") {
+		return "", fmt.Errorf("schema %q: names starting with pg_ are reserved", targetSchema)
+	}
+	params, err := parseDSN(dsn)
+	if err != nil {
+		return "", err
+	}
+	params["search_path"] = pq.QuoteIdentifier(targetSchema)
+	return formatDSN(params), nil
+}
+
+// createTargetSchema создает схему targetSchema, если она выбрана.
+func createTargetSchema(db *sqlx.DB, logger *zap.Logger) error {
+	if targetSchema == "" {
+		return nil
+	}
+	if _, err := db.Exec("CREATE SCHEMA IF NOT EXISTS " + pq.QuoteIdentifier(targetSchema) + ";"); err != nil {
+		logger.Error("failed to create schema", zap.Error(err), zap.String("schema", targetSchema))
+		return err
+	}
+	logger.Info("target schema ready", zap.String("schema", targetSchema))
+	return nil
+}
+
+// namespaceDB возвращает пул подключений, у которого search_path указывает
+// на схему сценария. Схема создается при первом обращении.
+func (r *runner) namespaceDB(namespace string, logger *zap.Logger) (*sqlx.DB, error) {
+	if namespace == "" {
+		return r.db, nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if db, ok := r.namespaces[namespace]; ok {
+		return db, nil
+	}
+
+	schema := pq.QuoteIdentifier(scenarioSchema(namespace))
+	if _, err := r.db.Exec("CREATE SCHEMA IF NOT EXISTS " + schema + ";"); err != nil {
+		logger.Error("failed to create schema", zap.Error(err), zap.String("namespace", namespace))
+		return nil, err
+	}
+	params, err := parseDSN(r.dsn)
+	if err != nil {
+		return nil, err
+	}
+	// lib/pq передает неизвестные параметры серверу как параметры сеанса
+	params["search_path"] = schema
+	params["application_name"] = scenarioApplicationName(namespace)
+	db, err := connect(r.driverName, formatDSN(params), logger)
+	if err != nil {
+		return nil, err
+	}
+	if r.namespaces == nil {
+		r.namespaces = make(map[string]*sqlx.DB)
+	}
+	r.namespaces[namespace] = db
+	logger.Info("namespace connected", zap.String("namespace", namespace))
+	return db, nil
+}
+
+// monitor возвращает подключение монитора для схемы сценария.
+func (r *runner) monitor(namespace string, logger *zap.Logger) (*sqlx.DB, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if monitor, ok := r.monitors[namespace]; ok {
+		return monitor, nil
+	}
+	// Без namespace монитор наследует search_path -schema из r.dsn
+	dsn := r.dsn
+	if namespace != "" {
+		params, err := parseDSN(dsn)
+		if err != nil {
+			return nil, err
+		}
+		params["search_path"] = pq.QuoteIdentifier(scenarioSchema(namespace))
+		dsn = formatDSN(params)
+	}
+	monitor, err := openMonitor(r.monitorDriver, dsn, logger)
+	if err != nil {
+		return nil, err
+	}
+	if r.monitors == nil {
+		r.monitors = make(map[string]*sqlx.DB)
+	}
+	r.monitors[namespace] = monitor
+	return monitor, nil
+}
+
+// runParallel запускает сценарии разных схем одновременно, сценарии одной
+// схемы и связанные зависимостями выполняются по очереди. Возвращает первую ошибку.
+func (r *runner) runParallel(names []string) error {
+	groups := parallelGroups(names)
+	errs := make(chan error, len(groups))
+	var wg sync.WaitGroup
+	for _, group := range groups {
+		wg.Add(1)
+		go func(names []string) {
+			defer wg.Done()
+			for _, name := range names {
+				if err := r.run(name, isolationProblems[name]); err != nil {
+					errs <- fmt.Errorf("%s: %w", name, err)
+					return
+				}
+			}
+		}(group)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+func (r *runner) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, db := range r.namespaces {
+		ignoreError(r.logger, "close pool", db.Close())
+	}
+	for _, monitor := range r.monitors {
+		ignoreError(r.logger, "close monitor pool", monitor.Close())
+	}
+	for _, peer := range r.peers {
+		ignoreError(r.logger, "close second database pool", peer.Close())
+	}
+}
+
+// selectScenarios возвращает сценарии, перечисленные через запятую, или все
+// зарегистрированные, в порядке их зависимостей.
+func selectScenarios(list string) ([]string, error) {
+	if list == "" {
+		names := make([]string, 0, len(isolationProblems))
+		for name := range isolationProblems {
+			names = append(names, name)
+		}
+		return orderScenarios(names)
+	}
+	names := strings.Split(list, ",")
+	for i, name := range names {
+		names[i] = strings.TrimSpace(name)
+		if _, ok := isolationProblems[names[i]]; !ok {
+			return nil, fmt.Errorf("unknown scenario %q", names[i])
+		}
+	}
+	return orderScenarios(names)
+}
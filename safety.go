@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// errUnsafeTarget означает, что база похожа на рабочую: миграции сценариев
+// удаляют и пересоздают таблицы, поэтому без -force запуск прерывается.
+var errUnsafeTarget = errors.New("target database is not a demo database, rerun with -force to use it anyway")
+
+// safeModeMaxRows - оценка количества строк в таблице сценария, выше которой
+// данные считаются значимыми. Строки -seed-rows к ней добавляются.
+const safeModeMaxRows = 100_000
+
+// createTablePattern находит имя таблицы, возможно со схемой, в CREATE TABLE;
+// последняя группа - имя без схемы.
+var createTablePattern = regexp.MustCompile(`(?i)CREATE\s+(?:UNLOGGED\s+)?TABLE\s+(?:IF\s+NOT\s+EXISTS\s+)?(?:(?:"[^"]+"|\w+)\.)?("[^"]+"|\w+)`)
+
+// generatedDemoTables - таблицы, которые сценарии создают циклом на сервере,
+// а не отдельными CREATE TABLE в миграциях, поэтому demoTables их не видит.
+var generatedDemoTables = []*regexp.Regexp{predicateExhaustionPattern}
+
+// generatedDemoTable сообщает, создает ли таблицу name цикл сценария.
+func generatedDemoTable(name string) bool {
+	for _, pattern := range generatedDemoTables {
+		if pattern.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// demoTables возвращает имена таблиц, которые создают миграции сценариев.
+func demoTables(migrations ...[]string) map[string]bool {
+	tables := make(map[string]bool)
+	for _, list := range migrations {
+		for _, m := range list {
+			for _, match := range createTablePattern.FindAllStringSubmatch(m, -1) {
+				// Имя без кавычек PostgreSQL приводит к нижнему регистру
+				name := match[1]
+				if strings.HasPrefix(name, `"`) {
+					name = strings.Trim(name, `"`)
+				} else {
+					name = strings.ToLower(name)
+				}
+				tables[name] = true
+			}
+		}
+	}
+	return tables
+}
+
+// checkSafeTarget проверяет, что в базе нет чужих таблиц и таблицы сценариев
+// не содержат много данных. extra - миграции, которые не входят в
+// зарегистрированные сценарии. Возвращает errUnsafeTarget с перечнем находок.
+func checkSafeTarget(db *sqlx.DB, logger *zap.Logger, extra ...[]string) error {
+	lists := append([][]string{auditMigrations}, extra...)
+	for _, s := range isolationProblems {
+		lists = append(lists, s.migrations)
+	}
+	demo := demoTables(lists...)
+
+	const tablesQuery = `SELECT n.nspname AS schema, c.relname AS name, GREATEST(c.reltuples, 0)::BIGINT AS rows
+         FROM pg_class c
+         JOIN pg_namespace n ON n.oid = c.relnamespace
+         WHERE c.relkind IN ('r', 'p')
+           AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+           AND n.nspname NOT LIKE 'pg\_%'
+           AND ($1::TEXT[] IS NULL OR n.nspname = ANY($1))
+         ORDER BY 1, 2;`
+	var tables []struct {
+		Schema string `db:"schema"`
+		Name   string `db:"name"`
+		Rows   int64  `db:"rows"`
+	}
+	// С -schema чужие таблицы других схем общей базы не мешают сценариям
+	if err := db.Select(&tables, tablesQuery, pq.Array(scenarioSchemas())); err != nil {
+		logger.Error("failed to list tables", zap.Error(err))
+		return err
+	}
+	var findings []string
+	for _, t := range tables {
+		switch {
+		case !demo[t.Name] && !generatedDemoTable(t.Name):
+			findings = append(findings, fmt.Sprintf("%s.%s is not created by any scenario", t.Schema, t.Name))
+		case t.Rows > safeModeMaxRows+int64(seed.rows):
+			findings = append(findings, fmt.Sprintf("%s.%s has about %d rows", t.Schema, t.Name, t.Rows))
+		}
+	}
+	if len(findings) > 0 {
+		logger.Error("refusing to run migrations", zap.Strings("findings", findings))
+		return fmt.Errorf("%w: %s", errUnsafeTarget, strings.Join(findings, "; "))
+	}
+	logger.Info("target database looks like a demo database", zap.Int("tables", len(tables)))
+	return nil
+}
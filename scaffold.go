@@ -0,0 +1,253 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"go.uber.org/zap"
+
+	"transactionIsolation/isolation"
+)
+
+var scenarioNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// scaffoldData - подстановки шаблонов нового сценария.
+type scaffoldData struct {
+	Name string
+	// Func - имя функции сценария, Export - суффикс имени теста
+	Func   string
+	Export string
+	// Level - уровень для YAML, LevelConst - константа database/sql для Go
+	Level      string
+	LevelConst string
+	// Dir - каталог YAML сценария относительно каталога теста
+	Dir string
+}
+
+var goScenarioTemplate = template.Must(template.New("go").Parse(`package main
+
+import (
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+var {{.Func}}Migrations = append([]string{}, personMigrations...)
+
+func init() {
+	// Отдельная схема позволяет запускать сценарий параллельно с остальными
+	if err := addScenarios(map[string]scenario{
+		"{{.Name}}": {level: {{.LevelConst}}, migrations: {{.Func}}Migrations, problem: {{.Func}}, namespace: "{{.Name}}"},
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// {{.Func}} TODO: опишите аномалию и ожидаемый результат.
+func {{.Func}}(db *sqlx.DB, logger *zap.Logger) (err error) {
+	// Проверка баланса после завершения транзакций
+	defer checkPostconditions(db, logger, &err,
+		// TODO: ожидаемый итог сценария
+		expectBalance(1, 1000),
+	)
+
+	tx1, tx2, err := beginPair(db, logger, {{.LevelConst}})
+	if err != nil {
+		return err
+	}
+
+	// TODO: шаги сценария
+	if err = readBalance(1, tx1, tx2); err != nil {
+		return err
+	}
+
+	return commitPair(tx1, tx2)
+}
+`))
+
+var yamlScenarioTemplate = template.Must(template.New("yaml").Parse(`name: {{.Name}}
+description: "TODO: опишите аномалию и ожидаемый результат"
+level: {{.Level}}
+namespace: {{.Name}}
+transactions:
+  - name: tx1
+  - name: tx2
+  - name: tx3
+steps:
+  # Чтение баланса в обеих транзакциях
+  - {tx: tx1, action: begin}
+  - {tx: tx2, action: begin}
+  - {tx: tx1, query: "SELECT balance FROM person WHERE id = $1;", params: [1], expect: {rows: [[1000]]}}
+  - {tx: tx2, query: "SELECT balance FROM person WHERE id = $1;", params: [1], expect: {rows: [[1000]]}}
+
+  # TODO: шаги сценария
+  - {tx: tx1, action: commit}
+  - {tx: tx2, action: commit}
+
+  # Проверка баланса после завершения транзакций
+  - {tx: tx3, action: begin}
+  - {tx: tx3, query: "SELECT balance FROM person WHERE id = $1;", params: [1], expect: {rows: [[1000]]}}
+  - {tx: tx3, action: commit}
+`))
+
+var scenarioTestTemplate = template.Must(template.New("test").Parse(`package main
+
+import (
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap/zaptest"
+)
+
+// Test{{.Export}} запускает сценарий {{.Name}} на базе из defaultDSN и пропускается, если база недоступна.
+func Test{{.Export}}(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	db, err := sqlx.Connect("postgres", defaultDSN)
+	if err != nil {
+		t.Skipf("postgres is not available: %v", err)
+	}
+	defer db.Close()
+{{if .Dir}}
+	scenarios, err := loadYAMLScenarios({{printf "%q" .Dir}}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, ok := scenarios["{{.Name}}"]
+	if !ok {
+		t.Fatalf("scenario %q not found", "{{.Name}}")
+	}
+{{else}}
+	s := isolationProblems["{{.Name}}"]
+{{end}}
+	r := &runner{db: db, driverName: "postgres", monitorDriver: "postgres", dsn: defaultDSN, logger: logger}
+	defer r.close()
+	if err = r.run("{{.Name}}", s); err != nil {
+		t.Fatal(err)
+	}
+}
+`))
+
+// newScenarioCommand реализует подкоманду new-scenario: создает заготовку
+// сценария на Go или YAML и интеграционный тест к ней.
+//
+//	new-scenario [-yaml] [-level "read committed"] [-dir .] [-scenarios scenarios] name
+func newScenarioCommand(args []string, logger *zap.Logger) error {
+	fs := flag.NewFlagSet("new-scenario", flag.ContinueOnError)
+	asYAML := fs.Bool("yaml", false, "generate a YAML scenario instead of Go code")
+	levelName := fs.String("level", "read committed", "isolation level of the scenario")
+	dir := fs.String("dir", ".", "directory for the Go scenario and the test")
+	scenariosDir := fs.String("scenarios", "scenarios", "directory for the YAML scenario")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: new-scenario [-yaml] [-level level] [-dir dir] [-scenarios dir] <name>")
+	}
+	name := fs.Arg(0)
+	if !scenarioNamePattern.MatchString(name) {
+		return fmt.Errorf("scenario name %q must match %s", name, scenarioNamePattern)
+	}
+	if _, ok := isolationProblems[name]; ok {
+		return fmt.Errorf("scenario %q already exists", name)
+	}
+	level, err := isolation.ParseLevel(*levelName, isolation.Postgres)
+	if err != nil {
+		return err
+	}
+
+	data := scaffoldData{
+		Name:       name,
+		Func:       camelCase(name, false),
+		Export:     camelCase(name, true),
+		Level:      strings.ToLower(level.String()),
+		LevelConst: "sql.Level" + strings.ReplaceAll(level.String(), " ", ""),
+	}
+	if !*asYAML {
+		if err = checkIdentifierFree(*dir, data.Func); err != nil {
+			return err
+		}
+	}
+	var files []string
+	if *asYAML {
+		if data.Dir, err = filepath.Rel(*dir, *scenariosDir); err != nil {
+			return err
+		}
+		data.Dir = filepath.ToSlash(data.Dir)
+		file := filepath.Join(*scenariosDir, name+".yaml")
+		if err = writeTemplate(file, yamlScenarioTemplate, data, logger); err != nil {
+			logger.Error("failed to write scenario", zap.Error(err), zap.String("file", file))
+			return err
+		}
+		files = append(files, file)
+	} else {
+		file := filepath.Join(*dir, name+".go")
+		if err = writeTemplate(file, goScenarioTemplate, data, logger); err != nil {
+			logger.Error("failed to write scenario", zap.Error(err), zap.String("file", file))
+			return err
+		}
+		files = append(files, file)
+	}
+	file := filepath.Join(*dir, name+"_test.go")
+	if err = writeTemplate(file, scenarioTestTemplate, data, logger); err != nil {
+		logger.Error("failed to write scenario test", zap.Error(err), zap.String("file", file))
+		return err
+	}
+	files = append(files, file)
+	logger.Info("scenario scaffolded", zap.String("scenario", name), zap.Strings("files", files))
+	return nil
+}
+
+// checkIdentifierFree проверяет, что функция и миграции сценария не совпадут
+// по имени с уже объявленными в пакете.
+func checkIdentifierFree(dir, funcName string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		src, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		for _, decl := range []string{"func " + funcName + "(", "var " + funcName + "Migrations "} {
+			if strings.Contains(string(src), decl) {
+				return fmt.Errorf("%s: %q is already declared, choose another scenario name", file, strings.TrimSuffix(decl, "("))
+			}
+		}
+	}
+	return nil
+}
+
+// writeTemplate создает файл из шаблона и не перезаписывает существующий.
+func writeTemplate(file string, t *template.Template, data scaffoldData, logger *zap.Logger) (err error) {
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	defer closeWritten(logger, f, &err)
+	return t.Execute(f, data)
+}
+
+// camelCase переводит snake_case имя сценария в имя Go функции.
+func camelCase(name string, exported bool) string {
+	var b strings.Builder
+	for i, part := range strings.Split(name, "_") {
+		if part == "" {
+			continue
+		}
+		if i > 0 || exported {
+			part = strings.ToUpper(part[:1]) + part[1:]
+		}
+		b.WriteString(part)
+	}
+	return b.String()
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+// errSchemaDrift означает, что таблица сценария уже существует и ее структура
+// отличается от создаваемой миграциями.
+var errSchemaDrift = errors.New("schema drift")
+
+// expectedSchemaName - временная схема, в которой миграции выполняются для
+// получения ожидаемой структуры таблиц. Транзакция с ней всегда откатывается.
+const expectedSchemaName = "transaction_isolation_expected"
+
+// schemaItemsQuery описывает таблицы схемы $1 строками вида "column name type",
+// "constraint name def", "index def". Имена выводятся без схемы, если она
+// входит в search_path, поэтому ожидаемая и текущая структуры сравнимы.
+const schemaItemsQuery = `SELECT c.relname AS relname, 'kind ' || c.relkind AS item
+           FROM pg_class c
+           WHERE c.relnamespace = (SELECT oid FROM pg_namespace WHERE nspname = $1) AND c.relkind IN ('r', 'p', 'm')
+         UNION ALL
+         SELECT c.relname, 'column ' || a.attname || ' ' || format_type(a.atttypid, a.atttypmod)
+             || CASE WHEN a.attnotnull THEN ' not null' ELSE '' END
+             || COALESCE(' default ' || pg_get_expr(d.adbin, d.adrelid), '')
+           FROM pg_class c
+           JOIN pg_attribute a ON a.attrelid = c.oid AND a.attnum > 0 AND NOT a.attisdropped
+           LEFT JOIN pg_attrdef d ON d.adrelid = c.oid AND d.adnum = a.attnum
+           WHERE c.relnamespace = (SELECT oid FROM pg_namespace WHERE nspname = $1) AND c.relkind IN ('r', 'p', 'm')
+         UNION ALL
+         SELECT c.relname, 'constraint ' || con.conname || ' ' || pg_get_constraintdef(con.oid)
+           FROM pg_constraint con
+           JOIN pg_class c ON c.oid = con.conrelid
+           WHERE c.relnamespace = (SELECT oid FROM pg_namespace WHERE nspname = $1) AND c.relkind IN ('r', 'p', 'm')
+         UNION ALL
+         SELECT c.relname, 'index ' || pg_get_indexdef(i.indexrelid)
+           FROM pg_index i
+           JOIN pg_class c ON c.oid = i.indrelid
+           WHERE c.relnamespace = (SELECT oid FROM pg_namespace WHERE nspname = $1) AND c.relkind IN ('r', 'p', 'm');`
+
+type schemaItem struct {
+	Table string `db:"relname"`
+	Item  string `db:"item"`
+}
+
+// checkSchema сравнивает таблицы текущей схемы с таблицами, которые создают
+// миграции. Ожидаемая структура получается выполнением миграций во временной
+// схеме в откатываемой транзакции. Отсутствующие таблицы не считаются
+// расхождением, их создадут миграции. Для существующих столбцы должны совпадать
+// полностью, а ограничения и индексы миграций - присутствовать; лишние
+// ограничения и индексы, которые сценарии добавляют по ходу выполнения, только
+// выводятся в лог. При расхождении таблицы не удаляются.
+func checkSchema(db *sqlx.DB, logger *zap.Logger, migrations []string) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		logger.Error("failed to begin schema check", zap.Error(err))
+		return err
+	}
+	defer ignoreDeferred(logger, "rollback schema check", tx.Rollback)
+
+	var current string
+	if err = tx.Get(&current, "SELECT current_schema();"); err != nil {
+		logger.Error("failed to get current schema", zap.Error(err))
+		return err
+	}
+	if _, err = tx.Exec("CREATE SCHEMA " + expectedSchemaName + ";"); err != nil {
+		logger.Error("failed to create expected schema", zap.Error(err))
+		return err
+	}
+	if _, err = tx.Exec("SET LOCAL search_path = " + expectedSchemaName + ";"); err != nil {
+		logger.Error("failed to set search_path", zap.Error(err))
+		return err
+	}
+	for _, m := range withBalanceType(migrations) {
+		if _, err = tx.Exec(m); err != nil {
+			logger.Error("failed to execute migration in expected schema", zap.Error(err), zap.String("migration", m))
+			return err
+		}
+	}
+	var expected, actual []schemaItem
+	if err = tx.Select(&expected, schemaItemsQuery, expectedSchemaName); err != nil {
+		logger.Error("failed to read expected schema", zap.Error(err))
+		return err
+	}
+	if _, err = tx.Exec("SELECT set_config('search_path', quote_ident($1), true);", current); err != nil {
+		logger.Error("failed to set search_path", zap.Error(err))
+		return err
+	}
+	if err = tx.Select(&actual, schemaItemsQuery, current); err != nil {
+		logger.Error("failed to read current schema", zap.Error(err))
+		return err
+	}
+
+	drift := schemaDrift(groupSchemaItems(expected), groupSchemaItems(actual), logger)
+	if len(drift) > 0 {
+		err = fmt.Errorf("%w in schema %s: %s", errSchemaDrift, current, strings.Join(drift, "; "))
+		logger.Error("schema does not match migrations", zap.Error(err))
+		return err
+	}
+	logger.Info("schema matches migrations", zap.String("schema", current))
+	return nil
+}
+
+func groupSchemaItems(items []schemaItem) map[string]map[string]bool {
+	tables := make(map[string]map[string]bool)
+	for _, it := range items {
+		if tables[it.Table] == nil {
+			tables[it.Table] = make(map[string]bool)
+		}
+		tables[it.Table][it.Item] = true
+	}
+	return tables
+}
+
+// schemaDrift возвращает описания расхождений существующих таблиц с ожидаемыми.
+func schemaDrift(expected, actual map[string]map[string]bool, logger *zap.Logger) []string {
+	var drift []string
+	for table, want := range expected {
+		got, ok := actual[table]
+		if !ok {
+			continue
+		}
+		for item := range want {
+			if !got[item] {
+				drift = append(drift, fmt.Sprintf("%s: missing %s", table, item))
+			}
+		}
+		for item := range got {
+			if want[item] {
+				continue
+			}
+			if strings.HasPrefix(item, "column ") || strings.HasPrefix(item, "kind ") {
+				drift = append(drift, fmt.Sprintf("%s: unexpected %s", table, item))
+				continue
+			}
+			logger.Info("extra schema object", zap.String("table", table), zap.String("item", item))
+		}
+	}
+	sort.Strings(drift)
+	return drift
+}
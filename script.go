@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"go.starlark.net/starlark"
+	"go.uber.org/zap"
+)
+
+// scriptEnv - окружение Starlark, общее для всех шагов одного YAML сценария.
+// Переменные, объявленные в script шагах, доступны в последующих шагах,
+// результат последнего запроса доступен как rows.
+type scriptEnv struct {
+	thread  *starlark.Thread
+	globals starlark.StringDict
+	// bound - значения, сохраненные шагами bind, по имени "tx.name"
+	bound map[string]starlark.Value
+}
+
+func newScriptEnv(logger *zap.Logger) *scriptEnv {
+	thread := &starlark.Thread{
+		Print: func(_ *starlark.Thread, msg string) {
+			logger.Info("script", zap.String("message", msg))
+		},
+	}
+	return &scriptEnv{thread: thread, globals: starlark.StringDict{"rows": starlark.NewList(nil), "affected": starlark.MakeInt(0), "gen": newGenerator(dataSeed).builtin()}, bound: make(map[string]starlark.Value)}
+}
+
+func (e *scriptEnv) exec(name, src string) error {
+	globals, err := starlark.ExecFile(e.thread, name, src, e.globals)
+	if err != nil {
+		return err
+	}
+	for k, v := range globals {
+		e.globals[k] = v
+	}
+	return nil
+}
+
+func (e *scriptEnv) eval(name, expr string) (starlark.Value, error) {
+	return starlark.Eval(e.thread, name, expr, e.globals)
+}
+
+func (e *scriptEnv) truth(name, expr string) (bool, error) {
+	v, err := e.eval(name, expr)
+	if err != nil {
+		return false, err
+	}
+	return bool(v.Truth()), nil
+}
+
+// args вычисляет выражение, возвращающее список параметров запроса.
+func (e *scriptEnv) args(name, expr string) ([]any, error) {
+	v, err := e.eval(name, expr)
+	if err != nil {
+		return nil, err
+	}
+	seq, ok := v.(starlark.Indexable)
+	if !ok {
+		return nil, fmt.Errorf("args must be a list, got %s", v.Type())
+	}
+	args := make([]any, seq.Len())
+	for i := range args {
+		if args[i], err = fromStarlark(seq.Index(i)); err != nil {
+			return nil, err
+		}
+	}
+	return args, nil
+}
+
+func (e *scriptEnv) setAffected(n int64) {
+	e.globals["affected"] = starlark.MakeInt64(n)
+}
+
+func (e *scriptEnv) setRows(rows [][]any) {
+	list := make([]starlark.Value, len(rows))
+	for i, row := range rows {
+		values := make([]starlark.Value, len(row))
+		for j, v := range row {
+			values[j] = toStarlark(v)
+		}
+		list[i] = starlark.NewList(values)
+	}
+	e.globals["rows"] = starlark.NewList(list)
+}
+
+func toStarlark(v any) starlark.Value {
+	switch v := v.(type) {
+	case nil:
+		return starlark.None
+	case bool:
+		return starlark.Bool(v)
+	case int64:
+		return starlark.MakeInt64(v)
+	case int:
+		return starlark.MakeInt(v)
+	case float64:
+		return starlark.Float(v)
+	case string:
+		return starlark.String(v)
+	case time.Time:
+		return starlark.String(v.Format(time.RFC3339Nano))
+	default:
+		return starlark.String(fmt.Sprint(v))
+	}
+}
+
+func fromStarlark(v starlark.Value) (any, error) {
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case starlark.Bool:
+		return bool(v), nil
+	case starlark.Int:
+		i, ok := v.Int64()
+		if !ok {
+			return nil, fmt.Errorf("integer %s out of range", v)
+		}
+		return i, nil
+	case starlark.Float:
+		return float64(v), nil
+	case starlark.String:
+		return string(v), nil
+	default:
+		return nil, fmt.Errorf("unsupported parameter type %s", v.Type())
+	}
+}
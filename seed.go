@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+)
+
+const (
+	seedConstant   = "constant"
+	seedSequential = "sequential"
+	seedRandom     = "random"
+
+	// seedFirstID - id первой сгенерированной строки; меньшие id заняты строками сценариев
+	seedFirstID = 1001
+)
+
+// seedConfig описывает дополнительные строки person для сценариев с флагом seeded.
+// Большая таблица меняет планы запросов (индексный доступ вместо полного
+// сканирования), а вместе с ними и гранулярность предикатных блокировок SSI.
+type seedConfig struct {
+	balance int64
+	rows    int
+	pattern string
+}
+
+var seed = seedConfig{balance: 1000, pattern: seedConstant}
+
+func (c seedConfig) validate() error {
+	if c.rows < 0 {
+		return fmt.Errorf("seed rows must not be negative, got %d", c.rows)
+	}
+	switch c.pattern {
+	case seedConstant, seedSequential, seedRandom:
+		return nil
+	default:
+		return fmt.Errorf("unknown seed pattern %q, expected %s, %s or %s", c.pattern, seedConstant, seedSequential, seedRandom)
+	}
+}
+
+// migrations возвращает вставку сгенерированных строк и сбор статистики для планировщика.
+func (c seedConfig) migrations() []string {
+	if c.rows == 0 {
+		return nil
+	}
+	balance := fmt.Sprintf("%d", c.balance)
+	switch c.pattern {
+	case seedSequential:
+		balance = fmt.Sprintf("%d + g - %d", c.balance, seedFirstID)
+	case seedRandom:
+		// Значения зависят только от -data-seed, повторный запуск получает те же данные
+		balance = sqlUniform("g", 2*c.balance+1)
+		if balanceType == balanceNumeric {
+			// Случайные суммы с копейками
+			balance = fmt.Sprintf("(%s)::NUMERIC / 100", sqlUniform("g", 200*c.balance+1))
+		}
+	}
+	return []string{
+		fmt.Sprintf(`INSERT INTO person (id, balance)
+           SELECT g, %s FROM generate_series(%d, %d) AS g;`, balance, seedFirstID, seedFirstID+c.rows-1),
+		`ANALYZE person;`,
+	}
+}
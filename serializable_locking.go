@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+// serializableLockingVariant - как списание с баланса в SERIALIZABLE берет блокировки.
+type serializableLockingVariant struct {
+	name      string
+	forUpdate bool // SELECT ... FOR UPDATE вместо простого чтения
+	lockFirst bool // LOCK TABLE первым запросом, до получения снимка
+	balance   int64
+}
+
+var serializableLockingVariants = []serializableLockingVariant{
+	// tx2 прерывается поздно: на UPDATE строки, измененной tx1
+	{name: "plain", balance: 700},
+	// tx2 ждет блокировку и прерывается раньше: уже на чтении FOR UPDATE
+	{name: "for_update", forUpdate: true, balance: 700},
+	// LOCK TABLE не требует снимка, поэтому снимок tx2 берется после фиксации tx1
+	// и прерывания нет совсем
+	{name: "lock_table_first", lockFirst: true, balance: 200},
+}
+
+func serializableLocking(db *sqlx.DB, logger *zap.Logger) error {
+	for _, v := range serializableLockingVariants {
+		if err := migrate(db, logger, []string{"UPDATE person SET balance = 1000 WHERE id = 1;"}); err != nil {
+			return err
+		}
+		if err := runSerializableLockingVariant(db, logger.With(zap.String("variant", v.name)), v); err != nil {
+			return fmt.Errorf("%s: %w", v.name, err)
+		}
+	}
+	return nil
+}
+
+func runSerializableLockingVariant(db *sqlx.DB, logger *zap.Logger, v serializableLockingVariant) (err error) {
+	// Проверка баланса после завершения транзакций
+	defer verifyFinalBalance(db, logger, &err, 1, v.balance)
+
+	// Запуск транзакций
+	tx1 := newTransaction(db, logger.With(zap.String("tx", "tx1")))
+	if err := tx1.begin(); err != nil {
+		return err
+	}
+	if err := tx1.setLevel(sql.LevelSerializable); err != nil {
+		return err
+	}
+	tx2 := newTransaction(db, logger.With(zap.String("tx", "tx2")))
+	if err := tx2.begin(); err != nil {
+		return err
+	}
+	if err := tx2.setLevel(sql.LevelSerializable); err != nil {
+		return err
+	}
+
+	// Чтение баланса в tx1
+	userID := 1
+	var balance1 int64
+	balance1, err = lockingRead(tx1, v, userID)
+	if err != nil {
+		return err
+	}
+
+	// tx2 начинает то же списание; при блокировках ждет tx1
+	var balance2 int64
+	pid, err := tx2.backendPID()
+	if err != nil {
+		return err
+	}
+	tx2Read := runAsync(func() error {
+		var err error
+		balance2, err = lockingRead(tx2, v, userID)
+		return err
+	})
+	blocking := v.forUpdate || v.lockFirst
+	if blocking {
+		if err = waitBlocked(tx2, pid, tx2Read); err != nil {
+			return err
+		}
+	} else if err = <-tx2Read; err != nil {
+		return err
+	}
+
+	// Списание в tx1
+	if err = tx1.updateUser(userID, int(balance1)-300); err != nil {
+		return err
+	}
+	if err = tx1.commit(); err != nil {
+		return err
+	}
+
+	// Списание в tx2
+	if blocking {
+		err = <-tx2Read
+	}
+	if err == nil {
+		err = tx2.updateUser(userID, int(balance2)-500)
+	}
+	if err == nil {
+		err = tx2.commit()
+	}
+	if errorCode(err) == "40001" {
+		tx2.logger.Info("tx aborted", zap.String("code", errorCode(err)))
+		return tx2.rollback()
+	}
+	return err
+}
+
+// lockingRead читает баланс, предварительно беря блокировки варианта.
+func lockingRead(t *transaction, v serializableLockingVariant, id int) (int64, error) {
+	if v.lockFirst {
+		if _, err := t.exec("LOCK TABLE person IN SHARE ROW EXCLUSIVE MODE;"); err != nil {
+			return 0, err
+		}
+	}
+	readQuery := "SELECT balance FROM person WHERE id = $1;"
+	if v.forUpdate {
+		readQuery = "SELECT balance FROM person WHERE id = $1 FOR UPDATE;"
+	}
+	return t.queryBalance(readQuery, id)
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// shrinkProblem ищет минимальный порядок шагов, сохраняющий аномалию случайного
+// запуска с порядком order, и сохраняет его сценарием в dir. reset возвращает
+// данные сценария в исходное состояние перед каждой проверкой.
+type shrinkProblem func(db *sqlx.DB, logger *zap.Logger, level sql.IsolationLevel, order []int, reset func() error, dir string) (string, error)
+
+// errNotReproducible - порядок шагов не воспроизводит аномалию при пошаговом выполнении.
+var errNotReproducible = errors.New("anomaly is not reproducible step by step")
+
+// errInvalidOrder - порядок нарушает структуру транзакции, например шаг до begin.
+var errInvalidOrder = errors.New("invalid step order")
+
+// shrinkLockTimeout ограничивает ожидание блокировки при пошаговом выполнении:
+// шаг, ждущий транзакцию, которая не может продолжиться раньше него, иначе
+// ждал бы вечно.
+const shrinkLockTimeout = 2 * time.Second
+
+// replayResult - итог шага, выполняемого в фоне.
+type replayResult struct {
+	step      int
+	committed bool
+	err       error
+}
+
+// replayOrder выполняет шаги order по одному. Шаг, упершийся в блокировку,
+// продолжает выполняться в фоне, а следующий шаг его транзакции ждет его
+// завершения. Возвращает, проявилась ли аномалия, порядок завершения шагов, в
+// котором ждавший шаг стоит после освободившего блокировку, и ждал ли
+// какой-нибудь шаг.
+func (y *yamlScenario) replayOrder(db *sqlx.DB, logger *zap.Logger, level sql.IsolationLevel, order []int) (anomaly bool, completed []int, blocked bool, err error) {
+	owners := y.stepOwners()
+	txs := make(map[string]*transaction)
+	envs := make(map[string]*scriptEnv)
+	committed := make(map[string]bool)
+	aborted := make(map[string]bool)
+	pending := make(map[string]<-chan replayResult)
+	defer func() {
+		for _, done := range pending {
+			<-done
+		}
+		for _, t := range txs {
+			if t.tx != nil {
+				ignoreError(t.logger, "rollback", t.tx.Rollback())
+			}
+		}
+	}()
+
+	settle := func(name string, r replayResult) error {
+		delete(pending, name)
+		completed = append(completed, r.step)
+		if r.err != nil {
+			if errorCode(r.err) == "" {
+				return r.err
+			}
+			aborted[name] = true
+			ignoreError(txs[name].logger, "rollback", txs[name].tx.Rollback())
+			return nil
+		}
+		committed[name] = committed[name] || r.committed
+		return nil
+	}
+	// poll забирает шаги, завершившиеся в фоне, в порядке имен транзакций
+	poll := func() error {
+		names := make([]string, 0, len(pending))
+		for name := range pending {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			select {
+			case r := <-pending[name]:
+				if err := settle(name, r); err != nil {
+					return err
+				}
+			default:
+			}
+		}
+		return nil
+	}
+
+	for _, i := range order {
+		name, step := owners[i], y.Steps[i]
+		if name == "" {
+			continue
+		}
+		if done := pending[name]; done != nil {
+			if err = settle(name, <-done); err != nil {
+				return false, nil, blocked, err
+			}
+		}
+		if aborted[name] {
+			continue
+		}
+		t := txs[name]
+		if t == nil {
+			t = newTransaction(db, logger.With(zap.String("tx", name)))
+			txs[name], envs[name] = t, newScriptEnv(logger)
+		}
+		if step.Script == "" && (step.Action == actionBegin) == t.open {
+			return false, nil, blocked, fmt.Errorf("%w: step %d", errInvalidOrder, i+1)
+		}
+
+		done := make(chan replayResult, 1)
+		go func(i int) {
+			ok, err := y.runLooseStep(t, envs[name], name, i, level)
+			if err == nil && y.Steps[i].Action == actionBegin {
+				err = t.setLocal("lock_timeout", shrinkLockTimeout.String())
+			}
+			done <- replayResult{step: i, committed: ok, err: err}
+		}(i)
+		select {
+		case r := <-done:
+			if err = settle(name, r); err != nil {
+				return false, nil, blocked, err
+			}
+		case <-time.After(blockedWait):
+			pending[name] = done
+			blocked = true
+		}
+		if err = poll(); err != nil {
+			return false, nil, blocked, err
+		}
+	}
+	names := make([]string, 0, len(pending))
+	for name := range pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err = settle(name, <-pending[name]); err != nil {
+			return false, nil, blocked, err
+		}
+	}
+	anomaly, err = y.anomalyHolds(db, logger, committed)
+	return anomaly, completed, blocked, err
+}
+
+// shrinkOrder удаляет из order шаги, пока аномалия сохраняется, затем меняет
+// местами соседние шаги разных транзакций, если это уменьшает число
+// переключений между транзакциями. Порядок шагов внутри транзакции не меняется.
+func (y *yamlScenario) shrinkOrder(order []int, holds func(order []int) (bool, error)) ([]int, error) {
+	for changed := true; changed; {
+		changed = false
+		for i := range order {
+			candidate := append(append([]int(nil), order[:i]...), order[i+1:]...)
+			ok, err := holds(candidate)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				order, changed = candidate, true
+				break
+			}
+		}
+	}
+
+	owners := y.stepOwners()
+	switches := func(order []int) int {
+		n := 0
+		for i := 1; i < len(order); i++ {
+			if owners[order[i]] != owners[order[i-1]] {
+				n++
+			}
+		}
+		return n
+	}
+	for changed := true; changed; {
+		changed = false
+		for i := 0; i+1 < len(order); i++ {
+			if owners[order[i]] == owners[order[i+1]] {
+				continue
+			}
+			candidate := append([]int(nil), order...)
+			candidate[i], candidate[i+1] = candidate[i+1], candidate[i]
+			if switches(candidate) >= switches(order) {
+				continue
+			}
+			ok, err := holds(candidate)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				order, changed = candidate, true
+				break
+			}
+		}
+	}
+	return order, nil
+}
+
+// shrink реализует shrinkProblem для YAML сценария. Сохраненный сценарий
+// выполняет шаги в порядке их завершения, поэтому ни один шаг в нем не ждет
+// блокировку, и его можно запустить обычным последовательным прогоном.
+func (y *yamlScenario) shrink(db *sqlx.DB, logger *zap.Logger, level sql.IsolationLevel, order []int, reset func() error, dir string) (string, error) {
+	quiet := withStatementTags(zap.NewNop()).With(zap.String("problem", y.Name))
+	replays := 0
+	replay := func(order []int) (bool, []int, bool, error) {
+		replays++
+		if err := reset(); err != nil {
+			return false, nil, false, err
+		}
+		anomaly, completed, blocked, err := y.replayOrder(db, quiet, level, order)
+		if errors.Is(err, errInvalidOrder) {
+			return false, nil, false, nil
+		}
+		return anomaly, completed, blocked, err
+	}
+	holds := func(order []int) (bool, error) {
+		anomaly, _, _, err := replay(order)
+		return anomaly, err
+	}
+
+	ok, err := holds(order)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("%w: order %v", errNotReproducible, stepNumbers(order))
+	}
+	minimal, err := y.shrinkOrder(order, holds)
+	if err != nil {
+		return "", err
+	}
+	_, completed, _, err := replay(minimal)
+	if err != nil {
+		return "", err
+	}
+	anomaly, _, blocked, err := replay(completed)
+	if err != nil {
+		return "", err
+	}
+	if !anomaly || blocked {
+		return "", fmt.Errorf("%w: minimal order %v needs concurrent steps", errNotReproducible, stepNumbers(minimal))
+	}
+	logger.Info("interleaving shrunk", zap.Ints("original", stepNumbers(order)), zap.Ints("minimal", stepNumbers(completed)),
+		zap.Int("replays", replays))
+
+	file := filepath.Join(dir, fmt.Sprintf("%s_%s_minimal.yaml", y.Name, strings.ReplaceAll(strings.ToLower(level.String()), " ", "_")))
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	if err = os.WriteFile(file, y.shrunkYAML(level, completed, order), 0o644); err != nil {
+		logger.Error("failed to save shrunk scenario", zap.Error(err), zap.String("file", file))
+		return "", err
+	}
+	return file, nil
+}
+
+// stepNumbers переводит индексы шагов в номера, как в логах и ошибках сценария.
+func stepNumbers(order []int) []int {
+	numbers := make([]int, len(order))
+	for i, step := range order {
+		numbers[i] = step + 1
+	}
+	return numbers
+}
+
+// shrunkStep - шаг сохраненного сценария без проверок, пауз и повторов,
+// которые случайный запуск не выполняет.
+type shrunkStep struct {
+	Tx      string   `yaml:"tx"`
+	Action  string   `yaml:"action,omitempty"`
+	Exec    string   `yaml:"exec,omitempty"`
+	Query   string   `yaml:"query,omitempty"`
+	Execute string   `yaml:"execute,omitempty"`
+	Script  string   `yaml:"script,omitempty"`
+	Params  []any    `yaml:"params,omitempty"`
+	Args    string   `yaml:"args,omitempty"`
+	When    string   `yaml:"when,omitempty"`
+	Bind    []string `yaml:"bind,omitempty"`
+}
+
+// shrunkYAML возвращает сценарий с шагами order на уровне level.
+func (y *yamlScenario) shrunkYAML(level sql.IsolationLevel, order, original []int) []byte {
+	type shrunkTx struct {
+		Name     string     `yaml:"name"`
+		Settings gucProfile `yaml:"settings,omitempty"`
+	}
+	out := struct {
+		Name         string       `yaml:"name"`
+		Description  string       `yaml:"description"`
+		Level        string       `yaml:"level"`
+		Namespace    string       `yaml:"namespace,omitempty"`
+		Seeded       bool         `yaml:"seeded,omitempty"`
+		Setup        []string     `yaml:"setup,omitempty"`
+		Transactions []shrunkTx   `yaml:"transactions"`
+		Steps        []shrunkStep `yaml:"steps"`
+		Anomaly      *yamlAnomaly `yaml:"anomaly"`
+	}{
+		Name: fmt.Sprintf("%s_%s_minimal", y.Name, strings.ReplaceAll(strings.ToLower(level.String()), " ", "_")),
+		Description: fmt.Sprintf("Minimal interleaving of %s at %s that still shows the anomaly; steps %v of the original scenario, shrunk from %v",
+			y.Name, strings.ToLower(level.String()), stepNumbers(order), stepNumbers(original)),
+		Level:     strings.ToLower(level.String()),
+		Namespace: y.Namespace,
+		Seeded:    y.Seeded,
+		Setup:     y.Setup,
+		Anomaly:   y.Anomaly,
+	}
+	// Все транзакции остаются объявленными: условие anomaly может ссылаться на любую
+	for _, tx := range y.Transactions {
+		out.Transactions = append(out.Transactions, shrunkTx{Name: tx.Name, Settings: tx.Settings})
+	}
+	owners := y.stepOwners()
+	for _, i := range order {
+		step := y.Steps[i]
+		out.Steps = append(out.Steps, shrunkStep{Tx: owners[i], Action: step.Action, Exec: step.Exec, Query: step.Query,
+			Execute: step.Execute, Script: step.Script, Params: step.Params, Args: step.Args, When: step.When, Bind: step.Bind})
+	}
+	data, _ := yaml.Marshal(out)
+	return data
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+// snapshotTooOldMaxThreshold - больший порог делает демонстрацию слишком долгой.
+const snapshotTooOldMaxThreshold = 2 * time.Minute
+
+// snapshotTooOld демонстрирует ошибку "snapshot too old" долгой транзакции
+// REPEATABLE READ, пока другая сессия обновляет и очищает таблицу.
+// Требует old_snapshot_threshold >= 0 (параметр удален в Postgres 17).
+func snapshotTooOld(db *sqlx.DB, logger *zap.Logger) error {
+	threshold, err := oldSnapshotThreshold(db, logger)
+	if err != nil {
+		return err
+	}
+
+	// Долгая транзакция получает снимок
+	tx1 := newTransaction(db, logger.With(zap.String("tx", "tx1")))
+	if err = tx1.begin(); err != nil {
+		return err
+	}
+	defer ignoreDeferred(logger, "rollback", tx1.rollback)
+	if err = tx1.setLevel(sql.LevelRepeatableRead); err != nil {
+		return err
+	}
+	if err = tx1.printUserBalance(1); err != nil {
+		return err
+	}
+
+	// Другая сессия обновляет строки и очищает старые версии
+	churnLogger := logger.With(zap.String("tx", "churn"))
+	wait := threshold + 10*time.Second
+	churnLogger.Info("churning table", zap.Duration("wait", wait))
+	for deadline := time.Now().Add(wait); time.Now().Before(deadline); {
+		if _, err = db.Exec("UPDATE person SET balance = balance + 1;"); err != nil {
+			churnLogger.Error("failed to update balance", zap.Error(err))
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if _, err = db.Exec("VACUUM person;"); err != nil {
+		churnLogger.Error("failed to vacuum", zap.Error(err))
+		return err
+	}
+	churnLogger.Info("table vacuumed")
+
+	// Повторное чтение в долгой транзакции
+	err = tx1.printUserBalance(1)
+	if err == nil {
+		tx1.logger.Info("snapshot still valid, old versions were not removed yet")
+		return nil
+	}
+	class := classifyError(err)
+	if class.Name != "snapshot_too_old" {
+		return err
+	}
+	tx1.logger.Info("snapshot too old", zap.String("code", class.Code), zap.String("explanation", class.Explanation))
+	return nil
+}
+
+func oldSnapshotThreshold(db *sqlx.DB, logger *zap.Logger) (time.Duration, error) {
+	var value string
+	if err := db.Get(&value, "SELECT setting FROM pg_settings WHERE name = 'old_snapshot_threshold';"); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, fmt.Errorf("%w: old_snapshot_threshold is not supported by this server", errScenarioSkipped)
+		}
+		logger.Error("failed to get old_snapshot_threshold", zap.Error(err))
+		return 0, err
+	}
+	var minutes int
+	if _, err := fmt.Sscan(value, &minutes); err != nil {
+		return 0, err
+	}
+	if minutes < 0 {
+		return 0, fmt.Errorf("%w: old_snapshot_threshold is disabled, set it to 0 or 1min and restart the server", errScenarioSkipped)
+	}
+	threshold := time.Duration(minutes) * time.Minute
+	if threshold > snapshotTooOldMaxThreshold {
+		return 0, fmt.Errorf("%w: old_snapshot_threshold %s is too long for the demo", errScenarioSkipped, threshold)
+	}
+	logger.Info("old_snapshot_threshold", zap.Duration("threshold", threshold))
+	return threshold, nil
+}
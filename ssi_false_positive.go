@@ -0,0 +1,166 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+const ssiAccounts = 10000
+
+var ssiMigrations = []string{
+	`DROP TABLE IF EXISTS account;`,
+	`CREATE TABLE account (
+           id INT NOT NULL,
+           owner TEXT NOT NULL,
+           balance BIGINT NOT NULL
+         );`,
+	fmt.Sprintf(`INSERT INTO account SELECT g, 'user' || g, 1000 FROM generate_series(1, %d) AS g;`, ssiAccounts),
+}
+
+// ssiVariant - есть ли индекс, по которому транзакции находят свои строки.
+type ssiVariant struct {
+	name  string
+	index bool
+	// settings - параметры планировщика, которые транзакции задают через SET LOCAL
+	settings map[string]string
+	// committed - сколько транзакций успешно фиксируется
+	committed int
+}
+
+var ssiVariants = []ssiVariant{
+	// Последовательное сканирование берет SIRead блокировку всей таблицы,
+	// поэтому запись каждой транзакции конфликтует с чтением другой
+	{name: "seq_scan", committed: 1},
+	// Индексный доступ блокирует только прочитанные строки и страницы индекса
+	// enable_seqscan = off исключает выбор последовательного сканирования по статистике
+	{name: "index_scan", index: true, settings: map[string]string{"enable_seqscan": "off"}, committed: 2},
+}
+
+// ssiFalsePositive показывает ложные срабатывания SSI: две транзакции
+// SERIALIZABLE меняют баланс разных владельцев и логически не конфликтуют,
+// но без индекса одна из них прерывается с ошибкой сериализации.
+func ssiFalsePositive(db *sqlx.DB, logger *zap.Logger) error {
+	for _, v := range ssiVariants {
+		if err := runSSIVariant(db, logger.With(zap.String("variant", v.name)), v); err != nil {
+			return fmt.Errorf("%s: %w", v.name, err)
+		}
+	}
+	return nil
+}
+
+func runSSIVariant(db *sqlx.DB, logger *zap.Logger, v ssiVariant) (err error) {
+	prepare := []string{
+		`UPDATE account SET balance = 1000 WHERE balance <> 1000;`,
+		`DROP INDEX IF EXISTS account_owner;`,
+	}
+	if v.index {
+		prepare = append(prepare, `CREATE INDEX account_owner ON account (owner);`)
+	}
+	prepare = append(prepare, `ANALYZE account;`)
+	if err = migrate(db, logger, prepare); err != nil {
+		return err
+	}
+
+	// Проверка суммы балансов после завершения транзакций
+	defer checkPostconditions(db, logger, &err,
+		expectValue("total balance", "SELECT SUM(balance) FROM account;", ssiAccounts*1000-100*v.committed))
+
+	// Запуск транзакций
+	tx1 := newTransaction(db, logger.With(zap.String("tx", "tx1")))
+	if err = tx1.begin(); err != nil {
+		return err
+	}
+	if err = tx1.setLevel(sql.LevelSerializable); err != nil {
+		return err
+	}
+	tx2 := newTransaction(db, logger.With(zap.String("tx", "tx2")))
+	if err = tx2.begin(); err != nil {
+		return err
+	}
+	if err = tx2.setLevel(sql.LevelSerializable); err != nil {
+		return err
+	}
+	for name, value := range v.settings {
+		for _, t := range []*transaction{tx1, tx2} {
+			if err = t.setLocal(name, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Каждая транзакция читает и меняет только баланс своего владельца
+	for _, step := range []struct {
+		t     *transaction
+		owner string
+	}{{tx1, "user1"}, {tx2, "user2"}} {
+		rows, err := step.t.query("SELECT balance FROM account WHERE owner = $1;", step.owner)
+		if err != nil {
+			return err
+		}
+		step.t.logger.Info("balance read", zap.String("owner", step.owner), zap.Any("balance", rows[0][0]))
+	}
+	if err = printPredicateLocks(tx1); err != nil {
+		return err
+	}
+	aborted := make(map[*transaction]bool)
+	for _, step := range []struct {
+		t     *transaction
+		owner string
+	}{{tx1, "user1"}, {tx2, "user2"}} {
+		if _, err = step.t.exec("UPDATE account SET balance = balance - 100 WHERE owner = $1;", step.owner); err != nil {
+			step.t.logger.Info("update rejected", zap.String("code", errorCode(err)))
+			if err = step.t.rollback(); err != nil {
+				return err
+			}
+			aborted[step.t] = true
+		}
+	}
+
+	// Фиксация; при конфликте прерывается транзакция, фиксирующаяся второй
+	for _, t := range []*transaction{tx1, tx2} {
+		if aborted[t] {
+			continue
+		}
+		if err = t.commit(); err != nil {
+			if errorCode(err) != "40001" {
+				return err
+			}
+			t.logger.Info("commit rejected", zap.String("code", errorCode(err)))
+		}
+	}
+	return nil
+}
+
+// printPredicateLocks выводит SIRead блокировки транзакции: relation означает
+// блокировку всей таблицы, page и tuple - страницы и строки. Блокировки читает
+// монитор, чтобы запрос к pg_locks не выполнялся внутри проверяемой транзакции.
+func printPredicateLocks(t *transaction) error {
+	if !monitorAccess.locks {
+		return nil
+	}
+	pid, err := t.backendPID()
+	if err != nil {
+		return err
+	}
+	var locks []struct {
+		LockType string  `db:"locktype"`
+		Relation *string `db:"relation"`
+		Page     *int64  `db:"page"`
+		Tuple    *int64  `db:"tuple"`
+	}
+	const locksQuery = `SELECT locktype, relation::regclass::text AS relation, page, tuple
+         FROM pg_locks
+         WHERE mode = 'SIReadLock' AND pid = $1
+         ORDER BY 1, 2, 3, 4;`
+	if err = monitorDB(t.db).Select(&locks, locksQuery, pid); err != nil {
+		t.logger.Error("failed to read predicate locks", zap.Error(err))
+		return err
+	}
+	for _, l := range locks {
+		t.logger.Info("predicate lock", zap.String("locktype", l.LockType), zap.Stringp("relation", l.Relation), zap.Int64p("page", l.Page), zap.Int64p("tuple", l.Tuple))
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+// statStatementsLimit - сколько самых долгих запросов попадает в отчет.
+const statStatementsLimit = 10
+
+// statementStat - нормализованная статистика запроса из pg_stat_statements.
+type statementStat struct {
+	Query   string  `db:"query" json:"query"`
+	Calls   int64   `db:"calls" json:"calls"`
+	TotalMs float64 `db:"total_ms" json:"total_ms"`
+	Rows    int64   `db:"rows" json:"rows"`
+}
+
+// statStatements сбрасывает и читает pg_stat_statements вокруг запуска сценария.
+type statStatements struct {
+	db *sqlx.DB
+	// timeColumn - total_exec_time начиная с Postgres 13, total_time в старых версиях
+	timeColumn string
+	logger     *zap.Logger
+}
+
+// openStatStatements возвращает nil без ошибки, если расширение не установлено.
+func openStatStatements(db *sqlx.DB, logger *zap.Logger) (*statStatements, error) {
+	var installed bool
+	if err := db.Get(&installed, "SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'pg_stat_statements');"); err != nil {
+		logger.Error("failed to check pg_stat_statements", zap.Error(err))
+		return nil, err
+	}
+	if !installed {
+		logger.Warn("pg_stat_statements is not installed, run CREATE EXTENSION pg_stat_statements")
+		return nil, nil
+	}
+	var version int
+	if err := db.Get(&version, "SHOW server_version_num;"); err != nil {
+		logger.Error("failed to get server version", zap.Error(err))
+		return nil, err
+	}
+	s := &statStatements{db: db, timeColumn: "total_exec_time", logger: logger}
+	if version < 130000 {
+		s.timeColumn = "total_time"
+	}
+	logger.Info("pg_stat_statements enabled")
+	return s, nil
+}
+
+func (s *statStatements) reset() error {
+	if _, err := s.db.Exec("SELECT pg_stat_statements_reset();"); err != nil {
+		s.logger.Error("failed to reset pg_stat_statements", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// snapshot возвращает самые долгие запросы текущей базы с момента reset.
+func (s *statStatements) snapshot() ([]statementStat, error) {
+	query := fmt.Sprintf(`SELECT query, calls, %[1]s AS total_ms, rows
+         FROM pg_stat_statements
+         WHERE dbid = (SELECT oid FROM pg_database WHERE datname = current_database())
+           AND query NOT LIKE '%%pg_stat_statements%%'
+         ORDER BY %[1]s DESC
+         LIMIT %[2]d;`, s.timeColumn, statStatementsLimit)
+	var stats []statementStat
+	if err := s.db.Select(&stats, query); err != nil {
+		s.logger.Error("failed to read pg_stat_statements", zap.Error(err))
+		return nil, err
+	}
+	return stats, nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// captureStepStates включает снимки состояния после каждого оператора
+// сценария (-step-states); снимки сохраняются в архив -archive.
+var captureStepStates bool
+
+// archivedStepsFile - снимки шагов в каталоге сценария архива.
+const archivedStepsFile = "steps.json"
+
+// stepTable - зафиксированное содержимое таблицы сценария, каким его видит монитор.
+type stepTable struct {
+	Columns []string `json:"columns"`
+	Rows    [][]any  `json:"rows"`
+}
+
+// stepTransaction - открытая транзакция сессии сценария.
+type stepTransaction struct {
+	PID int `db:"pid" json:"pid"`
+	// Tx - имя транзакции сценария из application_name
+	Tx        string     `db:"application_name" json:"tx"`
+	State     *string    `db:"state" json:"state"`
+	XactStart *time.Time `db:"xact_start" json:"xact_start"`
+	XID       *string    `db:"backend_xid" json:"backend_xid"`
+	Xmin      *string    `db:"backend_xmin" json:"backend_xmin"`
+	Query     *string    `db:"query" json:"query"`
+}
+
+// stepLock - блокировка сессии сценария.
+type stepLock struct {
+	PID      int     `db:"pid" json:"pid"`
+	LockType string  `db:"locktype" json:"locktype"`
+	Relation *string `db:"relation" json:"relation"`
+	Mode     string  `db:"mode" json:"mode"`
+	Granted  bool    `db:"granted" json:"granted"`
+}
+
+// stepState - снимок после оператора Index сценария: содержимое таблиц,
+// блокировки и открытые транзакции. Веб-интерфейс view показывает по
+// снимкам состояние на любом шаге временной шкалы.
+type stepState struct {
+	Index int       `json:"index"`
+	Tx    string    `json:"tx"`
+	Query string    `json:"query"`
+	Code  string    `json:"code,omitempty"`
+	At    time.Time `json:"at"`
+
+	Tables       map[string]stepTable `json:"tables,omitempty"`
+	Locks        []stepLock           `json:"locks,omitempty"`
+	Transactions []stepTransaction    `json:"transactions,omitempty"`
+}
+
+// summary возвращает шаг без снимка для списка шагов.
+func (s stepState) summary() stepState {
+	return stepState{Index: s.Index, Tx: s.Tx, Query: s.Query, Code: s.Code, At: s.At}
+}
+
+// stepStates собирает снимки шагов одного запуска сценария. Снимки делает
+// монитор, поэтому таблицы показаны в зафиксированном состоянии, а снимки
+// параллельных транзакций идут в порядке завершения их операторов.
+type stepStates struct {
+	mu sync.Mutex
+	// monitor - nil, пока runner не включил сбор для сценария
+	monitor         *sqlx.DB
+	applicationName string
+	tables          []string
+	steps           []stepState
+}
+
+// start включает сбор снимков таблиц tables и сессий с application_name.
+func (s *stepStates) start(monitor *sqlx.DB, applicationName string, tables []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.monitor = monitor
+	s.applicationName = applicationName
+	s.tables = tables
+}
+
+// stepStatesOf возвращает сборщик снимков сценария логгера или nil.
+func stepStatesOf(logger *zap.Logger) *stepStates {
+	c, ok := logger.Core().(*tagCore)
+	if !ok {
+		return nil
+	}
+	return c.tag.states
+}
+
+const stepTransactionsQuery = `SELECT pid, application_name, state, xact_start, backend_xid::TEXT AS backend_xid,
+           backend_xmin::TEXT AS backend_xmin, query
+         FROM pg_stat_activity
+         WHERE datname = current_database() AND xact_start IS NOT NULL
+           AND left(application_name, length($1) + 1) = $1 || ':'
+         ORDER BY application_name;`
+
+const stepLocksQuery = `SELECT l.pid, l.locktype, l.relation::regclass::text AS relation, l.mode, l.granted
+         FROM pg_locks l
+         JOIN pg_stat_activity a ON a.pid = l.pid
+         WHERE a.datname = current_database() AND l.locktype <> 'virtualxid'
+           AND left(a.application_name, length($1) + 1) = $1 || ':'
+         ORDER BY l.pid, l.granted DESC, l.locktype;`
+
+// capture делает снимок после оператора query транзакции tx.
+func (s *stepStates) capture(tx, query string, err error, logger *zap.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.monitor == nil {
+		return
+	}
+	state := stepState{Index: len(s.steps), Tx: tx, Query: query, Code: errorCode(err), At: time.Now()}
+	state.Tables = make(map[string]stepTable, len(s.tables))
+	for _, table := range s.tables {
+		t, terr := readStepTable(s.monitor, table)
+		if terr != nil {
+			logger.Error("failed to capture table", zap.Error(terr), zap.String("table", table))
+			continue
+		}
+		state.Tables[table] = t
+	}
+	if terr := s.monitor.Select(&state.Transactions, stepTransactionsQuery, s.applicationName); terr != nil {
+		logger.Error("failed to capture transactions", zap.Error(terr))
+	}
+	for i, t := range state.Transactions {
+		state.Transactions[i].Tx = t.Tx[strings.LastIndex(t.Tx, ":")+1:]
+	}
+	if monitorAccess.locks {
+		if lerr := s.monitor.Select(&state.Locks, stepLocksQuery, s.applicationName); lerr != nil {
+			logger.Error("failed to capture locks", zap.Error(lerr))
+		}
+	}
+	s.steps = append(s.steps, state)
+}
+
+// readStepTable читает таблицу целиком, строки упорядочены по первому столбцу.
+func readStepTable(monitor *sqlx.DB, table string) (stepTable, error) {
+	rows, err := monitor.Queryx("SELECT * FROM " + pq.QuoteIdentifier(table) + " ORDER BY 1;")
+	if err != nil {
+		return stepTable{}, err
+	}
+	defer rows.Close()
+	var t stepTable
+	if t.Columns, err = rows.Columns(); err != nil {
+		return stepTable{}, err
+	}
+	for rows.Next() {
+		values, err := rows.SliceScan()
+		if err != nil {
+			return stepTable{}, err
+		}
+		for i, v := range values {
+			if b, ok := v.([]byte); ok {
+				values[i] = string(b)
+			}
+		}
+		t.Rows = append(t.Rows, values)
+	}
+	return t, rows.Err()
+}
+
+// captureStep делает снимок состояния после оператора транзакции, если сбор включен.
+func (t *transaction) captureStep(query string, err error) {
+	if t.tag == nil || t.tag.states == nil {
+		return
+	}
+	t.tag.states.capture(t.tag.tx, query, err, t.logger)
+}
+
+// write сохраняет снимки в dir/<сценарий>/steps.json.
+func (s *stepStates) write(dir, name string, logger *zap.Logger) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.monitor == nil {
+		return nil
+	}
+	target := filepath.Join(dir, strings.ReplaceAll(name, "/", "_"))
+	if err := os.MkdirAll(target, 0o755); err != nil {
+		logger.Error("failed to create archive dir", zap.Error(err), zap.String("dir", target))
+		return err
+	}
+	data, err := json.Marshal(s.steps)
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(filepath.Join(target, archivedStepsFile), data, 0o644); err != nil {
+		logger.Error("failed to archive step states", zap.Error(err), zap.String("dir", target))
+		return err
+	}
+	logger.Info("step states archived", zap.String("dir", target), zap.Int("steps", len(s.steps)))
+	return nil
+}
+
+// scenarioTables возвращает таблицы, которые создают миграции, по алфавиту.
+func scenarioTables(migrations []string) []string {
+	var tables []string
+	for table := range demoTables(migrations) {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+// readStepStates читает снимки шагов сценария из каталога архива scenarioDir.
+func readStepStates(scenarioDir string) ([]stepState, error) {
+	data, err := os.ReadFile(filepath.Join(scenarioDir, archivedStepsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%s: no step states, run the scenario with -archive and -step-states", scenarioDir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var steps []stepState
+	if err = json.Unmarshal(data, &steps); err != nil {
+		return nil, fmt.Errorf("%s: %w", scenarioDir, err)
+	}
+	return steps, nil
+}
+
+// stepAt возвращает снимок шага index.
+func stepAt(steps []stepState, index int) (stepState, error) {
+	if index < 0 || index >= len(steps) {
+		return stepState{}, fmt.Errorf("step %d out of range, scenario has %d steps", index, len(steps))
+	}
+	return steps[index], nil
+}
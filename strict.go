@@ -0,0 +1,90 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+// strictMode (-strict) делает ошибкой запуска каждую ошибку, которую код
+// сознательно не обрабатывает: откат на пути ошибки и в defer, закрытие
+// сеанса и пулов, сброс состояния подключения, снимок блокировок для
+// диагностики, закрытие записанных файлов, потока событий и истории,
+// logger.Sync. Без -strict такие ошибки по-прежнему теряются.
+var strictMode bool
+
+// ignoredErrors - ошибки, проглоченные с -strict, по сценариям; "" - вне сценариев.
+var ignoredErrors = struct {
+	mu         sync.Mutex
+	byScenario map[string][]error
+}{byScenario: make(map[string][]error)}
+
+// ignoreError отмечает ошибку err операции what, которую вызывающий код не
+// обрабатывает. С -strict ошибка пишется в журнал со всеми полями логгера
+// и запоминается для сценария логгера: runner завершает сценарий ею. Откат
+// уже завершенной транзакции (sql.ErrTxDone) ошибкой не считается: defer
+// откатывает транзакцию на любом пути, в том числе после фиксации.
+func ignoreError(logger *zap.Logger, what string, err error) {
+	if err == nil || !strictMode || errors.Is(err, sql.ErrTxDone) {
+		return
+	}
+	var scenario string
+	if c, ok := logger.Core().(*tagCore); ok {
+		scenario = c.tag.scenario
+		if c.tag.tx != "" {
+			what = c.tag.tx + ": " + what
+		}
+	}
+	err = fmt.Errorf("strict: %s: %w", what, err)
+	logger.Error("ignored error", zap.Error(err))
+	ignoredErrors.mu.Lock()
+	defer ignoredErrors.mu.Unlock()
+	ignoredErrors.byScenario[scenario] = append(ignoredErrors.byScenario[scenario], err)
+}
+
+// ignoreDeferred - ignoreError для отложенного вызова:
+//
+//	defer ignoreDeferred(logger, "close session", tx1.closeSession)
+func ignoreDeferred(logger *zap.Logger, what string, f func() error) {
+	ignoreError(logger, what, f())
+}
+
+// strictErrors возвращает и забывает проглоченные ошибки сценария scenario.
+func strictErrors(scenario string) error {
+	ignoredErrors.mu.Lock()
+	defer ignoredErrors.mu.Unlock()
+	errs := ignoredErrors.byScenario[scenario]
+	delete(ignoredErrors.byScenario, scenario)
+	return errors.Join(errs...)
+}
+
+// syncLogger сбрасывает буферы логгера. stderr, подключенный к терминалу или
+// каналу, не поддерживает fsync, и zap возвращает EINVAL или ENOTTY на каждом
+// запуске; такая ошибка не означает потерю записей журнала.
+func syncLogger(logger *zap.Logger) error {
+	err := logger.Sync()
+	if errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOTTY) {
+		return nil
+	}
+	return err
+}
+
+// closeWritten закрывает записанный файл в defer функции с именованной
+// ошибкой err: на успешном пути ошибка закрытия - ошибка функции, потому
+// что данные могли не дойти до диска, а на пути ошибки она отмечается
+// ignoreError.
+//
+//	defer closeWritten(logger, f, &err)
+func closeWritten(logger *zap.Logger, f *os.File, err *error) {
+	cerr := f.Close()
+	if *err == nil {
+		*err = cerr
+		return
+	}
+	ignoreError(logger, "close "+f.Name(), cerr)
+}
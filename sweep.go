@@ -0,0 +1,165 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+const (
+	sweepStartTimeout = 60 * time.Second
+	sweepPollInterval = time.Second
+)
+
+// sweepTarget - контейнер Postgres одной версии.
+type sweepTarget struct {
+	version   string
+	container string
+	port      int
+}
+
+// sweepCommand реализует подкоманду sweep: запускает контейнеры нескольких
+// версий Postgres, строит для каждой матрицу видимости и выводит сравнение.
+//
+//	sweep [-versions 13,14,15,16] [-port 55430]
+func sweepCommand(args []string, logger *zap.Logger) error {
+	fs := flag.NewFlagSet("sweep", flag.ContinueOnError)
+	versions := fs.String("versions", "13,14,15,16", "comma separated postgres image tags")
+	port := fs.Int("port", 55430, "host port of the first container, next versions use the following ports")
+	progressFlag := fs.Bool("progress", false, "show a progress line on stdout")
+	estimateOnly := fs.Bool("estimate", false, "print the estimated runs, duration and transactions and exit without starting containers")
+	var budget runBudget
+	fs.DurationVar(&budget.duration, "budget", defaultBudgetDuration, "ask for confirmation before a sweep estimated to take longer than this; 0 disables")
+	fs.IntVar(&budget.transactions, "budget-transactions", defaultBudgetTransactions, "ask for confirmation before a sweep estimated to open more transactions than this; 0 disables")
+	fs.BoolVar(&budget.confirmed, "yes", false, "start a sweep over -budget without asking")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var targets []sweepTarget
+	for i, version := range strings.Split(*versions, ",") {
+		version = strings.TrimSpace(version)
+		targets = append(targets, sweepTarget{
+			version:   version,
+			container: fmt.Sprintf("transaction-isolation-sweep-%s", version),
+			port:      *port + i,
+		})
+	}
+	// Каждая версия - отдельный сервер: к матрице добавляется запуск контейнера
+	estimate := estimateCells("sweep", len(matrixWriters)*len(matrixReaders), matrixLevels, len(targets))
+	estimate.duration += time.Duration(len(targets)) * estimateSweepContainer
+	if *estimateOnly {
+		return estimate.print(os.Stdout)
+	}
+	if err := checkBudget(estimate, budget, true, logger); err != nil {
+		return err
+	}
+	if _, err := exec.LookPath("docker"); err != nil {
+		logger.Error("docker not found", zap.Error(err))
+		return err
+	}
+	// Версии серверов указаны в столбцах отчета
+	meta, err := collectMetadata(nil, logger)
+	if err != nil {
+		return err
+	}
+
+	if *progressFlag {
+		suiteProgress = newProgress(os.Stdout)
+		suiteProgress.addTotal(len(targets) * matrixCells())
+	}
+	matrices := make(map[string][]visibilityCell, len(targets))
+	for _, t := range targets {
+		targetLogger := logger.With(zap.String("postgres", t.version))
+		suiteProgress.setScope("PG " + t.version)
+		cells, err := sweepVersion(t, targetLogger)
+		if err != nil {
+			return fmt.Errorf("postgres %s: %w", t.version, err)
+		}
+		matrices[t.version] = cells
+	}
+	suiteProgress.close()
+	if err = meta.print(os.Stdout); err != nil {
+		return err
+	}
+	return printSweepReport(os.Stdout, targets, matrices)
+}
+
+func sweepVersion(t sweepTarget, logger *zap.Logger) ([]visibilityCell, error) {
+	run := exec.Command("docker", "run", "--detach", "--rm",
+		"--name", t.container,
+		"--env", "POSTGRES_PASSWORD=postgres",
+		"--publish", fmt.Sprintf("127.0.0.1:%d:5432", t.port),
+		"postgres:"+t.version)
+	suiteProgress.setStep("starting container")
+	if out, err := run.CombinedOutput(); err != nil {
+		logger.Error("failed to start container", zap.Error(err), zap.String("output", string(out)))
+		return nil, err
+	}
+	logger.Info("container started", zap.String("container", t.container), zap.Int("port", t.port))
+	defer func() {
+		if out, err := exec.Command("docker", "stop", t.container).CombinedOutput(); err != nil {
+			logger.Error("failed to stop container", zap.Error(err), zap.String("output", string(out)))
+			return
+		}
+		logger.Info("container stopped", zap.String("container", t.container))
+	}()
+
+	dsn := fmt.Sprintf("host=127.0.0.1 port=%d user=postgres password=postgres dbname=postgres sslmode=disable", t.port)
+	db, err := waitPostgres(dsn, logger)
+	if err != nil {
+		return nil, err
+	}
+	defer ignoreDeferred(logger, "close pool", db.Close)
+	return buildVisibilityMatrix(db, logger)
+}
+
+// waitPostgres ждет, пока сервер в контейнере начнет принимать подключения.
+func waitPostgres(dsn string, logger *zap.Logger) (*sqlx.DB, error) {
+	deadline := time.Now().Add(sweepStartTimeout)
+	for {
+		db, err := sqlx.Connect(backendPostgres, dsn)
+		if err == nil {
+			logger.Info("postgres is ready")
+			return db, nil
+		}
+		if time.Now().After(deadline) {
+			logger.Error("postgres did not start", zap.Error(err), zap.Duration("timeout", sweepStartTimeout))
+			return nil, err
+		}
+		time.Sleep(sweepPollInterval)
+	}
+}
+
+// printSweepReport выводит матрицы всех версий рядом; строки, в которых
+// версии расходятся, отмечены звездочкой.
+func printSweepReport(w io.Writer, targets []sweepTarget, matrices map[string][]visibilityCell) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprint(tw, "WRITER\tREADER\tLEVEL")
+	for _, t := range targets {
+		fmt.Fprintf(tw, "\tPG %s", t.version)
+	}
+	fmt.Fprintln(tw, "\tDIFF")
+
+	first := matrices[targets[0].version]
+	for i, c := range first {
+		fmt.Fprintf(tw, "%s\t%s\t%s", c.writer, c.reader, c.level)
+		diff := ""
+		for _, t := range targets {
+			visibility := matrices[t.version][i].visibility
+			if visibility != c.visibility {
+				diff = "*"
+			}
+			fmt.Fprintf(tw, "\t%s", visibility)
+		}
+		fmt.Fprintf(tw, "\t%s\n", diff)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// statementTag - метка операторов логической транзакции сценария.
+type statementTag struct {
+	scenario string
+	tx       string
+	// steps - общий счетчик операторов сценария
+	steps *atomic.Int64
+	// metrics - счетчики транзакций сценария для сводки
+	metrics *scenarioMetrics
+	// trace - история операторов сценария для разбора взаимоблокировок
+	trace *lockTrace
+	// states - снимки состояния после операторов сценария для -step-states
+	states *stepStates
+}
+
+// tagCore запоминает поля problem и tx, добавленные к логгеру через With.
+// Транзакция получает по ним имя сценария и свое имя без изменения
+// сигнатуры newTransaction во всех сценариях.
+type tagCore struct {
+	zapcore.Core
+	tag statementTag
+}
+
+func (c *tagCore) With(fields []zapcore.Field) zapcore.Core {
+	tag := c.tag
+	for _, f := range fields {
+		if f.Type != zapcore.StringType {
+			continue
+		}
+		switch f.Key {
+		case "problem":
+			tag = statementTag{scenario: f.String, steps: new(atomic.Int64), metrics: new(scenarioMetrics), trace: new(lockTrace), states: new(stepStates)}
+		case "tx":
+			tag.tx = f.String
+		}
+	}
+	return &tagCore{Core: c.Core.With(fields), tag: tag}
+}
+
+// withStatementTags включает метки операторов для транзакций, созданных с этим логгером.
+func withStatementTags(logger *zap.Logger) *zap.Logger {
+	return logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return &tagCore{Core: core}
+	}))
+}
+
+// statementTagOf возвращает метку транзакции или nil, если логгер не знает сценарий и транзакцию.
+func statementTagOf(logger *zap.Logger) *statementTag {
+	c, ok := logger.Core().(*tagCore)
+	if !ok || c.tag.steps == nil || c.tag.tx == "" {
+		return nil
+	}
+	tag := c.tag
+	return &tag
+}
+
+// comment возвращает комментарий вида /* scenario=lost_update tx=tx1 step=3 */
+// для следующего оператора.
+func (t *statementTag) comment() string {
+	return fmt.Sprintf("%sstep=%d */ ", t.commentPrefix(), t.steps.Add(1))
+}
+
+// commentPrefix - начало комментария без номера шага, общее для операторов транзакции.
+func (t *statementTag) commentPrefix() string {
+	sanitize := strings.NewReplacer("*/", "* /", "/*", "/ *")
+	return fmt.Sprintf("/* scenario=%s tx=%s ", sanitize.Replace(t.scenario), sanitize.Replace(t.tx))
+}
+
+// sql добавляет к оператору комментарий с меткой, по которому оператор
+// находится в логах сервера и pg_stat_activity, и учитывает его в
+// t.statements.
+func (t *transaction) sql(query string) string {
+	t.noteStatement(query)
+	if t.tag == nil {
+		return query
+	}
+	t.countStatement()
+	return t.tag.comment() + query
+}
+
+// maxApplicationName - длина application_name, после которой сервер его обрезает.
+const maxApplicationName = 63
+
+// setApplicationName дописывает имя транзакции к application_name сессии до
+// конца транзакции, например transaction_isolation:tx1. SHOW и SET не берут
+// снимок, поэтому после них транзакция еще может задать уровень изоляции.
+func (t *transaction) setApplicationName() error {
+	if t.tag == nil {
+		return nil
+	}
+	var base string
+	if err := t.tx.QueryRowContext(t.ctx, t.sql("SHOW application_name;")).Scan(&base); err != nil {
+		t.logger.Error("failed to get application_name", zap.Error(err))
+		return err
+	}
+	name := base + ":" + t.tag.tx
+	if len(name) > maxApplicationName {
+		name = name[:maxApplicationName]
+	}
+	return t.setLocal("application_name", name)
+}
+
+// taggedTx помечает операторы слоя sqlc так же, как операторы транзакции.
+type taggedTx struct {
+	t *transaction
+}
+
+func (x taggedTx) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return x.t.tx.ExecContext(ctx, x.t.sql(query), args...)
+}
+
+func (x taggedTx) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return x.t.tx.PrepareContext(ctx, x.t.sql(query))
+}
+
+func (x taggedTx) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return x.t.tx.QueryContext(ctx, x.t.sql(query), args...)
+}
+
+func (x taggedTx) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return x.t.tx.QueryRowContext(ctx, x.t.sql(query), args...)
+}
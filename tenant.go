@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+// tenantRole - роль без прав суперпользователя: политики RLS не действуют на
+// суперпользователя и владельца таблицы, поэтому транзакция арендатора
+// переключается на нее через SET LOCAL ROLE.
+const tenantRole = "tenant_user"
+
+var tenantMigrations = []string{
+	`DROP TABLE IF EXISTS document;`,
+	`CREATE TABLE document (
+           id INT PRIMARY KEY,
+           tenant TEXT NOT NULL,
+           title TEXT NOT NULL
+         );`,
+	`INSERT INTO document VALUES (1, 'a', 'contract'), (2, 'a', 'invoice'), (3, 'b', 'report');`,
+	`ALTER TABLE document ENABLE ROW LEVEL SECURITY;`,
+	`CREATE POLICY tenant_isolation ON document
+           USING (tenant = current_setting('app.tenant', true));`,
+}
+
+// tenantRoleMigrations создают роль арендатора; роль общая для кластера и
+// переживает пересоздание таблицы, права на таблицу выдаются заново.
+var tenantRoleMigrations = []string{
+	`DO $$
+         BEGIN
+           IF NOT EXISTS (SELECT FROM pg_roles WHERE rolname = 'tenant_user') THEN
+             CREATE ROLE tenant_user;
+           END IF;
+           EXECUTE format('GRANT USAGE ON SCHEMA %I TO tenant_user', current_schema());
+         END;
+         $$;`,
+	`GRANT SELECT, UPDATE ON document TO tenant_user;`,
+}
+
+// tenantVariant - уровень изоляции арендатора и ожидаемое поведение после
+// переноса документа в другого арендатора.
+type tenantVariant struct {
+	name  string
+	level sql.IsolationLevel
+	// visible - документы, которые видит повторное чтение арендатора
+	visible []int64
+	// code - ожидаемая ошибка UPDATE перенесенного документа, пусто - UPDATE не находит строку
+	code string
+}
+
+var tenantVariants = []tenantVariant{
+	// Новый снимок оператора: перенесенный документ уже не проходит политику
+	{name: "read_committed", level: sql.LevelReadCommitted, visible: []int64{1}},
+	// Политика проверяется в снимке транзакции и пропускает старую версию строки,
+	// но изменить строку, обновленную после снимка, нельзя
+	{name: "repeatable_read", level: sql.LevelRepeatableRead, visible: []int64{1, 2}, code: "40001"},
+	{name: "serializable", level: sql.LevelSerializable, visible: []int64{1, 2}, code: "40001"},
+}
+
+// tenantIsolation показывает, что предикаты политик RLS подчиняются тем же
+// правилам снимков, что и условия WHERE. Пока арендатор a читает свои
+// документы, администратор переносит документ 2 арендатору b. При READ
+// COMMITTED документ исчезает из следующего запроса, а UPDATE после ожидания
+// перепроверяет политику на новой версии строки и пропускает ее. При
+// REPEATABLE READ и SERIALIZABLE документ остается видимым до конца транзакции,
+// а UPDATE завершается ошибкой сериализации.
+func tenantIsolation(db *sqlx.DB, logger *zap.Logger) error {
+	if err := migrate(db, logger, tenantRoleMigrations); err != nil {
+		if errorCode(err) == "42501" {
+			return fmt.Errorf("%w: creating role %s requires CREATEROLE: %v", errScenarioSkipped, tenantRole, err)
+		}
+		return err
+	}
+	for _, v := range tenantVariants {
+		if err := migrate(db, logger, []string{`UPDATE document SET tenant = 'a', title = 'invoice' WHERE id = 2;`}); err != nil {
+			return err
+		}
+		if err := runTenantVariant(db, logger.With(zap.String("variant", v.name)), v); err != nil {
+			return fmt.Errorf("%s: %w", v.name, err)
+		}
+	}
+	return nil
+}
+
+func runTenantVariant(db *sqlx.DB, logger *zap.Logger, v tenantVariant) (err error) {
+	// Документ перенесен администратором и не изменен арендатором a
+	defer checkPostconditions(db, logger, &err,
+		expectValue("document 2 moved", "SELECT tenant || ':' || title FROM document WHERE id = 2;", "b:invoice"))
+
+	// Транзакция арендатора a под ролью без обхода RLS
+	tx1 := newTransaction(db, logger.With(zap.String("tx", "tenant")))
+	if err = tx1.begin(); err != nil {
+		return err
+	}
+	if err = tx1.setLevel(v.level); err != nil {
+		return err
+	}
+	if _, err = tx1.exec("SET LOCAL ROLE " + tenantRole + ";"); err != nil {
+		return err
+	}
+	if err = tx1.setLocal("app.tenant", "a"); err != nil {
+		return err
+	}
+	visible, err := tenantDocuments(tx1)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(visible, []int64{1, 2}) {
+		return fmt.Errorf("tenant a sees documents %v before the move, expected [1 2]", visible)
+	}
+
+	// Администратор переносит документ 2 арендатору b
+	tx2 := newTransaction(db, logger.With(zap.String("tx", "admin")))
+	if err = tx2.begin(); err != nil {
+		return err
+	}
+	if _, err = tx2.exec("UPDATE document SET tenant = $1 WHERE id = $2;", "b", 2); err != nil {
+		return err
+	}
+	if err = tx2.commit(); err != nil {
+		return err
+	}
+
+	// Повторное чтение и изменение перенесенного документа арендатором a
+	if visible, err = tenantDocuments(tx1); err != nil {
+		return err
+	}
+	logger.Info("documents visible after the move", zap.Int64s("ids", visible))
+	if !reflect.DeepEqual(visible, v.visible) {
+		return fmt.Errorf("tenant a sees documents %v after the move, expected %v", visible, v.visible)
+	}
+	affected, err := tx1.exec("UPDATE document SET title = $1 WHERE id = $2;", "edited", 2)
+	if err != nil {
+		tx1.logger.Info("update rejected", zap.String("code", errorCode(err)))
+		if errorCode(err) != v.code {
+			return err
+		}
+		return tx1.rollback()
+	}
+	if v.code != "" {
+		return fmt.Errorf("expected error %s, UPDATE changed %d rows", v.code, affected)
+	}
+	if affected != 0 {
+		return fmt.Errorf("UPDATE changed %d rows of a document moved to another tenant", affected)
+	}
+	return tx1.commit()
+}
+
+// tenantDocuments возвращает документы, которые политика показывает транзакции.
+func tenantDocuments(t *transaction) ([]int64, error) {
+	rows, err := t.query("SELECT id FROM document ORDER BY id;")
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int64, 0, len(rows))
+	for _, row := range rows {
+		ids = append(ids, row[0].(int64))
+	}
+	return ids, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+var triggerSummaryMigrations = append(append([]string{}, personMigrations...),
+	`DROP TABLE IF EXISTS person_total;`,
+	`CREATE TABLE person_total (
+           id INT PRIMARY KEY,
+           total BIGINT NOT NULL
+         );`,
+	`INSERT INTO person_total VALUES (1, 2000);`,
+	// Пересчет итога по всей таблице: подзапрос видит снимок, взятый до ожидания блокировки
+	`CREATE OR REPLACE FUNCTION person_total_recompute() RETURNS trigger AS $$
+         BEGIN
+           UPDATE person_total SET total = (SELECT SUM(balance) FROM person) WHERE id = 1;
+           RETURN NULL;
+         END;
+         $$ LANGUAGE plpgsql;`,
+	// Инкрементальное изменение итога: выражение перевычисляется над последней версией строки
+	`CREATE OR REPLACE FUNCTION person_total_delta() RETURNS trigger AS $$
+         BEGIN
+           UPDATE person_total SET total = total + NEW.balance - OLD.balance WHERE id = 1;
+           RETURN NULL;
+         END;
+         $$ LANGUAGE plpgsql;`,
+)
+
+// triggerSummaryVariant - способ поддержки итоговой таблицы триггером.
+type triggerSummaryVariant struct {
+	name     string
+	level    sql.IsolationLevel
+	function string
+	// consistent - итог совпадает с суммой балансов после обеих транзакций
+	consistent bool
+}
+
+var triggerSummaryVariants = []triggerSummaryVariant{
+	{name: "recompute", level: sql.LevelReadCommitted, function: "person_total_recompute"},
+	{name: "delta", level: sql.LevelReadCommitted, function: "person_total_delta", consistent: true},
+	{name: "recompute_serializable", level: sql.LevelSerializable, function: "person_total_recompute", consistent: true},
+}
+
+// triggerSummary показывает, что триггер выполняется в том же режиме снимков и
+// блокировок, что и вызвавший его запрос: при READ COMMITTED пересчет итога
+// в триггере теряет параллельное изменение.
+func triggerSummary(db *sqlx.DB, logger *zap.Logger) error {
+	for _, v := range triggerSummaryVariants {
+		if err := runTriggerSummaryVariant(db, logger.With(zap.String("variant", v.name)), v); err != nil {
+			return fmt.Errorf("%s: %w", v.name, err)
+		}
+	}
+	return nil
+}
+
+func runTriggerSummaryVariant(db *sqlx.DB, logger *zap.Logger, v triggerSummaryVariant) (err error) {
+	prepare := []string{
+		`DROP TRIGGER IF EXISTS person_total_trigger ON person;`,
+		`UPDATE person SET balance = 1000;`,
+		`UPDATE person_total SET total = 2000;`,
+		fmt.Sprintf(`CREATE TRIGGER person_total_trigger AFTER UPDATE ON person
+           FOR EACH ROW EXECUTE FUNCTION %s();`, v.function),
+	}
+	if err := migrate(db, logger, prepare); err != nil {
+		return err
+	}
+
+	// Сверка итоговой таблицы с суммой балансов после завершения транзакций
+	defer checkPostconditions(db, logger, &err,
+		expectValue("summary consistent", "SELECT total = (SELECT SUM(balance) FROM person) FROM person_total WHERE id = 1;", v.consistent))
+
+	// Запуск транзакций
+	tx1 := newTransaction(db, logger.With(zap.String("tx", "tx1")))
+	if err := tx1.begin(); err != nil {
+		return err
+	}
+	if err := tx1.setLevel(v.level); err != nil {
+		return err
+	}
+	tx2 := newTransaction(db, logger.With(zap.String("tx", "tx2")))
+	if err := tx2.begin(); err != nil {
+		return err
+	}
+	if err := tx2.setLevel(v.level); err != nil {
+		return err
+	}
+
+	// Триггер 1 транзакции блокирует строку итога до commit
+	if err := tx1.updateUser(1, 1500); err != nil {
+		return err
+	}
+
+	// Триггер 2 транзакции ждет блокировку строки итога
+	pid, err := tx2.backendPID()
+	if err != nil {
+		return err
+	}
+	tx2Done := runAsync(func() error {
+		return tx2.updateUser(2, 500)
+	})
+	if err = waitBlocked(tx2, pid, tx2Done); err != nil {
+		return err
+	}
+	if err := tx1.commit(); err != nil {
+		return err
+	}
+	if err := <-tx2Done; err != nil {
+		tx2.logger.Info("update rejected", zap.String("code", errorCode(err)))
+		return tx2.rollback()
+	}
+	return tx2.commit()
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const driverPostgresSSH = "postgres+ssh"
+
+// sshTunnelConfig - параметры подключения к базе через бастион.
+type sshTunnelConfig struct {
+	host       string // user@host:port бастиона
+	jump       string // необязательный промежуточный хост user@host:port
+	key        string // путь к приватному ключу; без него используется ssh-agent
+	knownHosts string
+	insecure   bool
+}
+
+// sshDialer открывает TCP соединения к базе через SSH клиент бастиона.
+type sshDialer struct {
+	client *ssh.Client
+}
+
+func (d *sshDialer) Dial(network, address string) (net.Conn, error) {
+	return d.client.Dial(network, address)
+}
+
+// DialTimeout прерывает открытие канала через бастион по истечении timeout
+// (connect_timeout в DSN).
+func (d *sshDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return d.DialContext(ctx, network, address)
+}
+
+// DialContext открывает канал через бастион; lib/pq предпочитает его Dial и
+// DialTimeout и передает контекст подключения к базе.
+func (d *sshDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.client.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &sshConn{Conn: conn}, nil
+}
+
+// sshConn - канал туннеля. Каналы SSH не поддерживают сроки, а lib/pq при
+// connect_timeout ставит срок на установку соединения и без поддержки
+// отказался бы от канала; sshConn закрывает канал по истечении срока.
+type sshConn struct {
+	net.Conn
+	mu    sync.Mutex
+	timer *time.Timer
+}
+
+func (c *sshConn) SetDeadline(deadline time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if !deadline.IsZero() {
+		c.timer = time.AfterFunc(time.Until(deadline), func() {
+			_ = c.Conn.Close()
+		})
+	}
+	return nil
+}
+
+func (c *sshConn) SetReadDeadline(deadline time.Time) error {
+	return c.SetDeadline(deadline)
+}
+
+func (c *sshConn) SetWriteDeadline(deadline time.Time) error {
+	return c.SetDeadline(deadline)
+}
+
+type sshDriver struct {
+	dialer *sshDialer
+}
+
+func (d *sshDriver) Open(name string) (driver.Conn, error) {
+	return pq.DialOpen(d.dialer, name)
+}
+
+// sshTunnel - клиенты SSH в порядке подключения: jump хост, если задан, и
+// бастион, подключенный через него.
+type sshTunnel struct {
+	clients []*ssh.Client
+}
+
+// Close закрывает бастион и затем jump хост, через который он подключен.
+func (t *sshTunnel) Close() error {
+	var errs []error
+	for i := len(t.clients) - 1; i >= 0; i-- {
+		errs = append(errs, t.clients[i].Close())
+	}
+	return errors.Join(errs...)
+}
+
+// openSSHTunnel подключается к бастиону (при необходимости через jump хост)
+// и регистрирует драйвер postgres+ssh, соединения которого идут через туннель.
+// Если подключение к бастиону не удалось, уже открытый jump хост закрывается.
+func openSSHTunnel(cfg sshTunnelConfig, logger *zap.Logger) (_ *sshTunnel, err error) {
+	auth, err := sshAuth(cfg.key)
+	if err != nil {
+		logger.Error("failed to prepare ssh auth", zap.Error(err))
+		return nil, err
+	}
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if !cfg.insecure {
+		if hostKeyCallback, err = knownhosts.New(expandHome(cfg.knownHosts)); err != nil {
+			logger.Error("failed to read known hosts", zap.Error(err), zap.String("path", cfg.knownHosts))
+			return nil, err
+		}
+	}
+
+	tunnel := &sshTunnel{}
+	defer func() {
+		if err != nil {
+			ignoreError(logger, "close ssh tunnel", tunnel.Close())
+		}
+	}()
+	var client *ssh.Client
+	for _, hop := range []string{cfg.jump, cfg.host} {
+		if hop == "" {
+			continue
+		}
+		userName, addr, err := splitSSHAddress(hop)
+		if err != nil {
+			return nil, err
+		}
+		clientConfig := &ssh.ClientConfig{
+			User:            userName,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         10 * time.Second,
+		}
+		if client, err = dialSSH(client, addr, clientConfig); err != nil {
+			logger.Error("failed to connect to ssh host", zap.Error(err), zap.String("host", addr))
+			return nil, err
+		}
+		tunnel.clients = append(tunnel.clients, client)
+		logger.Info("ssh connected", zap.String("host", addr), zap.String("user", userName))
+	}
+
+	sql.Register(driverPostgresSSH, &sshDriver{dialer: &sshDialer{client: client}})
+	sqlx.BindDriver(driverPostgresSSH, sqlx.DOLLAR)
+	return tunnel, nil
+}
+
+// dialSSH подключается к addr напрямую или через уже открытый клиент.
+func dialSSH(via *ssh.Client, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	if via == nil {
+		return ssh.Dial("tcp", addr, config)
+	}
+	conn, err := via.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+func sshAuth(keyPath string) ([]ssh.AuthMethod, error) {
+	if keyPath != "" {
+		key, err := os.ReadFile(expandHome(keyPath))
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) {
+			passphrase := os.Getenv("SSH_KEY_PASSPHRASE")
+			if passphrase == "" {
+				return nil, fmt.Errorf("%s is encrypted, set SSH_KEY_PASSPHRASE", keyPath)
+			}
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
+		}
+		if err != nil {
+			return nil, err
+		}
+		return []ssh.AuthMethod{ssh.PublicKeys(signer)}, nil
+	}
+
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, errors.New("no ssh key given and SSH_AUTH_SOCK is not set")
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	return []ssh.AuthMethod{ssh.PublicKeysCallback(agent.NewClient(conn).Signers)}, nil
+}
+
+// splitSSHAddress разбирает [user@]host[:port].
+func splitSSHAddress(s string) (string, string, error) {
+	userName, host, ok := strings.Cut(s, "@")
+	if !ok {
+		host = userName
+		current, err := user.Current()
+		if err != nil {
+			return "", "", err
+		}
+		userName = current.Username
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "22")
+	}
+	return userName, host, nil
+}
+
+func expandHome(path string) string {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, rest)
+		}
+	}
+	return path
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// blockedThreshold - оператор, выполнявшийся дольше, считается ждавшим
+// блокировку: операторы сценариев на небольших таблицах выполняются быстрее.
+const blockedThreshold = 100 * time.Millisecond
+
+// longTxThreshold - транзакция, открытая дольше, отмечается в сводке и
+// предупреждением после сценария: пока она открыта, VACUUM не может заморозить
+// строки новее ее снимка, и возраст datfrozenxid растет; 0 - без проверки.
+var longTxThreshold = 10 * time.Second
+
+// printTxSummary включает сводку по транзакциям после каждого сценария.
+var printTxSummary = true
+
+const (
+	outcomeOpen       = "open"
+	outcomeCommitted  = "committed"
+	outcomeRolledBack = "rolled back"
+	outcomeAborted    = "aborted"
+)
+
+// txCounters - счетчики логической транзакции сценария по всем ее попыткам.
+type txCounters struct {
+	statements  int64
+	rowsRead    int64
+	rowsWritten int64
+	retries     int64
+	blocked     time.Duration
+	outcome     string
+	// opened - начало незавершенной попытки, longest - самая долгая завершенная
+	opened  time.Time
+	longest time.Duration
+}
+
+// held возвращает самую долгую попытку, считая незавершенную до now.
+func (c *txCounters) held(now time.Time) time.Duration {
+	if !c.opened.IsZero() {
+		return max(c.longest, now.Sub(c.opened))
+	}
+	return c.longest
+}
+
+// scenarioMetrics собирает счетчики транзакций одного запуска сценария
+// независимо от истории, архива и событий.
+type scenarioMetrics struct {
+	mu    sync.Mutex
+	order []string
+	txs   map[string]*txCounters
+}
+
+func (m *scenarioMetrics) update(tx string, f func(c *txCounters)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.txs[tx]
+	if !ok {
+		if m.txs == nil {
+			m.txs = make(map[string]*txCounters)
+		}
+		c = &txCounters{outcome: outcomeOpen}
+		m.txs[tx] = c
+		m.order = append(m.order, tx)
+	}
+	f(c)
+}
+
+// print выводит сводку в порядке первого появления транзакций.
+func (m *scenarioMetrics) print(w io.Writer, scenario string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.order) == 0 {
+		return nil
+	}
+	fmt.Fprintf(w, "%s: transactions\n", scenario)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TX\tSTATEMENTS\tROWS READ\tROWS WRITTEN\tRETRIES\tBLOCKED\tHELD\tOUTCOME")
+	now := time.Now()
+	for _, tx := range m.order {
+		c := m.txs[tx]
+		held := c.held(now).Round(time.Millisecond).String()
+		if longTxThreshold > 0 && c.held(now) >= longTxThreshold {
+			held += " (long)"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%s\t%s\t%s\n", tx, c.statements, c.rowsRead, c.rowsWritten, c.retries,
+			c.blocked.Round(time.Millisecond), held, c.outcome)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+// warnLongTransactions предупреждает о транзакциях сценария, открытых дольше
+// longTxThreshold, и возвращает их имена.
+func (m *scenarioMetrics) warnLongTransactions(logger *zap.Logger) []string {
+	if longTxThreshold <= 0 {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var long []string
+	now := time.Now()
+	for _, tx := range m.order {
+		c := m.txs[tx]
+		if held := c.held(now); held >= longTxThreshold {
+			logger.Warn("transaction held longer than threshold", zap.String("tx", tx),
+				zap.Duration("held", held), zap.Duration("threshold", longTxThreshold), zap.String("outcome", c.outcome))
+			long = append(long, tx)
+		}
+	}
+	return long
+}
+
+// scenarioMetricsOf возвращает счетчики сценария логгера или nil.
+func scenarioMetricsOf(logger *zap.Logger) *scenarioMetrics {
+	c, ok := logger.Core().(*tagCore)
+	if !ok {
+		return nil
+	}
+	return c.tag.metrics
+}
+
+// countStatement учитывает оператор, отправленный транзакцией.
+func (t *transaction) countStatement() {
+	if t.tag == nil {
+		return
+	}
+	t.tag.metrics.update(t.tag.tx, func(c *txCounters) { c.statements++ })
+}
+
+// observe учитывает результат оператора, начатого в started: прочитанные и
+// измененные строки, ожидание и прерывание транзакции сервером.
+func (t *transaction) observe(started time.Time, read, written int64, err error) {
+	if t.tag == nil {
+		return
+	}
+	elapsed := time.Since(started)
+	t.tag.metrics.update(t.tag.tx, func(c *txCounters) {
+		c.rowsRead += read
+		c.rowsWritten += written
+		if elapsed >= blockedThreshold {
+			c.blocked += elapsed
+		}
+		if class := classifyError(err); class.Retryable {
+			c.outcome = outcomeAborted + " " + class.Code
+		}
+	})
+}
+
+// observeEnd учитывает начало, фиксацию или откат транзакции. Начало после
+// прерывания сервером считается повтором.
+func (t *transaction) observeEnd(outcome string, err error) {
+	if t.tag == nil {
+		return
+	}
+	now := time.Now()
+	t.tag.metrics.update(t.tag.tx, func(c *txCounters) {
+		// Попытка завершается фиксацией, откатом или новым begin после прерывания
+		if !c.opened.IsZero() {
+			c.longest = max(c.longest, now.Sub(c.opened))
+			c.opened = time.Time{}
+		}
+		switch outcome {
+		case outcomeOpen:
+			if c.outcome != outcomeOpen && c.outcome != outcomeCommitted && c.outcome != outcomeRolledBack {
+				c.retries++
+			}
+			c.outcome = outcomeOpen
+			c.opened = now
+		case outcomeRolledBack:
+			// Откат после фиксации или прерывания сохраняет их итог
+			if c.outcome == outcomeOpen {
+				c.outcome = outcomeRolledBack
+			}
+		default:
+			c.outcome = outcome
+			if err != nil {
+				c.outcome = outcomeAborted
+				if code := errorCode(err); code != "" {
+					c.outcome += " " + code
+				}
+			}
+		}
+	})
+}
+
+// rowCount возвращает длину среза, на который указывает dest.
+func rowCount(dest any) int64 {
+	v := reflect.ValueOf(dest)
+	if v.Kind() == reflect.Pointer && v.Elem().Kind() == reflect.Slice {
+		return int64(v.Elem().Len())
+	}
+	return 0
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// viewRow - сценарий архива на временной шкале: смещения и ширины в процентах
+// от общей длительности запуска.
+type viewRow struct {
+	Result runResult
+	Dir    string
+	Tables []string
+	Offset float64
+	Setup  float64
+	Steps  float64
+	// HasSteps - архив содержит снимки шагов -step-states
+	HasSteps bool
+}
+
+type viewPage struct {
+	Dir      string
+	Started  time.Time
+	Duration time.Duration
+	Verdicts map[string]int
+	// Metadata - условия запуска первого сценария, у которого они сохранены
+	Metadata []string
+	Rows     []viewRow
+}
+
+var viewTemplate = template.Must(template.New("view").Funcs(template.FuncMap{
+	"pct":  func(v float64) string { return fmt.Sprintf("%.3f%%", v) },
+	"addf": func(a, b float64) float64 { return a + b },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Dir}}</title>
+<style>
+body { font-family: sans-serif; font-size: 13px; margin: 20px; }
+table { border-collapse: collapse; width: 100%; }
+td, th { padding: 4px 8px; border-bottom: 1px solid #ddd; text-align: left; vertical-align: top; }
+.lane { position: relative; height: 16px; min-width: 400px; background: #f4f4f4; }
+.bar { position: absolute; top: 2px; height: 12px; }
+.setup { background: #b0b0b0; }
+.ok { background: #4caf50; }
+.error, .timeout { background: #e53935; }
+.skipped { background: #fbc02d; }
+.error-text { color: #b71c1c; white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h2>{{.Dir}}</h2>
+<p>started {{.Started.Format "2006-01-02 15:04:05"}}, wall time {{.Duration}}{{range $verdict, $n := .Verdicts}}, {{$verdict}}: {{$n}}{{end}}</p>
+{{if .Metadata}}<pre>{{range .Metadata}}{{.}}
+{{end}}</pre>{{end}}
+<table>
+<tr><th>SCENARIO</th><th>LEVEL</th><th>VERDICT</th><th>SETUP MS</th><th>STEPS MS</th><th>TIMELINE</th><th>FILES</th></tr>
+{{range .Rows}}
+<tr>
+<td>{{.Result.Scenario}}</td>
+<td>{{.Result.Level}}</td>
+<td>{{.Result.Verdict}}</td>
+<td>{{.Result.MigrationMs}}</td>
+<td>{{.Result.DurationMs}}</td>
+<td><div class="lane" title="{{.Result.StartedAt.Format "15:04:05.000"}}">
+<div class="bar setup" style="left: {{pct .Offset}}; width: {{pct .Setup}}"></div>
+<div class="bar {{.Result.Verdict}}" style="left: {{pct (addf .Offset .Setup)}}; width: {{pct .Steps}}"></div>
+</div>{{if .Result.Error}}<div class="error-text">{{.Result.Error}}</div>{{end}}</td>
+<td>{{$dir := .Dir}}{{range .Tables}}<a href="files/{{$dir}}/{{.}}">{{.}}</a><br>{{end}}<a href="files/{{$dir}}/result.json">result.json</a>{{if .HasSteps}}<br><a href="timeline/{{$dir}}">steps</a>{{end}}</td>
+</tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
+
+// newViewPage раскладывает сценарии архива по времени запуска.
+func newViewPage(dir string, runs map[string]archivedRun) viewPage {
+	page := viewPage{Dir: dir, Verdicts: make(map[string]int)}
+	var finished time.Time
+	for _, run := range runs {
+		r := run.result
+		end := r.StartedAt.Add(time.Duration(r.MigrationMs+r.DurationMs) * time.Millisecond)
+		if page.Started.IsZero() || r.StartedAt.Before(page.Started) {
+			page.Started = r.StartedAt
+		}
+		if end.After(finished) {
+			finished = end
+		}
+		page.Verdicts[r.Verdict]++
+	}
+	page.Duration = finished.Sub(page.Started).Round(time.Millisecond)
+	total := float64(page.Duration.Milliseconds())
+	if total == 0 {
+		total = 1
+	}
+	for _, run := range runs {
+		r := run.result
+		row := viewRow{
+			Result: r,
+			Dir:    strings.ReplaceAll(r.Scenario, "/", "_"),
+			Offset: float64(r.StartedAt.Sub(page.Started).Milliseconds()) / total * 100,
+			Setup:  float64(r.MigrationMs) / total * 100,
+			Steps:  float64(r.DurationMs) / total * 100,
+		}
+		row.HasSteps = run.steps
+		for table := range run.tables {
+			row.Tables = append(row.Tables, table)
+		}
+		sort.Strings(row.Tables)
+		page.Rows = append(page.Rows, row)
+	}
+	sort.Slice(page.Rows, func(i, j int) bool {
+		if !page.Rows[i].Result.StartedAt.Equal(page.Rows[j].Result.StartedAt) {
+			return page.Rows[i].Result.StartedAt.Before(page.Rows[j].Result.StartedAt)
+		}
+		return page.Rows[i].Result.Scenario < page.Rows[j].Result.Scenario
+	})
+	for _, row := range page.Rows {
+		if row.Result.Metadata != nil {
+			page.Metadata = row.Result.Metadata.lines()
+			break
+		}
+	}
+	return page
+}
+
+// viewHandler отдает страницу с временной шкалой, результаты в JSON по
+// /results.json, снимки шагов по /steps/ и файлы архива по /files/. Архив читается при каждом запросе
+// страницы, поэтому видны и сценарии, дописанные после запуска view.
+func viewHandler(dir string, logger *zap.Logger) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/" {
+			http.NotFound(w, req)
+			return
+		}
+		runs, err := readArchivedRuns(dir)
+		if err != nil {
+			logger.Error("failed to read archive", zap.Error(err), zap.String("dir", dir))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err = viewTemplate.Execute(w, newViewPage(filepath.Base(dir), runs)); err != nil {
+			logger.Error("failed to render page", zap.Error(err))
+		}
+	})
+	mux.HandleFunc("/results.json", func(w http.ResponseWriter, req *http.Request) {
+		runs, err := readArchivedRuns(dir)
+		if err != nil {
+			logger.Error("failed to read archive", zap.Error(err), zap.String("dir", dir))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		results := make([]runResult, 0, len(runs))
+		for _, run := range runs {
+			results = append(results, run.result)
+		}
+		sort.Slice(results, func(i, j int) bool { return results[i].StartedAt.Before(results[j].StartedAt) })
+		w.Header().Set("Content-Type", "application/json")
+		if err = json.NewEncoder(w).Encode(results); err != nil {
+			logger.Error("failed to write results", zap.Error(err))
+		}
+	})
+	mux.HandleFunc("/steps/", func(w http.ResponseWriter, req *http.Request) {
+		serveStepStates(w, req, dir, logger)
+	})
+	mux.HandleFunc("/timeline/", func(w http.ResponseWriter, req *http.Request) {
+		scenarioDir := strings.TrimPrefix(req.URL.Path, "/timeline/")
+		if scenarioDir == "" || scenarioDir != filepath.Base(scenarioDir) || scenarioDir == ".." {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := timelineTemplate.Execute(w, scenarioDir); err != nil {
+			logger.Error("failed to render page", zap.Error(err))
+		}
+	})
+	mux.Handle("/files/", http.StripPrefix("/files/", http.FileServer(http.Dir(dir))))
+	return mux
+}
+
+// serveStepStates отдает снимки шагов сценария архива: /steps/<каталог>
+// - список шагов без снимков, /steps/<каталог>/<шаг> - снимок шага.
+func serveStepStates(w http.ResponseWriter, req *http.Request, dir string, logger *zap.Logger) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/steps/"), "/")
+	if len(parts) > 2 || parts[0] == "" || parts[0] == ".." || parts[0] == "." {
+		http.NotFound(w, req)
+		return
+	}
+	steps, err := readStepStates(filepath.Join(dir, parts[0]))
+	if err != nil {
+		logger.Error("failed to read step states", zap.Error(err), zap.String("scenario", parts[0]))
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	var body any
+	if len(parts) == 1 {
+		summaries := make([]stepState, len(steps))
+		for i, s := range steps {
+			summaries[i] = s.summary()
+		}
+		body = summaries
+	} else {
+		index, err := strconv.Atoi(parts[1])
+		if err != nil {
+			http.Error(w, "step index must be a number", http.StatusBadRequest)
+			return
+		}
+		if body, err = stepAt(steps, index); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(body); err != nil {
+		logger.Error("failed to write step states", zap.Error(err))
+	}
+}
+
+// timelineTemplate - страница сценария с ползунком по шагам: при каждом
+// сдвиге она запрашивает снимок шага у /steps/.
+var timelineTemplate = template.Must(template.New("timeline").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.}}</title>
+<style>
+body { font-family: sans-serif; font-size: 13px; margin: 20px; }
+table { border-collapse: collapse; margin-bottom: 12px; }
+td, th { padding: 2px 8px; border-bottom: 1px solid #ddd; text-align: left; }
+input[type=range] { width: 100%; }
+.error { color: #b71c1c; }
+</style>
+</head>
+<body>
+<h2><a href="../">runs</a> / {{.}}</h2>
+<input id="step" type="range" min="0" max="0" value="0">
+<p id="statement"></p>
+<div id="state"></div>
+<script>
+const scenario = {{.}};
+const slider = document.getElementById("step");
+function table(title, columns, rows) {
+  let html = "<h4>" + title + "</h4><table><tr>" + columns.map(c => "<th>" + c + "</th>").join("") + "</tr>";
+  for (const row of rows || []) {
+    html += "<tr>" + row.map(v => "<td>" + (v === null ? "NULL" : String(v).replace(/</g, "&lt;")) + "</td>").join("") + "</tr>";
+  }
+  return html + "</table>";
+}
+async function show(index) {
+  const step = await (await fetch("../steps/" + scenario + "/" + index)).json();
+  const statement = document.getElementById("statement");
+  statement.textContent = "#" + step.index + " " + step.tx + ": " + step.query + (step.code ? " (" + step.code + ")" : "");
+  statement.className = step.code ? "error" : "";
+  let html = "";
+  for (const [name, t] of Object.entries(step.tables || {})) {
+    html += table(name, t.columns, t.rows);
+  }
+  html += table("transactions", ["tx", "pid", "state", "backend_xid", "backend_xmin", "query"],
+    (step.transactions || []).map(t => [t.tx, t.pid, t.state, t.backend_xid, t.backend_xmin, t.query]));
+  html += table("locks", ["pid", "locktype", "relation", "mode", "granted"],
+    (step.locks || []).map(l => [l.pid, l.locktype, l.relation, l.mode, l.granted]));
+  document.getElementById("state").innerHTML = html;
+}
+fetch("../steps/" + scenario).then(r => r.json()).then(steps => {
+  slider.max = Math.max(steps.length - 1, 0);
+  slider.oninput = () => show(slider.value);
+  if (steps.length > 0) show(0);
+});
+</script>
+</body>
+</html>
+`))
+
+// viewCommand реализует подкоманду view: view [-addr localhost:8080] run-dir.
+// Показывает архив -archive без подключения к базе.
+func viewCommand(args []string, logger *zap.Logger) error {
+	fs := flag.NewFlagSet("view", flag.ContinueOnError)
+	addr := fs.String("addr", "localhost:8080", "address to serve the viewer on")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: view [-addr host:port] <run-dir>")
+	}
+	dir := fs.Arg(0)
+	runs, err := readArchivedRuns(dir)
+	if err != nil {
+		logger.Error("failed to read archive", zap.Error(err), zap.String("dir", dir))
+		return err
+	}
+	if len(runs) == 0 {
+		return fmt.Errorf("%s: no archived results, run scenarios with -archive %s first", dir, dir)
+	}
+	logger.Info("serving archived runs", zap.String("dir", dir), zap.Int("scenarios", len(runs)), zap.String("url", "http://"+*addr+"/"))
+	return http.ListenAndServe(*addr, viewHandler(dir, logger))
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+const watchDebounce = 300 * time.Millisecond
+
+// watchScenarios перезагружает YAML сценарии из dir и профили из файла
+// -guc-profiles configPath при каждом изменении файлов и заново запускает
+// выбранные сценарии. Ошибки сценариев не прерывают наблюдение.
+func watchScenarios(r *runner, dir, configPath, selected string, loaded map[string]scenario, logger *zap.Logger) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Error("failed to create watcher", zap.Error(err))
+		return err
+	}
+	defer ignoreDeferred(logger, "close watcher", watcher.Close)
+	if err = watcher.Add(dir); err != nil {
+		logger.Error("failed to watch dir", zap.Error(err), zap.String("dir", dir))
+		return err
+	}
+	// Редакторы сохраняют файл через переименование временного, и наблюдение
+	// за самим файлом прекратилось бы после первого сохранения, поэтому
+	// наблюдается его каталог
+	if configPath != "" {
+		configPath = filepath.Clean(configPath)
+		if configDir := filepath.Dir(configPath); configDir != filepath.Clean(dir) {
+			if err = watcher.Add(configDir); err != nil {
+				logger.Error("failed to watch dir", zap.Error(err), zap.String("dir", configDir))
+				return err
+			}
+		}
+	}
+	logger.Info("watching scenarios", zap.String("dir", dir), zap.String("config", configPath))
+
+	timer := time.NewTimer(watchDebounce)
+	timer.Stop()
+	for {
+		select {
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if !watchedFile(ev.Name, dir, configPath) {
+				continue
+			}
+			logger.Info("scenario file changed", zap.String("file", ev.Name), zap.String("op", ev.Op.String()))
+			timer.Reset(watchDebounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			logger.Error("watcher error", zap.Error(err))
+		case <-timer.C:
+			custom, err := loadYAMLScenarios(dir, logger)
+			if err != nil {
+				continue
+			}
+			if err = replaceScenarios(loaded, custom); err != nil {
+				logger.Error("failed to register scenarios", zap.Error(err))
+				continue
+			}
+			loaded = custom
+			if configPath != "" {
+				// Профили с неизвестным параметром прервали бы каждую транзакцию
+				// сценария, поэтому до исправления файла остаются прежние
+				previous := gucProfiles
+				if err = loadGUCProfiles(configPath); err != nil {
+					logger.Error("failed to load guc profiles", zap.Error(err), zap.String("path", configPath))
+					continue
+				}
+				if err = checkGUCProfiles(r.db, logger); err != nil {
+					logger.Error("invalid guc profiles", zap.Error(err), zap.String("path", configPath))
+					gucProfiles = previous
+					continue
+				}
+			}
+
+			names, err := selectScenarios(selected)
+			if err != nil {
+				logger.Error("failed to select scenarios", zap.Error(err))
+				continue
+			}
+			for _, name := range names {
+				if err = r.run(name, isolationProblems[name]); err != nil {
+					logger.Error("scenario failed", zap.Error(err), zap.String("problem", name))
+				}
+			}
+			logger.Info("waiting for changes", zap.String("dir", dir))
+		}
+	}
+}
+
+// replaceScenarios заменяет зарегистрированные сценарии loaded на custom.
+// Имена проверяются до замены: если имя из custom занято сценарием не из
+// loaded, остаются прежние сценарии.
+func replaceScenarios(loaded, custom map[string]scenario) error {
+	for name := range custom {
+		if _, ok := isolationProblems[name]; !ok {
+			continue
+		}
+		if _, reloaded := loaded[name]; !reloaded {
+			return fmt.Errorf("scenario %q already exists", name)
+		}
+	}
+	var removed []string
+	for name := range loaded {
+		delete(isolationProblems, name)
+		if _, ok := custom[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	unregister(removed)
+	return addScenarios(custom)
+}
+
+// watchedFile сообщает, что name - YAML сценарий из dir или файл configPath.
+func watchedFile(name, dir, configPath string) bool {
+	name = filepath.Clean(name)
+	if configPath != "" && name == configPath {
+		return true
+	}
+	if filepath.Dir(name) != filepath.Clean(dir) {
+		return false
+	}
+	ext := filepath.Ext(name)
+	return ext == ".yaml" || ext == ".yml"
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"database/sql"
+	_ "embed"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+//go:embed workloads/smallbank.yaml
+var smallbankWorkload []byte
+
+// builtinWorkloads - нагрузки, которые -workload и decide находят по имени без файла.
+var builtinWorkloads = map[string][]byte{"smallbank": smallbankWorkload}
+
+// workloadLevels - уровни, на которых нагрузка выполняется в режиме benchmark.
+var workloadLevels = []sql.IsolationLevel{sql.LevelReadCommitted, sql.LevelRepeatableRead, sql.LevelSerializable}
+
+// workloadScenarios читает описания нагрузки в формате decide и возвращает для
+// каждого сценарий workload/<name>. Сценарий выполняет смесь шаблонов на всех
+// уровнях workloadLevels и записывает результаты benchmark по каждому шаблону и
+// по смеси в целом, поэтому их можно сравнить на графиках -charts.
+func workloadScenarios(files []string, logger *zap.Logger) (map[string]scenario, error) {
+	scenarios := make(map[string]scenario, len(files))
+	for _, file := range files {
+		w, err := readDecisionWorkload(file)
+		if err != nil {
+			logger.Error("failed to load workload", zap.Error(err), zap.String("file", file))
+			return nil, err
+		}
+		setup := w.Setup
+		if len(setup) == 0 {
+			setup = personMigrations
+		}
+		// Нагрузка создает таблицы в своей схеме и может выполняться параллельно с остальными
+		scenarios["workload/"+w.Name] = scenario{
+			level:       sql.LevelReadCommitted,
+			migrations:  setup,
+			problem:     workloadBenchmark(w),
+			namespace:   "workload_" + strings.ReplaceAll(w.Name, "-", "_"),
+			description: "benchmark of workload " + w.Name + " at each isolation level",
+			tags:        []string{"workload", "benchmark"},
+			cost: scenarioCost{
+				levels:       workloadLevels,
+				transactions: len(workloadLevels) * w.Workers * w.Iterations,
+				sessions:     w.Workers,
+				duration:     time.Duration(len(workloadLevels)*w.Iterations) * estimateWorkloadTx,
+			},
+		}
+	}
+	return scenarios, nil
+}
+
+func workloadBenchmark(w *decisionWorkload) isolationProblem {
+	return func(db *sqlx.DB, logger *zap.Logger) error {
+		for _, level := range workloadLevels {
+			suiteProgress.setStep(level.String())
+			levelLogger := logger.With(zap.String("workload", w.Name), zap.String("level", level.String()))
+			result, err := runDecisionLevel(db, w, level, levelLogger)
+			if err != nil {
+				return fmt.Errorf("%s: %w", level, err)
+			}
+			scenarioName := "workload/" + w.Name
+			var latency int64
+			for _, t := range result.templates {
+				latency += int64(t.latency)
+				recordBenchmark(newBenchmarkResult(scenarioName, t.name, level.String(),
+					int(t.commits), int(t.aborts), result.elapsed, t.latency))
+				levelLogger.Info("template finished", zap.String("template", t.name),
+					zap.Int64("commits", t.commits), zap.Int64("aborts", t.aborts), zap.Duration("latency", t.latency))
+			}
+			recordBenchmark(newBenchmarkResult(scenarioName, "mix", level.String(),
+				int(result.commits), int(result.aborts), result.elapsed, time.Duration(latency)))
+			// Нарушенные инварианты на слабых уровнях ожидаемы, benchmark только сообщает о них
+			if len(result.violated) > 0 {
+				levelLogger.Warn("invariants violated", zap.Strings("invariants", result.violated))
+			}
+		}
+		return nil
+	}
+}
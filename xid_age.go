@@ -0,0 +1,141 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+var xidAgeMigrations = []string{
+	`DROP TABLE IF EXISTS frozen;`,
+	`CREATE TABLE frozen (
+           id INT PRIMARY KEY,
+           value INT NOT NULL
+         );`,
+	`INSERT INTO frozen SELECT g, 0 FROM generate_series(1, 100) AS g;`,
+}
+
+// xidAgeTransactions - сколько транзакций с xid выполняется, пока открыта
+// долгая транзакция; на столько же VACUUM FREEZE отстает от текущего xid.
+const xidAgeTransactions = 200
+
+// wraparoundLimit - возраст xid, после которого сервер перестает выдавать
+// новые xid, чтобы не потерять видимость старых строк (около 2^31).
+const wraparoundLimit = 2_000_000_000
+
+// databaseAge - возраст самого старого незамороженного xid базы.
+type databaseAge struct {
+	Age int64 `db:"age"`
+	// FreezeMaxAge - autovacuum_freeze_max_age: при этом возрасте запускается
+	// принудительная очистка от зацикливания
+	FreezeMaxAge int64 `db:"freeze_max_age"`
+}
+
+// logDatabaseAge выводит возраст базы относительно порогов заморозки.
+func logDatabaseAge(monitor *sqlx.DB, logger *zap.Logger) error {
+	var a databaseAge
+	const ageQuery = `SELECT age(datfrozenxid) AS age, current_setting('autovacuum_freeze_max_age')::BIGINT AS freeze_max_age
+         FROM pg_database WHERE datname = current_database();`
+	if err := monitor.Get(&a, ageQuery); err != nil {
+		logger.Error("failed to read database age", zap.Error(err))
+		return err
+	}
+	logger.Info("database xid age", zap.Int64("age(datfrozenxid)", a.Age),
+		zap.String("of_autovacuum_freeze_max_age", fmt.Sprintf("%.2f%%", 100*float64(a.Age)/float64(a.FreezeMaxAge))),
+		zap.String("of_wraparound_limit", fmt.Sprintf("%.4f%%", 100*float64(a.Age)/wraparoundLimit)))
+	return nil
+}
+
+// frozenTableAge замораживает frozen через VACUUM FREEZE и возвращает возраст
+// relfrozenxid: VACUUM замораживает только строки старше снимков всех
+// открытых транзакций, поэтому возраст не опускается ниже возраста самой
+// старой из них.
+func frozenTableAge(monitor *sqlx.DB, logger *zap.Logger) (int64, error) {
+	// VACUUM не выполняется внутри транзакции, монитор отправляет его отдельно
+	if _, err := monitor.Exec("VACUUM (FREEZE) frozen;"); err != nil {
+		logger.Error("failed to freeze table", zap.Error(err))
+		return 0, err
+	}
+	var age int64
+	if err := monitor.Get(&age, "SELECT age(relfrozenxid) FROM pg_class WHERE oid = 'frozen'::regclass;"); err != nil {
+		logger.Error("failed to read table age", zap.Error(err))
+		return 0, err
+	}
+	logger.Info("table frozen", zap.Int64("age(relfrozenxid)", age))
+	return age, nil
+}
+
+// xidAge показывает оператору, как долгая транзакция приближает зацикливание
+// счетчика транзакций. Сценарий выводит age(datfrozenxid) базы относительно
+// autovacuum_freeze_max_age, затем держит открытой транзакцию REPEATABLE READ,
+// пока другие сессии тратят xidAgeTransactions xid. VACUUM FREEZE в это время
+// не может заморозить строки новее ее снимка, и возраст relfrozenxid таблицы
+// растет вместе с возрастом транзакции; после фиксации заморозка догоняет
+// текущий xid. Транзакции сценариев, открытые дольше -long-tx, отмечаются
+// предупреждением по той же причине.
+func xidAge(db *sqlx.DB, logger *zap.Logger) error {
+	monitor := monitorDB(db)
+	if err := logDatabaseAge(monitor, logger); err != nil {
+		return err
+	}
+
+	tx1, err := beginTx(db, logger, "tx1", sql.LevelRepeatableRead)
+	if err != nil {
+		return err
+	}
+	// txid_current назначает транзакции xid и берет снимок
+	if _, err = tx1.query("SELECT txid_current();"); err != nil {
+		return err
+	}
+	pid, err := tx1.backendPID()
+	if err != nil {
+		return err
+	}
+
+	logger.Info("consuming transaction ids", zap.Int("transactions", xidAgeTransactions))
+	for i := 0; i < xidAgeTransactions; i++ {
+		if _, err = monitor.Exec("SELECT txid_current();"); err != nil {
+			logger.Error("failed to consume transaction id", zap.Error(err))
+			return err
+		}
+	}
+	if monitorAccess.locks {
+		var held struct {
+			XIDAge  int64 `db:"xid_age"`
+			XminAge int64 `db:"xmin_age"`
+		}
+		const heldQuery = `SELECT age(backend_xid) AS xid_age, age(backend_xmin) AS xmin_age FROM pg_stat_activity WHERE pid = $1;`
+		if err = monitor.Get(&held, heldQuery, pid); err != nil {
+			logger.Error("failed to read transaction age", zap.Error(err))
+			return err
+		}
+		tx1.logger.Info("open transaction age", zap.Int64("age(backend_xid)", held.XIDAge), zap.Int64("age(backend_xmin)", held.XminAge))
+	}
+
+	blocked, err := frozenTableAge(monitor, logger.With(zap.String("while", "tx1 open")))
+	if err != nil {
+		return err
+	}
+	if err = tx1.commit(); err != nil {
+		return err
+	}
+	freed, err := frozenTableAge(monitor, logger.With(zap.String("while", "tx1 committed")))
+	if err != nil {
+		return err
+	}
+	if err = logDatabaseAge(monitor, logger); err != nil {
+		return err
+	}
+
+	if blocked < xidAgeTransactions {
+		return fmt.Errorf("expected VACUUM FREEZE to stay at least %d xids behind while tx1 is open, age(relfrozenxid) = %d", xidAgeTransactions, blocked)
+	}
+	// Более старый снимок другой сессии сервера держит заморозку и после фиксации tx1
+	if freed >= blocked {
+		logger.Warn("VACUUM FREEZE did not advance after tx1 committed: another session holds an older snapshot",
+			zap.Int64("while_open", blocked), zap.Int64("after_commit", freed))
+	}
+	return nil
+}